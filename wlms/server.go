@@ -2,6 +2,7 @@ package main
 
 import (
 	"container/list"
+	"context"
 	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
 	"io"
 	"log"
@@ -433,8 +434,12 @@ func (server *Server) GameConnected(name string) {
 }
 
 // The relay informs us that the game with the given name has been closed
-func (server *Server) GameClosed(name string) {
-	log.Printf("Relay notifies us that the game '%s' has been closed", name)
+func (server *Server) GameClosed(name string, reason relayinterface.CloseReason) {
+	if reason != relayinterface.CloseReasonNormal {
+		log.Printf("Relay notifies us that the game '%s' has been closed (%v)", name, reason)
+	} else {
+		log.Printf("Relay notifies us that the game '%s' has been closed", name)
+	}
 	game := server.HasGame(name)
 	if game == nil {
 		// The game might have already been deleted when the host has notified us about its end
@@ -443,6 +448,36 @@ func (server *Server) GameClosed(name string) {
 	server.RemoveGame(game)
 }
 
+// The relay informs us that a client has reconnected to its game after losing the connection
+func (server *Server) ClientReconnected(name string, playerID uint64) {
+	log.Printf("Relay notifies us that client %v reconnected to game '%s'", playerID, name)
+}
+
+// The relay informs us that another player has become the host of a game
+func (server *Server) HostChanged(name string, playerID uint64) {
+	log.Printf("Relay notifies us that client %v is now the host of game '%s'", playerID, name)
+}
+
+// The relay warns us that it is nearly full
+func (server *Server) OnCapacityWarning(current, max int) {
+	log.Printf("Relay notifies us that it is nearly full with %v of %v games", current, max)
+}
+
+// The relay alerts us of a problem the operators should know about
+func (server *Server) OnRelayAlert(alert relayinterface.RelayAlert) {
+	log.Printf("Relay alerts us: %v: %v", alert.Code, alert.Message)
+}
+
+// The relay refused a connection to a game
+func (server *Server) ClientJoinRejected(rejection relayinterface.JoinRejection) {
+	log.Printf("Relay refused connection from %v to game '%s': %v", rejection.RemoteAddr, rejection.Game, rejection.Reason)
+}
+
+// A player sent a chat message in a game on the relay
+func (server *Server) ClientChat(message relayinterface.ChatMessage) {
+	log.Printf("Chat in game '%s' from %v (id %v): %s", message.Game, message.PlayerName, message.PlayerID, message.Message)
+}
+
 // The current status has been requested over RPC
 func (s *Server) Status() *relayinterface.ServerStatus {
 	users := 0
@@ -573,6 +608,12 @@ func (s *Server) mainLoop() {
 				s.clients.Remove(e)
 			}
 			close(s.acceptedConnections)
+			// Keep the relays from notifying us while we go away
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := s.relay.Quiesce(ctx); err != nil {
+				log.Printf("Unable to quiesce relays: %v", err)
+			}
+			cancel()
 			s.serverHasShutdown <- true
 			return
 		case <-cleanupTicker.C:
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"net"
+	"time"
+)
+
+// How many accepted connections can wait for the relay if AcceptQueueSize is not configured
+const DefaultAcceptQueueSize = 128
+
+// The relay alerts the metaserver at most this often that it is overloaded
+const overloadAlertInterval = time.Minute
+
+// Accepts game connections and queues them for the main loop until the listener is closed.
+// When the queue is full, the relay is overloaded: The metaserver is alerted and the
+// connection is refused or waits for room in the queue, depending on AcceptOverflow
+func (s *Server) acceptConnections(ln net.Listener) {
+	var lastAlert time.Time
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case s.acceptedConnections <- conn:
+			continue
+		default:
+		}
+		if time.Since(lastAlert) >= overloadAlertInterval {
+			lastAlert = time.Now()
+			message := fmt.Sprintf("%v accepted connections are waiting to be handled", cap(s.acceptedConnections))
+			lifecycleLog.Warnf("Relay is overloaded: %v", message)
+			s.wlms.OnRelayAlert(relayinterface.RelayAlert{Code: relayinterface.AlertOverloaded, Message: message})
+		}
+		if s.config.AcceptOverflow == "block" {
+			s.acceptedConnections <- conn
+		} else {
+			New(conn, s.traffic).Disconnect("OVERLOADED")
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How many host passwords can be verified per game within passwordCheckWindow
+const maxPasswordChecks = 5
+
+const passwordCheckWindow = time.Minute
+
+// attemptLimiter allows a limited number of attempts within a sliding window
+type attemptLimiter struct {
+	max    int
+	window time.Duration
+
+	mutex    sync.Mutex
+	attempts []time.Time
+}
+
+func newAttemptLimiter(max int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{max: max, window: window}
+}
+
+// Records an attempt. Returns false and records nothing if there were
+// too many attempts within the window already
+func (a *attemptLimiter) Allow() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := time.Now()
+	recent := a.attempts[:0]
+	for _, t := range a.attempts {
+		if now.Sub(t) < a.window {
+			recent = append(recent, t)
+		}
+	}
+	a.attempts = recent
+	if len(a.attempts) >= a.max {
+		return false
+	}
+	a.attempts = append(a.attempts, now)
+	return true
+}
+
+// After how many wrong host passwords a game is locked if PasswordLockoutThreshold is not configured
+const DefaultPasswordLockoutThreshold = 10
+
+// How long a game is locked if PasswordLockoutWindow is not configured
+const DefaultPasswordLockoutWindow = 5 * time.Minute
+
+// passwordLockout counts wrong host passwords by source and locks a source
+// for a while once it presented too many. A correct password resets the count
+type passwordLockout struct {
+	threshold int
+	window    time.Duration
+
+	mutex       sync.Mutex
+	failures    map[string]int
+	lockedUntil map[string]time.Time
+}
+
+// Returns nil if the lockout is disabled
+func newPasswordLockout(threshold int, window time.Duration) *passwordLockout {
+	if threshold <= 0 || window <= 0 {
+		return nil
+	}
+	return &passwordLockout{
+		threshold:   threshold,
+		window:      window,
+		failures:    make(map[string]int),
+		lockedUntil: make(map[string]time.Time),
+	}
+}
+
+// Returns until when the source is locked, the zero time if it is not
+func (l *passwordLockout) Locked(source string) time.Time {
+	if l == nil {
+		return time.Time{}
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	until, ok := l.lockedUntil[source]
+	if ok && !time.Now().Before(until) {
+		delete(l.lockedUntil, source)
+		return time.Time{}
+	}
+	return until
+}
+
+// Records a wrong password. Returns until when the source is locked if this locked it
+func (l *passwordLockout) Failed(source string) time.Time {
+	if l == nil {
+		return time.Time{}
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.failures[source]++
+	if l.failures[source] < l.threshold {
+		return time.Time{}
+	}
+	delete(l.failures, source)
+	until := time.Now().Add(l.window)
+	l.lockedUntil[source] = until
+	return until
+}
+
+// Records a correct password
+func (l *passwordLockout) Succeeded(source string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.failures, source)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a game counts as forwarding data for MaxTotalBandwidth after it forwarded something
+const bandwidthActivity = time.Second
+
+// bandwidthShaper shares MaxTotalBandwidth fairly between the games: Each game
+// forwarding data gets the same share, so a few busy games can not starve the
+// others. Games which are idle do not take a share.
+type bandwidthShaper struct {
+	ceiling int
+	// The share of each game which forwarded data recently
+	games map[*Game]*bandwidthShare
+	// When the games which are idle have been forgotten last
+	pruned time.Time
+	// When the metaserver has been alerted last that the ceiling is reached
+	lastAlert time.Time
+	mutex     sync.Mutex
+	// How often frames have been delayed and datagrams dropped. Accessed atomically
+	throttled int64
+}
+
+type bandwidthShare struct {
+	bucket   *tokenBucket
+	lastUsed time.Time
+}
+
+// Returns nil if the bandwidth is unlimited
+func newBandwidthShaper(ceiling int) *bandwidthShaper {
+	if ceiling <= 0 {
+		return nil
+	}
+	return &bandwidthShaper{ceiling: ceiling, games: make(map[*Game]*bandwidthShare)}
+}
+
+// Returns the bucket of the game with the rate of its current share.
+// Has to be called with the mutex held
+func (s *bandwidthShaper) bucketOf(game *Game, now time.Time) *tokenBucket {
+	if now.Sub(s.pruned) >= bandwidthActivity {
+		for g, share := range s.games {
+			if now.Sub(share.lastUsed) >= bandwidthActivity {
+				delete(s.games, g)
+			}
+		}
+		s.pruned = now
+	}
+	share, ok := s.games[game]
+	if !ok {
+		share = &bandwidthShare{bucket: &tokenBucket{last: now}}
+		s.games[game] = share
+		share.bucket.tokens = float64(s.ceiling) / float64(len(s.games))
+	}
+	share.lastUsed = now
+	share.bucket.rate = float64(s.ceiling) / float64(len(s.games))
+	return share.bucket
+}
+
+// Accounts for bytes forwarded by the game and returns how long to wait before
+// forwarding them to stay within the share of the game
+func (s *bandwidthShaper) reserve(game *Game, bytes int, now time.Time) time.Duration {
+	if s == nil {
+		return 0
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delay := s.bucketOf(game, now).take(bytes, now)
+	if delay > 0 {
+		atomic.AddInt64(&s.throttled, 1)
+	}
+	return delay
+}
+
+// Accounts for a datagram forwarded by the game. Returns false if it has to be
+// dropped since the game exceeds its share
+func (s *bandwidthShaper) allow(game *Game, bytes int, now time.Time) bool {
+	if s == nil {
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.bucketOf(game, now).tryTake(bytes, now) {
+		atomic.AddInt64(&s.throttled, 1)
+		return false
+	}
+	return true
+}
+
+// Returns whether the metaserver should be alerted that games are throttled, at most every overloadAlertInterval
+func (s *bandwidthShaper) alertDue(now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if now.Sub(s.lastAlert) < overloadAlertInterval {
+		return false
+	}
+	s.lastAlert = now
+	return true
+}
+
+// Returns how often frames have been delayed and datagrams dropped to stay below the ceiling
+func (s *bandwidthShaper) throttledCount() int64 {
+	if s == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&s.throttled)
+}
+
+// Waits until the game may forward the given number of bytes within its share of MaxTotalBandwidth
+func (game *Game) shapeBandwidth(bytes int) {
+	if bytes == 0 {
+		return
+	}
+	delay := game.server.bandwidth.reserve(game, bytes, time.Now())
+	if delay == 0 {
+		return
+	}
+	game.server.alertBandwidth()
+	time.Sleep(delay)
+}
+
+// Returns whether a datagram of the given number of bytes fits into the share
+// of the game. Datagrams are dropped instead of waiting since they are late anyway then
+func (game *Game) allowDatagram(bytes int) bool {
+	if game.server.bandwidth.allow(game, bytes, time.Now()) {
+		return true
+	}
+	game.server.alertBandwidth()
+	return false
+}
+
+// Alerts the metaserver that the relay needs more bandwidth
+func (s *Server) alertBandwidth() {
+	if !s.bandwidth.alertDue(time.Now()) {
+		return
+	}
+	message := fmt.Sprintf("Games are throttled to stay below %v bytes per second", s.config.MaxTotalBandwidth)
+	lifecycleLog.Warnf("Bandwidth ceiling reached: %v", message)
+	// Not waiting for the queue, datagrams are forwarded with the mutex of the UDP relay held
+	go s.wlms.OnRelayAlert(relayinterface.RelayAlert{Code: relayinterface.AlertBandwidthExceeded, Message: message})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// At which percentage of MaxGames the metaserver is warned if CapacityWarningPercent is not configured
+const DefaultCapacityWarningPercent = 80
+
+// Returns the number of games at which the relay counts as nearly full, 0 if there is no such limit
+func (s *Server) softMaxGames() int {
+	maxGames := s.limits.Get().MaxGames
+	if maxGames <= 0 || s.config.CapacityWarningPercent <= 0 {
+		return 0
+	}
+	soft := (maxGames*s.config.CapacityWarningPercent + 99) / 100
+	if soft < 1 {
+		soft = 1
+	}
+	return soft
+}
+
+// Warns the metaserver once when the number of games reaches the soft limit.
+// The warning is sent again after the number dropped below it.
+// Has to be called with gamesMutex held
+func (s *Server) checkCapacity() {
+	soft := s.softMaxGames()
+	if soft == 0 {
+		return
+	}
+	games := s.games.Len()
+	if games < soft {
+		atomic.StoreInt32(&s.capacityWarned, 0)
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&s.capacityWarned, 0, 1) {
+		return
+	}
+	maxGames := s.limits.Get().MaxGames
+	lifecycleLog.Warnf("Relay is nearly full: %v of %v games", games, maxGames)
+	s.wlms.OnCapacityWarning(games, maxGames)
+}
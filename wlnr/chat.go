@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"time"
+)
+
+// How long a chat message can be if MaxChatLength is not configured, in bytes
+const DefaultMaxChatLength = 500
+
+// How many chat messages a participant can send per minute if ChatMessagesPerMinute is not configured
+const DefaultChatMessagesPerMinute = 30
+
+// Limits how many chat messages a participant can send per minute.
+// Only used by the goroutine reading from the connection
+type chatLimiter struct {
+	limit       int
+	windowStart time.Time
+	count       int
+}
+
+// Returns whether another message can be send now
+func (l *chatLimiter) allow(now time.Time) bool {
+	if now.Sub(l.windowStart) >= time.Minute {
+		l.windowStart = now
+		l.count = 0
+	}
+	if l.count >= l.limit {
+		return false
+	}
+	l.count++
+	return true
+}
+
+// Reads a chat message of the participant and sends it to everyone in the game,
+// including the sender. Messages which are too long or exceed the rate limit are
+// dropped. Returns false if the participant has been disconnected
+func (game *Game) handleChat(client *Client) bool {
+	message, err := client.ReadString()
+	if err != nil {
+		game.DisconnectClient(client, "PROTOCOL_VIOLATION")
+		return false
+	}
+	config := &game.server.config
+	if message == "" {
+		return true
+	}
+	if client.spectator && config.MuteSpectators {
+		forwardingLog.Debugf("Dropping chat message of spectator (id=%v) in game %v", client.id, game.logName())
+		return true
+	}
+	if len(message) > config.MaxChatLength {
+		forwardingLog.Infof("Dropping chat message of %v bytes from client (id=%v) in game %v, the limit is %v bytes",
+			len(message), client.id, game.logName(), config.MaxChatLength)
+		return true
+	}
+	if client.chat == nil {
+		client.chat = &chatLimiter{limit: config.ChatMessagesPerMinute}
+	}
+	if !client.chat.allow(time.Now()) {
+		forwardingLog.Infof("Dropping chat message of client (id=%v) in game %v, it sends too many", client.id, game.logName())
+		return true
+	}
+	cmd := NewCommand(kChat)
+	cmd.AppendUInt(client.id)
+	cmd.AppendString(message)
+	host, clients := game.participants()
+	if host != nil {
+		host.SendCommand(cmd)
+	}
+	for _, receiver := range clients {
+		game.sendToClient(receiver, cmd)
+	}
+	if config.ReportChat {
+		game.server.wlms.ClientChat(relayinterface.ChatMessage{
+			Game:       game.Name(),
+			PlayerID:   uint64(client.id),
+			PlayerName: client.playerName,
+			Spectator:  client.spectator,
+			Message:    message,
+		})
+	}
+	return true
+}
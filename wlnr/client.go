@@ -3,28 +3,71 @@ package main
 import (
 	"bufio"
 	"io"
-	"log"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
 const PING_INTERVAL_S = 90
 
+// The ping interval of participants of ranked games, see GameData.Ranked
+const RANKED_PING_INTERVAL_S = 20
+
 // Structure to bundle the TCP connection with its packet buffer
 type Client struct {
 	// The TCP connection to the client
 	conn net.Conn
 
+	// The address of the client. Kept since conn is nil after disconnecting
+	remoteAddr string
+
 	// The id of this client when refering to him in messages to the host
 	// This id is only unique inside one game
 	id uint8
 
+	// The token the client can use to reconnect to its slot if the connection is lost.
+	// Empty if reconnecting is disabled
+	reconnectToken string
+
+	// Whether the client only watches the game, see kSpectator
+	spectator bool
+
+	// The name of the player in the lobby, see kPlayerName. Might be empty
+	playerName string
+
+	// Whether the client presented a join token of its game, see kJoinToken
+	invited bool
+
+	// Whether datagrams of the UDP relay are carried over this connection, see kMux
+	muxed bool
+
+	// The largest frame of game data the client wants to get, see kFrameSize. 0 if any
+	frameSize int
+
+	// The version of the game, see kClientVersion. Might be empty
+	clientVersion string
+
+	// Whether the client asked for its address as seen by the relay, see kObservedAddress
+	observeAddress bool
+
+	// Limits the chat messages send by the client, created on its first message
+	chat *chatLimiter
+
+	// Delimits the frames of game data, depends on the protocol version. See Framer()
+	framer Framer
+
 	// To read data from the network
 	reader *bufio.Reader
 
-	// A channel for commands to send
+	// A channel for commands to send, holding up to sendQueueSize of them
 	chan_out chan *Command
 
+	// Set when the client is disconnected because its queue ran full. Accessed atomically
+	lagging int32
+
+	// Set once we closed the connection, see detachConn. Accessed atomically
+	closed int32
+
 	// A timer deciding when the next ping will be send
 	pingTimer *time.Timer
 
@@ -33,6 +76,10 @@ type Client struct {
 	// waiting, the connection is probably lost.
 	waitingForPong bool
 
+	// Seconds between two pings, a pong has to arrive before the next ping.
+	// Accessed atomically since it is changed while the ping loop runs
+	pingIntervalS int64
+
 	// The sequence number of the last send ping.
 	// If waitingForPong is true, this is the number
 	// we are waiting for
@@ -49,16 +96,26 @@ type Client struct {
 	// Can't be calculated on the fly since timeLastPing might already
 	// have been overwritten by the next ping
 	rttLastPing time.Duration
+
+	// Counts the bytes send to the client
+	traffic *TrafficMeter
 }
 
-func New(conn net.Conn) *Client {
+// How many commands can wait to be written to a connection. Each connection is
+// written by its own goroutine, so a slow one only fills its own queue
+const sendQueueSize = 256
+
+func New(conn net.Conn, traffic *TrafficMeter) *Client {
 	client := &Client{
 		conn:            conn,
+		remoteAddr:      conn.RemoteAddr().String(),
+		traffic:         traffic,
 		id:              0,
 		reader:          bufio.NewReader(conn),
-		chan_out:        make(chan *Command),
+		chan_out:        make(chan *Command, sendQueueSize),
 		pingTimer:       time.NewTimer(time.Second * 1), // Do the next ping now
 		waitingForPong:  false,
+		pingIntervalS:   PING_INTERVAL_S,
 		lastSendPingSeq: 0,
 		timeLastPing:    time.Now(),
 		timeLastPong:    time.Now(),
@@ -67,10 +124,16 @@ func New(conn net.Conn) *Client {
 	go func() {
 		for {
 			cmd := <-client.chan_out
-			if client.conn == nil {
+			if cmd == nil {
+				// Everything before has been written, see Disconnect
+				conn.Close()
 				break
 			}
-			client.conn.Write(cmd.GetBytes())
+			n, _ := conn.Write(cmd.GetBytes())
+			client.traffic.AddBytesSend(n)
+			if cmd.sample != nil {
+				cmd.sample.done()
+			}
 		}
 	}()
 	go client.pingLoop()
@@ -83,6 +146,12 @@ func (c *Client) ReadUint8() (uint8, error) {
 	return b[0], error
 }
 
+func (c *Client) ReadBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, error := io.ReadFull(c.reader, b)
+	return b, error
+}
+
 func (c *Client) ReadString() (string, error) {
 	str, error := c.reader.ReadString('\000')
 	// Remove final \0
@@ -92,52 +161,82 @@ func (c *Client) ReadString() (string, error) {
 	return str, error
 }
 
+// Reads a frame of game data as defined by the framer of the protocol version of the client
 func (c *Client) ReadPacket() ([]byte, error) {
-	length_bytes := make([]byte, 2)
-	_, error := io.ReadFull(c.reader, length_bytes)
-	if error != nil {
-		return length_bytes, error
-	}
-	length := int(length_bytes[0])<<8 | int(length_bytes[1])
-	if length < 2 {
-		return nil, io.ErrUnexpectedEOF
+	return c.Framer().ReadFrame(c.reader)
+}
+
+// Returns how the frames of game data of this client are delimited.
+// Frames are length prefixed until the protocol version is known
+func (c *Client) Framer() Framer {
+	if c.framer == nil {
+		return lengthPrefixFramer{}
 	}
-	packet := make([]byte, length)
-	packet[0] = length_bytes[0]
-	packet[1] = length_bytes[1]
-	_, error = io.ReadFull(c.reader, packet[2:])
-	// TODO(Notabilis): Think about this (and similar places). The client might be able
-	// to keep the server waiting here. Actually, he can simply keep the connection
-	// idling anyway. Is this a problem? Might be a possibility for DoS.
-	// Is there a ping in the GameHost code? Won't help before a game is assigned
-	// to the client, though. So probably add some fast disconnect on idle.
-	return packet, error
+	return c.framer
 }
 
 func (c *Client) SendCommand(cmd *Command) {
 	c.chan_out <- cmd
 }
 
-// Sends a disconnect message and closes the connection
+// Queues the command unless the queue of the client is full. Returns false then
+func (c *Client) TrySendCommand(cmd *Command) bool {
+	select {
+	case c.chan_out <- cmd:
+		return true
+	default:
+		return false
+	}
+}
+
+// How long the final messages of a disconnect may take to be written
+const disconnectWriteTimeout = 5 * time.Second
+
+// Sends a disconnect message and closes the connection.
+// For reasons other than "NORMAL", a kProtocolError is send before
 func (c *Client) Disconnect(reason string) {
-	if c.conn == nil {
+	// Since closing the connection indirectly calls this method again,
+	// mark the connection as closed before
+	conn := c.detachConn()
+	if conn == nil {
 		return
 	}
-	log.Printf("Disconnecting client (id=%v) because %v\n", c.id, reason)
+	lifecycleLog.Infof("Disconnecting client (id=%v) because %v", c.id, reason)
+	// Do not wait forever for a peer which does not read anymore
+	conn.SetWriteDeadline(time.Now().Add(disconnectWriteTimeout))
+	if perr, ok := protocolErrors[reason]; ok {
+		cmd := NewCommand(kProtocolError)
+		cmd.AppendUInt(perr.code)
+		cmd.AppendString(perr.description)
+		c.SendCommand(cmd)
+	}
 	cmd := NewCommand(kDisconnect)
 	cmd.AppendString(reason)
 	c.SendCommand(cmd)
-	// Since conn.Close() indirectly calls this method again,
-	// mark the connection as closed before calling it
+	// The writer closes the connection after sending the messages
+	c.chan_out <- nil
+}
+
+// Marks the connection as closed by us and returns it, so only the first caller
+// closes it. Returns nil if it has been closed before
+func (c *Client) detachConn() net.Conn {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
 	conn := c.conn
 	c.conn = nil
-	conn.Close()
+	return conn
+}
+
+// Whether we closed the connection, safe to call from any goroutine
+func (c *Client) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) != 0
 }
 
 func (c *Client) pingLoop() {
 	for {
 		<-c.pingTimer.C
-		if c.conn == nil {
+		if c.isClosed() {
 			// Seems we are disconnecting for some reason
 			break
 		}
@@ -149,18 +248,23 @@ func (c *Client) pingLoop() {
 			cmd := NewCommand(kPing)
 			cmd.AppendUInt(c.lastSendPingSeq)
 			c.SendCommand(cmd)
-			c.pingTimer.Reset(time.Second * PING_INTERVAL_S)
+			c.pingTimer.Reset(time.Second * time.Duration(atomic.LoadInt64(&c.pingIntervalS)))
 		} else {
 			// Bad luck: We got no response so disconnect client
 			// In the case of the game host this also takes down the game
 			// by closing the socket -> game will notice it and abort
-			log.Printf("Timeout of client (id=%v), disconnecting", c.id)
+			lifecycleLog.Warnf("Timeout of client (id=%v), disconnecting", c.id)
 			c.Disconnect("TIMEOUT")
 			break
 		}
 	}
 }
 
+// Changes how often the client is pinged, starting after the next ping
+func (c *Client) SetPingInterval(seconds int64) {
+	atomic.StoreInt64(&c.pingIntervalS, seconds)
+}
+
 func (c *Client) HandlePong(seq uint8) {
 	c.waitingForPong = false
 	if seq != c.lastSendPingSeq {
@@ -177,6 +281,10 @@ func (c *Client) HandlePong(seq uint8) {
 	c.rttLastPing = time.Since(c.timeLastPing)
 }
 
+func (c *Client) RemoteAddr() string {
+	return c.remoteAddr
+}
+
 func (c *Client) TimeLastPong() time.Time {
 	return c.timeLastPong
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parses a version of the game like "1.1" into its numbers.
+// Anything after the digits of a part, e.g. "rc1" in "1.2rc1", is ignored
+func parseClientVersion(version string) ([]int, error) {
+	if version == "" {
+		return nil, fmt.Errorf("empty version")
+	}
+	var numbers []int
+	for _, part := range strings.Split(version, ".") {
+		digits := 0
+		for digits < len(part) && part[digits] >= '0' && part[digits] <= '9' {
+			digits++
+		}
+		n, err := strconv.Atoi(part[:digits])
+		if err != nil {
+			return nil, fmt.Errorf("invalid version '%v'", version)
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, nil
+}
+
+// Whether the version reported by a client is older than the minimum.
+// Missing parts count as 0, so "1" is the same as "1.0"
+func olderClientVersion(version, minimum []int) bool {
+	for i := 0; i < len(version) || i < len(minimum); i++ {
+		v, m := 0, 0
+		if i < len(version) {
+			v = version[i]
+		}
+		if i < len(minimum) {
+			m = minimum[i]
+		}
+		if v != m {
+			return v < m
+		}
+	}
+	return false
+}
+
+// Whether a client reporting the given version, see kClientVersion, may connect.
+// If MinClientVersion is configured, clients without a valid version are refused
+func (s *Server) acceptsClientVersion(version string) bool {
+	if s.config.MinClientVersion == "" {
+		return true
+	}
+	minimum, err := parseClientVersion(s.config.MinClientVersion)
+	if err != nil {
+		// Caught by RelayConfig.Validate
+		return true
+	}
+	reported, err := parseClientVersion(version)
+	return err == nil && !olderClientVersion(reported, minimum)
+}
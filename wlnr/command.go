@@ -2,6 +2,8 @@ package main
 
 type Command struct {
 	data []byte
+	// Set if the time until the command has been written should be measured
+	sample *latencySample
 }
 
 func NewCommand(c byte) *Command {
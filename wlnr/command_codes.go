@@ -15,6 +15,15 @@ const (
 	kPong                  uint8 = 5
 	kRoundTripTimeRequest  uint8 = 6
 	kRoundTripTimeResponse uint8 = 7
+	// Send before kHello with a token issued by the metaserver.
+	// Required if the relay only accepts connections with join tokens
+	kJoinToken uint8 = 8
+	// Send by the relay to the host and the new host when the host role moved
+	// to another client. Contains the new id of the receiver
+	kHostChanged uint8 = 9
+	// Send after kWelcome if the game uses the UDP relay. Contains the token
+	// which has to be send as first datagram to the UDP port of the relay
+	kUDPToken uint8 = 10
 	// host
 	kConnectClient    uint8 = 11
 	kDisconnectClient uint8 = 12
@@ -23,4 +32,66 @@ const (
 	// client
 	kToHost   uint8 = 21
 	kFromHost uint8 = 22
+	// Send to a client after kWelcome if reconnecting is enabled.
+	// Presenting the token as password on kHello within the grace period
+	// reattaches the client to its old slot.
+	kReconnectToken uint8 = 23
+	// Send before kHello by clients which only watch the game.
+	// The number of spectators on the relay is limited by MaxTotalSpectators
+	kSpectator uint8 = 24
+	// Send before kHello with the name of the player in the lobby.
+	// Only used to find players, see FindPlayer
+	kPlayerName uint8 = 25
+	// Send before kHello by a host or client which can not reach the UDP port of
+	// the relay. Its datagrams are then carried over this connection as kDatagram,
+	// and it gets no kUDPToken
+	kMux uint8 = 26
+	// A datagram of the UDP relay carried over the connection, see kMux.
+	// Contains the length (uint16) and the datagram as it would be send over UDP.
+	// Send by the relay and by the participant
+	kDatagram uint8 = 27
+	// Send before kHello with the largest frame of game data (uint16) the participant
+	// wants to handle. Frames larger than the preference of the host or the client
+	// are not forwarded between them, the sender gets kFrameRefused instead
+	kFrameSize uint8 = 28
+	// Send before kHello with the version of the game, e.g. "1.1". Required if the
+	// relay is configured with a MinClientVersion
+	kClientVersion uint8 = 29
+	// relay to host and clients
+	// Send right before kDisconnect if the connection is closed because of a problem.
+	// Contains one of the codes in protocol_errors.go and a short description
+	kProtocolError uint8 = 31
+	// Send to everyone in a game when the relay will be restarted soon and to
+	// everyone joining then. Contains a message for the players and the time
+	// of the restart (RFC 3339)
+	kMaintenance uint8 = 32
+	// Send by the host or a client with a chat message (string) for everyone in the game.
+	// The relay sends it to all participants, including the sender, with the id of
+	// the sender (uint8) before the message. Unlike game data, the relay understands
+	// chat messages, so it can limit them, see MaxChatLength
+	kChat uint8 = 33
+	// Send before kHello by a participant which wants to learn its public address,
+	// e.g., to diagnose connectivity problems behind a NAT. The relay answers after
+	// kWelcome with the transport (uint8, see below) and the address it sees for
+	// the connection (string, "ip:port"), like the reflexive address of STUN.
+	// If the game uses the UDP relay, it answers again once the UDP token arrived
+	kObservedAddress uint8 = 34
+	// Send by the host of a game using end-to-end encryption when it switches to a
+	// new key, with the number of the new key epoch (uint8, 1 to 255, wrapping to 1).
+	// The keys themselves are exchanged within the game data, the relay never sees them.
+	// The relay sends the epoch to all clients and, after kWelcome, to everyone joining
+	// later. All game data following it in the stream is encrypted with the new key
+	kKeyEpoch uint8 = 35
+	// Send by the relay to the sender of a frame of game data it did not forward
+	// since the frame exceeds the kFrameSize preference of the host or the receiver.
+	// Contains the id of the receiver (uint8, ID_HOST for frames to the host) and
+	// the largest frame (uint16) forwarded between them. The sender has to split
+	// the frame itself, the relay does not know what is inside
+	kFrameRefused uint8 = 36
+)
+
+// The transports of kObservedAddress
+const (
+	kTransportTCP uint8 = 0
+	kTransportUDP uint8 = 1
 )
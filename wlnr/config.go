@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration which is written as, e.g., "30s" in the config file
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// RelayConfig contains all settings of the relay.
+// The zero value is a valid configuration, see DefaultRelayConfig for the values used for unset fields.
+type RelayConfig struct {
+	// Maximal number of notifications for the metaserver waiting to be send
+	CallbackQueueSize int
+	// What to do if the queue is full: "block", "drop-oldest" or "drop-and-flag"
+	CallbackOverflow string
+	// Address of the RPC server of the metaserver, defaults to localhost:7399
+	MetaserverAddr string
+	// Region this relay is located in, used by the metaserver to select a nearby relay
+	Region string
+	// Maximal number of games on this relay, 0 means unlimited
+	MaxGames int
+	// Maximal number of games with the same GameData.OwnerID at the same time,
+	// 0 means unlimited. Games without owner are not limited
+	MaxGamesPerOwner int
+	// Replaces MaxGamesPerOwner for the owners in the map, e.g., for tournament
+	// organizers. 0 means unlimited
+	OwnerGameLimits map[string]int
+	// Percentage of MaxGames at which the metaserver is warned that the relay
+	// is getting full, defaults to 80
+	CapacityWarningPercent int
+	// Load shedding: When this many hosts and clients are connected to the games
+	// of the relay, new spectators are refused. At ShedCasualAt, new players of
+	// games which are not ranked and new such games are refused as well. Players
+	// in the games and players reconnecting are never refused. Disabled if 0
+	ShedSpectatorsAt int
+	ShedCasualAt     int
+	// Whether game names differing only in case refer to the same game.
+	// Whitespace around game names is always ignored
+	CaseInsensitiveGameNames bool
+	// Maximal number of game connections from one IP address, 0 means unlimited
+	MaxConnectionsPerIP int
+	// How many accepted game connections can wait for the relay to handle them, defaults to 128
+	AcceptQueueSize int
+	// What to do with new game connections while the queue is full: "refuse" them
+	// or "block" accepting until there is room again. The metaserver is alerted
+	// either way. Defaults to "refuse"
+	AcceptOverflow string
+	// Token the metaserver has to present to query and change the limits at runtime.
+	// Changing the limits is disabled if this is empty
+	AdminToken string
+	// Name of an environment variable or path of a file to read AdminToken from
+	// instead, so the token does not have to be written into the configuration
+	AdminTokenEnv  string
+	AdminTokenFile string
+	// Connections to the rpc port and game connections which have not joined a game
+	// yet are closed when nothing is received from them for this long. Disabled if 0
+	IdleConnectionTimeout Duration
+	// How long the relay may take to shut down after SIGINT or SIGTERM, defaults to 30s.
+	// It exits without finishing the shutdown after that
+	ShutdownTimeout Duration
+	// How long the slot of a client that lost its connection is kept so it can reconnect.
+	// Reconnecting is disabled if this is 0
+	ReconnectGracePeriod Duration
+	// Address to accept game connections on, defaults to :7397
+	GameListenAddr string
+	// Marks the packets the relay sends to games, over TCP and over the UDP relay,
+	// with this DSCP value (0-63, e.g. 46 for expedited forwarding) so managed
+	// networks can queue them with priority. Not marked if 0. Only affects packets
+	// send by the relay, not those send to it. Supported on Linux, best-effort on
+	// other Unix systems and not supported on Windows; a warning is logged if the
+	// value can not be set
+	GameTrafficDSCP int
+	// Host name or IP address players use to reach this relay
+	PublicAddress string
+	// Whether to log the addresses of players connecting to and disconnecting from games.
+	// Addresses are not logged or reported to the metaserver if this is false
+	AuditLog bool
+	// Whether to compress the rpc connections to the metaserver
+	CompressRPC bool
+	// Games are closed when they exist for longer than this, no matter what
+	// happens in them. Unlimited if 0
+	MaxGameLifetime Duration
+	// File to keep the state of the games in so they survive a restart of the relay.
+	// The state is not kept if this is empty
+	StateFile string
+	// How often the state file is written, defaults to 10s
+	StateSnapshotInterval Duration
+	// How long restored games wait for their host and clients to reconnect, defaults to 60s
+	StateRestoreGracePeriod Duration
+	// Directory to record the game data of all games to. Games are not recorded if this is empty
+	RecordDir string
+	// Start a new recording file when the current one reaches this many bytes. Disabled if 0
+	RecordRotateSize int64
+	// Start a new recording file when the current one is this old. Disabled if 0
+	RecordRotateInterval Duration
+	// Whether DumpGameState also writes the dump of a recorded game next to its recording
+	WriteStateDumps bool
+	// How long a game is kept after its host left so he can rejoin it. The clients
+	// are disconnected nevertheless. The game is closed immediately if this is 0
+	CloseGraceDelay Duration
+	// Whether connections to games have to present a join token issued by the metaserver
+	// before the handshake. Each token allows one connection
+	RequireJoinTokens bool
+	// How long an issued join token can be used, defaults to 5m
+	JoinTokenLifetime Duration
+	// Whether the names of players are taken from their join tokens, which the
+	// metaserver issues for the players it authenticated with IssuePlayerJoinToken.
+	// The relay keeps the name next to the random token, the token itself carries no
+	// signed name. Connections without a token or sending another name with
+	// kPlayerName are refused, and players joining with a token without name have
+	// none. Requires RequireJoinTokens
+	EnforcePlayerNames bool
+	// Address to accept datagrams for games with GameData.UDPEnabled on, e.g. ":7397".
+	// The UDP relay is disabled if this is empty
+	UDPListenAddr string
+	// Maximal number of spectators in all games together. Further spectators are
+	// refused while players can still join. Unlimited if 0
+	MaxTotalSpectators int
+	// Limits the game data the host and each client of a game can send
+	HostRateLimit   RateLimit
+	ClientRateLimit RateLimit
+	// Bytes of game data per second the relay forwards in all games together.
+	// When it is reached, each game forwarding data gets the same share: Frames
+	// wait for it and datagrams are dropped. Unlimited if 0
+	MaxTotalBandwidth int
+	// After how many wrong host passwords further attempts for a game are refused
+	// for PasswordLockoutWindow, defaults to 10 and 5m. The attempts are counted for
+	// each IP address separately if PasswordLockoutPerIP is set, the metaserver counts as one address
+	PasswordLockoutThreshold int
+	PasswordLockoutWindow    Duration
+	PasswordLockoutPerIP     bool
+	// The oldest version of the game which can connect to games, e.g., "1.1".
+	// Games have to report their version then, see kClientVersion. All are accepted if empty
+	MinClientVersion string
+	// Frames of game data larger than this many bytes are a protocol violation.
+	// Unlimited if 0, the framing allows up to 65535 bytes
+	MaxFrameSize int
+	// Statuses larger than this many bytes are send truncated to the metaserver,
+	// defaults to relayinterface.DefaultMaxStatusSize
+	MaxStatusSize int
+	// How many recently closed games are kept for GetGameHistory, defaults to 100
+	HistorySize int
+	// How many recent log messages are kept for GetRecentLogs, defaults to 1000
+	LogBufferSize int
+	// How long before a scheduled maintenance players are told about it, defaults to 30m.
+	// Within this time the announcement is send again every MaintenanceResendInterval, defaults to 5m
+	MaintenanceLeadTime       Duration
+	MaintenanceResendInterval Duration
+	// Chat messages longer than this many bytes are dropped, defaults to 500.
+	// Each participant can send ChatMessagesPerMinute messages, defaults to 30
+	MaxChatLength         int
+	ChatMessagesPerMinute int
+	// Whether spectators only receive the chat of a game and can not send to it
+	MuteSpectators bool
+	// Whether the chat messages are passed to the metaserver, see ClientChat
+	ReportChat bool
+	// Log levels of the subsystems: "debug", "info" or "warn", defaults to "info".
+	// ForwardingLogLevel is about the game data passed between host and clients,
+	// RPCLogLevel about the connection to the metaserver and LifecycleLogLevel
+	// about games and players coming and going
+	ForwardingLogLevel string
+	RPCLogLevel        string
+	LifecycleLogLevel  string
+}
+
+// Sets the levels of the loggers of all subsystems as configured
+func (l *RelayConfig) applyLogLevels() {
+	for _, subsystem := range []struct {
+		level  string
+		logger *relayinterface.Logger
+	}{
+		{l.ForwardingLogLevel, forwardingLog},
+		{l.RPCLogLevel, relayinterface.RPCLog},
+		{l.LifecycleLogLevel, lifecycleLog},
+	} {
+		level, _ := relayinterface.ParseLogLevel(subsystem.level)
+		subsystem.logger.SetLevel(level)
+	}
+}
+
+func (l *RelayConfig) RPCOptions() relayinterface.ServerRPCOptions {
+	options := relayinterface.ServerRPCOptions{
+		CallbackQueueSize: l.CallbackQueueSize,
+		MetaserverAddr:    l.MetaserverAddr,
+		Compress:          l.CompressRPC,
+		MaxStatusSize:     l.MaxStatusSize,
+		IdleTimeout:       l.IdleConnectionTimeout.Duration,
+		AdminToken:        l.AdminToken,
+	}
+	options.CallbackOverflow, _ = parseOverflowPolicy(l.CallbackOverflow)
+	return options
+}
+
+func parseOverflowPolicy(name string) (relayinterface.CallbackOverflowPolicy, bool) {
+	switch name {
+	case "", "block":
+		return relayinterface.CallbackOverflowBlock, true
+	case "drop-oldest":
+		return relayinterface.CallbackOverflowDropOldest, true
+	case "drop-and-flag":
+		return relayinterface.CallbackOverflowDropAndFlag, true
+	}
+	return relayinterface.CallbackOverflowBlock, false
+}
+
+// Returns the configuration used if there is no config file.
+func DefaultRelayConfig() RelayConfig {
+	var config RelayConfig
+	config.applyDefaults()
+	return config
+}
+
+// Fills in the fields which are not set and have a default value
+func (l *RelayConfig) applyDefaults() {
+	if l.CallbackQueueSize == 0 {
+		l.CallbackQueueSize = relayinterface.DefaultCallbackQueueSize
+	}
+	if l.CallbackOverflow == "" {
+		l.CallbackOverflow = "block"
+	}
+	if l.MetaserverAddr == "" {
+		l.MetaserverAddr = "localhost:7399"
+	}
+	if l.GameListenAddr == "" {
+		l.GameListenAddr = DefaultGameListenAddr
+	}
+	if l.StateSnapshotInterval.Duration == 0 {
+		l.StateSnapshotInterval.Duration = DefaultStateSnapshotInterval
+	}
+	if l.StateRestoreGracePeriod.Duration == 0 {
+		l.StateRestoreGracePeriod.Duration = DefaultStateRestoreGracePeriod
+	}
+	if l.JoinTokenLifetime.Duration == 0 {
+		l.JoinTokenLifetime.Duration = DefaultJoinTokenLifetime
+	}
+	if l.PasswordLockoutThreshold == 0 {
+		l.PasswordLockoutThreshold = DefaultPasswordLockoutThreshold
+	}
+	if l.PasswordLockoutWindow.Duration == 0 {
+		l.PasswordLockoutWindow.Duration = DefaultPasswordLockoutWindow
+	}
+	if l.ShutdownTimeout.Duration == 0 {
+		l.ShutdownTimeout.Duration = DefaultShutdownTimeout
+	}
+	if l.HistorySize == 0 {
+		l.HistorySize = DefaultHistorySize
+	}
+	if l.LogBufferSize == 0 {
+		l.LogBufferSize = DefaultLogBufferSize
+	}
+	if l.MaintenanceLeadTime.Duration == 0 {
+		l.MaintenanceLeadTime.Duration = DefaultMaintenanceLeadTime
+	}
+	if l.MaintenanceResendInterval.Duration == 0 {
+		l.MaintenanceResendInterval.Duration = DefaultMaintenanceResendInterval
+	}
+	if l.MaxChatLength == 0 {
+		l.MaxChatLength = DefaultMaxChatLength
+	}
+	if l.ChatMessagesPerMinute == 0 {
+		l.ChatMessagesPerMinute = DefaultChatMessagesPerMinute
+	}
+	if l.AcceptQueueSize == 0 {
+		l.AcceptQueueSize = DefaultAcceptQueueSize
+	}
+	if l.AcceptOverflow == "" {
+		l.AcceptOverflow = "refuse"
+	}
+	if l.CapacityWarningPercent == 0 {
+		l.CapacityWarningPercent = DefaultCapacityWarningPercent
+	}
+}
+
+// ConfigError lists all problems found in a configuration.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+func (e *ConfigError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// Checks all fields of the configuration. Returns a *ConfigError listing all problems.
+func (l *RelayConfig) Validate() error {
+	problems := &ConfigError{}
+	if l.CallbackQueueSize < 0 {
+		problems.add("CallbackQueueSize must not be negative")
+	}
+	if _, ok := parseOverflowPolicy(l.CallbackOverflow); !ok {
+		problems.add("unknown CallbackOverflow policy '%v'", l.CallbackOverflow)
+	}
+	if l.MetaserverAddr != "" {
+		if _, _, err := net.SplitHostPort(l.MetaserverAddr); err != nil {
+			problems.add("invalid MetaserverAddr '%v': %v", l.MetaserverAddr, err)
+		}
+	}
+	if l.GameListenAddr != "" {
+		if _, port, err := net.SplitHostPort(l.GameListenAddr); err != nil {
+			problems.add("invalid GameListenAddr '%v': %v", l.GameListenAddr, err)
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			problems.add("invalid port in GameListenAddr '%v'", l.GameListenAddr)
+		}
+	}
+	for name, value := range map[string]int64{
+		"MaxGames":                         int64(l.MaxGames),
+		"MaxGamesPerOwner":                 int64(l.MaxGamesPerOwner),
+		"MaxConnectionsPerIP":              int64(l.MaxConnectionsPerIP),
+		"GameTrafficDSCP":                  int64(l.GameTrafficDSCP),
+		"CapacityWarningPercent":           int64(l.CapacityWarningPercent),
+		"ShedSpectatorsAt":                 int64(l.ShedSpectatorsAt),
+		"ShedCasualAt":                     int64(l.ShedCasualAt),
+		"AcceptQueueSize":                  int64(l.AcceptQueueSize),
+		"RecordRotateSize":                 l.RecordRotateSize,
+		"HistorySize":                      int64(l.HistorySize),
+		"LogBufferSize":                    int64(l.LogBufferSize),
+		"MaxChatLength":                    int64(l.MaxChatLength),
+		"ChatMessagesPerMinute":            int64(l.ChatMessagesPerMinute),
+		"MaxFrameSize":                     int64(l.MaxFrameSize),
+		"MaxStatusSize":                    int64(l.MaxStatusSize),
+		"PasswordLockoutThreshold":         int64(l.PasswordLockoutThreshold),
+		"MaxTotalSpectators":               int64(l.MaxTotalSpectators),
+		"MaxTotalBandwidth":                int64(l.MaxTotalBandwidth),
+		"HostRateLimit.BytesPerSecond":     int64(l.HostRateLimit.BytesPerSecond),
+		"HostRateLimit.PacketsPerSecond":   int64(l.HostRateLimit.PacketsPerSecond),
+		"ClientRateLimit.BytesPerSecond":   int64(l.ClientRateLimit.BytesPerSecond),
+		"ClientRateLimit.PacketsPerSecond": int64(l.ClientRateLimit.PacketsPerSecond),
+	} {
+		if value < 0 {
+			problems.add("%v must not be negative", name)
+		}
+	}
+	for owner, limit := range l.OwnerGameLimits {
+		if limit < 0 {
+			problems.add("OwnerGameLimits of '%v' must not be negative", owner)
+		}
+	}
+	for name, value := range map[string]Duration{
+		"ReconnectGracePeriod":        l.ReconnectGracePeriod,
+		"IdleConnectionTimeout":       l.IdleConnectionTimeout,
+		"ShutdownTimeout":             l.ShutdownTimeout,
+		"MaxGameLifetime":             l.MaxGameLifetime,
+		"StateSnapshotInterval":       l.StateSnapshotInterval,
+		"StateRestoreGracePeriod":     l.StateRestoreGracePeriod,
+		"RecordRotateInterval":        l.RecordRotateInterval,
+		"CloseGraceDelay":             l.CloseGraceDelay,
+		"JoinTokenLifetime":           l.JoinTokenLifetime,
+		"MaintenanceLeadTime":         l.MaintenanceLeadTime,
+		"PasswordLockoutWindow":       l.PasswordLockoutWindow,
+		"MaintenanceResendInterval":   l.MaintenanceResendInterval,
+		"HostRateLimit.MaxThrottle":   l.HostRateLimit.MaxThrottle,
+		"ClientRateLimit.MaxThrottle": l.ClientRateLimit.MaxThrottle,
+	} {
+		if value.Duration < 0 {
+			problems.add("%v must not be negative", name)
+		}
+	}
+	switch l.AcceptOverflow {
+	case "", "refuse", "block":
+	default:
+		problems.add("unknown AcceptOverflow '%v'", l.AcceptOverflow)
+	}
+	if l.CapacityWarningPercent > 100 {
+		problems.add("CapacityWarningPercent must not be above 100")
+	}
+	if l.GameTrafficDSCP > 63 {
+		problems.add("GameTrafficDSCP must not be above 63")
+	}
+	if l.ShedSpectatorsAt > 0 && l.ShedCasualAt > 0 && l.ShedCasualAt < l.ShedSpectatorsAt {
+		problems.add("ShedCasualAt must not be below ShedSpectatorsAt, spectators are refused first")
+	}
+	if l.EnforcePlayerNames && !l.RequireJoinTokens {
+		problems.add("EnforcePlayerNames requires RequireJoinTokens")
+	}
+	if l.UDPListenAddr != "" {
+		if _, port, err := net.SplitHostPort(l.UDPListenAddr); err != nil {
+			problems.add("invalid UDPListenAddr '%v': %v", l.UDPListenAddr, err)
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			problems.add("invalid port in UDPListenAddr '%v'", l.UDPListenAddr)
+		}
+	}
+	for name, value := range map[string]string{
+		"ForwardingLogLevel": l.ForwardingLogLevel,
+		"RPCLogLevel":        l.RPCLogLevel,
+		"LifecycleLogLevel":  l.LifecycleLogLevel,
+	} {
+		if _, err := relayinterface.ParseLogLevel(value); err != nil {
+			problems.add("%v: %v", name, err)
+		}
+	}
+	if l.MinClientVersion != "" {
+		if _, err := parseClientVersion(l.MinClientVersion); err != nil {
+			problems.add("MinClientVersion: %v", err)
+		}
+	}
+	if l.StateFile != "" {
+		if info, err := os.Stat(filepath.Dir(l.StateFile)); err != nil || !info.IsDir() {
+			problems.add("directory of StateFile '%v' does not exist", l.StateFile)
+		}
+	}
+	if l.RecordDir != "" {
+		if info, err := os.Stat(l.RecordDir); err != nil || !info.IsDir() {
+			problems.add("RecordDir '%v' is not a directory", l.RecordDir)
+		}
+	}
+	// Sorted so the message does not depend on the order of the maps above
+	sort.Strings(problems.Problems)
+	if len(problems.Problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// LoadRelayConfig reads the configuration from the given JSON file, loads
+// the secrets it references, fills in the defaults and validates it.
+// Unknown fields are reported as error to catch typos.
+func LoadRelayConfig(path string) (RelayConfig, error) {
+	var config RelayConfig
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return config, err
+	}
+	if err := config.loadSecrets(); err != nil {
+		return config, err
+	}
+	config.applyDefaults()
+	return config, config.Validate()
+}
+
+// Returns all settings of the configuration with the secrets redacted.
+// Fields of nested settings are named like "HostRateLimit.MaxThrottle"
+func (l *RelayConfig) View() relayinterface.RelayConfigView {
+	view := make(relayinterface.RelayConfigView)
+	addConfigFields(view, "", reflect.ValueOf(*l))
+	return view
+}
+
+func addConfigFields(view relayinterface.RelayConfigView, prefix string, value reflect.Value) {
+	for i := 0; i < value.NumField(); i++ {
+		name := prefix + value.Type().Field(i).Name
+		switch field := value.Field(i).Interface().(type) {
+		case Duration:
+			view[name] = field.String()
+		case RateLimit:
+			addConfigFields(view, name+".", value.Field(i))
+		case string:
+			if secretConfigFields[name] && field != "" {
+				field = redactedSecret
+			}
+			view[name] = field
+		default:
+			view[name] = fmt.Sprint(field)
+		}
+	}
+}
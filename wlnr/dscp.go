@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// Returns the ListenConfig for the sockets of game connections and of the UDP relay.
+// If dscp is not 0, the packets send over the sockets are marked with it, see
+// RelayConfig.GameTrafficDSCP. Marking is best-effort: if the platform does not
+// support it, a warning is logged and the socket is used unmarked
+func gameListenConfig(dscp int) *net.ListenConfig {
+	if dscp == 0 {
+		return &net.ListenConfig{}
+	}
+	return &net.ListenConfig{
+		Control: func(network, address string, conn syscall.RawConn) error {
+			var markErr error
+			if err := conn.Control(func(fd uintptr) {
+				markErr = setTrafficClass(fd, network, dscp<<2)
+			}); err != nil {
+				return err
+			}
+			if markErr != nil {
+				lifecycleLog.Warnf("Unable to mark the game traffic on %v with DSCP %v: %v", address, dscp, markErr)
+			}
+			return nil
+		},
+	}
+}
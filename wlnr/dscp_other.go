@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+)
+
+func setTrafficClass(fd uintptr, network string, tos int) error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+// Sets the type of service byte of the socket. Sockets accepted by a listening
+// socket inherit it on Linux
+func setTrafficClass(fd uintptr, network string, tos int) error {
+	if strings.HasSuffix(network, "6") {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos); err != nil {
+			return err
+		}
+		// IPv4 peers of a dual stack socket are marked with IP_TOS, which not all
+		// platforms support on IPv6 sockets
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		return nil
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+}
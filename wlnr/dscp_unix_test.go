@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+	. "gopkg.in/check.v1"
+	"net"
+	"syscall"
+)
+
+func (s *ServerSuite) TestGameTrafficIsMarked(c *C) {
+	ln, _, err := listenForGames("127.0.0.1:0", 46)
+	c.Assert(err, IsNil)
+	defer ln.Close()
+	raw, err := ln.(*net.TCPListener).SyscallConn()
+	c.Assert(err, IsNil)
+	var tos int
+	raw.Control(func(fd uintptr) {
+		tos, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	})
+	c.Assert(err, IsNil)
+	c.Assert(tos, Equals, 46<<2)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"sync/atomic"
+	"time"
+)
+
+// Returns a snapshot of what the relay knows about the game. Only reads the
+// game, so it can be called while data is forwarded
+func (game *Game) dump() relayinterface.GameStateDump {
+	dump := relayinterface.GameStateDump{
+		Name:            game.gameName,
+		TakenAt:         time.Now(),
+		CreatedAt:       game.createdAt,
+		ProtocolVersion: game.protocolVersion,
+		Public:          game.public,
+		UDPEnabled:      game.udpEnabled,
+		Tags:            game.tags,
+		NextClientID:    game.nextClientId,
+		HostConnected:   game.host != nil,
+		BytesForwarded:  atomic.LoadInt64(&game.bytesForwarded),
+		LastTraffic:     time.Unix(0, atomic.LoadInt64(&game.lastTraffic)),
+		Recorded:        game.recorder != nil,
+	}
+	participants := []*Client{}
+	if game.host != nil {
+		participants = append(participants, game.host)
+	}
+	for e := game.clients.Front(); e != nil; e = e.Next() {
+		participants = append(participants, e.Value.(*Client))
+	}
+	for _, client := range participants {
+		dump.Participants = append(dump.Participants, relayinterface.ParticipantDump{
+			PlayerInfo:     game.playerInfo(client),
+			LastPingSeq:    client.lastSendPingSeq,
+			WaitingForPong: client.waitingForPong,
+			RTT:            client.rttLastPing,
+			CanReconnect:   client.reconnectToken != "",
+		})
+	}
+	for _, slot := range game.reconnectSlots {
+		dump.ReconnectSlots = append(dump.ReconnectSlots, uint64(slot.id))
+	}
+	return dump
+}
+
+// Returns a snapshot of the state of the game for debugging.
+// If configured, the snapshot is also written next to the recording of the game
+func (s *Server) DumpGameState(name string) (relayinterface.GameStateDump, error) {
+	game := s.findGame(name)
+	if game == nil {
+		return relayinterface.GameStateDump{}, relayinterface.ErrGameNotFound
+	}
+	dump := game.dump()
+	if s.config.WriteStateDumps && game.recorder != nil {
+		b, err := json.MarshalIndent(dump, "", "  ")
+		if err != nil {
+			return dump, err
+		}
+		if dump.Path, err = game.recorder.WriteDump(b, dump.TakenAt); err != nil {
+			lifecycleLog.Warnf("Unable to write state dump of game %v: %v", game.logName(), err)
+			return dump, err
+		}
+		lifecycleLog.Infof("Wrote state dump of game %v to %v", game.logName(), dump.Path)
+	}
+	return dump, nil
+}
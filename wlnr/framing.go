@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"io"
+)
+
+// Framer reads and writes the frames of game data passed between host and clients.
+// The relay does not look into the frames, it only has to know where they end.
+// Which framer a connection uses depends on the relay protocol version it negotiated
+type Framer interface {
+	// Reads the next frame, including its length or delimiter
+	ReadFrame(r *bufio.Reader) ([]byte, error)
+	// Appends a frame as returned by ReadFrame to the command
+	WriteFrame(cmd *Command, frame []byte)
+}
+
+// The framers of the supported relay protocol versions
+var framers = map[uint8]Framer{
+	kRelayProtocolVersion: lengthPrefixFramer{},
+}
+
+// Returns the framer for the given protocol version, nil if the version is not supported
+func framerFor(version uint8) Framer {
+	return framers[version]
+}
+
+// lengthPrefixFramer handles frames starting with their length as big endian uint16.
+// The length includes the two bytes of the length itself
+type lengthPrefixFramer struct{}
+
+func (lengthPrefixFramer) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	length_bytes := make([]byte, 2)
+	_, error := io.ReadFull(r, length_bytes)
+	if error != nil {
+		return length_bytes, error
+	}
+	length := int(length_bytes[0])<<8 | int(length_bytes[1])
+	if length < 2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	packet := make([]byte, length)
+	packet[0] = length_bytes[0]
+	packet[1] = length_bytes[1]
+	_, error = io.ReadFull(r, packet[2:])
+	// TODO(Notabilis): Think about this (and similar places). The client might be able
+	// to keep the server waiting here. Actually, he can simply keep the connection
+	// idling anyway. Is this a problem? Might be a possibility for DoS.
+	// Is there a ping in the GameHost code? Won't help before a game is assigned
+	// to the client, though. So probably add some fast disconnect on idle.
+	return packet, error
+}
+
+func (lengthPrefixFramer) WriteFrame(cmd *Command, frame []byte) {
+	cmd.AppendBytes(frame)
+}
+
+// Returns the largest frame which can be forwarded between the given host and
+// client: The smaller preference of both, see kFrameSize, within MaxFrameSize.
+// 0 if there is no limit
+func (game *Game) frameLimit(host, client *Client) int {
+	limit := game.server.config.MaxFrameSize
+	for _, participant := range []*Client{client, host} {
+		if participant != nil && participant.frameSize > 0 && (limit == 0 || participant.frameSize < limit) {
+			limit = participant.frameSize
+		}
+	}
+	return limit
+}
+
+// Disconnects the sender of a frame larger than MaxFrameSize. Returns whether the frame can be forwarded
+func (game *Game) checkFrameSize(sender *Client, frame []byte) bool {
+	if max := game.server.config.MaxFrameSize; max > 0 && len(frame) > max {
+		forwardingLog.Warnf("Client (id=%v) of game %v sent a frame of %v bytes, more than %v, disconnecting", sender.id, game.logName(), len(frame), max)
+		game.DisconnectClient(sender, "PROTOCOL_VIOLATION")
+		return false
+	}
+	return true
+}
+
+// Whether the frame fits the limit negotiated between the host and the client.
+// The relay can not split frames since it does not know what is inside, so
+// larger frames are refused: The sender gets kFrameRefused and may split them
+func (game *Game) frameFits(host, client, sender *Client, frame []byte) bool {
+	limit := game.frameLimit(host, client)
+	if limit == 0 || len(frame) <= limit {
+		return true
+	}
+	receiver := client
+	if sender == client {
+		receiver = host
+	}
+	forwardingLog.Warnf("Refusing frame of %v bytes between the host and client (id=%v) of game %v, they accept at most %v", len(frame), client.id, game.logName(), limit)
+	cmd := NewCommand(kFrameRefused)
+	cmd.AppendUInt(receiver.id)
+	cmd.AppendUInt(uint8(limit >> 8))
+	cmd.AppendUInt(uint8(limit))
+	game.sendToClient(sender, cmd)
+	return false
+}
@@ -2,9 +2,18 @@ package main
 
 import (
 	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
 	"io"
 	"log"
 	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,6 +23,9 @@ const ID_HOST = 1
 // The used protocol version is not known since the host has not yet connected
 const VERSION_UNKNOWN = 0
 
+// How long to wait for the host to connect after a game has been created
+const hostConnectTimeout = 30 * time.Second
+
 type Game struct {
 	// The connection (net.Conn most likely) that let us talk to the game host
 	host *Client
@@ -35,90 +47,816 @@ type Game struct {
 	// game. This is guaranteed to be unique by the metaserver.
 	gameName string
 
-	// The password which has to be presented by the host to make sure
-	// he really is the host
-	hostPassword string
+	// The name of the game as used for looking it up, see Server.gameKey.
+	// gameName is shown to the players
+	key string
+
+	// Hash of the password which has to be presented by the host to make sure
+	// he really is the host. Only the hash is kept so it can be written to the state file
+	hostPasswordHash string
+	// Limits how often the metaserver can check the host password, see Server.VerifyHostPassword
+	passwordChecks *attemptLimiter
+	// Locks out whoever presents too many wrong host passwords. Nil if disabled
+	lockout *passwordLockout
+
+	// Whether the game should be listed in the lobby
+	public bool
+
+	// Whether new clients are refused, see Server.LockGame
+	locked bool
+
+	// Whether new clients without a join token are refused, see Server.MakeInviteOnly.
+	// Changed with the lifecycle mutex held
+	inviteOnly bool
+
+	// The current key epoch announced by the host with kKeyEpoch, 0 if none.
+	// Changed with the lifecycle mutex held. Accessed atomically
+	keyEpoch int32
+
+	// Who created the game, see GameData.OwnerID
+	ownerID string
+
+	// Id to trace the creation of the game, see GameData.RequestID
+	requestID string
+
+	// Whether the participants are given tokens for the UDP relay
+	udpEnabled bool
+
+	// Whether stricter rules apply to the game, see GameData.Ranked
+	ranked bool
+
+	// Attributes of the game for the lobby, the relay does not care about them
+	tags map[string]string
 
 	// A reference of the server since we have to tell him when we shut down
 	server *Server
 
 	// Whether we are currently shutting down
 	currentlyShuttingDown bool
+
+	// Whether the game has been written to the state file when the relay shut
+	// down. It is restored on the next start, so it is not reported as closed
+	persisted bool
+
+	// Serializes the lifecycle transitions of the game: the host connecting or
+	// leaving and the game being closed. GameConnected and GameClosed are queued
+	// while holding it, so the metaserver learns about them in the order they
+	// happened. Once the game is shutting down, no host is accepted anymore.
+	// Not held while forwarding game data
+	lifecycle sync.Mutex
+
+	// Slots of clients which lost their connection, by reconnection token
+	reconnectSlots map[string]*reconnectSlot
+	// The reconnection tokens of the slots which expired, reconnecting with them is refused
+	expiredTokens map[string]bool
+
+	// Close the game if no game data has been forwarded for this long. Disabled if 0
+	autoCloseAfterNoTraffic time.Duration
+	// When game data has been forwarded the last time, in unix nanoseconds.
+	// Accessed atomically since all connections of the game update it
+	lastTraffic int64
+	// The number of bytes of game data forwarded to the participants. Accessed atomically
+	bytesForwarded int64
+	// The number of frames forwarded, to decide which ones are timed. Accessed atomically
+	framesSeen int64
+	// The bytes and frames forwarded since the last ResetGameCounters, and when
+	// that happened in unix nanoseconds (0 if never). Unlike the counters above,
+	// these start from zero again on a reset. Accessed atomically
+	counterBytes  int64
+	counterFrames int64
+	countersSince int64
+	// How long the timed frames took to be forwarded
+	latency LatencyHistogram
+	// Checks lastTraffic if autoCloseAfterNoTraffic is set
+	trafficTimer *time.Timer
+
+	// When the game has been created on the relay
+	createdAt time.Time
+	// The significant events of the game, protected by timelineMutex
+	timeline      []relayinterface.TimelineEvent
+	timelineMutex sync.Mutex
+	// The most players connected at the same time, including the host
+	peakPlayers int
+
+	// Why the game is shut down, reported to the metaserver
+	closeReason relayinterface.CloseReason
+
+	// When the game is removed if no host connected to it until then
+	hostDeadline time.Time
+	// When the game is closed no matter what. Zero if the lifetime is unlimited
+	expiresAt time.Time
+	// Closes the game at expiresAt
+	lifetimeTimer *time.Timer
+
+	// Records the forwarded game data. Nil if recording is disabled
+	recorder *Recorder
+	// Which frames the recorder records, kept to restore the game
+	recordSampling relayinterface.FrameSampling
+
+	// Shuts the game down if the host does not come back after leaving.
+	// Only set while waiting for the host, see Config.CloseGraceDelay
+	closeTimer *time.Timer
+}
+
+// The slot of a client which lost its connection and might reconnect
+type reconnectSlot struct {
+	id        uint8
+	spectator bool
+	timer     *time.Timer
+}
+
+func NewGame(data relayinterface.GameData, server *Server) *Game {
+	return newGame(data, server, hostConnectTimeout)
 }
 
-func NewGame(name, password string, server *Server) *Game {
+// Creates a game which is removed if no host connects within the given time
+func newGame(data relayinterface.GameData, server *Server, hostTimeout time.Duration) *Game {
+	name := data.Name
 	game := &Game{
-		host:                  nil,
-		clients:               list.New(),
-		nextClientId:          ID_HOST + 1,
-		protocolVersion:       VERSION_UNKNOWN,
-		gameName:              name,
-		hostPassword:          password,
-		server:                server,
-		currentlyShuttingDown: false,
-	}
-	time.AfterFunc(30 * time.Second, func() { server.RemoveGameIfNoHostIsConnected(name) })
+		host:                    nil,
+		clients:                 list.New(),
+		nextClientId:            ID_HOST + 1,
+		protocolVersion:         VERSION_UNKNOWN,
+		gameName:                name,
+		key:                     server.gameKey(name),
+		hostPasswordHash:        hashPassword(data.Password),
+		passwordChecks:          newAttemptLimiter(maxPasswordChecks, passwordCheckWindow),
+		lockout:                 newPasswordLockout(server.config.PasswordLockoutThreshold, server.config.PasswordLockoutWindow.Duration),
+		public:                  data.Public,
+		ownerID:                 data.OwnerID,
+		requestID:               data.RequestID,
+		udpEnabled:              data.UDPEnabled,
+		ranked:                  data.Ranked,
+		tags:                    data.Tags,
+		server:                  server,
+		currentlyShuttingDown:   false,
+		reconnectSlots:          make(map[string]*reconnectSlot),
+		expiredTokens:           make(map[string]bool),
+		autoCloseAfterNoTraffic: data.AutoCloseAfterNoTraffic,
+		recordSampling:          data.RecordSampling,
+		lastTraffic:             time.Now().UnixNano(),
+		createdAt:               time.Now(),
+		hostDeadline:            time.Now().Add(hostTimeout),
+	}
+	game.recordTimeline(relayinterface.TimelineEvent{Type: relayinterface.EventGameCreated, Time: game.createdAt})
+	time.AfterFunc(hostTimeout, func() { server.RemoveGameIfNoHostIsConnected(name) })
+	if game.autoCloseAfterNoTraffic > 0 {
+		game.trafficTimer = time.AfterFunc(game.autoCloseAfterNoTraffic, game.checkTraffic)
+	}
+	if lifetime := server.config.MaxGameLifetime.Duration; lifetime > 0 {
+		game.expiresAt = time.Now().Add(lifetime)
+		game.lifetimeTimer = time.AfterFunc(lifetime, game.expire)
+	}
+	if dir := server.config.RecordDir; dir != "" {
+		recorder, err := NewRecorder(dir, name, server.config.RecordRotateSize, server.config.RecordRotateInterval.Duration, data.RecordSampling)
+		if err != nil {
+			lifecycleLog.Warnf("Unable to record game '%v': %v", name, err)
+		} else {
+			game.recorder = recorder
+		}
+	}
 	return game
 }
 
+// Returns the hash of a host password as kept by games
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// Whether the given password is the one of the host
+func (game *Game) isHostPassword(password string) bool {
+	return hashPassword(password) == game.hostPasswordHash
+}
+
+// Checks the host password presented from the given address, which is empty
+// for the metaserver. Fails with ErrLockedOut without checking while too many
+// wrong passwords have been presented, by anyone or from the same IP address
+// if PasswordLockoutPerIP is configured
+func (game *Game) checkHostPassword(password, remoteAddr string) error {
+	source := ""
+	if game.server.config.PasswordLockoutPerIP && remoteAddr != "" {
+		if ip, _, err := net.SplitHostPort(remoteAddr); err == nil {
+			source = ip
+		}
+	}
+	if !game.lockout.Locked(source).IsZero() {
+		return relayinterface.ErrLockedOut
+	}
+	if !game.isHostPassword(password) {
+		if until := game.lockout.Failed(source); !until.IsZero() {
+			lifecycleLog.Warnf("Too many wrong host passwords for game %v, locked until %v", game.logName(), until)
+		}
+		return relayinterface.ErrWrongPassword
+	}
+	game.lockout.Succeeded(source)
+	return nil
+}
+
+// Tells the metaserver that a connection presenting a host password has been refused
+func (game *Game) rejectJoin(client *Client, err error) {
+	rejection := relayinterface.JoinRejection{
+		Game:       game.Name(),
+		RemoteAddr: client.RemoteAddr(),
+		Reason:     relayinterface.RejectWrongPassword,
+	}
+	if err == relayinterface.ErrLockedOut {
+		rejection.Reason = relayinterface.RejectLockedOut
+	}
+	lifecycleLog.Infof("Refusing host from %v for game %v: %v", client.RemoteAddr(), game.logName(), err)
+	game.server.wlms.ClientJoinRejected(rejection)
+}
+
+// Closes the game since it reached the maximal lifetime
+func (game *Game) expire() {
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	if game.currentlyShuttingDown {
+		return
+	}
+	lifecycleLog.Infof("Closing game %v since it exists for longer than %v", game.logName(), game.server.config.MaxGameLifetime.Duration)
+	game.closeReason = relayinterface.CloseReasonExpired
+	game.shutdown()
+}
+
+// Returns how long until the given deadline or 0 if there is none
+func timeUntil(deadline time.Time) time.Duration {
+	if deadline.IsZero() {
+		return 0
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		// About to be closed, but 0 would mean unlimited
+		return time.Nanosecond
+	}
+	return remaining
+}
+
+// Returns how long the game may still exist or 0 if there is no limit
+func (game *Game) remainingLifetime() time.Duration {
+	return timeUntil(game.expiresAt)
+}
+
+// Returns how long until the game is removed for not having a host or 0 if
+// the host connected in time
+func (game *Game) timeUntilNoHostClose() time.Duration {
+	if game.host != nil || !time.Now().Before(game.hostDeadline) {
+		// RemoveGameIfNoHostIsConnected only checks once at the deadline
+		return 0
+	}
+	return timeUntil(game.hostDeadline)
+}
+
+// Returns how long until checkTraffic closes the game if no game data is
+// forwarded until then, or 0 if the game is not closed for missing traffic
+func (game *Game) timeUntilNoTrafficClose() time.Duration {
+	if game.autoCloseAfterNoTraffic <= 0 || game.host == nil {
+		return 0
+	}
+	lastTraffic := time.Unix(0, atomic.LoadInt64(&game.lastTraffic))
+	return timeUntil(lastTraffic.Add(game.autoCloseAfterNoTraffic))
+}
+
+// Remembers that a frame or datagram has been forwarded, taking the given number of bytes
+// to all receivers. Pings and other control messages do not count since they are send by idle players, too
+func (game *Game) noteTraffic(bytes int) {
+	atomic.StoreInt64(&game.lastTraffic, time.Now().UnixNano())
+	atomic.AddInt64(&game.bytesForwarded, int64(bytes))
+	atomic.AddInt64(&game.counterBytes, int64(bytes))
+	atomic.AddInt64(&game.counterFrames, 1)
+}
+
+// Updates peakPlayers after a player joined
+func (game *Game) notePlayers() {
+	players := game.clients.Len()
+	if game.host != nil {
+		players++
+	}
+	if players > game.peakPlayers {
+		game.peakPlayers = players
+	}
+}
+
+// Returns what is kept about the game in the history after it has been closed
+func (game *Game) summary() relayinterface.GameSummary {
+	return relayinterface.GameSummary{
+		Name:        game.gameName,
+		Duration:    time.Since(game.createdAt),
+		PeakPlayers: game.peakPlayers,
+		TotalBytes:  atomic.LoadInt64(&game.bytesForwarded),
+		CloseReason: game.closeReason,
+		ClosedAt:    time.Now(),
+	}
+}
+
+// Closes the game if no game data has been forwarded within autoCloseAfterNoTraffic.
+// Otherwise checks again when that time would be reached
+func (game *Game) checkTraffic() {
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	if game.currentlyShuttingDown {
+		return
+	}
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&game.lastTraffic)))
+	if idle < game.autoCloseAfterNoTraffic || game.host == nil {
+		// Without host the game is removed by RemoveGameIfNoHostIsConnected
+		game.trafficTimer.Reset(game.autoCloseAfterNoTraffic - idle)
+		return
+	}
+	lifecycleLog.Infof("Closing game %v since no game data has been forwarded for %v", game.logName(), idle)
+	game.closeReason = relayinterface.CloseReasonNoTraffic
+	game.shutdown()
+}
+
 func (game *Game) Name() string {
 	return game.gameName
 }
 
+// Returns the name of the game for log lines, with its request id if there is one
+func (game *Game) logName() string {
+	return gameLogName(game.gameName, game.requestID)
+}
+
+func gameLogName(name, requestID string) string {
+	if requestID == "" {
+		return fmt.Sprintf("'%v'", name)
+	}
+	return fmt.Sprintf("'%v' (request %v)", name, requestID)
+}
+
+// Returns the description of the game as passed to the metaserver, without the password
+func (game *Game) Data() relayinterface.GameData {
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	data := relayinterface.GameData{
+		Name:                    game.gameName,
+		Public:                  game.public,
+		Locked:                  game.locked,
+		InviteOnly:              game.inviteOnly,
+		AutoCloseAfterNoTraffic: game.autoCloseAfterNoTraffic,
+		RemainingLifetime:       game.remainingLifetime(),
+		TimeUntilNoHostClose:    game.timeUntilNoHostClose(),
+		TimeUntilNoTrafficClose: game.timeUntilNoTrafficClose(),
+		Tags:                    game.tags,
+		OwnerID:                 game.ownerID,
+		UDPEnabled:              game.udpEnabled,
+		Ranked:                  game.ranked,
+		KeyEpoch:                int(atomic.LoadInt32(&game.keyEpoch)),
+	}
+	for _, remaining := range []time.Duration{data.RemainingLifetime, data.TimeUntilNoHostClose, data.TimeUntilNoTrafficClose} {
+		if remaining > 0 && (data.TimeUntilClose == 0 || remaining < data.TimeUntilClose) {
+			data.TimeUntilClose = remaining
+		}
+	}
+	return data
+}
+
+// Returns whether the game is selected by the filter of ListGamesFiltered
+func (game *Game) matches(filter relayinterface.GameFilter) bool {
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	if filter.OnlyOpen && (game.host == nil || game.locked) {
+		return false
+	}
+	if filter.MinProtocol > 0 || filter.MaxProtocol > 0 {
+		version := int(game.protocolVersion)
+		if game.protocolVersion == VERSION_UNKNOWN ||
+			(filter.MinProtocol > 0 && version < filter.MinProtocol) ||
+			(filter.MaxProtocol > 0 && version > filter.MaxProtocol) {
+			return false
+		}
+	}
+	if filter.NameContains != "" && !strings.Contains(strings.ToLower(game.gameName), strings.ToLower(filter.NameContains)) {
+		return false
+	}
+	if filter.ExcludePrivate && !game.public {
+		return false
+	}
+	if filter.ExcludeRanked && game.ranked {
+		return false
+	}
+	return true
+}
+
+// Stops forwarding datagrams of the client over the UDP relay
+func (game *Game) forgetUDP(client *Client) {
+	if game.server.udp != nil {
+		game.server.udp.Forget(client)
+	}
+}
+
+// Disconnects everyone and removes the game from the relay. Returns after the
+// game has been removed, even if it has already been shutting down before
 func (game *Game) Shutdown() {
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	game.shutdown()
+}
+
+// Shuts the game down since the relay is shutting down. If the game has been
+// persisted to the state file, the metaserver is not told that it closed
+func (game *Game) shutdownRelay(persisted bool) {
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	if game.closeReason == relayinterface.CloseReasonNormal {
+		game.closeReason = relayinterface.CloseReasonShutdown
+	}
+	game.persisted = persisted
+	game.shutdown()
+}
+
+// Same as Shutdown, has to be called with the lifecycle mutex held
+func (game *Game) shutdown() {
 	if game.currentlyShuttingDown == true {
 		return
 	}
 	game.currentlyShuttingDown = true
-	log.Printf("Shutting down game '%v'\n", game.gameName)
+	lifecycleLog.Infof("Shutting down game %v", game.logName())
+	if game.trafficTimer != nil {
+		game.trafficTimer.Stop()
+	}
+	if game.lifetimeTimer != nil {
+		game.lifetimeTimer.Stop()
+	}
+	if game.closeTimer != nil {
+		game.closeTimer.Stop()
+	}
+	if game.recorder != nil {
+		if err := game.recorder.Close(); err != nil {
+			lifecycleLog.Warnf("Unable to finish recording of game %v: %v", game.logName(), err)
+		}
+	}
+	for token, slot := range game.reconnectSlots {
+		slot.timer.Stop()
+		delete(game.reconnectSlots, token)
+	}
+	reason := "NORMAL"
+	if game.closeReason == relayinterface.CloseReasonShutdown {
+		reason = "SHUTDOWN"
+	}
 	for game.clients.Len() > 0 {
-		game.DisconnectClient(game.clients.Front().Value.(*Client), "NORMAL")
+		game.disconnectClient(game.clients.Front().Value.(*Client), reason)
 	}
-	game.DisconnectClient(game.host, "NORMAL")
+	game.disconnectClient(game.host, reason)
 	game.server.RemoveGameObject(game)
 }
 
 func (game *Game) addClient(client *Client, version uint8, password string) {
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	if game.currentlyShuttingDown {
+		// Removed while the client connected
+		client.Disconnect("GAME_UNKNOWN")
+		return
+	}
+	if game.ranked {
+		client.SetPingInterval(RANKED_PING_INTERVAL_S)
+	}
+	// Checked before the host password, so the participants of a restored game
+	// can reattach before its host is back
+	if slot, ok := game.reconnectSlots[password]; ok {
+		if game.protocolVersion == VERSION_UNKNOWN {
+			// Restored game without host, which sets the version again when it reconnects
+			game.protocolVersion = version
+		} else if game.protocolVersion != version {
+			client.Disconnect("WRONG_VERSION")
+			return
+		}
+		game.reattachClient(client, password, slot)
+		return
+	}
+	if game.expiredTokens[password] {
+		// The client expects its old slot, the host already dropped it
+		lifecycleLog.Infof("Refusing client from %v reconnecting too late to game %v", client.RemoteAddr(), game.logName())
+		client.Disconnect("SLOT_EXPIRED")
+		return
+	}
 	if game.host == nil {
 		// First connection to this game / no host yet
-		if password != game.hostPassword {
-			client.Disconnect("NO_HOST")
+		if err := game.checkHostPassword(password, client.RemoteAddr()); err != nil {
+			game.rejectJoin(client, err)
+			if err == relayinterface.ErrLockedOut {
+				client.Disconnect("LOCKED_OUT")
+			} else {
+				client.Disconnect("NO_HOST")
+			}
 			return
 		}
+		if game.closeTimer != nil {
+			// The host came back in time
+			game.closeTimer.Stop()
+			game.closeTimer = nil
+			lifecycleLog.Infof("Host rejoined game %v", game.logName())
+		}
 		game.protocolVersion = version
 		game.host = client
 		game.host.id = ID_HOST
-		go game.handleHostMessages()
+		game.server.counters.AddOpenGames(1)
+		game.server.counters.AddClients(1)
+		game.server.players.Add(client, game)
+		go game.handleMessages(client)
+		game.notePlayers()
+		game.audit(client, "Connected")
 		// Send message to metaserver
 		game.server.GameConnected(game.Name())
-		log.Printf("Accepted new host (id=%v) with protocol version %v for game '%v'", ID_HOST, version, game.Name())
+		game.recordTimeline(relayinterface.TimelineEvent{Type: relayinterface.EventGameConnected, PlayerID: ID_HOST})
+		lifecycleLog.Infof("Accepted new host (id=%v) with protocol version %v for game %v", ID_HOST, version, game.logName())
 	} else {
 		// A normal client
 		if game.protocolVersion != version {
 			client.Disconnect("WRONG_VERSION")
 			return
 		}
+		if game.locked {
+			lifecycleLog.Infof("Refusing new client from %v for locked game %v", client.RemoteAddr(), game.logName())
+			game.server.wlms.ClientJoinRejected(relayinterface.JoinRejection{
+				Game:       game.Name(),
+				RemoteAddr: client.RemoteAddr(),
+				Reason:     relayinterface.RejectGameLocked,
+			})
+			client.Disconnect("GAME_LOCKED")
+			return
+		}
+		if game.server.sheds(client.priority(game.ranked)) {
+			lifecycleLog.Infof("Refusing new client from %v for game %v, the relay is overloaded", client.RemoteAddr(), game.logName())
+			game.server.wlms.ClientJoinRejected(relayinterface.JoinRejection{
+				Game:       game.Name(),
+				RemoteAddr: client.RemoteAddr(),
+				Reason:     relayinterface.RejectOverloaded,
+			})
+			client.Disconnect("OVERLOADED")
+			return
+		}
+		if game.inviteOnly && !client.invited {
+			lifecycleLog.Infof("Refusing client from %v without invitation for game %v", client.RemoteAddr(), game.logName())
+			game.server.wlms.ClientJoinRejected(relayinterface.JoinRejection{
+				Game:       game.Name(),
+				RemoteAddr: client.RemoteAddr(),
+				Reason:     relayinterface.RejectNotInvited,
+			})
+			client.Disconnect("NO_TOKEN")
+			return
+		}
 		if game.nextClientId >= 250 {
 			// Avoid overflow of uint8 id
-			log.Printf("Too many clients in game %v, disconnecting new client", game.Name())
+			lifecycleLog.Warnf("Too many clients in game %v, disconnecting new client", game.logName())
 			client.Disconnect("NORMAL")
 			return
 		}
+		if client.spectator && !game.server.counters.TryAddSpectator(game.server.config.MaxTotalSpectators) {
+			lifecycleLog.Warnf("Too many spectators on the relay, refusing spectator for game %v", game.logName())
+			client.Disconnect("SPECTATORS_FULL")
+			return
+		}
 		client.id = game.nextClientId
 		game.nextClientId = game.nextClientId + 1
 		game.clients.PushBack(client)
-		go game.handleClientMessages(client)
+		game.server.counters.AddClients(1)
+		game.server.players.Add(client, game)
+		go game.handleMessages(client)
+		game.notePlayers()
+		game.audit(client, "Connected")
 		cmd := NewCommand(kConnectClient)
 		cmd.AppendUInt(client.id)
 		game.host.SendCommand(cmd)
-		log.Printf("Accepted new client (id=%v) with protocol version %v for game '%v'", client.id, version, game.Name())
+		game.publishClientEvent(relayinterface.EventClientConnected, client)
+		lifecycleLog.Infof("Accepted new client (id=%v) with protocol version %v for game %v", client.id, version, game.logName())
+	}
+	game.sendWelcome(client)
+}
+
+func (game *Game) sendWelcome(client *Client) {
+	// Register with the UDP relay before the welcome, so datagrams the
+	// participant sends right after it are not dropped
+	udpToken := ""
+	if game.udpEnabled && game.server.udp != nil {
+		if client.muxed {
+			game.server.udp.IssueMuxed(game, client)
+		} else {
+			udpToken = game.server.udp.Issue(game, client)
+		}
 	}
 	cmd := NewCommand(kWelcome)
 	cmd.AppendUInt(game.protocolVersion)
 	cmd.AppendString(game.gameName)
 	client.SendCommand(cmd)
+	if client.observeAddress {
+		client.SendCommand(observedAddressCommand(kTransportTCP, client.RemoteAddr()))
+	}
+	if udpToken != "" {
+		cmd = NewCommand(kUDPToken)
+		cmd.AppendString(udpToken)
+		client.SendCommand(cmd)
+	}
+	game.server.sendMaintenanceBanner(client)
+	game.sendKeyEpoch(client)
+	if client.id == ID_HOST || game.server.config.ReconnectGracePeriod.Duration <= 0 {
+		return
+	}
+	if client.reconnectToken == "" {
+		client.reconnectToken = newReconnectToken()
+	}
+	cmd = NewCommand(kReconnectToken)
+	cmd.AppendString(client.reconnectToken)
+	client.SendCommand(cmd)
+}
+
+// Returns the answer to kObservedAddress
+func observedAddressCommand(transport uint8, addr string) *Command {
+	cmd := NewCommand(kObservedAddress)
+	cmd.AppendUInt(transport)
+	cmd.AppendString(addr)
+	return cmd
+}
+
+// Generates a random token a client can use to reconnect to its slot
+func newReconnectToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Unable to generate reconnection token: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Gives a client the slot it had before losing its connection.
+// The host is not told about it since, for him, the client never left.
+func (game *Game) reattachClient(client *Client, token string, slot *reconnectSlot) {
+	slot.timer.Stop()
+	delete(game.reconnectSlots, token)
+	client.id = slot.id
+	client.spectator = slot.spectator
+	client.reconnectToken = token
+	game.clients.PushBack(client)
+	game.server.counters.AddClients(1)
+	game.server.players.Add(client, game)
+	if client.spectator {
+		// The slot has been kept for it, so it does not count against MaxTotalSpectators
+		game.server.counters.AddSpectators(1)
+	}
+	go game.handleMessages(client)
+	game.notePlayers()
+	game.audit(client, "Reconnected")
+	lifecycleLog.Infof("Client (id=%v) reconnected to game %v", client.id, game.logName())
+	game.sendWelcome(client)
+	game.server.ClientReconnected(game.Name(), client.id)
+	game.recordTimeline(relayinterface.TimelineEvent{Type: relayinterface.EventClientReconnected, PlayerID: uint64(client.id)})
+}
+
+// Called when the connection to a client broke down without a disconnect message.
+// If reconnecting is enabled, the slot of the client is kept for the grace period.
+// Returns whether the slot is kept.
+func (game *Game) keepSlotOfLostClient(client *Client) bool {
+	grace := game.server.config.ReconnectGracePeriod.Duration
+	if grace <= 0 || client.reconnectToken == "" || game.currentlyShuttingDown {
+		return false
+	}
+	if client.isClosed() {
+		// We closed the connection ourself, so it has not been lost
+		return false
+	}
+	for e := game.clients.Front(); e != nil; e = e.Next() {
+		if e.Value.(*Client) != client {
+			continue
+		}
+		game.clients.Remove(e)
+		game.server.counters.AddClients(-1)
+		game.server.players.Remove(client)
+		if client.spectator {
+			game.server.counters.AddSpectators(-1)
+		}
+		game.audit(client, "Lost connection to")
+		game.forgetUDP(client)
+		game.publishClientEvent(relayinterface.EventClientDisconnected, client)
+		if conn := client.detachConn(); conn != nil {
+			conn.Close()
+			// Stops the writer like Disconnect does, the commands still queued fail on the closed connection
+			client.chan_out <- nil
+		}
+		token := client.reconnectToken
+		slot := &reconnectSlot{id: client.id, spectator: client.spectator}
+		slot.timer = time.AfterFunc(grace, func() { game.expireSlot(token, slot) })
+		game.reconnectSlots[token] = slot
+		lifecycleLog.Warnf("Lost connection to client (id=%v) of game %v, keeping its slot for %v", client.id, game.logName(), grace)
+		return true
+	}
+	return false
+}
+
+// Called when a client did not reconnect within the grace period
+func (game *Game) expireSlot(token string, slot *reconnectSlot) {
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	if game.currentlyShuttingDown || game.reconnectSlots[token] != slot {
+		// Reconnected in the meantime
+		return
+	}
+	delete(game.reconnectSlots, token)
+	game.expiredTokens[token] = true
+	lifecycleLog.Warnf("Client (id=%v) did not reconnect to game %v in time", slot.id, game.logName())
+	if game.host != nil {
+		cmd := NewCommand(kDisconnectClient)
+		cmd.AppendUInt(slot.id)
+		game.host.SendCommand(cmd)
+	}
+}
+
+// Logs the address of a client together with the game, if audit logging is enabled
+func (game *Game) audit(client *Client, event string) {
+	if !game.server.config.AuditLog {
+		return
+	}
+	log.Printf("Audit: %v client (id=%v) of game '%v' from %v", event, client.id, game.Name(), client.RemoteAddr())
+}
+
+// Tells a subscribed metaserver about a client of the game
+func (game *Game) publishClientEvent(eventType relayinterface.EventType, client *Client) {
+	game.recordTimeline(relayinterface.TimelineEvent{Type: eventType, PlayerID: uint64(client.id)})
+	game.server.wlms.PublishEvent(relayinterface.Event{
+		Type:     eventType,
+		Game:     game.Name(),
+		PlayerID: uint64(client.id),
+	})
+}
+
+// Returns the host of the game, nil while it is not connected
+func (game *Game) currentHost() *Client {
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	return game.host
+}
+
+// Returns the host, which might be nil, and a copy of the clients of the game.
+// Takes the lifecycle mutex, so they can be sent to without holding it
+func (game *Game) participants() (*Client, []*Client) {
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	clients := make([]*Client, 0, game.clients.Len())
+	for e := game.clients.Front(); e != nil; e = e.Next() {
+		clients = append(clients, e.Value.(*Client))
+	}
+	return game.host, clients
+}
+
+// Returns the connected clients with the given ids. Takes the lifecycle mutex,
+// so they can be sent to without holding it
+func (game *Game) clientsWithIDs(ids []uint8) []*Client {
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	clients := make([]*Client, 0, len(ids))
+	for _, id := range ids {
+		if client := game.getClient(id); client != nil {
+			// Should always be the case but might not be due to
+			// network delays (host did not receive our message yet)
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// Returns information about the host and all clients in the game
+func (game *Game) Players() []relayinterface.PlayerInfo {
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	var players []relayinterface.PlayerInfo
+	if game.host != nil {
+		players = append(players, game.playerInfo(game.host))
+	}
+	for e := game.clients.Front(); e != nil; e = e.Next() {
+		players = append(players, game.playerInfo(e.Value.(*Client)))
+	}
+	return players
+}
+
+func (game *Game) playerInfo(client *Client) relayinterface.PlayerInfo {
+	info := relayinterface.PlayerInfo{
+		ID:        uint64(client.id),
+		IsHost:    client == game.host,
+		Spectator: client.spectator,
+		Name:      client.playerName,
+	}
+	if client != game.host {
+		info.MaxFrameSize = game.frameLimit(game.host, client)
+	}
+	if game.server.config.AuditLog {
+		info.RemoteAddr = client.RemoteAddr()
+		if game.server.udp != nil {
+			info.UDPAddr = game.server.udp.AddrOf(client)
+		}
+	}
+	return info
 }
 
+// Whether the error returned when reading from a client means the connection has been lost
+func isConnectionLost(err error) bool {
+	if err == io.EOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// Returns the connected client with the given id or nil.
+// Has to be called with the lifecycle mutex held
 func (game *Game) getClient(id uint8) *Client {
 	for e := game.clients.Front(); e != nil; e = e.Next() {
 		if e.Value.(*Client).id == id {
@@ -128,15 +866,52 @@ func (game *Game) getClient(id uint8) *Client {
 	return nil
 }
 
+// Returns whether the participant with the given id is connected or may still reconnect
+func (game *Game) playerConnection(id uint8) relayinterface.PlayerConnection {
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	if id == ID_HOST {
+		if game.host != nil {
+			return relayinterface.PlayerConnected
+		}
+		return relayinterface.PlayerGone
+	}
+	if game.getClient(id) != nil {
+		return relayinterface.PlayerConnected
+	}
+	for _, slot := range game.reconnectSlots {
+		if slot.id == id {
+			return relayinterface.PlayerReconnecting
+		}
+	}
+	return relayinterface.PlayerGone
+}
+
 func (game *Game) DisconnectClient(client *Client, reason string) {
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	game.disconnectClient(client, reason)
+}
+
+// Same as DisconnectClient, has to be called with the lifecycle mutex held
+func (game *Game) disconnectClient(client *Client, reason string) {
 	if client == nil {
 		return
 	} else if game.host == client {
+		game.audit(client, "Disconnecting")
+		game.forgetUDP(client)
 		game.host.Disconnect(reason)
 		game.host = nil
+		game.server.counters.AddOpenGames(-1)
+		game.server.counters.AddClients(-1)
+		game.server.players.Remove(client)
+		if delay := game.server.config.CloseGraceDelay.Duration; delay > 0 && !game.currentlyShuttingDown {
+			game.waitForHostToRejoin(delay)
+			return
+		}
 		// Admittedly: Shutting down the game is hard. But when the host is sending
 		// trash or becomes disconnected there is nothing we can do anyway
-		game.Shutdown()
+		game.shutdown()
 		return
 	}
 	for e := game.clients.Front(); e != nil; e = e.Next() {
@@ -146,13 +921,112 @@ func (game *Game) DisconnectClient(client *Client, reason string) {
 				cmd.AppendUInt(client.id)
 				game.host.SendCommand(cmd)
 			}
+			game.audit(client, "Disconnecting")
+			game.forgetUDP(client)
 			client.Disconnect(reason)
 			game.clients.Remove(e)
+			game.server.counters.AddClients(-1)
+			game.server.players.Remove(client)
+			if client.spectator {
+				game.server.counters.AddSpectators(-1)
+			}
+			game.publishClientEvent(relayinterface.EventClientDisconnected, client)
 			break
 		}
 	}
 }
 
+// Queues the command for a client without waiting for it. If the queue of the client
+// is full, it does not keep up with the game and is disconnected, so it does
+// not hold up the host and the other clients
+func (game *Game) sendToClient(client *Client, cmd *Command) {
+	if client.TrySendCommand(cmd) {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&client.lagging, 0, 1) {
+		forwardingLog.Warnf("Client (id=%v) of game %v does not keep up with the game, disconnecting", client.id, game.logName())
+		go func() {
+			// Disconnecting waits for room in the full queue, so it must not hold the
+			// lifecycle mutex. Removing the client afterwards does not send again
+			client.Disconnect("TOO_SLOW")
+			game.DisconnectClient(client, "TOO_SLOW")
+		}()
+	}
+}
+
+// Makes the connected client with the given id the host of the game. The old host
+// becomes a normal client and takes over the id of the new host. If newPassword
+// is not empty, it replaces the host password of the game.
+// Called while holding the lifecycle mutex.
+func (game *Game) transferHost(id uint8, newPassword string) error {
+	if game.host == nil {
+		return relayinterface.ErrPlayerNotFound
+	}
+	newHost := game.getClient(id)
+	if newHost == nil || newHost.spectator {
+		// Spectators only watch, so they can not host the game
+		return relayinterface.ErrPlayerNotFound
+	}
+	oldHost := game.host
+	for e := game.clients.Front(); e != nil; e = e.Next() {
+		if e.Value.(*Client) == newHost {
+			game.clients.Remove(e)
+			break
+		}
+	}
+	newHost.id = ID_HOST
+	newHost.reconnectToken = ""
+	oldHost.id = id
+	game.clients.PushBack(oldHost)
+	game.host = newHost
+	if newPassword != "" {
+		game.hostPasswordHash = hashPassword(newPassword)
+	}
+
+	// Both learn their new ids, then the new host learns about its clients
+	cmd := NewCommand(kHostChanged)
+	cmd.AppendUInt(ID_HOST)
+	newHost.SendCommand(cmd)
+	cmd = NewCommand(kHostChanged)
+	cmd.AppendUInt(oldHost.id)
+	oldHost.SendCommand(cmd)
+	if game.server.config.ReconnectGracePeriod.Duration > 0 {
+		oldHost.reconnectToken = newReconnectToken()
+		cmd = NewCommand(kReconnectToken)
+		cmd.AppendString(oldHost.reconnectToken)
+		oldHost.SendCommand(cmd)
+	}
+	for e := game.clients.Front(); e != nil; e = e.Next() {
+		cmd = NewCommand(kConnectClient)
+		cmd.AppendUInt(e.Value.(*Client).id)
+		newHost.SendCommand(cmd)
+	}
+
+	game.audit(newHost, "Transferred host role to")
+	lifecycleLog.Infof("Client (id=%v) of game %v became the host, old host is now client (id=%v)", id, game.logName(), oldHost.id)
+	game.server.HostChanged(game.Name(), uint64(id))
+	game.recordTimeline(relayinterface.TimelineEvent{Type: relayinterface.EventHostChanged, PlayerID: uint64(id)})
+	return nil
+}
+
+// Called when the host left. Disconnects the clients since there is no one to
+// relay to, but keeps the game for the given delay so the host can rejoin it
+// without the game disappearing from the lobby
+func (game *Game) waitForHostToRejoin(delay time.Duration) {
+	for game.clients.Len() > 0 {
+		game.disconnectClient(game.clients.Front().Value.(*Client), "NORMAL")
+	}
+	lifecycleLog.Infof("Host left game %v, closing it in %v unless he rejoins", game.logName(), delay)
+	game.closeTimer = time.AfterFunc(delay, func() {
+		game.lifecycle.Lock()
+		defer game.lifecycle.Unlock()
+		if game.host == nil && !game.currentlyShuttingDown {
+			lifecycleLog.Infof("Host did not rejoin game %v in time", game.logName())
+			game.shutdown()
+		}
+	})
+}
+
 func (game *Game) handlePong(client *Client) {
 	seq, err := client.ReadUint8()
 	if err != nil {
@@ -172,123 +1046,226 @@ func (game *Game) addClientRTT(cmd *Command, client *Client) {
 
 func (game *Game) sendRTTs(receiver *Client) {
 	cmd := NewCommand(kRoundTripTimeResponse)
+	host, clients := game.participants()
 	// Count how many non-nil clients we have
-	client_count := 0
-	if game.host != nil {
+	client_count := len(clients)
+	if host != nil {
 		client_count++
 	}
-	for e := game.clients.Front(); e != nil; e = e.Next() {
-		if e.Value.(*Client) != nil {
-			client_count++
-		}
-	}
 	cmd.AppendUInt(uint8(client_count))
-	if game.host != nil {
-		game.addClientRTT(cmd, game.host)
+	if host != nil {
+		game.addClientRTT(cmd, host)
 	}
-	for e := game.clients.Front(); e != nil; e = e.Next() {
-		if e.Value.(*Client) != nil {
-			game.addClientRTT(cmd, e.Value.(*Client))
-		}
+	for _, client := range clients {
+		game.addClientRTT(cmd, client)
 	}
 	receiver.SendCommand(cmd)
 }
-func (game *Game) handleClientMessages(client *Client) {
+
+// Reads the messages of the client until it disconnects. Depending on the
+// current role of the client, they are handled as messages of the host or of a
+// normal client, so the role can change while the client is connected
+func (game *Game) handleMessages(client *Client) {
+	hostLimiter := newRateLimiter(game.server.config.HostRateLimit)
+	clientLimiter := newRateLimiter(game.server.config.ClientRateLimit)
 	for {
 		// Read for ever until an error occurres or we receive a disconnect
 		command, err := client.ReadUint8()
-		if err == io.EOF {
-			game.DisconnectClient(client, "NORMAL")
-			return
-		} else if err != nil {
-			game.DisconnectClient(client, "PROTOCOL_VIOLATION")
+		if err != nil {
+			game.handleReadError(client, err)
 			return
 		}
-		switch command {
-		case kToHost:
-			packet, err := client.ReadPacket()
-			if err != nil {
-				game.DisconnectClient(client, "PROTOCOL_VIOLATION")
-				return
-			}
-			if client == nil {
-				game.DisconnectClient(game.host, "INVALID_ID")
-			}
-			// TODO(Notabilis): This line might be a problem when there is no host temporarily.
-			// Also, what if the old connection is replaced by a new host a few seconds later?
-			// We will probably lose packets this way. :/
-			cmd := NewCommand(kFromClient)
-			cmd.AppendUInt(client.id)
-			cmd.AppendBytes(packet)
-			game.host.SendCommand(cmd)
-		case kDisconnect:
-			// Read but ignore the reason
-			client.ReadString()
-			game.DisconnectClient(client, "NORMAL")
+		var ok bool
+		if client == game.currentHost() {
+			ok = game.handleHostCommand(client, command, hostLimiter)
+		} else {
+			ok = game.handleClientCommand(client, command, clientLimiter)
+		}
+		if !ok {
 			return
-		case kPong:
-			game.handlePong(client)
-		case kRoundTripTimeRequest:
-			game.sendRTTs(client)
 		}
+	}
+}
 
+// Pauses reading from the client while it exceeds its rate limit.
+// Disconnects it and returns false if it exceeds the limit for too long
+func (game *Game) throttle(client *Client, limiter *rateLimiter, size int) bool {
+	if limiter.Wait(size) {
+		return true
 	}
+	forwardingLog.Warnf("Client (id=%v) of game %v exceeds its rate limit for too long, disconnecting", client.id, game.logName())
+	game.DisconnectClient(client, "PROTOCOL_VIOLATION")
+	return false
 }
 
-func (game *Game) handleHostMessages() {
-	for {
-		// Read for ever until an error occurs or we receive a disconnect
-		if game.host == nil {
-			// host is nil: Disconnect induced by some other code
-			return
+func (game *Game) handleReadError(client *Client, err error) {
+	// The host might leave while the game is removed
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	if client == game.host {
+		if err == io.EOF {
+			game.disconnectClient(client, "NORMAL")
+		} else {
+			game.disconnectClient(client, "PROTOCOL_VIOLATION")
 		}
-		command, err := game.host.ReadUint8()
+		return
+	}
+	if isConnectionLost(err) && game.keepSlotOfLostClient(client) {
+		return
+	} else if err == io.EOF {
+		game.disconnectClient(client, "NORMAL")
+	} else {
+		game.disconnectClient(client, "PROTOCOL_VIOLATION")
+	}
+}
+
+// Reads a datagram carried over the connection of the participant and passes it
+// to the UDP relay. Returns false if the participant has been disconnected
+func (game *Game) handleMuxedDatagram(client *Client, limiter *rateLimiter) bool {
+	hi, err := client.ReadUint8()
+	if err != nil {
+		game.DisconnectClient(client, "PROTOCOL_VIOLATION")
+		return false
+	}
+	lo, err := client.ReadUint8()
+	if err != nil {
+		game.DisconnectClient(client, "PROTOCOL_VIOLATION")
+		return false
+	}
+	size := int(hi)<<8 | int(lo)
+	if size > maxDatagramSize {
+		game.DisconnectClient(client, "PROTOCOL_VIOLATION")
+		return false
+	}
+	datagram, err := client.ReadBytes(size)
+	if err != nil {
+		game.DisconnectClient(client, "PROTOCOL_VIOLATION")
+		return false
+	}
+	if !game.throttle(client, limiter, size) {
+		return false
+	}
+	if client.muxed && game.server.udp != nil {
+		game.server.udp.HandleMuxed(client, datagram)
+	}
+	return true
+}
+
+// Handles a command of a normal client. Returns false if the client has been disconnected
+func (game *Game) handleClientCommand(client *Client, command uint8, limiter *rateLimiter) bool {
+	switch command {
+	case kToHost:
+		packet, err := client.ReadPacket()
 		if err != nil {
-			if err == io.EOF {
-				game.DisconnectClient(game.host, "NORMAL")
-			} else {
-				game.DisconnectClient(game.host, "PROTOCOL_VIOLATION")
-			}
-			return
+			game.DisconnectClient(client, "PROTOCOL_VIOLATION")
+			return false
 		}
-		switch command {
-		case kToClients:
-			var destinations []*Client
-			for {
-				id, err := game.host.ReadUint8()
-				if err != nil {
-					game.DisconnectClient(game.host, "PROTOCOL_VIOLATION")
-					return
-				}
-				if id == 0 {
-					break
-				}
-				client := game.getClient(id)
-				if client != nil {
-					// Should always be the case but might not be due to
-					// network delays (host did not receive our message yet)
-					destinations = append(destinations, client)
-				}
-			}
-			packet, err := game.host.ReadPacket()
+		if !game.throttle(client, limiter, len(packet)) || !game.checkFrameSize(client, packet) {
+			return false
+		}
+		host := game.currentHost()
+		if host == nil {
+			// Participant of a restored game whose host did not reconnect yet
+			return true
+		}
+		if !game.frameFits(host, client, client, packet) {
+			return true
+		}
+		game.shapeBandwidth(len(packet))
+		// TODO(Notabilis): This line might be a problem when there is no host temporarily.
+		// Also, what if the old connection is replaced by a new host a few seconds later?
+		// We will probably lose packets this way. :/
+		cmd := NewCommand(kFromClient)
+		cmd.AppendUInt(client.id)
+		client.Framer().WriteFrame(cmd, packet)
+		cmd.sample = game.sampleLatency()
+		host.SendCommand(cmd)
+		game.noteTraffic(len(packet))
+		if game.recorder != nil {
+			game.recorder.Record(client.id, packet)
+		}
+		if forwardingLog.Enabled(relayinterface.LogLevelDebug) {
+			forwardingLog.Debugf("Forwarded %v bytes from client (id=%v) to the host of game %v", len(packet), client.id, game.logName())
+		}
+	case kDisconnect:
+		// Read but ignore the reason
+		client.ReadString()
+		game.DisconnectClient(client, "NORMAL")
+		return false
+	case kPong:
+		game.handlePong(client)
+	case kRoundTripTimeRequest:
+		game.sendRTTs(client)
+	case kDatagram:
+		return game.handleMuxedDatagram(client, limiter)
+	case kChat:
+		return game.handleChat(client)
+	}
+	return true
+}
+
+// Handles a command of the host. Returns false if the host has been disconnected
+func (game *Game) handleHostCommand(host *Client, command uint8, limiter *rateLimiter) bool {
+	switch command {
+	case kToClients:
+		var ids []uint8
+		for {
+			id, err := host.ReadUint8()
 			if err != nil {
-				game.DisconnectClient(game.host, "PROTOCOL_VIOLATION")
-				return
+				game.DisconnectClient(host, "PROTOCOL_VIOLATION")
+				return false
 			}
-			cmd := NewCommand(kFromHost)
-			cmd.AppendBytes(packet)
-			for _, client := range destinations {
-				client.SendCommand(cmd)
+			if id == 0 {
+				break
 			}
-		case kDisconnect:
-			// Read but ignore
-			game.host.ReadString()
-			game.DisconnectClient(game.host, "NORMAL")
-			return
-		case kPong:
-			game.handlePong(game.host)
-		case kRoundTripTimeRequest:
-			game.sendRTTs(game.host)
+			ids = append(ids, id)
+		}
+		destinations := game.clientsWithIDs(ids)
+		packet, err := host.ReadPacket()
+		if err != nil {
+			game.DisconnectClient(host, "PROTOCOL_VIOLATION")
+			return false
+		}
+		if !game.throttle(host, limiter, len(packet)) || !game.checkFrameSize(host, packet) {
+			return false
+		}
+		fitting := destinations[:0]
+		for _, client := range destinations {
+			if game.frameFits(host, client, host, packet) {
+				fitting = append(fitting, client)
+			}
+		}
+		destinations = fitting
+		game.shapeBandwidth(len(packet) * len(destinations))
+		cmd := NewCommand(kFromHost)
+		// All participants of a game use the same protocol version, so the same framer
+		host.Framer().WriteFrame(cmd, packet)
+		cmd.sample = game.sampleLatency()
+		for _, client := range destinations {
+			game.sendToClient(client, cmd)
+		}
+		game.noteTraffic(len(packet) * len(destinations))
+		if game.recorder != nil {
+			game.recorder.Record(ID_HOST, packet)
+		}
+		if forwardingLog.Enabled(relayinterface.LogLevelDebug) {
+			forwardingLog.Debugf("Forwarded %v bytes from the host of game %v to %v clients", len(packet), game.logName(), len(destinations))
 		}
+	case kDisconnect:
+		// Read but ignore
+		host.ReadString()
+		game.DisconnectClient(host, "NORMAL")
+		return false
+	case kPong:
+		game.handlePong(host)
+	case kRoundTripTimeRequest:
+		game.sendRTTs(host)
+	case kDatagram:
+		return game.handleMuxedDatagram(host, limiter)
+	case kChat:
+		return game.handleChat(host)
+	case kKeyEpoch:
+		return game.handleKeyEpoch(host)
 	}
+	return true
 }
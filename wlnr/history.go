@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"sync"
+)
+
+// How many closed games are kept if HistorySize is not configured
+const DefaultHistorySize = 100
+
+// GameHistory keeps the summaries of the most recently closed games.
+// The oldest summary is dropped when a new one does not fit anymore.
+type GameHistory struct {
+	mutex sync.Mutex
+	// Ring buffer of the summaries, next is the index the next one is written to
+	summaries []relayinterface.GameSummary
+	// The timelines of the games, at the same index as their summary
+	timelines [][]relayinterface.TimelineEvent
+	next      int
+	full      bool
+}
+
+func NewGameHistory(size int) *GameHistory {
+	if size <= 0 {
+		size = DefaultHistorySize
+	}
+	return &GameHistory{
+		summaries: make([]relayinterface.GameSummary, size),
+		timelines: make([][]relayinterface.TimelineEvent, size),
+	}
+}
+
+// Adds the summary and the timeline of a closed game
+func (h *GameHistory) Add(summary relayinterface.GameSummary, timeline []relayinterface.TimelineEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.summaries[h.next] = summary
+	h.timelines[h.next] = timeline
+	h.next = (h.next + 1) % len(h.summaries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Returns up to limit summaries, the most recently closed game first.
+// All kept summaries are returned if limit is not positive
+func (h *GameHistory) Recent(limit int) []relayinterface.GameSummary {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	count := h.next
+	if h.full {
+		count = len(h.summaries)
+	}
+	if limit <= 0 || limit > count {
+		limit = count
+	}
+	recent := make([]relayinterface.GameSummary, 0, limit)
+	for i := 1; i <= limit; i++ {
+		recent = append(recent, h.summaries[(h.next-i+len(h.summaries))%len(h.summaries)])
+	}
+	return recent
+}
+
+// Returns the timeline of the most recently closed game whose name has the given key
+func (h *GameHistory) Timeline(key string, keyOf func(name string) string) ([]relayinterface.TimelineEvent, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	count := h.next
+	if h.full {
+		count = len(h.summaries)
+	}
+	for i := 1; i <= count; i++ {
+		index := (h.next - i + len(h.summaries)) % len(h.summaries)
+		if keyOf(h.summaries[index].Name) == key {
+			return h.timelines[index], true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How long an issued join token is valid if JoinTokenLifetime is not configured
+const DefaultJoinTokenLifetime = 5 * time.Minute
+
+// A token issued by the metaserver that allows one connection to a game
+type joinToken struct {
+	game string
+	// The name of the player the metaserver authenticated, empty if not known
+	player  string
+	expires time.Time
+}
+
+// JoinTokens keeps the tokens issued by the metaserver until they are used or expire.
+type JoinTokens struct {
+	tokens map[string]joinToken
+	mutex  sync.Mutex
+}
+
+func NewJoinTokens() *JoinTokens {
+	return &JoinTokens{
+		tokens: make(map[string]joinToken),
+	}
+}
+
+// Creates a token for one connection to the given game.
+func (t *JoinTokens) Issue(game string, lifetime time.Duration) string {
+	return t.IssueFor(game, "", lifetime)
+}
+
+// Creates a token for one connection of the player with the given name to the game.
+// The name is kept on the relay, the token does not contain it
+func (t *JoinTokens) IssueFor(game, player string, lifetime time.Duration) string {
+	token := newReconnectToken()
+	now := time.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	// Forget about tokens which have never been used
+	for key, old := range t.tokens {
+		if now.After(old.expires) {
+			delete(t.tokens, key)
+		}
+	}
+	t.tokens[token] = joinToken{game: game, player: player, expires: now.Add(lifetime)}
+	return token
+}
+
+// Uses up the token. Returns the game and the player it is valid for and
+// false if there is no such token or it expired.
+func (t *JoinTokens) Redeem(token string) (string, string, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	issued, ok := t.tokens[token]
+	if !ok {
+		return "", "", false
+	}
+	delete(t.tokens, token)
+	if time.Now().After(issued.expires) {
+		return "", "", false
+	}
+	return issued.game, issued.player, true
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// Handles kKeyEpoch of the host: Remembers the new epoch and passes it on to the clients.
+// The relay only tracks the number, the keys are never send through it unencrypted.
+// Returns false if the host has been disconnected
+func (game *Game) handleKeyEpoch(host *Client) bool {
+	epoch, err := host.ReadUint8()
+	if err != nil || epoch == 0 {
+		game.DisconnectClient(host, "PROTOCOL_VIOLATION")
+		return false
+	}
+	// Clients joining meanwhile get either the old epoch followed by this
+	// command or already the new epoch with their welcome
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	atomic.StoreInt32(&game.keyEpoch, int32(epoch))
+	cmd := NewCommand(kKeyEpoch)
+	cmd.AppendUInt(epoch)
+	for e := game.clients.Front(); e != nil; e = e.Next() {
+		game.sendToClient(e.Value.(*Client), cmd)
+	}
+	lifecycleLog.Debugf("Host of game %v switched to key epoch %v", game.logName(), epoch)
+	return true
+}
+
+// Tells a joining participant which key epoch the following game data uses.
+// Nothing is send if the host never announced one.
+// Has to be called with the lifecycle mutex held
+func (game *Game) sendKeyEpoch(client *Client) {
+	epoch := atomic.LoadInt32(&game.keyEpoch)
+	if epoch == 0 {
+		return
+	}
+	cmd := NewCommand(kKeyEpoch)
+	cmd.AppendUInt(uint8(epoch))
+	client.SendCommand(cmd)
+}
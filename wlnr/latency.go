@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"sync/atomic"
+	"time"
+)
+
+// Only every this many forwarded frames of a game is timed, so timing costs next to nothing
+const latencySampleEvery = 16
+
+// The upper bound of the first bucket of a LatencyHistogram. Each further bucket is twice as wide
+const latencyBucketBase = time.Microsecond
+
+// Number of buckets of a LatencyHistogram. The last one has no upper bound
+const latencyBuckets = 26
+
+// LatencyHistogram counts how long frames took from being read to being written
+// to the receiving connection. The buckets grow exponentially, so percentiles are
+// only known up to a factor of two. Safe for concurrent use
+type LatencyHistogram struct {
+	buckets [latencyBuckets]int64
+	count   int64
+	sum     int64
+}
+
+// Where the upper bound of the given bucket is, the last bucket has none
+func bucketBound(bucket int) time.Duration {
+	return latencyBucketBase << uint(bucket)
+}
+
+// Adds the latency of one frame
+func (h *LatencyHistogram) Add(latency time.Duration) {
+	bucket := 0
+	for bucket < latencyBuckets-1 && latency > bucketBound(bucket) {
+		bucket++
+	}
+	atomic.AddInt64(&h.buckets[bucket], 1)
+	atomic.AddInt64(&h.sum, int64(latency))
+	atomic.AddInt64(&h.count, 1)
+}
+
+// Returns the average and the upper bounds of the buckets containing the 95th and 99th percentile
+func (h *LatencyHistogram) Stats() relayinterface.LatencyStats {
+	count := atomic.LoadInt64(&h.count)
+	stats := relayinterface.LatencyStats{Samples: count}
+	if count == 0 {
+		return stats
+	}
+	stats.Average = time.Duration(atomic.LoadInt64(&h.sum) / count)
+	var seen int64
+	for bucket := 0; bucket < latencyBuckets; bucket++ {
+		seen += atomic.LoadInt64(&h.buckets[bucket])
+		if stats.P95 == 0 && seen*100 >= count*95 {
+			stats.P95 = bucketBound(bucket)
+		}
+		if seen*100 >= count*99 {
+			stats.P99 = bucketBound(bucket)
+			break
+		}
+	}
+	return stats
+}
+
+// A timed frame on its way to a connection
+type latencySample struct {
+	queuedAt   time.Time
+	histograms []*LatencyHistogram
+}
+
+// Called after the frame has been written
+func (s *latencySample) done() {
+	latency := time.Since(s.queuedAt)
+	for _, h := range s.histograms {
+		h.Add(latency)
+	}
+}
+
+// Returns the sample to attach to the next forwarded frame of the game, nil if it is not timed
+func (game *Game) sampleLatency() *latencySample {
+	if atomic.AddInt64(&game.framesSeen, 1)%latencySampleEvery != 0 {
+		return nil
+	}
+	return &latencySample{time.Now(), []*LatencyHistogram{&game.latency, game.server.latency}}
+}
+
+// Returns the forwarding latency of the game with the given name, or of all games if it is empty
+func (s *Server) ForwardingLatency(name string) (relayinterface.LatencyStats, error) {
+	if name == "" {
+		return s.latency.Stats(), nil
+	}
+	game := s.findGame(name)
+	if game == nil {
+		return relayinterface.LatencyStats{}, relayinterface.ErrGameNotFound
+	}
+	return game.latency.Stats(), nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"net"
+	"sync"
+)
+
+// Limits holds the resource limits of the relay which can be changed while it is running.
+type Limits struct {
+	limits relayinterface.RelayLimits
+	mutex  sync.RWMutex
+}
+
+func (l *Limits) Get() relayinterface.RelayLimits {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.limits
+}
+
+func (l *Limits) Set(limits relayinterface.RelayLimits) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.limits = limits
+}
+
+// Counts the open game connections per IP address.
+type connectionsPerIP struct {
+	counts map[string]int
+	mutex  sync.Mutex
+}
+
+func newConnectionsPerIP() *connectionsPerIP {
+	return &connectionsPerIP{
+		counts: make(map[string]int),
+	}
+}
+
+// Counts the connection unless there are already max connections from its address.
+// The returned connection uncounts itself when it is closed. Returns nil if the limit is
+// reached. There is no limit if max is 0.
+func (c *connectionsPerIP) track(conn net.Conn, max int) net.Conn {
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		// Not a network connection, e.g., in tests
+		return conn
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if max > 0 && c.counts[ip] >= max {
+		return nil
+	}
+	c.counts[ip]++
+	return &trackedConn{Conn: conn, release: func() { c.release(ip) }}
+}
+
+func (c *connectionsPerIP) release(ip string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.counts[ip]--
+	if c.counts[ip] <= 0 {
+		delete(c.counts, ip)
+	}
+}
+
+// A connection which is counted by connectionsPerIP.
+type trackedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (t *trackedConn) Close() error {
+	t.once.Do(t.release)
+	return t.Conn.Close()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"sync"
+)
+
+// How many log messages are kept if LogBufferSize is not configured
+const DefaultLogBufferSize = 1000
+
+// LogBuffer keeps the most recent messages written by the loggers.
+// The oldest message is dropped when a new one does not fit anymore.
+type LogBuffer struct {
+	mutex sync.Mutex
+	// Ring buffer of the messages, next is the index the next one is written to
+	lines []relayinterface.LogLine
+	next  int
+	full  bool
+}
+
+func NewLogBuffer(size int) *LogBuffer {
+	if size <= 0 {
+		size = DefaultLogBufferSize
+	}
+	return &LogBuffer{lines: make([]relayinterface.LogLine, size)}
+}
+
+// Adds a written message, see relayinterface.CaptureLogs
+func (b *LogBuffer) Add(line relayinterface.LogLine) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.lines[b.next] = line
+	b.next = (b.next + 1) % len(b.lines)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Returns up to limit of the most recent messages with at least the given level,
+// the oldest first. All kept messages of the level are returned if limit is not positive
+func (b *LogBuffer) Recent(limit int, minLevel relayinterface.LogLevel) []relayinterface.LogLine {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	count := b.next
+	if b.full {
+		count = len(b.lines)
+	}
+	var recent []relayinterface.LogLine
+	for i := 1; i <= count && (limit <= 0 || len(recent) < limit); i++ {
+		line := b.lines[(b.next-i+len(b.lines))%len(b.lines)]
+		if line.Level >= minLevel {
+			recent = append(recent, line)
+		}
+	}
+	for i, j := 0, len(recent)-1; i < j; i, j = i+1, j-1 {
+		recent[i], recent[j] = recent[j], recent[i]
+	}
+	return recent
+}
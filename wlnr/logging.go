@@ -0,0 +1,14 @@
+package main
+
+import (
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+)
+
+// Loggers of the subsystems of the relay. The rpc connection to the metaserver
+// logs to relayinterface.RPCLog. The levels are set by RelayConfig.applyLogLevels
+
+// Game data passed between the host and the clients of games
+var forwardingLog = relayinterface.NewLogger(relayinterface.LogLevelInfo)
+
+// Games and players coming and going
+var lifecycleLog = relayinterface.NewLogger(relayinterface.LogLevelInfo)
@@ -1,5 +1,22 @@
 package main
 
+import (
+	"flag"
+	"log"
+)
+
 func main() {
-	RunServer()
+	var config string
+	flag.StringVar(&config, "config", "", "Configuration file to read.")
+	flag.Parse()
+
+	cfg := DefaultRelayConfig()
+	if config != "" {
+		log.Println("Loading configuration")
+		var err error
+		if cfg, err = LoadRelayConfig(config); err != nil {
+			log.Fatalf("Could not load config file: %v", err)
+		}
+	}
+	RunServer(cfg)
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"sync"
+	"time"
+)
+
+// How long before a scheduled maintenance players are told about it if MaintenanceLeadTime is not configured
+const DefaultMaintenanceLeadTime = 30 * time.Minute
+
+// How often the maintenance banner is send again if MaintenanceResendInterval is not configured
+const DefaultMaintenanceResendInterval = 5 * time.Minute
+
+// Maintenance is a banner announcing a planned restart of the relay.
+// Within the lead time before the restart it is send to all participants
+// of all games repeatedly and to everyone joining a game
+type Maintenance struct {
+	mutex   sync.Mutex
+	message string
+	at      time.Time
+	// Closed to stop the goroutine sending the current banner
+	cancel chan struct{}
+}
+
+// Returns the banner to send now, an empty message if there is none
+func (m *Maintenance) current(lead time.Duration) (string, time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	if m.message == "" || now.Before(m.at.Add(-lead)) || !now.Before(m.at) {
+		return "", time.Time{}
+	}
+	return m.message, m.at
+}
+
+// Returns when the maintenance is scheduled, the zero time if there is none
+func (m *Maintenance) scheduled() time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.message == "" {
+		return time.Time{}
+	}
+	return m.at
+}
+
+// Replaces the current banner. Returns the channel closed when it is replaced or cancelled
+func (m *Maintenance) set(message string, at time.Time) chan struct{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.cancel != nil {
+		close(m.cancel)
+		m.cancel = nil
+	}
+	m.message = message
+	m.at = at
+	if message != "" {
+		m.cancel = make(chan struct{})
+	}
+	return m.cancel
+}
+
+// Removes the banner if it is still the one scheduled for the given time
+func (m *Maintenance) expire(at time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.at.Equal(at) && m.cancel != nil {
+		close(m.cancel)
+		m.cancel = nil
+		m.message = ""
+	}
+}
+
+func newMaintenanceCommand(message string, at time.Time) *Command {
+	cmd := NewCommand(kMaintenance)
+	cmd.AppendString(message)
+	cmd.AppendString(at.UTC().Format(time.RFC3339))
+	return cmd
+}
+
+// Sends the banner to the client if a maintenance is coming up
+func (s *Server) sendMaintenanceBanner(client *Client) {
+	message, at := s.maintenance.current(s.config.MaintenanceLeadTime.Duration)
+	if message != "" {
+		client.SendCommand(newMaintenanceCommand(message, at))
+	}
+}
+
+// Sends the banner to the participants of all games
+func (s *Server) broadcastMaintenance() {
+	message, at := s.maintenance.current(s.config.MaintenanceLeadTime.Duration)
+	if message == "" {
+		return
+	}
+	lifecycleLog.Infof("Announcing maintenance at %v: %v", at, message)
+	for _, game := range s.gameList() {
+		host, clients := game.participants()
+		if host != nil {
+			host.SendCommand(newMaintenanceCommand(message, at))
+		}
+		for _, client := range clients {
+			client.SendCommand(newMaintenanceCommand(message, at))
+		}
+	}
+}
+
+// Announces a restart of the relay at the given time to all players.
+// Replaces a maintenance scheduled before
+func (s *Server) ScheduleMaintenance(message string, at time.Time) error {
+	if message == "" {
+		return relayinterface.ErrEmptyMessage
+	}
+	if !at.After(time.Now()) {
+		return relayinterface.ErrMaintenancePassed
+	}
+	cancel := s.maintenance.set(message, at)
+	lifecycleLog.Infof("Maintenance scheduled at %v: %v", at, message)
+	go s.announceMaintenance(at, cancel)
+	return nil
+}
+
+// Stops announcing the scheduled maintenance
+func (s *Server) CancelMaintenance() {
+	s.maintenance.set("", time.Time{})
+	lifecycleLog.Infof("Maintenance cancelled")
+}
+
+// Broadcasts the banner regularly within the lead time until the maintenance is due
+func (s *Server) announceMaintenance(at time.Time, cancel chan struct{}) {
+	interval := s.config.MaintenanceResendInterval.Duration
+	wait := time.Until(at.Add(-s.config.MaintenanceLeadTime.Duration))
+	for {
+		if remaining := time.Until(at); wait > remaining {
+			wait = remaining
+		}
+		select {
+		case <-cancel:
+			return
+		case <-time.After(wait):
+		}
+		if !time.Now().Before(at) {
+			s.maintenance.expire(at)
+			return
+		}
+		s.broadcastMaintenance()
+		wait = interval
+	}
+}
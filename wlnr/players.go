@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"sort"
+	"sync"
+)
+
+// PlayerIndex knows which games the players with a name, see kPlayerName,
+// are connected to. Players without a name are not indexed.
+type PlayerIndex struct {
+	mutex   sync.Mutex
+	players map[string]map[*Client]*Game
+}
+
+func NewPlayerIndex() *PlayerIndex {
+	return &PlayerIndex{players: make(map[string]map[*Client]*Game)}
+}
+
+// Remembers that the client is connected to the game
+func (p *PlayerIndex) Add(client *Client, game *Game) {
+	if client.playerName == "" {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	games, ok := p.players[client.playerName]
+	if !ok {
+		games = make(map[*Client]*Game)
+		p.players[client.playerName] = games
+	}
+	games[client] = game
+}
+
+// Forgets the client after it left its game
+func (p *PlayerIndex) Remove(client *Client) {
+	if client.playerName == "" {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	games := p.players[client.playerName]
+	delete(games, client)
+	if len(games) == 0 {
+		delete(p.players, client.playerName)
+	}
+}
+
+// Returns where the player with the given name is connected
+func (p *PlayerIndex) Find(name string) []relayinterface.PlayerLocation {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	locations := make([]relayinterface.PlayerLocation, 0, len(p.players[name]))
+	for client, game := range p.players[name] {
+		locations = append(locations, relayinterface.PlayerLocation{
+			GameName:    game.Name(),
+			PlayerID:    uint64(client.id),
+			IsHost:      client == game.host,
+			IsSpectator: client.spectator,
+		})
+	}
+	sort.Slice(locations, func(i, j int) bool {
+		return locations[i].GameName < locations[j].GameName
+	})
+	return locations
+}
@@ -0,0 +1,73 @@
+package main
+
+// Codes of kProtocolError. It is send right before kDisconnect whenever the relay
+// closes a connection because of a problem, so the game can explain to the player
+// why the connection has been closed. Disconnects with reason "NORMAL" have no code.
+// Keep this synchronized with relay_protocol.h
+const (
+	// An invalid or oversized message has been received, or the connection
+	// exceeded its rate limit for too long
+	kErrorProtocolViolation uint8 = 1
+	// The game uses a version of the relay protocol the relay does not speak
+	kErrorWrongVersion uint8 = 2
+	// There is no game with the requested name on the relay
+	kErrorGameUnknown uint8 = 3
+	// The host of the game has not connected yet, so only the host can connect
+	kErrorNoHost uint8 = 4
+	// The relay requires a valid join token before the handshake
+	kErrorNoToken uint8 = 5
+	// The relay has as many spectators as it accepts
+	kErrorSpectatorsFull uint8 = 6
+	// The connection did not answer a ping in time
+	kErrorTimeout uint8 = 7
+	// The host sent a message for a client which is not in the game
+	kErrorInvalidID uint8 = 8
+	// There are too many connections from the same address
+	kErrorTooManyConnections uint8 = 9
+	// The relay gets more connections than it can handle, try again later
+	kErrorOverloaded uint8 = 10
+	// Too many wrong host passwords have been presented, try again later
+	kErrorLockedOut uint8 = 11
+	// The metaserver removed the client from the game on behalf of the host
+	kErrorKicked uint8 = 12
+	// The version of the game is too old for the relay, see kClientVersion
+	kErrorUpgradeRequired uint8 = 13
+	// The host does not let new players join the game at the moment
+	kErrorGameLocked uint8 = 14
+	// The connection did not take the game data as fast as the host sent it
+	kErrorTooSlow uint8 = 15
+	// The relay is shutting down, e.g., to be restarted
+	kErrorShutdown uint8 = 16
+	// The name of the player differs from the one the metaserver issued the join token for
+	kErrorNameMismatch uint8 = 17
+	// The reconnection token is for a slot which has not been reclaimed in time
+	kErrorSlotExpired uint8 = 18
+)
+
+// A code of kProtocolError with a short description in English
+type protocolError struct {
+	code        uint8
+	description string
+}
+
+// The error frames send for the reasons passed to Client.Disconnect
+var protocolErrors = map[string]protocolError{
+	"PROTOCOL_VIOLATION":   {kErrorProtocolViolation, "invalid message or rate limit exceeded"},
+	"WRONG_VERSION":        {kErrorWrongVersion, "unsupported relay protocol version"},
+	"GAME_UNKNOWN":         {kErrorGameUnknown, "game does not exist"},
+	"NO_HOST":              {kErrorNoHost, "game has no host yet"},
+	"NO_TOKEN":             {kErrorNoToken, "valid join token required"},
+	"SPECTATORS_FULL":      {kErrorSpectatorsFull, "no more spectators accepted"},
+	"TIMEOUT":              {kErrorTimeout, "connection timed out"},
+	"INVALID_ID":           {kErrorInvalidID, "message for unknown client"},
+	"TOO_MANY_CONNECTIONS": {kErrorTooManyConnections, "too many connections from this address"},
+	"OVERLOADED":           {kErrorOverloaded, "relay is overloaded"},
+	"LOCKED_OUT":           {kErrorLockedOut, "too many wrong passwords"},
+	"KICKED":               {kErrorKicked, "kicked from the game"},
+	"UPGRADE_REQUIRED":     {kErrorUpgradeRequired, "game version too old, upgrade required"},
+	"GAME_LOCKED":          {kErrorGameLocked, "game does not accept new players"},
+	"TOO_SLOW":             {kErrorTooSlow, "connection too slow for the game"},
+	"SHUTDOWN":             {kErrorShutdown, "relay is shutting down"},
+	"NAME_MISMATCH":        {kErrorNameMismatch, "player name does not match the join token"},
+	"SLOT_EXPIRED":         {kErrorSlotExpired, "reconnected too late, join again"},
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"time"
+)
+
+// RateLimit limits the game data a single connection can send to the relay.
+// A connection exceeding it is throttled by pausing reads from it.
+type RateLimit struct {
+	// Bytes of game data per second. Unlimited if 0
+	BytesPerSecond int
+	// Packets of game data per second. Unlimited if 0
+	PacketsPerSecond int
+	// Disconnect a connection if it has to be throttled for this long without
+	// a break. Connections are only throttled, never disconnected, if this is 0
+	MaxThrottle Duration
+}
+
+func (l RateLimit) enabled() bool {
+	return l.BytesPerSecond > 0 || l.PacketsPerSecond > 0
+}
+
+// A token bucket holding up to one second worth of tokens.
+// Tokens can be taken beyond the content, which has to be waited for then
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// Adds the tokens earned since the last call
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// Takes n tokens and returns how long to wait until they would have been available
+func (b *tokenBucket) take(n int, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Takes n tokens if they are available. Returns false and takes none otherwise
+func (b *tokenBucket) tryTake(n int, now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(now)
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// rateLimiter enforces a RateLimit on the game data read from one connection.
+// Only used by the goroutine reading from the connection
+type rateLimiter struct {
+	bytes       *tokenBucket
+	packets     *tokenBucket
+	maxThrottle time.Duration
+	// When the connection started to be throttled continuously, zero if it is not throttled
+	throttledSince time.Time
+}
+
+// Returns nil if the limit is disabled
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if !limit.enabled() {
+		return nil
+	}
+	now := time.Now()
+	return &rateLimiter{
+		bytes:       newTokenBucket(limit.BytesPerSecond, now),
+		packets:     newTokenBucket(limit.PacketsPerSecond, now),
+		maxThrottle: limit.MaxThrottle.Duration,
+	}
+}
+
+// Accounts for a packet of the given size read from the connection and pauses
+// until the connection is within its limit again.
+// Returns false without waiting if it should be disconnected instead
+func (r *rateLimiter) Wait(size int) bool {
+	if r == nil {
+		return true
+	}
+	now := time.Now()
+	delay := r.bytes.take(size, now)
+	if d := r.packets.take(1, now); d > delay {
+		delay = d
+	}
+	if delay == 0 {
+		r.throttledSince = time.Time{}
+		return true
+	}
+	if r.throttledSince.IsZero() {
+		r.throttledSince = now
+	}
+	if r.maxThrottle > 0 && now.Add(delay).Sub(r.throttledSince) > r.maxThrottle {
+		return false
+	}
+	time.Sleep(delay)
+	return true
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// The games created by VerifyReachability are named with this prefix and a random suffix
+const reachabilityGamePrefix = "reachability-"
+
+// How long VerifyReachability may take
+const reachabilityTimeout = 5 * time.Second
+
+// The result of the last VerifyReachability, reported in the status
+type reachabilityCheck struct {
+	mutex     sync.Mutex
+	checkedAt time.Time
+	reachable bool
+	err       string
+}
+
+func (r *reachabilityCheck) set(reachable bool, err string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.checkedAt = time.Now()
+	r.reachable = reachable
+	r.err = err
+}
+
+func (r *reachabilityCheck) last() (time.Time, bool, string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.checkedAt, r.reachable, r.err
+}
+
+// Checks that players can reach the relay at its PublicAddress: Connects to the
+// game port through the public address and joins a throwaway private game, so
+// it is known that this relay answered and not something else. Needs the network
+// in front of the relay to allow connecting to its own public address.
+// Returns an error if the check can not be done, e.g., without PublicAddress
+func (s *Server) VerifyReachability() (bool, error) {
+	if s.config.PublicAddress == "" {
+		return false, fmt.Errorf("No PublicAddress configured")
+	}
+	if s.gamePort == 0 {
+		return false, fmt.Errorf("Relay does not accept game connections")
+	}
+	name, password, remove, err := s.createThrowawayGame(reachabilityGamePrefix)
+	if err != nil {
+		return false, fmt.Errorf("Unable to create game: %v", err)
+	}
+	defer remove()
+
+	addr := net.JoinHostPort(s.config.PublicAddress, fmt.Sprint(s.gamePort))
+	peer, err := s.dialSelfTest(addr, name, password, time.Now().Add(reachabilityTimeout))
+	if err != nil {
+		lifecycleLog.Warnf("Relay is not reachable at its public address %v: %v", addr, err)
+		s.reachability.set(false, err.Error())
+		return false, nil
+	}
+	peer.conn.Close()
+	lifecycleLog.Infof("Relay is reachable at its public address %v", addr)
+	s.reachability.set(true, "")
+	return true, nil
+}
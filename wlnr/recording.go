@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recorder writes the game data forwarded in a game to segment files.
+// Each frame is stored as the time in unix nanoseconds (uint64), the id of the
+// sender (uint8), the length of the packet (uint32) and the packet itself.
+// All numbers are big endian. If the game is sampled, the skipped frames are
+// missing without a trace.
+type Recorder struct {
+	// Directory and common prefix of the segment files
+	prefix string
+	// Start a new segment when the current one reaches this size or age. Disabled if 0
+	rotateSize     int64
+	rotateInterval time.Duration
+	// Which frames are recorded
+	sampling relayinterface.FrameSampling
+
+	// Protects all following fields. Frames and rotations are serialized by it,
+	// so every frame ends up in exactly one segment
+	mutex        sync.Mutex
+	file         *os.File
+	writer       *bufio.Writer
+	segment      int
+	size         int64
+	segmentStart time.Time
+	// The number of frames within the size limits of the sampling so far
+	candidates int
+}
+
+// Starts recording a game into the given directory.
+func NewRecorder(dir, gameName string, rotateSize int64, rotateInterval time.Duration, sampling relayinterface.FrameSampling) (*Recorder, error) {
+	r := &Recorder{
+		prefix:         filepath.Join(dir, fmt.Sprintf("%v-%v", sanitizeFileName(gameName), time.Now().Unix())),
+		rotateSize:     rotateSize,
+		rotateInterval: rotateInterval,
+		sampling:       sampling,
+	}
+	if err := r.openSegment(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Replaces all characters of a game name which might cause trouble in a file name
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func (r *Recorder) segmentPath(segment int) string {
+	return fmt.Sprintf("%v.%04d.rec", r.prefix, segment)
+}
+
+// Opens the next segment file. Has to be called with the mutex held
+func (r *Recorder) openSegment() error {
+	r.segment++
+	file, err := os.OpenFile(r.segmentPath(r.segment), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	r.file = file
+	r.writer = bufio.NewWriter(file)
+	r.size = 0
+	r.segmentStart = time.Now()
+	return nil
+}
+
+// Flushes and closes the current segment. Has to be called with the mutex held
+func (r *Recorder) closeSegment() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.writer.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file = nil
+	r.writer = nil
+	return err
+}
+
+// Finishes the current segment and starts a new one.
+// Returns the path of the finished segment.
+func (r *Recorder) Rotate() (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.rotate()
+}
+
+func (r *Recorder) rotate() (string, error) {
+	if r.file == nil {
+		return "", os.ErrClosed
+	}
+	finished := r.segmentPath(r.segment)
+	if err := r.closeSegment(); err != nil {
+		return finished, err
+	}
+	return finished, r.openSegment()
+}
+
+// Whether a frame of the given size is recorded. Has to be called with the mutex held
+func (r *Recorder) sampled(size int) bool {
+	if (r.sampling.MinSize > 0 && size < r.sampling.MinSize) ||
+		(r.sampling.MaxSize > 0 && size > r.sampling.MaxSize) {
+		return false
+	}
+	r.candidates++
+	return r.sampling.EveryNth <= 1 || (r.candidates-1)%r.sampling.EveryNth == 0
+}
+
+// Appends a frame send by the client with the given id, unless it is skipped
+// by the sampling. Starts a new segment before if the current one is full.
+func (r *Recorder) Record(from uint8, packet []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil || !r.sampled(len(packet)) {
+		return
+	}
+	if (r.rotateSize > 0 && r.size >= r.rotateSize) ||
+		(r.rotateInterval > 0 && time.Since(r.segmentStart) >= r.rotateInterval) {
+		if _, err := r.rotate(); err != nil {
+			forwardingLog.Warnf("Unable to record game to %v: %v", r.prefix, err)
+			return
+		}
+	}
+	var header [13]byte
+	binary.BigEndian.PutUint64(header[0:8], uint64(time.Now().UnixNano()))
+	header[8] = from
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(packet)))
+	if _, err := r.writer.Write(header[:]); err != nil {
+		forwardingLog.Warnf("Unable to record game to %v: %v", r.prefix, err)
+		return
+	}
+	if _, err := r.writer.Write(packet); err != nil {
+		forwardingLog.Warnf("Unable to record game to %v: %v", r.prefix, err)
+		return
+	}
+	r.size += int64(len(header) + len(packet))
+}
+
+// Writes a dump of the state of the game taken at the given time next to the segments.
+// Returns the path of the written file.
+func (r *Recorder) WriteDump(dump []byte, takenAt time.Time) (string, error) {
+	path := fmt.Sprintf("%v.%v.state.json", r.prefix, takenAt.UnixNano())
+	return path, ioutil.WriteFile(path, dump, 0644)
+}
+
+// Finishes the recording.
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.closeSegment()
+}
@@ -0,0 +1,86 @@
+package relayinterface
+
+import (
+	"time"
+)
+
+// How long a RelayPool keeps the games of an owner on one relay if
+// ClientRPCOptions.AffinityGracePeriod is not set
+const DefaultAffinityGracePeriod = 2 * time.Minute
+
+// The relay the games of an owner are created on
+type poolAffinity struct {
+	relay *ClientRPC
+	// The number of games of the owner on the relay and, once there are none
+	// left, until when new games of the owner still go to the relay
+	games   int
+	expires time.Time
+}
+
+// Returns the relay new games of the owner should be created on, or nil if
+// the owner has none or it can not take the game. Has to be called without the
+// mutex of the pool locked, it asks the relay for its status
+func (pool *RelayPool) stickyRelay(ownerID string, required RelayCapabilities) *ClientRPC {
+	if ownerID == "" {
+		return nil
+	}
+	pool.mutex.Lock()
+	affinity, ok := pool.affinities[ownerID]
+	if ok && affinity.games == 0 && time.Now().After(affinity.expires) {
+		delete(pool.affinities, ownerID)
+		ok = false
+	}
+	reason := ""
+	if ok {
+		reason = pool.excludedRelay(affinity.relay, required)
+	}
+	pool.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	if reason == "" {
+		_, reason = pool.checkRelayStatus(affinity.relay)
+	}
+	if reason != "" {
+		RPCLog.Infof("RelayPool: Not creating game of owner %v on relay at %v it used before: %v", ownerID, affinity.relay.relayAddr, reason)
+		return nil
+	}
+	return affinity.relay
+}
+
+// Remembers that a game of the owner has been created on the relay.
+// Has to be called with the mutex of the pool locked
+func (pool *RelayPool) recordAffinity(name, ownerID string, relay *ClientRPC) {
+	if ownerID == "" {
+		return
+	}
+	if pool.affinities == nil {
+		pool.affinities = make(map[string]*poolAffinity)
+		pool.affinityOf = make(map[string]*poolAffinity)
+	}
+	affinity, ok := pool.affinities[ownerID]
+	if !ok || affinity.relay != relay {
+		affinity = &poolAffinity{relay: relay}
+		pool.affinities[ownerID] = affinity
+	}
+	affinity.games++
+	pool.affinityOf[name] = affinity
+}
+
+// Starts the grace period of the owner of the closed game once it has no games
+// left on the relay. Has to be called with the mutex of the pool locked
+func (pool *RelayPool) releaseAffinity(name string) {
+	affinity, ok := pool.affinityOf[name]
+	if !ok {
+		return
+	}
+	delete(pool.affinityOf, name)
+	affinity.games--
+	if affinity.games == 0 {
+		grace := pool.affinityGracePeriod
+		if grace <= 0 {
+			grace = DefaultAffinityGracePeriod
+		}
+		affinity.expires = time.Now().Add(grace)
+	}
+}
@@ -0,0 +1,95 @@
+package relayinterface
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	errCreateGameFailed          = errors.New("Unable to create game on relay")
+	errGameClosedBeforeConnected = errors.New("Game closed before the host connected")
+)
+
+// hostWaiters keeps track of callers waiting for hosts to connect to their games.
+type hostWaiters struct {
+	waiting map[string][]chan error
+	mutex   sync.Mutex
+}
+
+func newHostWaiters() *hostWaiters {
+	return &hostWaiters{
+		waiting: make(map[string][]chan error),
+	}
+}
+
+// Returns a channel that receives nil when the host of the given game connects,
+// or an error if the game is closed before.
+func (w *hostWaiters) add(name string) chan error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	ch := make(chan error, 1)
+	w.waiting[name] = append(w.waiting[name], ch)
+	return ch
+}
+
+// Stops waiting on the given channel.
+func (w *hostWaiters) remove(name string, ch chan error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	chans := w.waiting[name]
+	for i, c := range chans {
+		if c == ch {
+			chans = append(chans[:i], chans[i+1:]...)
+			break
+		}
+	}
+	if len(chans) == 0 {
+		delete(w.waiting, name)
+	} else {
+		w.waiting[name] = chans
+	}
+}
+
+// Wakes up everyone waiting for the given game.
+func (w *hostWaiters) notify(name string, err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, ch := range w.waiting[name] {
+		ch <- err
+	}
+	delete(w.waiting, name)
+}
+
+// Creates the game with the given function and waits until its host connects.
+func (w *hostWaiters) createAndAwait(ctx context.Context, name string, create func() error) error {
+	// Start waiting before creating the game so the notification can not be missed
+	ch := w.add(name)
+	defer w.remove(name, ch)
+	if err := create(); err != nil {
+		return err
+	}
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// notifyingCallback passes notifications on to the wrapped callback
+// and wakes up callers waiting for hosts to connect.
+type notifyingCallback struct {
+	ClientCallback
+	waiters *hostWaiters
+}
+
+func (c *notifyingCallback) GameConnected(name string) {
+	c.ClientCallback.GameConnected(name)
+	c.waiters.notify(name, nil)
+}
+
+func (c *notifyingCallback) GameClosed(name string, reason CloseReason) {
+	c.ClientCallback.GameClosed(name, reason)
+	c.waiters.notify(name, errGameClosedBeforeConnected)
+}
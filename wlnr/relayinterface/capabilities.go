@@ -0,0 +1,50 @@
+package relayinterface
+
+import (
+	"strings"
+)
+
+// RelayCapabilities is a set of optional features supported by a relay.
+type RelayCapabilities uint32
+
+const (
+	// The relay compresses rpc connections if asked to
+	CapabilityCompression RelayCapabilities = 1 << iota
+	// Clients losing their connection can reconnect to their slot
+	CapabilityReconnect
+	// Connections to games are only accepted with a token from IssueJoinToken
+	CapabilityJoinTokens
+	// Games with GameData.UDPEnabled can forward datagrams, see ServerStatus.UDPPort
+	CapabilityUDP
+	// Participants which can not use UDP can have their datagrams carried over
+	// their game connection instead, see kMux of the relay protocol
+	CapabilityMux
+)
+
+// Has returns whether all of the given capabilities are in the set.
+func (c RelayCapabilities) Has(required RelayCapabilities) bool {
+	return c&required == required
+}
+
+func (c RelayCapabilities) String() string {
+	var names []string
+	if c.Has(CapabilityCompression) {
+		names = append(names, "compression")
+	}
+	if c.Has(CapabilityReconnect) {
+		names = append(names, "reconnect")
+	}
+	if c.Has(CapabilityJoinTokens) {
+		names = append(names, "join-tokens")
+	}
+	if c.Has(CapabilityUDP) {
+		names = append(names, "udp")
+	}
+	if c.Has(CapabilityMux) {
+		names = append(names, "mux")
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
@@ -1,10 +1,72 @@
 package relayinterface
 
+import (
+	"context"
+	"time"
+)
+
+// ServerStatus is used in both directions: The relay requests it from the
+// metaserver and the metaserver requests it from the relay.
 type ServerStatus struct {
 	NClients        int // does not count IRC users
-	NClientsInGames int
+	NClientsInGames int // only set by the metaserver, every client of a relay is in a game
 	NGames          int // contains nOpenGames
 	NOpenGames      int
+
+	// The following fields are only set by the relay
+
+	// Region the relay is located in as configured by the operator, e.g., "eu"
+	Region string
+	// Maximal number of games on the relay, 0 if unlimited
+	MaxGames int
+	// Number of games at which the relay warns that it is nearly full, 0 if unlimited.
+	// The RelayPool only creates games on such relays if all others are full
+	SoftMaxGames int
+	// Maximal number of game connections from one IP address, 0 if unlimited
+	MaxConnectionsPerIP int
+	// Number of clients only watching games, included in NClients
+	NSpectators int
+	// Maximal number of spectators on the relay, 0 if unlimited
+	MaxTotalSpectators int
+	// Random id of the relay process, generated on startup
+	InstanceID string
+	// Host name or IP address players use to reach the relay, if configured
+	PublicAddress string
+	// The port the relay accepts game connections on
+	GamePort int
+	// The port the relay accepts datagrams of games using UDP on, 0 if disabled
+	UDPPort int
+	// The version of the protocol spoken between the relay and the game clients
+	ProtocolVersion uint8
+	// When the relay will be restarted for a maintenance announced with
+	// ScheduleMaintenance, zero if none is scheduled
+	MaintenanceAt time.Time
+	// The oldest version of the game the relay accepts connections from, e.g., "1.1".
+	// Empty if all versions are accepted
+	MinClientVersion string
+	// How often serving a rpc connection of the metaserver failed with a panic since the relay started
+	RPCPanics int
+	// Which new connections and games the relay refuses since it is overloaded,
+	// e.g., to route casual games elsewhere
+	Shedding SheddingLevel
+	// Bytes per second the relay sent over the last second
+	Throughput float64
+	// Bytes of game data per second the relay forwards at most, 0 if unlimited.
+	// Games are throttled to share it fairly when it is reached
+	MaxTotalBandwidth int
+	// How often frames have been delayed and datagrams dropped to stay below
+	// MaxTotalBandwidth since the relay started
+	BandwidthThrottled int64
+	// When the relay last checked that it can be reached at PublicAddress, see
+	// VerifyReachability, zero if never. The relay checks once on startup.
+	// ReachabilityError tells why it was not reachable
+	ReachabilityCheckedAt time.Time
+	Reachable             bool
+	ReachabilityError     string
+	// Set if the status was too large to be send, only the numbers are left then.
+	// Hint tells where to get the details instead
+	Truncated bool
+	Hint      string
 }
 
 // Client is an interface for communicating with the relay server.
@@ -15,10 +77,195 @@ type Client interface {
 	// The given password protects the host-position in the new game.
 	// Fails if there is no relay or the game already exists.
 	CreateGame(name string, password string) bool
+	// Same as CreateGame but prefers a relay in the given region
+	// if there are multiple relays to choose from.
+	CreateGameInRegion(name string, password string, region string) bool
+	// Same as CreateGame but with all settings of the game, e.g., GameData.AutoCloseAfterNoTraffic.
+	CreateGameWithSettings(game GameData) bool
+	// Same as CreateGameWithSettings but tells why the game could not be created,
+	// e.g., ErrGameExists or ErrOwnerGameLimit if GameData.OwnerID has too many games.
+	CreateGameErr(game GameData) error
+	// Returns how many games with the given GameData.OwnerID exist, e.g., to
+	// tell a user why no further game can be created.
+	CountGamesByOwner(ownerID string) (int, error)
+	// Keeps the name free for the given time. Only a game created with the returned
+	// token in GameData.ReservationToken can use the name until then.
+	// Fails with ErrGameExists or ErrNameReserved if the name is taken.
+	ReserveGameName(name string, ttl time.Duration) (string, error)
+	// Same as CreateGame but waits until the host connected to the game.
+	// Fails if the game can not be created, is closed again before the
+	// host connected or if ctx expires before.
+	CreateGameAndAwaitHost(ctx context.Context, name string, password string) error
 	// Closes the game on the relay, removing all state of it
 	// and closing all network connections.
 	// Fails if there is no game with this name.
+	// The relay notifies GameConnected and GameClosed of a game in the order they
+	// happened, and no GameConnected follows once RemoveGame succeeded, even
+	// if the host connected at the same time.
 	RemoveGame(name string) bool
+	// Same as RemoveGame for multiple games in one call. Each game is removed
+	// independently, the result contains nil for each removed game and the reason
+	// for each game that could not be removed, e.g., ErrGameNotFound.
+	// If the returned error is set, it is unknown which games have been removed.
+	RemoveGames(names []string) (map[string]error, error)
+	// Removes all games created with the given GameData.OwnerID, e.g., after the
+	// machine of their host went offline. Returns the number of removed games.
+	RemoveGamesByOwner(ownerID string) (int, error)
+	// Changes whether the game is listed publicly. The host password of the game is required.
+	// Fails with ErrGameNotFound or ErrWrongPassword, or ErrLockedOut after too many wrong passwords.
+	SetVisibility(name string, password string, public bool) error
+	// Makes the game private like SetVisibility and invite-only: New players are
+	// refused unless they present a join token of the game, see IssueJoinToken, even
+	// on relays which do not require join tokens otherwise. The players in the game
+	// stay connected, and players reconnecting with their reconnection token as well
+	// as the host rejoining are not affected. Returns the given number of new join
+	// tokens to hand out as invitations. Making the game public with SetVisibility
+	// ends the invite-only mode. Fails like SetVisibility.
+	MakeInviteOnly(name string, password string, invites int) ([]string, error)
+	// Changes whether new players are refused by the game, the players in the
+	// game are not affected. To lock the lobby while setting up teams, for example.
+	// The host password of the game is required, see GameData.Locked.
+	// Fails with ErrGameNotFound or ErrWrongPassword.
+	LockGame(gameName string, hostPassword string, locked bool) (bool, error)
+	// Checks whether the password is the host password of the game without changing anything.
+	// The relay allows only a few checks per game and minute, further ones
+	// fail with ErrTooManyAttempts. Also fails with ErrGameNotFound, and with
+	// ErrLockedOut after too many wrong passwords.
+	VerifyHostPassword(gameName, password string) (bool, error)
+	// Makes the connected player with the given id the host of the game.
+	// The old host stays in the game as a normal player. The host password of the
+	// game is required. If newHostPassword is not empty, it replaces the password.
+	// Fails with ErrGameNotFound, ErrWrongPassword or ErrPlayerNotFound.
+	TransferHost(gameName, hostPassword, newHostPlayer, newHostPassword string) (bool, error)
+	// Disconnects the player with the given id, see PlayerInfo.ID, from the game.
+	// The player is told that it has been kicked. The host password of the game is
+	// required and the host can not be kicked.
+	// Fails with ErrGameNotFound, ErrWrongPassword or ErrPlayerNotFound.
+	KickPlayerByID(gameName, hostPassword string, playerID uint64) (bool, error)
+	// Requests all games on the relay, including private ones.
+	// The passwords of the games are not returned.
+	ListGames() ([]GameData, error)
+	// Requests up to limit games of the relay sorted by name, skipping the first offset
+	// games, and how many games there are. For relays with too many games for ListGames.
+	ListGamesPage(offset, limit int) (games []GameData, total int, err error)
+	// Requests the games of the relay matching the filter, e.g., the open games
+	// for the lobby. The relay filters them, so the others are not transferred.
+	// The passwords of the games are not returned.
+	ListGamesFiltered(filter GameFilter) ([]GameData, error)
+	// Requests the players currently connected to the game with the given name.
+	// Fails if there is no game with this name.
+	GetGamePlayers(name string) ([]PlayerInfo, error)
+	// Requests whether the player with the given id is connected to the game, lost
+	// its connection but may still reconnect, or is gone, e.g., to confirm a kick.
+	// Fails if there is no game with this name.
+	IsPlayerConnected(gameName string, playerID uint64) (PlayerConnection, error)
+	// Requests how long the relay takes to forward frames of game data in all games:
+	// The average and the 95th and 99th percentile.
+	ForwardingLatency() (avg, p95, p99 time.Duration, err error)
+	// Same as ForwardingLatency but only for the given game.
+	GameForwardingLatency(gameName string) (avg, p95, p99 time.Duration, err error)
+	// Requests how much game data the relay forwarded in the game since it has been
+	// created or since ResetGameCounters has been called the last time.
+	// Fails with ErrGameNotFound.
+	GetGameTraffic(gameName string) (GameTraffic, error)
+	// Zeroes the counters returned by GetGameTraffic, to measure the traffic over a
+	// part of a long game. The host password of the game is required.
+	// The totals, e.g., GameSummary.TotalBytes, the status and the traffic rate of
+	// the relay, are not affected.
+	// Fails with ErrGameNotFound or ErrWrongPassword.
+	ResetGameCounters(gameName, hostPassword string) error
+	// Requests a snapshot of the state of the game on the relay for debugging, e.g., of a desync.
+	// Does not disturb the game. Depending on its configuration, the relay also writes the
+	// snapshot next to the recording of the game, see GameStateDump.Path.
+	DumpGameState(gameName string) (GameStateDump, error)
+	// Requests the games the player with the given lobby name is connected to.
+	// Only players whose game told the relay their name can be found.
+	FindPlayer(name string) ([]PlayerLocation, error)
+	// Collects everything a player needs to join the game with the given name.
+	// Fails with ErrGameNotFound if there is no such game.
+	BuildJoinInstruction(gameName string) (JoinInstruction, error)
+	// Requests the description of the game with the given name, e.g., how long
+	// it may still exist. The password of the game is not returned.
+	// Fails with ErrGameNotFound if there is no such game.
+	GetGame(name string) (GameData, error)
+	// Same as GetGame for multiple games in one call, e.g., to refresh the games
+	// shown in the lobby. Games which do not exist are missing in the result.
+	GetGames(names []string) (map[string]GameData, error)
+	// Requests the summaries of up to limit games recently closed on the relay,
+	// the last closed game first. The relay only keeps a limited number of them.
+	// All kept summaries are returned if limit is not positive.
+	GetGameHistory(limit int) ([]GameSummary, error)
+	// Requests the significant events of the game in the order they happened, e.g.,
+	// for post-match analysis: when it has been created, the host connected,
+	// players joined and left, the host changed and the game has been closed.
+	// Closed games are available as long as the relay keeps their summary.
+	// Fails with ErrGameNotFound otherwise.
+	GetGameTimeline(gameName string) ([]TimelineEvent, error)
+	// Finishes the current recording file of the game on the relay and continues in a new one.
+	// Returns the path of the finished file on the relay.
+	// Fails with ErrGameNotFound or ErrNotRecorded.
+	RotateRecording(gameName string) (string, error)
+	// Creates a single-use token allowing a player to connect to the game.
+	// Relays configured to require join tokens refuse connections without one.
+	// The token expires after a while if it is not used.
+	IssueJoinToken(gameName string) (string, error)
+	// Same as IssueJoinToken for the player with the given name, whom the metaserver
+	// authenticated. Relays configured to enforce player names use this name for the
+	// connection instead of the one the player claims and refuse it if they differ.
+	// Fails with ErrEmptyPlayerName without a name.
+	IssuePlayerJoinToken(gameName, playerName string) (string, error)
+	// Checks whether the relay is reachable.
+	Ping() error
+	// Checks whether the relay is reachable and whether it can reach us
+	// on the callback channel.
+	Health() HealthReport
+	// Returns how far the clock of the relay is ahead of ours, negative if it is
+	// behind, as estimated by the last Ping or Health. Times like the one of
+	// ScheduleMaintenance are converted with it. known is false until the relay
+	// has been pinged. A warning is logged if the skew is too large, see
+	// ClientRPCOptions.MaxClockSkew, which usually means that NTP is not working.
+	ClockSkew() (skew time.Duration, known bool)
+	// Requests the optional features supported by the relay.
+	Capabilities() (RelayCapabilities, error)
+	// Requests the versions of the relay protocol the relay accepts from game
+	// clients in ascending order, so a game can be routed to a relay its host
+	// and players can talk to.
+	SupportedProtocols() ([]int, error)
+	// Makes the relay create a private game, connect a host and a client to it
+	// over its game port and forward a frame between them, so the whole path
+	// game data takes through the relay is checked. The game is removed afterwards.
+	SelfTest() error
+	// Makes the relay connect to its own game port through its PublicAddress and
+	// join a throwaway game there, so a PublicAddress players can not reach is noticed
+	// before they try. Only works if the network of the relay lets it connect to its
+	// own public address. Fails if the check can not be done, e.g., without PublicAddress.
+	// The result is also reported in ServerStatus.
+	VerifyReachability(ctx context.Context) (bool, error)
+	// Requests the current status of the relay.
+	Status() (ServerStatus, error)
+	// Requests the average number of bytes per second the relay did send over the
+	// given window. The window is limited to the last few minutes.
+	TrafficRate(window time.Duration) (float64, error)
+	// Announces a restart of the relay at the given time to all players, replacing
+	// the maintenance announced before. Requires the admin token of the relay.
+	ScheduleMaintenance(message string, at time.Time) error
+	// Stops announcing the scheduled maintenance.
+	CancelMaintenance() error
+	// Makes the relay accept both admin tokens from now on, next might be empty.
+	// See ClientRPC.SetAuthTokens for how to rotate the token.
+	SetAuthTokens(current, next string) error
+	// Replaces the admin token presented to the relay, without telling the relay.
+	SetAdminToken(token string)
+	// Calls the handler with each event reported by the relay, e.g., a client
+	// connecting to a game, until the returned function is called.
+	// Events are delivered in order. If the handler is slow, the relay queues the
+	// events and drops them according to its overflow policy when the queue is full.
+	Subscribe(handler func(Event)) (unsubscribe func(), err error)
+	// Tells the relay that we are shutting down, so it holds back its notifications
+	// until we connect again instead of failing to deliver them. Returns once the
+	// relay delivered the notification it was sending or ctx expired.
+	// Call CloseConnection afterwards.
+	Quiesce(ctx context.Context) error
 	// Closes connection to the relay.
 	CloseConnection()
 }
@@ -29,7 +276,23 @@ type ClientCallback interface {
 	// The relay notifies that a host has connectd to the game with the given name.
 	GameConnected(name string)
 	// The relay notifies that the game with the given name has been closed on the relay.
-	GameClosed(name string)
+	GameClosed(name string, reason CloseReason)
+	// The relay notifies that a client lost its connection to the game with the given name
+	// but reconnected to its old slot. This is not a new player joining the game.
+	ClientReconnected(name string, playerID uint64)
+	// The relay notifies that the player with the given id became the host of the game.
+	HostChanged(name string, playerID uint64)
+	// The relay notifies that it reached its soft limit of current out of max games.
+	// Games can still be created until it is full.
+	OnCapacityWarning(current, max int)
+	// The relay alerts of a problem operators should know about, e.g., AlertOverloaded.
+	OnRelayAlert(alert RelayAlert)
+	// The relay notifies that it refused a connection to a game, e.g., because of a
+	// wrong host password. Repeated wrong passwords lead to RejectLockedOut.
+	ClientJoinRejected(rejection JoinRejection)
+	// The relay passes a chat message send in a game, if it is configured to do so.
+	// The metaserver can log it or, e.g., kick the sender with KickPlayerByID.
+	ClientChat(message ChatMessage)
 	// Request the current status, e.g., number of active users and games.
 	Status() *ServerStatus
 }
@@ -1,109 +1,626 @@
 package relayinterface
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/rpc"
 	"net/rpc/jsonrpc"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// The address of the relay when using NewClientRPC
+const defaultRelayAddress = "localhost:7398"
+
+// The address we listen on for notifications of relays
+const relayListenAddress = ":7399"
+
+// ClientRPCOptions contains the settings for a ClientRPC.
+// The zero value is a valid configuration.
+type ClientRPCOptions struct {
+	// Address of the RPC server of the relay. Defaults to localhost:7398.
+	// Ignored by NewRelayPool.
+	RelayAddr string
+	// Whether to compress the rpc connections if the relay supports it.
+	// Only worth it for a relay at a remote location, see BenchmarkStatusPayload.
+	Compress bool
+	// Token presented to the relay for administrative calls like SetLimits.
+	AdminToken string
+	// Whether to log how long the steps of creating a game on the relay took
+	DebugTiming bool
+	// How often calls are attempted if the connection to the relay breaks
+	Retries RetryBudgets
+	// Replace the connection to each relay by a new one this often, see ClientRPC.Refresh.
+	// Keeps mappings of NAT routers and firewalls fresh. Disabled if 0
+	RefreshInterval time.Duration
+	// Creates a span around each call to a relay. Calls are not traced if nil
+	Tracer Tracer
+	// Address of a relay to fail over to when the relay at RelayAddr can not be
+	// reached anymore after all retries. The games created through the client
+	// are created on the standby again, and the relays swap their roles.
+	// Ignored by NewRelayPool, which spreads the games over its relays instead.
+	StandbyAddr string
+	// Called after failing over to the standby relay, before the call which
+	// noticed the failure continues on the standby. Might be nil
+	OnFailover func(Failover)
+	// A warning is logged if the clock of the relay is off by more than this,
+	// see ClientRPC.ClockSkew. Defaults to DefaultMaxClockSkew
+	MaxClockSkew time.Duration
+	// How long after the last game of an owner (GameData.OwnerID) closed a RelayPool
+	// still creates new games of the owner on the same relay, so a host coming back
+	// finds what the relay kept of its old game, e.g., while it waits for the host to
+	// rejoin. Defaults to DefaultAffinityGracePeriod. Only used by NewRelayPool
+	AffinityGracePeriod time.Duration
+}
+
+// Attempts of a call if RetryBudgets are not set
+const (
+	DefaultIdempotentAttempts    = 4
+	DefaultNonIdempotentAttempts = 2
+)
+
+// RetryBudgets limits how often a call to the relay is attempted in total when
+// the connection to the relay breaks. Each attempt after the first one is done
+// on a new connection. Values which are not positive mean the defaults.
+//
+// Calls which have not reached the relay are always safe to repeat. But if the
+// connection breaks while waiting for the answer, it is unknown whether the relay
+// executed the call. Repeating an idempotent call like RemoveGame does no harm then,
+// the game is removed no matter how often it is done. Repeating a call like CreateGame
+// might fail because the first attempt succeeded, or create something twice, so such
+// calls are only repeated if they did not reach the relay.
+type RetryBudgets struct {
+	// For calls like RemoveGame, ListGames or Status
+	Idempotent int
+	// For calls like CreateGame, ReserveGameName or IssueJoinToken
+	NonIdempotent int
+}
+
+// The methods of the relay which can be repeated without changing the result
+var idempotentMethods = map[string]bool{
+	"RemoveGame":          true,
+	"RemoveGames":         true,
+	"RemoveGamesByOwner":  true,
+	"SetVisibility":       true,
+	"LockGame":            true,
+	"ListGames":           true,
+	"ListGamesPage":       true,
+	"ListGamesFiltered":   true,
+	"GetGamePlayers":      true,
+	"IsPlayerConnected":   true,
+	"FindPlayer":          true,
+	"DumpGameState":       true,
+	"ForwardingLatency":   true,
+	"GetGameTraffic":      true,
+	"ResetGameCounters":   true,
+	"GetGame":             true,
+	"GetGames":            true,
+	"CountGamesByOwner":   true,
+	"GetGameHistory":      true,
+	"GetGameTimeline":     true,
+	"GetLimits":           true,
+	"GetEffectiveConfig":  true,
+	"GetRecentLogs":       true,
+	"SetLimits":           true,
+	"ScheduleMaintenance": true,
+	"CancelMaintenance":   true,
+	"SetAuthTokens":       true,
+	"Subscribe":           true,
+	"Ping":                true,
+	"Quiesce":             true,
+	"Capabilities":        true,
+	"SupportedProtocols":  true,
+	"Status":              true,
+	"TrafficRate":         true,
+}
+
+// Returns how often the given method may be attempted
+func (r RetryBudgets) attempts(method string) int {
+	if idempotentMethods[method] {
+		if r.Idempotent > 0 {
+			return r.Idempotent
+		}
+		return DefaultIdempotentAttempts
+	}
+	if r.NonIdempotent > 0 {
+		return r.NonIdempotent
+	}
+	return DefaultNonIdempotentAttempts
+}
+
 // ClientRPC is an internal struct which implements relayinterface.Client
 // over a RPC connection.
 type ClientRPC struct {
-	callback ClientCallback
-	relay    *rpc.Client
+	relay     *rpc.Client
+	relayAddr string
+	// The calls running on relay, so Refresh can wait for them before closing it
+	calls *sync.WaitGroup
+	// Protects relay, relayAddr, calls, capabilities and adminToken
+	relayMutex sync.RWMutex
+	compress   bool
+	adminToken string
+	// Whether to log the time games take to create
+	debugTiming bool
+	retries     RetryBudgets
+	tracer      Tracer
+	// The optional features of the relay, as reported when connecting. Protected by relayMutex
+	capabilities RelayCapabilities
+	// Only set if this client opened the listener itself, i.e., is not part of a RelayPool
 	listener net.Listener
+	// Callers waiting for hosts to connect. Only set together with listener
+	waiters *hostWaiters
+	// The handlers of Subscribe. Only set together with listener
+	subscribers *eventSubscribers
+	// Closed by CloseConnection to stop refreshing the connection
+	closed    chan struct{}
+	closeOnce sync.Once
+	// How often the connection is refreshed, 0 if it is not
+	refreshInterval time.Duration
+	// The ConnectionState, replaced as a whole
+	state atomic.Value
+	// How far the clock of the relay is ahead of ours, a time.Duration. Unset until
+	// the relay answered a Ping, see ClockSkew
+	skew         atomic.Value
+	maxClockSkew time.Duration
+	// The relay to fail over to, see ClientRPCOptions.StandbyAddr. Nil if there is none
+	standby    *ClientRPC
+	onFailover func(Failover)
+	// The games created through this client, to create them on the standby when
+	// failing over. Only kept if there is a standby. Protected by gamesMutex
+	knownGames map[string]GameData
+	gamesMutex sync.Mutex
 }
 
 // ClientRPCMethods is a helper struct so only some methods are exposed to RPC.
 type ClientRPCMethods struct {
-	client *ClientRPC
+	callback    ClientCallback
+	subscribers *eventSubscribers
 }
 
 // NewClientRPC creates a struct that implements relayinterface.Client over RPC.
 // An RPC server running on localhost:7398 is assumed.
 // Methods of the given callback are called with notifications of the server.
 func NewClientRPC(callback ClientCallback) Client {
-	client := &ClientRPC{
-		callback: callback,
-	}
+	return NewClientRPCWithOptions(callback, ClientRPCOptions{})
+}
 
-	if !client.connect() {
+// NewClientRPCWithOptions is the same as NewClientRPC but uses the given settings.
+// Returns nil if connecting fails, see ConnectClientRPC for the reason.
+func NewClientRPCWithOptions(callback ClientCallback, options ClientRPCOptions) Client {
+	client, err := ConnectClientRPC(callback, options)
+	if err != nil {
+		RPCLog.Warnf("ClientRPC: %v", err)
 		return nil
 	}
+	return client
+}
+
+// ConnectClientRPC is the same as NewClientRPCWithOptions but returns why connecting failed.
+// The error is a *ConnectionError, either ErrRelayUnreachable or ErrListenFailed.
+func ConnectClientRPC(callback ClientCallback, options ClientRPCOptions) (*ClientRPC, error) {
+	relayAddr := options.RelayAddr
+	if relayAddr == "" {
+		relayAddr = defaultRelayAddress
+	}
+	callback = callbackOrIgnore(callback)
+	client := newClientRPC(relayAddr, options)
+	client.waiters = newHostWaiters()
+	client.subscribers = newEventSubscribers()
+
+	if err := client.connect(); err != nil {
+		return nil, err
+	}
+	if options.StandbyAddr != "" {
+		client.addStandby(options.StandbyAddr, options)
+		callback = &standbyCallback{callback, client}
+	}
 
-	// Open our rpc server
-	rpcLn, err := net.Listen("tcp", ":7399")
+	rpcLn, err := listenForRelays(&notifyingCallback{callback, client.waiters}, client.subscribers, relayListenAddress, options.Compress)
 	if err != nil {
-		log.Printf("Error when listening for RPC calls: %v", err)
-		return nil
+		client.CloseConnection()
+		return nil, err
 	}
 	client.listener = rpcLn
+	client.startRefreshing(options.RefreshInterval)
 
-	// Run our rpc server
-	clientMethods := &ClientRPCMethods{
-		client: client,
+	return client, nil
+}
+
+// Creates the client for the relay at the given address without connecting to it
+func newClientRPC(relayAddr string, options ClientRPCOptions) *ClientRPC {
+	return &ClientRPC{
+		relayAddr:    relayAddr,
+		compress:     options.Compress,
+		adminToken:   options.AdminToken,
+		debugTiming:  options.DebugTiming,
+		retries:      options.Retries,
+		tracer:       options.Tracer,
+		closed:       make(chan struct{}),
+		maxClockSkew: options.MaxClockSkew,
 	}
+}
 
-	rpc.Register(clientMethods)
+// Opens our rpc server on the given address so relays can send notifications to us.
+// Events are passed to the given subscribers, which might be nil if there are none.
+// Fails with ErrListenFailed if opening it failed.
+func listenForRelays(callback ClientCallback, subscribers *eventSubscribers, addr string, compress bool) (net.Listener, error) {
+	rpcLn, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, &ConnectionError{Kind: ErrListenFailed, Addr: addr, Err: err}
+	}
+
+	// Run our rpc server. Each listener has its own so the methods
+	// always call the callback given here
+	clientMethods := &ClientRPCMethods{
+		callback:    callbackOrIgnore(callback),
+		subscribers: subscribers,
+	}
+	server := rpc.NewServer()
+	server.Register(clientMethods)
 
 	go func() {
 		for {
 			conn, err := rpcLn.Accept()
 			if err != nil {
-				continue
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				return
 			}
-			go jsonrpc.ServeConn(conn)
+			go serveRPC(conn, compress, server, 0)
 		}
 	}()
+	return rpcLn, nil
+}
 
-	return client
+// Open connection to relay server. Fails with ErrRelayUnreachable
+func (client *ClientRPC) connect() error {
+	client.relayMutex.Lock()
+	defer client.relayMutex.Unlock()
+	relay, capabilities, err := client.dial(client.relayAddr)
+	if err != nil {
+		err = &ConnectionError{Kind: ErrRelayUnreachable, Addr: client.relayAddr, Err: err}
+		client.markDisconnected(err, 0)
+		return err
+	}
+	client.setRelay(relay, capabilities)
+	client.markConnected()
+	return nil
+}
+
+// Replaces the connection to the relay and the capabilities reported over it.
+// Returns the old connection and its running calls.
+// Has to be called with relayMutex locked
+func (client *ClientRPC) setRelay(relay *rpc.Client, capabilities RelayCapabilities) (*rpc.Client, *sync.WaitGroup) {
+	old, oldCalls := client.relay, client.calls
+	client.relay = relay
+	client.calls = &sync.WaitGroup{}
+	client.capabilities = capabilities
+	return old, oldCalls
+}
+
+// Opens a connection to the relay server at the given address
+// and queries its capabilities.
+func (client *ClientRPC) dial(relayAddr string) (*rpc.Client, RelayCapabilities, error) {
+	connection, err := dialRPC(relayAddr, time.Duration(10)*time.Second, client.compress)
+	if err != nil {
+		return nil, 0, err
+	}
+	relay := jsonrpc.NewClient(connection)
+	// Learn about the features of the relay before any game is created on it
+	var capabilities RelayCapabilities
+	if err := relay.Call("ServerRPCMethods.Capabilities", "", &capabilities); err != nil {
+		RPCLog.Warnf("Unable to get capabilities of relay server at %v, assuming none: %v", relayAddr, err)
+		capabilities = 0
+	}
+	RPCLog.Infof("Connected to relay server at %v with capabilities %v", relayAddr, capabilities)
+	return relay, capabilities, nil
+}
+
+// Returns the optional features of the relay as reported when connecting
+func (client *ClientRPC) currentCapabilities() RelayCapabilities {
+	client.relayMutex.RLock()
+	defer client.relayMutex.RUnlock()
+	return client.capabilities
+}
+
+// Reconnect replaces the connection to the relay by one to the relay at the given address.
+// The listener for notifications of the relay stays open. Calls which are currently
+// running on the old connection are repeated on the new one. If the new relay can not
+// be reached, the old connection is kept.
+func (client *ClientRPC) Reconnect(newRelayAddr string) error {
+	client.relayMutex.Lock()
+	defer client.relayMutex.Unlock()
+	relay, capabilities, err := client.dial(newRelayAddr)
+	if err != nil {
+		return err
+	}
+	old, _ := client.setRelay(relay, capabilities)
+	client.relayAddr = newRelayAddr
+	client.markConnected()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Refresh replaces the connection to the relay by a new one to the same relay.
+// Unlike Reconnect, the old connection is only closed after the calls running on
+// it finished, so none of them is lost or has to be repeated. New calls use the
+// new connection at once. If the relay can not be reached, the old connection is kept.
+func (client *ClientRPC) Refresh() error {
+	client.relayMutex.RLock()
+	relayAddr := client.relayAddr
+	client.relayMutex.RUnlock()
+	// Dial without blocking calls, they go over the old connection meanwhile
+	relay, capabilities, err := client.dial(relayAddr)
+	if err != nil {
+		if !client.ConnectionState().Connected {
+			client.markDisconnected(err, 0)
+		}
+		return err
+	}
+	client.relayMutex.Lock()
+	if client.relayAddr != relayAddr {
+		// Reconnect() moved us to another relay meanwhile
+		client.relayMutex.Unlock()
+		relay.Close()
+		return nil
+	}
+	old, calls := client.setRelay(relay, capabilities)
+	client.relayMutex.Unlock()
+	client.markConnected()
+	if old != nil {
+		go func() {
+			calls.Wait()
+			old.Close()
+		}()
+	}
+	return nil
+}
+
+// Calls Refresh in the given interval until the connection is closed. Does nothing if it is 0
+func (client *ClientRPC) startRefreshing(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	client.refreshInterval = interval
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := client.Refresh(); err != nil {
+					RPCLog.Warnf("ClientRPC: Unable to refresh connection to relay at %v: %v", client.relayAddr, err)
+				} else {
+					RPCLog.Debugf("ClientRPC: Refreshed connection to relay at %v", client.relayAddr)
+				}
+			case <-client.closed:
+				return
+			}
+		}
+	}()
+}
+
+// Returns the current connection to the relay
+func (client *ClientRPC) currentRelay() *rpc.Client {
+	client.relayMutex.RLock()
+	defer client.relayMutex.RUnlock()
+	return client.relay
+}
+
+// Returns the current connection to the relay for a call.
+// The returned function has to be called when the call finished
+func (client *ClientRPC) acquireRelay() (*rpc.Client, func()) {
+	client.relayMutex.RLock()
+	defer client.relayMutex.RUnlock()
+	calls := client.calls
+	if calls == nil {
+		return client.relay, func() {}
+	}
+	calls.Add(1)
+	return client.relay, calls.Done
 }
 
-// Open connection to relay server
-func (client *ClientRPC) connect() bool {
-	connection, err := net.DialTimeout("tcp", "localhost:7398", time.Duration(10)*time.Second)
+// Called when the given connection to the relay has been lost.
+// Reconnects unless the connection has already been replaced in the meantime.
+func (client *ClientRPC) replaceLostRelay(lost *rpc.Client) bool {
+	client.relayMutex.Lock()
+	defer client.relayMutex.Unlock()
+	if client.relay != lost {
+		// Reconnect() or another call has been faster
+		return true
+	}
+	relay, capabilities, err := client.dial(client.relayAddr)
 	if err != nil {
-		log.Printf("Unable to connect to relay server at localhost: %v", err)
+		RPCLog.Warnf("Unable to connect to relay server at %v: %v", client.relayAddr, err)
+		client.markDisconnected(err, 0)
 		return false
 	}
-	client.relay = jsonrpc.NewClient(connection)
-	log.Println("Connected to relay server")
+	client.setRelay(relay, capabilities)
+	client.markConnected()
 	return true
 }
 
 // CloseConnection terminates the connection to the relay server.
 func (client *ClientRPC) CloseConnection() {
-	client.listener.Close()
+	if client.closed != nil {
+		client.closeOnce.Do(func() { close(client.closed) })
+	}
+	if client.standby != nil {
+		client.standby.CloseConnection()
+	}
+	if client.listener != nil {
+		client.listener.Close()
+	} else if relay := client.currentRelay(); relay != nil {
+		relay.Close()
+	}
+}
+
+// Quiesce asks the relay to hold back its notifications until we connect again.
+func (client *ClientRPC) Quiesce(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		var pending int
+		err := client.callRelayMethodCtx(ctx, "Quiesce", "", &pending)
+		if err == nil {
+			RPCLog.Debugf("ClientRPC: Relay at %v holds back %v notifications", client.relayAddr, pending)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Calls the given method on the relay.
+// Reconnects and repeats the call if the connection to the relay has been lost,
+// as often as the RetryBudgets of the client allow for the method.
+func (client *ClientRPC) callRelayMethod(method string, args interface{}, reply interface{}) error {
+	return client.callRelayMethodCtx(context.Background(), method, args, reply)
+}
+
+// Same as callRelayMethod, the span of the call is a child of the span in ctx.
+// The call itself is not cancelled by ctx.
+func (client *ClientRPC) callRelayMethodCtx(ctx context.Context, method string, args interface{}, reply interface{}) (err error) {
+	attempts := client.retries.attempts(method)
+	i := 0
+	ctx, endSpan := client.startSpan(ctx, method, args)
+	defer func() { endSpan(err, i+1) }()
+	args = client.withTraceParent(ctx, args)
+	for ; i < attempts; i++ {
+		relay, done := client.acquireRelay()
+		err = relay.Call("ServerRPCMethods."+method, args, reply)
+		done()
+		if errors.Is(err, net.ErrClosed) && client.currentRelay() != relay {
+			// Reconnect() closed the connection while the call was running,
+			// repeat it on the new one without using up an attempt
+			i--
+			continue
+		}
+		// ErrShutdown: The connection was lost before, the call did not reach the relay.
+		// ErrUnexpectedEOF: The connection broke while waiting for the answer
+		if err != rpc.ErrShutdown && err != io.ErrUnexpectedEOF {
+			client.markConnected()
+			return err
+		}
+		if (err == io.ErrUnexpectedEOF && !idempotentMethods[method]) || i == attempts-1 {
+			client.markDisconnected(err, 0)
+			if i == attempts-1 {
+				// The relay failed all attempts, later calls go to the standby
+				client.failover(relay, err)
+			}
+			return err
+		}
+		client.markDisconnected(err, attempts-i-1)
+		if !client.replaceLostRelay(relay) {
+			if client.failover(relay, err) {
+				continue
+			}
+			RPCLog.Warnf("ClientRPC: Lost connection to relay and are unable to reconnect")
+			return err
+		}
+		RPCLog.Warnf("ClientRPC: Lost connection to relay but was able to reconnect")
+	}
+	return err
 }
 
 // CreateGame tells the relay server to start a game with the given name.
 // The host position in the game is protected by the given password
 func (client *ClientRPC) CreateGame(name string, hostPassword string) bool {
-	// Tell relay to host game
-	success := false
-	data := GameData{
+	return client.CreateGameWithSettings(GameData{
 		Name:     name,
 		Password: hostPassword,
+		Public:   true,
+	})
+}
+
+// CreateGameWithSettings tells the relay server to start a game described by the given data.
+func (client *ClientRPC) CreateGameWithSettings(data GameData) bool {
+	return client.createGame(context.Background(), data)
+}
+
+// CreateGameErr tells the relay server to start a game described by the given data
+// and returns why it could not be created.
+func (client *ClientRPC) CreateGameErr(data GameData) error {
+	return client.createGameErr(context.Background(), data)
+}
+
+func (client *ClientRPC) createGame(ctx context.Context, data GameData) bool {
+	if err := client.createGameErr(ctx, data); err != nil {
+		RPCLog.Warnf("ClientRPC  error: %v", err)
+		return false
 	}
-	for i := 0; i < 2; i++ {
-		err := client.relay.Call("ServerRPCMethods.NewGame", data, &success)
-		if err == nil {
-			break
-		}
-		if err == rpc.ErrShutdown {
-			if !client.connect() {
-				log.Printf("ClientRPC: Lost connection to relay and are unable to reconnect")
-				return false
-			}
-			log.Printf("ClientRPC: Lost connection to relay but was able to reconnect")
-		} else {
-			log.Printf("ClientRPC  error: %v", err)
-			return false
-		}
+	return true
+}
+
+func (client *ClientRPC) createGameErr(ctx context.Context, data GameData) error {
+	if client.debugTiming {
+		return client.createGameWithTiming(ctx, data)
 	}
-	return success
+	// Tell relay to host game
+	success := false
+	if err := client.callRelayMethodCtx(ctx, "NewGame", data, &success); err != nil {
+		return knownError(err)
+	}
+	if !success {
+		return errCreateGameFailed
+	}
+	client.rememberGame(data)
+	return nil
+}
+
+// Creates the game and logs how long the steps took.
+func (client *ClientRPC) createGameWithTiming(ctx context.Context, data GameData) error {
+	var timing CreateGameTiming
+	start := time.Now()
+	err := client.callRelayMethodCtx(ctx, "NewGameWithTiming", TimedGameRequest{data, start}, &timing)
+	RPCLog.Infof("ClientRPC: Creating game '%v' took %v (transfer %v, validation %v, setup %v)",
+		data.Name, time.Since(start), timing.Transfer, timing.Validation, timing.Setup)
+	if err == nil {
+		client.rememberGame(data)
+	}
+	return knownError(err)
+}
+
+// CountGamesByOwner requests the number of games with the given owner.
+func (client *ClientRPC) CountGamesByOwner(ownerID string) (int, error) {
+	var count int
+	err := client.callRelayMethod("CountGamesByOwner", ownerID, &count)
+	return count, knownError(err)
+}
+
+// ReserveGameName keeps the name free on the relay for the given time.
+func (client *ClientRPC) ReserveGameName(name string, ttl time.Duration) (string, error) {
+	var token string
+	err := client.callRelayMethod("ReserveGameName", ReservationRequest{name, ttl}, &token)
+	return token, knownError(err)
+}
+
+// CreateGameInRegion is the same as CreateGame since there is only one relay.
+func (client *ClientRPC) CreateGameInRegion(name string, hostPassword string, region string) bool {
+	return client.CreateGame(name, hostPassword)
+}
+
+// CreateGameAndAwaitHost creates the game and waits until the host connected to it.
+// Fails if the game could not be created or is closed before the host connected.
+// If ctx expires, the game stays on the relay which removes it if the host does not
+// connect in time.
+func (client *ClientRPC) CreateGameAndAwaitHost(ctx context.Context, name string, hostPassword string) error {
+	return client.waiters.createAndAwait(ctx, name, func() error {
+		if !client.createGame(ctx, GameData{Name: name, Password: hostPassword, Public: true}) {
+			return errCreateGameFailed
+		}
+		return nil
+	})
 }
 
 func (client *ClientRPC) RemoveGame(name string) bool {
@@ -113,39 +630,566 @@ func (client *ClientRPC) RemoveGame(name string) bool {
 		Name:     name,
 		Password: "",
 	}
-	for i := 0; i < 2; i++ {
-		err := client.relay.Call("ServerRPCMethods.RemoveGame", data, &success)
-		if err == nil {
-			break
-		}
-		if err == rpc.ErrShutdown {
-			if !client.connect() {
-				log.Printf("ClientRPC: Lost connection to relay and are unable to reconnect")
-				return false
-			}
-			log.Printf("ClientRPC: Lost connection to relay but was able to reconnect")
-		} else {
-			log.Printf("ClientRPC  error: %v", err)
-			return false
-		}
+	if err := client.callRelayMethod("RemoveGame", data, &success); err != nil {
+		RPCLog.Warnf("ClientRPC  error: %v", err)
+		return false
 	}
+	client.forgetGames(name)
 	return success
 }
 
+// RemoveGames removes multiple games from the relay in one call.
+func (client *ClientRPC) RemoveGames(names []string) (map[string]error, error) {
+	var texts map[string]string
+	if err := client.callRelayMethod("RemoveGames", GameNames{names}, &texts); err != nil {
+		return nil, err
+	}
+	results := make(map[string]error, len(texts))
+	for name, text := range texts {
+		results[name] = errorFromText(text)
+	}
+	client.forgetGames(names...)
+	return results, nil
+}
+
+// RemoveGamesByOwner removes all games of the owner from the relay.
+func (client *ClientRPC) RemoveGamesByOwner(ownerID string) (int, error) {
+	names, err := client.removeGamesByOwner(ownerID)
+	return len(names), err
+}
+
+// Same as RemoveGamesByOwner but returns the names of the removed games
+func (client *ClientRPC) removeGamesByOwner(ownerID string) ([]string, error) {
+	var names []string
+	err := client.callRelayMethod("RemoveGamesByOwner", GameData{OwnerID: ownerID}, &names)
+	client.forgetGames(names...)
+	return names, err
+}
+
+// LockGame changes whether the game refuses new players.
+func (client *ClientRPC) LockGame(name string, hostPassword string, locked bool) (bool, error) {
+	var success bool
+	data := GameData{
+		Name:     name,
+		Password: hostPassword,
+		Locked:   locked,
+	}
+	err := client.callRelayMethod("LockGame", data, &success)
+	return success, knownError(err)
+}
+
+// MakeInviteOnly makes the game private and refuses new players without a join token.
+func (client *ClientRPC) MakeInviteOnly(name string, hostPassword string, invites int) ([]string, error) {
+	var tokens []string
+	err := client.callRelayMethod("MakeInviteOnly", InviteOnlyRequest{Name: name, Password: hostPassword, Invites: invites}, &tokens)
+	return tokens, knownError(err)
+}
+
+// SetVisibility changes whether the game is listed publicly.
+func (client *ClientRPC) SetVisibility(name string, hostPassword string, public bool) error {
+	var success bool
+	data := GameData{
+		Name:     name,
+		Password: hostPassword,
+		Public:   public,
+	}
+	return knownError(client.callRelayMethod("SetVisibility", data, &success))
+}
+
+// GetGameTimeline requests the events of the given game, the oldest first.
+func (client *ClientRPC) GetGameTimeline(gameName string) ([]TimelineEvent, error) {
+	var timeline []TimelineEvent
+	err := client.callRelayMethod("GetGameTimeline", GameData{Name: gameName}, &timeline)
+	return timeline, knownError(err)
+}
+
+// GetGameHistory requests the summaries of the recently closed games.
+func (client *ClientRPC) GetGameHistory(limit int) ([]GameSummary, error) {
+	var summaries []GameSummary
+	err := client.callRelayMethod("GetGameHistory", limit, &summaries)
+	return summaries, err
+}
+
+// VerifyHostPassword checks the host password of the game.
+func (client *ClientRPC) VerifyHostPassword(gameName, password string) (bool, error) {
+	var matches bool
+	err := client.callRelayMethod("VerifyHostPassword", GameData{Name: gameName, Password: password}, &matches)
+	return matches, knownError(err)
+}
+
+// KickPlayerByID disconnects the player with the given id from the game.
+func (client *ClientRPC) KickPlayerByID(gameName, hostPassword string, playerID uint64) (bool, error) {
+	var success bool
+	err := client.callRelayMethod("KickPlayerByID", KickRequest{gameName, hostPassword, playerID}, &success)
+	return success, knownError(err)
+}
+
+// TransferHost makes another connected player the host of the game.
+func (client *ClientRPC) TransferHost(gameName, hostPassword, newHostPlayer, newHostPassword string) (bool, error) {
+	var success bool
+	data := HostTransfer{
+		Name:        gameName,
+		Password:    hostPassword,
+		NewHost:     newHostPlayer,
+		NewPassword: newHostPassword,
+	}
+	err := client.callRelayMethod("TransferHost", data, &success)
+	return success, knownError(err)
+}
+
+// ListGames requests all games on the relay.
+func (client *ClientRPC) ListGames() ([]GameData, error) {
+	var games []GameData
+	err := client.callRelayMethod("ListGames", "", &games)
+	return games, err
+}
+
+// ListGamesFiltered requests the games on the relay matching the filter.
+func (client *ClientRPC) ListGamesFiltered(filter GameFilter) ([]GameData, error) {
+	var games []GameData
+	err := client.callRelayMethod("ListGamesFiltered", filter, &games)
+	return games, err
+}
+
+// ListGamesPage requests some of the games on the relay.
+func (client *ClientRPC) ListGamesPage(offset, limit int) ([]GameData, int, error) {
+	var page GamesPage
+	err := client.callRelayMethod("ListGamesPage", GamesPageRequest{offset, limit}, &page)
+	return page.Games, page.Total, err
+}
+
+// GetGamePlayers requests the players connected to the given game.
+func (client *ClientRPC) GetGamePlayers(name string) ([]PlayerInfo, error) {
+	var players []PlayerInfo
+	err := client.callRelayMethod("GetGamePlayers", GameData{Name: name}, &players)
+	return players, knownError(err)
+}
+
+// IsPlayerConnected requests whether the player is connected to the given game.
+func (client *ClientRPC) IsPlayerConnected(gameName string, playerID uint64) (PlayerConnection, error) {
+	var connection PlayerConnection
+	err := client.callRelayMethod("IsPlayerConnected", PlayerConnectionRequest{gameName, playerID}, &connection)
+	return connection, knownError(err)
+}
+
+// ForwardingLatency requests how long the relay takes to forward frames in all games.
+func (client *ClientRPC) ForwardingLatency() (avg, p95, p99 time.Duration, err error) {
+	return client.GameForwardingLatency("")
+}
+
+// GameForwardingLatency requests how long the relay takes to forward frames in the game.
+func (client *ClientRPC) GameForwardingLatency(gameName string) (avg, p95, p99 time.Duration, err error) {
+	stats, err := client.forwardingLatency(gameName)
+	return stats.Average, stats.P95, stats.P99, err
+}
+
+func (client *ClientRPC) forwardingLatency(gameName string) (LatencyStats, error) {
+	var stats LatencyStats
+	err := client.callRelayMethod("ForwardingLatency", GameData{Name: gameName}, &stats)
+	return stats, err
+}
+
+// GetGameTraffic requests the game data forwarded in the game since the last reset.
+func (client *ClientRPC) GetGameTraffic(gameName string) (GameTraffic, error) {
+	var traffic GameTraffic
+	err := client.callRelayMethod("GetGameTraffic", GameData{Name: gameName}, &traffic)
+	return traffic, knownError(err)
+}
+
+// ResetGameCounters zeroes the counters returned by GetGameTraffic.
+func (client *ClientRPC) ResetGameCounters(gameName, hostPassword string) error {
+	var success bool
+	err := client.callRelayMethod("ResetGameCounters", GameData{Name: gameName, Password: hostPassword}, &success)
+	return knownError(err)
+}
+
+// DumpGameState requests a snapshot of the state of the game.
+func (client *ClientRPC) DumpGameState(gameName string) (GameStateDump, error) {
+	var dump GameStateDump
+	err := client.callRelayMethod("DumpGameState", GameData{Name: gameName}, &dump)
+	return dump, err
+}
+
+// FindPlayer requests the games the player is connected to.
+func (client *ClientRPC) FindPlayer(name string) ([]PlayerLocation, error) {
+	var locations []PlayerLocation
+	err := client.callRelayMethod("FindPlayer", name, &locations)
+	return locations, err
+}
+
+// BuildJoinInstruction collects the settings of the relay a player needs to join the given game.
+func (client *ClientRPC) BuildJoinInstruction(gameName string) (JoinInstruction, error) {
+	if _, err := client.GetGame(gameName); err != nil {
+		return JoinInstruction{}, err
+	}
+	status, err := client.Status()
+	if err != nil {
+		return JoinInstruction{}, err
+	}
+	return JoinInstruction{
+		Address:         status.PublicAddress,
+		Port:            status.GamePort,
+		GameName:        gameName,
+		ProtocolVersion: status.ProtocolVersion,
+		Capabilities:    client.currentCapabilities(),
+	}, nil
+}
+
+// GetGame requests the description of the given game.
+func (client *ClientRPC) GetGame(name string) (GameData, error) {
+	var game GameData
+	err := client.callRelayMethod("GetGame", GameData{Name: name}, &game)
+	return game, knownError(err)
+}
+
+// GetGames requests the descriptions of multiple games in one call.
+func (client *ClientRPC) GetGames(names []string) (map[string]GameData, error) {
+	var games map[string]GameData
+	err := client.callRelayMethod("GetGames", GameNames{names}, &games)
+	return games, knownError(err)
+}
+
+// RotateRecording starts a new recording file for the given game.
+func (client *ClientRPC) RotateRecording(gameName string) (string, error) {
+	var path string
+	err := client.callRelayMethod("RotateRecording", GameData{Name: gameName}, &path)
+	return path, knownError(err)
+}
+
+// IssueJoinToken requests a token for one connection to the given game.
+func (client *ClientRPC) IssueJoinToken(gameName string) (string, error) {
+	var token string
+	err := client.callRelayMethod("IssueJoinToken", GameData{Name: gameName}, &token)
+	return token, knownError(err)
+}
+
+// IssuePlayerJoinToken requests a token for one connection of the player to the given game.
+func (client *ClientRPC) IssuePlayerJoinToken(gameName, playerName string) (string, error) {
+	var token string
+	err := client.callRelayMethod("IssuePlayerJoinToken", PlayerJoinTokenRequest{Name: gameName, PlayerName: playerName}, &token)
+	return token, knownError(err)
+}
+
+// GetLimits requests the resource limits of the relay.
+// Requires the admin token configured on the relay, fails with ErrUnauthorized otherwise.
+func (client *ClientRPC) GetLimits() (RelayLimits, error) {
+	var limits RelayLimits
+	err := client.callRelayMethod("GetLimits", LimitsRequest{AdminToken: client.currentAdminToken()}, &limits)
+	return limits, knownError(err)
+}
+
+// SetLimits changes the resource limits of the relay. Only new games and
+// connections are affected by the new limits.
+// Requires the admin token configured on the relay, fails with ErrUnauthorized otherwise.
+func (client *ClientRPC) SetLimits(limits RelayLimits) error {
+	var success bool
+	err := client.callRelayMethod("SetLimits", LimitsRequest{AdminToken: client.currentAdminToken(), Limits: limits}, &success)
+	return knownError(err)
+}
+
+// GetEffectiveConfig requests the settings the relay is running with, including
+// the defaults and the current limits. Secrets are redacted.
+// Requires the admin token configured on the relay, fails with ErrUnauthorized otherwise.
+func (client *ClientRPC) GetEffectiveConfig() (RelayConfigView, error) {
+	var view RelayConfigView
+	err := client.callRelayMethod("GetEffectiveConfig", LimitsRequest{AdminToken: client.currentAdminToken()}, &view)
+	return view, knownError(err)
+}
+
+// GetRecentLogs requests up to limit of the most recent log messages of the relay
+// with at least the given level, the oldest first. All kept messages are returned if
+// limit is not positive. Secrets are never logged, so they are not part of the messages.
+// Requires the admin token configured on the relay, fails with ErrUnauthorized otherwise.
+func (client *ClientRPC) GetRecentLogs(limit int, minLevel LogLevel) ([]LogLine, error) {
+	var lines []LogLine
+	err := client.callRelayMethod("GetRecentLogs", LogsRequest{AdminToken: client.currentAdminToken(), Limit: limit, MinLevel: minLevel}, &lines)
+	return lines, knownError(err)
+}
+
+// Returns the admin token presented to the relay
+func (client *ClientRPC) currentAdminToken() string {
+	client.relayMutex.RLock()
+	defer client.relayMutex.RUnlock()
+	return client.adminToken
+}
+
+// SetAdminToken replaces the admin token presented to the relay for administrative calls.
+func (client *ClientRPC) SetAdminToken(token string) {
+	client.relayMutex.Lock()
+	defer client.relayMutex.Unlock()
+	client.adminToken = token
+}
+
+// SetAuthTokens makes the relay accept the current and the next admin token
+// from now on. To rotate the token without failing calls, call it with the old
+// token as current and the new one as next, call SetAdminToken with the new
+// token, and finally call it with the new token as current and no next token.
+// Requires the admin token configured on the relay, fails with ErrUnauthorized otherwise.
+// Fails with ErrEmptyToken if current is empty
+func (client *ClientRPC) SetAuthTokens(current, next string) error {
+	var success bool
+	err := client.callRelayMethod("SetAuthTokens", AuthTokensRequest{AdminToken: client.currentAdminToken(), Current: current, Next: next}, &success)
+	return knownError(err)
+}
+
+// ScheduleMaintenance announces a restart of the relay at the given time. The relay
+// shows the message to the players of all games shortly before, see MaintenanceLeadTime
+// of the relay configuration. Replaces the maintenance scheduled before.
+// The time is converted to the clock of the relay, see ClockSkew.
+// Requires the admin token configured on the relay, fails with ErrUnauthorized otherwise.
+func (client *ClientRPC) ScheduleMaintenance(message string, at time.Time) error {
+	var success bool
+	request := MaintenanceRequest{AdminToken: client.currentAdminToken(), Message: message, At: client.relayTime(at)}
+	err := client.callRelayMethod("ScheduleMaintenance", request, &success)
+	return knownError(err)
+}
+
+// CancelMaintenance stops announcing the scheduled maintenance.
+// Requires the admin token configured on the relay, fails with ErrUnauthorized otherwise.
+func (client *ClientRPC) CancelMaintenance() error {
+	var success bool
+	err := client.callRelayMethod("CancelMaintenance", MaintenanceRequest{AdminToken: client.currentAdminToken()}, &success)
+	return knownError(err)
+}
+
+// Subscribe calls the handler with each event reported by the relay until the
+// returned function is called. The handler should return quickly since the relay
+// waits for it and queues further events in the meantime.
+func (client *ClientRPC) Subscribe(handler func(Event)) (func(), error) {
+	if client.subscribers == nil {
+		return nil, errors.New("Subscribe the RelayPool instead")
+	}
+	return subscribe(client.subscribers, []*ClientRPC{client}, handler)
+}
+
+// Asks the relay to send events or to stop sending them.
+func (client *ClientRPC) setSubscribed(subscribed bool) error {
+	var ignored bool
+	return client.callRelayMethod("Subscribe", SubscriptionRequest{subscribed}, &ignored)
+}
+
+// Ping checks whether the relay is reachable and updates the estimated ClockSkew.
+func (client *ClientRPC) Ping() error {
+	var response PingResponse
+	sent := time.Now()
+	err := client.callRelayMethod("Ping", PingRequest{}, &response)
+	if err == nil {
+		client.noteClockSkew(sent, time.Now(), response.Now)
+	}
+	return err
+}
+
+// Health checks both directions of the connection to the relay.
+// The relay tries to call us back while answering, so a working callback
+// channel implies that calling the relay works, too.
+func (client *ClientRPC) Health() HealthReport {
+	var response PingResponse
+	sent := time.Now()
+	err := client.callRelayMethod("Ping", PingRequest{CheckCallback: true}, &response)
+	if err != nil {
+		return HealthReport{
+			RelayError:    err.Error(),
+			CallbackError: "relay not reachable",
+		}
+	}
+	// The relay read its clock before calling us back, so the callback does not count
+	client.noteClockSkew(sent, time.Now().Add(-response.CallbackTook), response.Now)
+	return HealthReport{
+		RelayOK:       true,
+		CallbackOK:    response.CallbackOK,
+		CallbackError: response.CallbackError,
+	}
+}
+
+// Capabilities requests the optional features of the relay.
+func (client *ClientRPC) Capabilities() (RelayCapabilities, error) {
+	var capabilities RelayCapabilities
+	err := client.callRelayMethod("Capabilities", "", &capabilities)
+	if err == nil {
+		client.relayMutex.Lock()
+		client.capabilities = capabilities
+		client.relayMutex.Unlock()
+	}
+	return capabilities, err
+}
+
+// SupportedProtocols requests the versions of the relay protocol the relay accepts.
+func (client *ClientRPC) SupportedProtocols() ([]int, error) {
+	var versions []int
+	err := client.callRelayMethod("SupportedProtocols", "", &versions)
+	return versions, err
+}
+
+// SelfTest makes the relay forward a frame between two connections of a throwaway game.
+func (client *ClientRPC) SelfTest() error {
+	var success bool
+	err := client.callRelayMethod("SelfTest", "", &success)
+	return knownError(err)
+}
+
+// VerifyReachability makes the relay check that it can be reached at its public address.
+func (client *ClientRPC) VerifyReachability(ctx context.Context) (bool, error) {
+	var reachable bool
+	err := client.callRelayMethodCtx(ctx, "VerifyReachability", "", &reachable)
+	return reachable, knownError(err)
+}
+
+// Status requests the current status of the relay.
+func (client *ClientRPC) Status() (ServerStatus, error) {
+	var status ServerStatus
+	err := client.callRelayMethod("Status", "", &status)
+	return status, err
+}
+
+// TrafficRate requests the bytes per second the relay did send over the given window.
+func (client *ClientRPC) TrafficRate(window time.Duration) (float64, error) {
+	var rate float64
+	err := client.callRelayMethod("TrafficRate", TrafficRequest{window}, &rate)
+	return rate, err
+}
+
+// ignoringCallback is used instead of a nil ClientCallback.
+// It drops all notifications and reports an empty status.
+type ignoringCallback struct{}
+
+func (ignoringCallback) GameConnected(name string)                      {}
+func (ignoringCallback) GameClosed(name string, reason CloseReason)     {}
+func (ignoringCallback) ClientReconnected(name string, playerID uint64) {}
+func (ignoringCallback) HostChanged(name string, playerID uint64)       {}
+func (ignoringCallback) OnCapacityWarning(current, max int)             {}
+func (ignoringCallback) OnRelayAlert(alert RelayAlert)                  {}
+func (ignoringCallback) ClientJoinRejected(rejection JoinRejection)     {}
+func (ignoringCallback) ClientChat(message ChatMessage)                 {}
+func (ignoringCallback) Status() *ServerStatus                          { return &ServerStatus{} }
+
+// Returns the given callback or, if it is nil, one that ignores all notifications.
+func callbackOrIgnore(callback ClientCallback) ClientCallback {
+	if callback != nil {
+		return callback
+	}
+	RPCLog.Infof("ClientRPC: No callback given, ignoring notifications of the relay")
+	return ignoringCallback{}
+}
+
+// Turns a panic of the callback into an error returned to the relay,
+// so a broken callback does not take down the whole metaserver.
+func recoverCallback(method string, err *error) {
+	if r := recover(); r != nil {
+		RPCLog.Warnf("ClientRPC: Callback panicked in %v: %v", method, r)
+		*err = fmt.Errorf("callback failed in %v", method)
+	}
+}
+
+// Hello is called by the relay over rpc when it connects to us.
+func (client *ClientRPCMethods) Hello(in *HelloData, response *bool) (err error) {
+	RPCLog.Infof("ClientRPC: Relay %v connected with capabilities %v", in.InstanceID, in.Capabilities)
+	*response = true
+	return nil
+}
+
+// Ping is called by the relay over rpc to check whether we are reachable.
+func (client *ClientRPCMethods) Ping(in *string, response *bool) (err error) {
+	*response = true
+	return nil
+}
+
+// Logs a warning when the relay reports that it had to drop notifications.
+func (client *ClientRPCMethods) warnIfEventsDropped(in *GameData) {
+	if in.EventsDropped {
+		RPCLog.Warnf("ClientRPC: Relay dropped notifications, list of games might be out of sync")
+	}
+}
+
+// Logs the notification with its request id so it can be followed across the logs.
+func (client *ClientRPCMethods) traceNotification(action string, in *GameData) {
+	if in.RequestID != "" {
+		RPCLog.Infof("ClientRPC: Relay notifies %v for game '%v' (request %v)", action, in.Name, in.RequestID)
+	}
+}
+
 // GameConnected is called by the relay over rpc when a host connected to a game.
 func (client *ClientRPCMethods) GameConnected(in *GameData, response *bool) (err error) {
-	client.client.callback.GameConnected(in.Name)
+	defer recoverCallback("GameConnected", &err)
+	client.traceNotification("GameConnected", in)
+	client.warnIfEventsDropped(in)
+	client.callback.GameConnected(in.Name)
 	return nil
 }
 
 // GameClosed is called by the relay over rpc when a game has ended.
 func (client *ClientRPCMethods) GameClosed(in *GameData, response *bool) (err error) {
-	client.client.callback.GameClosed(in.Name)
+	defer recoverCallback("GameClosed", &err)
+	client.traceNotification("GameClosed", in)
+	client.warnIfEventsDropped(in)
+	client.callback.GameClosed(in.Name, in.CloseReason)
 	return nil
 }
 
-// GameClosed is called by the relay over rpc when a game has ended.
+// HostChanged is called by the relay over rpc when another player became the host of a game.
+func (client *ClientRPCMethods) HostChanged(in *GameData, response *bool) (err error) {
+	defer recoverCallback("HostChanged", &err)
+	client.traceNotification("HostChanged", in)
+	client.callback.HostChanged(in.Name, in.PlayerID)
+	return nil
+}
+
+// OnCapacityWarning is called by the relay over rpc when it is nearly full.
+func (client *ClientRPCMethods) OnCapacityWarning(in *CapacityWarning, response *bool) (err error) {
+	defer recoverCallback("OnCapacityWarning", &err)
+	client.callback.OnCapacityWarning(in.Current, in.Max)
+	return nil
+}
+
+// OnRelayAlert is called by the relay over rpc when it has a problem operators should know about.
+func (client *ClientRPCMethods) OnRelayAlert(in *RelayAlert, response *bool) (err error) {
+	defer recoverCallback("OnRelayAlert", &err)
+	client.callback.OnRelayAlert(*in)
+	return nil
+}
+
+// ClientJoinRejected is called by the relay over rpc when it refused a connection to a game.
+func (client *ClientRPCMethods) ClientJoinRejected(in *JoinRejection, response *bool) (err error) {
+	defer recoverCallback("ClientJoinRejected", &err)
+	client.callback.ClientJoinRejected(*in)
+	return nil
+}
+
+// ClientChat is called by the relay over rpc with a chat message of a game.
+func (client *ClientRPCMethods) ClientChat(in *ChatMessage, response *bool) (err error) {
+	defer recoverCallback("ClientChat", &err)
+	client.callback.ClientChat(*in)
+	return nil
+}
+
+// ClientReconnected is called by the relay over rpc when a client reconnected to its slot.
+func (client *ClientRPCMethods) ClientReconnected(in *GameData, response *bool) (err error) {
+	defer recoverCallback("ClientReconnected", &err)
+	client.traceNotification("ClientReconnected", in)
+	client.warnIfEventsDropped(in)
+	client.callback.ClientReconnected(in.Name, in.PlayerID)
+	return nil
+}
+
+// Event is called by the relay over rpc when something happened and we subscribed to events.
+func (client *ClientRPCMethods) Event(in *Event, response *bool) (err error) {
+	defer recoverCallback("Event", &err)
+	if in.EventsDropped {
+		RPCLog.Warnf("ClientRPC: Relay dropped events, subscribers missed some of them")
+	}
+	if client.subscribers != nil {
+		client.subscribers.publish(*in)
+	}
+	return nil
+}
+
+// Status is called by the relay over rpc when it wants to know our status.
 func (client *ClientRPCMethods) Status(in *string, response *ServerStatus) (err error) {
-	*response = *client.client.callback.Status()
+	defer recoverCallback("Status", &err)
+	status := client.callback.Status()
+	if status == nil {
+		RPCLog.Warnf("ClientRPC: Callback returned no status")
+		return errors.New("status not available")
+	}
+	*response = limitStatusSize(*status, DefaultMaxStatusSize)
 	return nil
 }
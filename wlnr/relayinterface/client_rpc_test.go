@@ -0,0 +1,1225 @@
+package relayinterface
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ClientRPCSuite struct{}
+
+var _ = Suite(&ClientRPCSuite{})
+
+// RecordingCallback remembers the notifications it receives.
+type RecordingCallback struct {
+	mutex  sync.Mutex
+	events []string
+	status ServerStatus
+}
+
+func (r *RecordingCallback) record(format string, args ...interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *RecordingCallback) Events() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func (r *RecordingCallback) GameConnected(name string) {
+	r.record("GameConnected %v", name)
+}
+
+func (r *RecordingCallback) GameClosed(name string, reason CloseReason) {
+	r.record("GameClosed %v '%v'", name, reason)
+}
+
+func (r *RecordingCallback) ClientReconnected(name string, playerID uint64) {
+	r.record("ClientReconnected %v %v", name, playerID)
+}
+
+func (r *RecordingCallback) HostChanged(name string, playerID uint64) {
+	r.record("HostChanged %v %v", name, playerID)
+}
+
+func (r *RecordingCallback) OnCapacityWarning(current, max int) {
+	r.record("OnCapacityWarning %v %v", current, max)
+}
+
+func (r *RecordingCallback) OnRelayAlert(alert RelayAlert) {
+	r.record("OnRelayAlert %v '%v'", alert.Code, alert.Message)
+}
+
+func (r *RecordingCallback) ClientJoinRejected(rejection JoinRejection) {
+	r.record("ClientJoinRejected %v %v", rejection.Game, rejection.Reason)
+}
+
+func (r *RecordingCallback) ClientChat(message ChatMessage) {
+	r.record("ClientChat %v %v %v", message.Game, message.PlayerID, message.Message)
+}
+
+func (r *RecordingCallback) Status() *ServerStatus {
+	r.record("Status")
+	return &r.status
+}
+
+// FakeRelay calls the methods a relay calls on the metaserver.
+type FakeRelay struct {
+	client *rpc.Client
+}
+
+// Opens the listener for relays with the given callback on a free port
+// and connects a FakeRelay to it.
+func ListenWithFakeRelay(c *C, callback ClientCallback) (net.Listener, *FakeRelay) {
+	ln, err := listenForRelays(callback, nil, "127.0.0.1:0", false)
+	c.Assert(err, IsNil)
+	client, err := jsonrpc.Dial("tcp", ln.Addr().String())
+	c.Assert(err, IsNil)
+	return ln, &FakeRelay{client}
+}
+
+func (f *FakeRelay) Call(method string, in interface{}, out interface{}) error {
+	return f.client.Call("ClientRPCMethods."+method, in, out)
+}
+
+func (f *FakeRelay) Close() {
+	f.client.Close()
+}
+
+func (s *ClientRPCSuite) TestGameConnected(c *C) {
+	callback := &RecordingCallback{}
+	ln, relay := ListenWithFakeRelay(c, callback)
+	defer ln.Close()
+	defer relay.Close()
+	var ignored bool
+	c.Assert(relay.Call("GameConnected", GameData{Name: "game"}, &ignored), IsNil)
+	c.Assert(callback.Events(), DeepEquals, []string{"GameConnected game"})
+}
+
+func (s *ClientRPCSuite) TestGameClosed(c *C) {
+	callback := &RecordingCallback{}
+	ln, relay := ListenWithFakeRelay(c, callback)
+	defer ln.Close()
+	defer relay.Close()
+	var ignored bool
+	c.Assert(relay.Call("GameClosed", GameData{Name: "game"}, &ignored), IsNil)
+	c.Assert(relay.Call("GameClosed", GameData{Name: "idle", CloseReason: CloseReasonNoTraffic}, &ignored), IsNil)
+	c.Assert(callback.Events(), DeepEquals, []string{"GameClosed game ''", "GameClosed idle 'NoTraffic'"})
+}
+
+func (s *ClientRPCSuite) TestClientReconnected(c *C) {
+	callback := &RecordingCallback{}
+	ln, relay := ListenWithFakeRelay(c, callback)
+	defer ln.Close()
+	defer relay.Close()
+	var ignored bool
+	c.Assert(relay.Call("ClientReconnected", GameData{Name: "game", PlayerID: 3}, &ignored), IsNil)
+	c.Assert(callback.Events(), DeepEquals, []string{"ClientReconnected game 3"})
+}
+
+func (s *ClientRPCSuite) TestStatus(c *C) {
+	callback := &RecordingCallback{status: ServerStatus{NClients: 5, NGames: 2}}
+	ln, relay := ListenWithFakeRelay(c, callback)
+	defer ln.Close()
+	defer relay.Close()
+	var status ServerStatus
+	c.Assert(relay.Call("Status", "", &status), IsNil)
+	c.Assert(status.NClients, Equals, 5)
+	c.Assert(status.NGames, Equals, 2)
+	c.Assert(callback.Events(), DeepEquals, []string{"Status"})
+}
+
+// NilStatusCallback has no status to report
+type NilStatusCallback struct {
+	RecordingCallback
+}
+
+func (n *NilStatusCallback) Status() *ServerStatus {
+	return nil
+}
+
+func (s *ClientRPCSuite) TestNilStatusReturnsError(c *C) {
+	ln, relay := ListenWithFakeRelay(c, &NilStatusCallback{})
+	defer ln.Close()
+	defer relay.Close()
+	var status ServerStatus
+	c.Assert(relay.Call("Status", "", &status), ErrorMatches, "status not available")
+	// The connection is still served
+	var ignored bool
+	c.Assert(relay.Call("Ping", "", &ignored), IsNil)
+}
+
+func (s *ClientRPCSuite) TestNilCallbackIgnoresNotifications(c *C) {
+	ln, relay := ListenWithFakeRelay(c, nil)
+	defer ln.Close()
+	defer relay.Close()
+	var ignored bool
+	c.Assert(relay.Call("GameConnected", GameData{Name: "game"}, &ignored), IsNil)
+	c.Assert(relay.Call("GameClosed", GameData{Name: "game"}, &ignored), IsNil)
+	c.Assert(relay.Call("ClientReconnected", GameData{Name: "game", PlayerID: 2}, &ignored), IsNil)
+	var status ServerStatus
+	c.Assert(relay.Call("Status", "", &status), IsNil)
+	c.Assert(status, DeepEquals, ServerStatus{})
+}
+
+func (s *ClientRPCSuite) TestPanickingCallbackReturnsError(c *C) {
+	// A typed nil pointer is not caught by the nil check and panics on use
+	var callback *RecordingCallback
+	ln, relay := ListenWithFakeRelay(c, callback)
+	defer ln.Close()
+	defer relay.Close()
+	var ignored bool
+	c.Assert(relay.Call("GameConnected", GameData{Name: "game"}, &ignored), ErrorMatches, ".*GameConnected.*")
+	var status ServerStatus
+	c.Assert(relay.Call("Status", "", &status), ErrorMatches, ".*Status.*")
+	// The connection is still served
+	c.Assert(relay.Call("Ping", "", &ignored), IsNil)
+}
+
+func (s *ClientRPCSuite) TestHalfClosedConnectionIsClosed(c *C) {
+	callback := &RecordingCallback{}
+	ln, err := listenForRelays(callback, nil, "127.0.0.1:0", false)
+	c.Assert(err, IsNil)
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	c.Assert(conn.(*net.TCPConn).CloseWrite(), IsNil)
+	// The relay side notices and closes its end
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+}
+
+func (s *ClientRPCSuite) TestRelayReconnectsTwice(c *C) {
+	callback := &RecordingCallback{}
+	ln, err := listenForRelays(callback, nil, "127.0.0.1:0", false)
+	c.Assert(err, IsNil)
+	defer ln.Close()
+	var expected []string
+	for i := 0; i < 3; i++ {
+		client, err := jsonrpc.Dial("tcp", ln.Addr().String())
+		c.Assert(err, IsNil)
+		var ignored bool
+		name := fmt.Sprintf("game%v", i)
+		c.Assert(client.Call("ClientRPCMethods.GameConnected", GameData{Name: name}, &ignored), IsNil)
+		expected = append(expected, "GameConnected "+name)
+		client.Close()
+	}
+	c.Assert(callback.Events(), DeepEquals, expected)
+}
+
+func (s *ClientRPCSuite) TestListenFailureIsReported(c *C) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer taken.Close()
+	_, err = listenForRelays(&RecordingCallback{}, nil, taken.Addr().String(), false)
+	c.Assert(errors.Is(err, ErrListenFailed), Equals, true)
+	c.Assert(errors.Is(err, ErrRelayUnreachable), Equals, false)
+	c.Assert(err, ErrorMatches, ".*"+taken.Addr().String()+".*")
+}
+
+func (s *ClientRPCSuite) TestUnreachableRelayIsReported(c *C) {
+	// Nothing listens on the port after closing the listener
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	addr := ln.Addr().String()
+	ln.Close()
+	client, err := ConnectClientRPC(&RecordingCallback{}, ClientRPCOptions{RelayAddr: addr})
+	c.Assert(client, IsNil)
+	c.Assert(errors.Is(err, ErrRelayUnreachable), Equals, true)
+	c.Assert(err, ErrorMatches, ".*"+addr+".*")
+}
+
+// BreakingRelay answers the first call on each connection, which is the
+// Capabilities call when connecting, and closes the connection on the next one.
+type BreakingRelay struct {
+	ln          net.Listener
+	connections int32
+}
+
+func NewBreakingRelay(c *C) *BreakingRelay {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	relay := &BreakingRelay{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&relay.connections, 1)
+			go relay.serve(conn)
+		}
+	}()
+	return relay
+}
+
+func (r *BreakingRelay) serve(conn net.Conn) {
+	defer conn.Close()
+	decoder := json.NewDecoder(conn)
+	var request struct {
+		ID uint64 `json:"id"`
+	}
+	if decoder.Decode(&request) != nil {
+		return
+	}
+	fmt.Fprintf(conn, "{\"id\":%d,\"result\":0,\"error\":null}\n", request.ID)
+	// Wait until the call arrives so it is known to have reached the relay
+	decoder.Decode(&request)
+}
+
+func (r *BreakingRelay) Connections() int {
+	return int(atomic.LoadInt32(&r.connections))
+}
+
+func (s *ClientRPCSuite) TestIdempotentCallsUseTheirBudget(c *C) {
+	relay := NewBreakingRelay(c)
+	defer relay.ln.Close()
+	client := &ClientRPC{relayAddr: relay.ln.Addr().String(), retries: RetryBudgets{Idempotent: 3, NonIdempotent: 1}}
+	c.Assert(client.connect(), IsNil)
+	c.Assert(client.RemoveGame("game"), Equals, false)
+	// Repeated on a new connection each time
+	c.Assert(relay.Connections(), Equals, 3)
+}
+
+func (s *ClientRPCSuite) TestNonIdempotentCallsAreNotRepeatedAfterReachingTheRelay(c *C) {
+	relay := NewBreakingRelay(c)
+	defer relay.ln.Close()
+	client := &ClientRPC{relayAddr: relay.ln.Addr().String(), retries: RetryBudgets{Idempotent: 3, NonIdempotent: 3}}
+	c.Assert(client.connect(), IsNil)
+	c.Assert(client.CreateGame("game", "secret"), Equals, false)
+	// The relay might have created the game, so the call must not be repeated
+	c.Assert(relay.Connections(), Equals, 1)
+}
+
+func (s *ClientRPCSuite) TestRetryBudgetDefaults(c *C) {
+	c.Assert(RetryBudgets{}.attempts("RemoveGame"), Equals, DefaultIdempotentAttempts)
+	c.Assert(RetryBudgets{}.attempts("NewGame"), Equals, DefaultNonIdempotentAttempts)
+	c.Assert(RetryBudgets{Idempotent: 7}.attempts("Status"), Equals, 7)
+	c.Assert(RetryBudgets{NonIdempotent: 5}.attempts("IssueJoinToken"), Equals, 5)
+}
+
+func (s *ClientRPCSuite) TestPoolWithoutHealthyRelayFailsAtOnce(c *C) {
+	down := &ClientRPC{relayAddr: "relay-a:7398"}
+	lacking := &ClientRPC{relayAddr: "relay-b:7398"}
+	pool := &RelayPool{
+		relays:    []*ClientRPC{down, lacking},
+		games:     make(map[string]*ClientRPC),
+		reserved:  make(map[string]poolReservation),
+		unhealthy: map[*ClientRPC]error{down: ErrRelayUnreachable},
+	}
+	err := pool.TryCreateGame(GameData{Name: "game"}, "", CapabilityUDP)
+	c.Assert(errors.Is(err, ErrNoHealthyRelay), Equals, true)
+	c.Assert(err, ErrorMatches, `No healthy relay available: relay-a:7398 \(down: Relay is unreachable\), relay-b:7398 \(missing capabilities udp\)`)
+	c.Assert(pool.CreateGameRequiring("game", "secret", "", CapabilityUDP), Equals, false)
+}
+
+// SlowRelay answers every call after a delay and remembers the called methods.
+// All calls but Capabilities, Status and those given to Answer succeed with true.
+type SlowRelay struct {
+	ln      net.Listener
+	delay   time.Duration
+	calls   int32
+	mutex   sync.Mutex
+	methods []string
+	// The answers to the methods given to Answer and the last parameters of each method
+	results map[string]string
+	params  map[string]json.RawMessage
+}
+
+func NewSlowRelay(c *C, delay time.Duration) *SlowRelay {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	relay := &SlowRelay{ln: ln, delay: delay, results: make(map[string]string), params: make(map[string]json.RawMessage)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go relay.serve(conn)
+		}
+	}()
+	return relay
+}
+
+func (r *SlowRelay) serve(conn net.Conn) {
+	defer conn.Close()
+	decoder := json.NewDecoder(conn)
+	var writeMutex sync.Mutex
+	for {
+		var request struct {
+			ID     uint64          `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if decoder.Decode(&request) != nil {
+			return
+		}
+		atomic.AddInt32(&r.calls, 1)
+		r.mutex.Lock()
+		r.methods = append(r.methods, request.Method)
+		r.params[request.Method] = request.Params
+		result, answered := r.results[request.Method]
+		r.mutex.Unlock()
+		switch {
+		case answered:
+		case request.Method == "ServerRPCMethods.Capabilities":
+			result = "0"
+		case request.Method == "ServerRPCMethods.Status":
+			result = `{"NGames":3,"MaxGames":4,"Region":"eu"}`
+		default:
+			result = "true"
+		}
+		go func(id uint64) {
+			time.Sleep(r.delay)
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+			fmt.Fprintf(conn, "{\"id\":%d,\"result\":%v,\"error\":null}\n", id, result)
+		}(request.ID)
+	}
+}
+
+func (r *SlowRelay) Calls() int {
+	return int(atomic.LoadInt32(&r.calls))
+}
+
+// Makes the relay answer calls of the method with the given JSON
+func (r *SlowRelay) Answer(method, result string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.results["ServerRPCMethods."+method] = result
+}
+
+// Returns the parameters of the last call of the method
+func (r *SlowRelay) Params(method string) json.RawMessage {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.params["ServerRPCMethods."+method]
+}
+
+func (r *SlowRelay) Methods() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.methods...)
+}
+
+func (s *ClientRPCSuite) TestRefreshDoesNotLoseRunningCalls(c *C) {
+	relay := NewSlowRelay(c, 200*time.Millisecond)
+	defer relay.ln.Close()
+	client := newClientRPC(relay.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(client.connect(), IsNil)
+	result := make(chan bool)
+	go func() { result <- client.RemoveGame("game") }()
+	time.Sleep(50 * time.Millisecond)
+	old := client.currentRelay()
+	c.Assert(client.Refresh(), IsNil)
+	c.Assert(client.currentRelay() == old, Equals, false)
+	c.Assert(<-result, Equals, true)
+	// Capabilities on both connections and the call, which has not been repeated
+	c.Assert(relay.Calls(), Equals, 3)
+	client.CloseConnection()
+}
+
+func (s *ClientRPCSuite) TestReconnectMovesRunningCallsToTheNewRelay(c *C) {
+	old := NewSlowRelay(c, 200*time.Millisecond)
+	defer old.ln.Close()
+	moved := NewSlowRelay(c, 0)
+	defer moved.ln.Close()
+	client := newClientRPC(old.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(client.connect(), IsNil)
+	defer client.CloseConnection()
+
+	// An unreachable relay keeps the old connection
+	down := NewSlowRelay(c, 0)
+	down.ln.Close()
+	connection := client.currentRelay()
+	c.Assert(client.Reconnect(down.ln.Addr().String()), NotNil)
+	c.Assert(client.currentRelay() == connection, Equals, true)
+	c.Assert(client.relayAddr, Equals, old.ln.Addr().String())
+
+	result := make(chan bool)
+	go func() { result <- client.RemoveGame("game") }()
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(client.Reconnect(moved.ln.Addr().String()), IsNil)
+	c.Assert(<-result, Equals, true)
+	c.Assert(client.relayAddr, Equals, moved.ln.Addr().String())
+	c.Assert(client.ConnectionState().Connected, Equals, true)
+	// The call has been repeated on the new relay
+	c.Assert(moved.Methods(), DeepEquals, []string{"ServerRPCMethods.Capabilities", "ServerRPCMethods.RemoveGame"})
+	c.Assert(client.CreateGameErr(GameData{Name: "new", Password: "secret"}), IsNil)
+	c.Assert(moved.Methods()[2], Equals, "ServerRPCMethods.NewGame")
+}
+
+// Run with -race to catch unsynchronized access to the capabilities
+func (s *ClientRPCSuite) TestCapabilitiesCanBeReadWhileRefreshing(c *C) {
+	relay := NewSlowRelay(c, 0)
+	defer relay.ln.Close()
+	relay.Answer("Capabilities", fmt.Sprintf("%d", CapabilityUDP))
+	relay.Answer("GetGame", `{"Name":"game"}`)
+	client := newClientRPC(relay.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(client.connect(), IsNil)
+	defer client.CloseConnection()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			c.Check(client.Refresh(), IsNil)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		instruction, err := client.BuildJoinInstruction("game")
+		c.Assert(err, IsNil)
+		c.Assert(instruction.Capabilities, Equals, CapabilityUDP)
+	}
+	<-done
+	c.Assert(client.currentCapabilities(), Equals, CapabilityUDP)
+}
+
+func (s *ClientRPCSuite) TestFailoverToStandbyRelay(c *C) {
+	primary := NewSlowRelay(c, 0)
+	standby := NewSlowRelay(c, 0)
+	defer standby.ln.Close()
+	failovers := make(chan Failover, 1)
+	client := newClientRPC(primary.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(client.connect(), IsNil)
+	client.addStandby(standby.ln.Addr().String(), ClientRPCOptions{OnFailover: func(f Failover) { failovers <- f }})
+	defer client.CloseConnection()
+	c.Assert(client.CreateGameErr(GameData{Name: "kept", Password: "secret"}), IsNil)
+	c.Assert(client.CreateGameErr(GameData{Name: "removed", Password: "secret"}), IsNil)
+	c.Assert(client.RemoveGame("removed"), Equals, true)
+
+	// The primary dies
+	primary.ln.Close()
+	client.currentRelay().Close()
+	c.Assert(client.RemoveGame("other"), Equals, true)
+	failover := <-failovers
+	c.Assert(failover.From, Equals, primary.ln.Addr().String())
+	c.Assert(failover.To, Equals, standby.ln.Addr().String())
+	c.Assert(failover.Cause, NotNil)
+	c.Assert(failover.Replayed, DeepEquals, []string{"kept"})
+	c.Assert(failover.Failed, HasLen, 0)
+	c.Assert(standby.Methods(), DeepEquals, []string{
+		"ServerRPCMethods.Capabilities", "ServerRPCMethods.NewGame", "ServerRPCMethods.RemoveGame"})
+	// The primary is the standby now
+	c.Assert(client.standby.relayAddr, Equals, primary.ln.Addr().String())
+}
+
+func (s *ClientRPCSuite) TestClockSkewIsEstimatedAndApplied(c *C) {
+	relay := NewSlowRelay(c, 0)
+	defer relay.ln.Close()
+	relay.Answer("Ping", fmt.Sprintf(`{"Now":%q}`, time.Now().Add(time.Hour).Format(time.RFC3339Nano)))
+	client := newClientRPC(relay.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(client.connect(), IsNil)
+	defer client.CloseConnection()
+	_, known := client.ClockSkew()
+	c.Assert(known, Equals, false)
+
+	// Pings the relay first since the skew is not known yet
+	at := time.Now().Add(10 * time.Minute)
+	c.Assert(client.ScheduleMaintenance("restart", at), IsNil)
+	skew, known := client.ClockSkew()
+	c.Assert(known, Equals, true)
+	c.Assert(skew > 59*time.Minute && skew <= time.Hour, Equals, true)
+	var params []MaintenanceRequest
+	c.Assert(json.Unmarshal(relay.Params("ScheduleMaintenance"), &params), IsNil)
+	c.Assert(params[0].At.Sub(at), Equals, skew)
+
+	c.Assert(estimateClockSkew(at, at.Add(2*time.Second), at.Add(-time.Minute)), Equals, -time.Minute-time.Second)
+}
+
+func (s *ClientRPCSuite) TestCreateGameAndAwaitHost(c *C) {
+	relay := NewSlowRelay(c, 0)
+	defer relay.ln.Close()
+	client := newClientRPC(relay.ln.Addr().String(), ClientRPCOptions{})
+	client.waiters = newHostWaiters()
+	c.Assert(client.connect(), IsNil)
+	recorder := &RecordingCallback{}
+	callback := &notifyingCallback{recorder, client.waiters}
+	// Calls the notification once the relay has been asked to create the game
+	await := func(name string, ctx context.Context, notify func()) error {
+		calls := relay.Calls()
+		result := make(chan error, 1)
+		go func() { result <- client.CreateGameAndAwaitHost(ctx, name, "secret") }()
+		if notify != nil {
+			for relay.Calls() == calls {
+				time.Sleep(time.Millisecond)
+			}
+			notify()
+		}
+		return <-result
+	}
+
+	c.Assert(await("connected", context.Background(), func() { callback.GameConnected("connected") }), IsNil)
+	c.Assert(await("closed", context.Background(), func() { callback.GameClosed("closed", CloseReasonNoHost) }), Equals, errGameClosedBeforeConnected)
+	// The notifications are passed on
+	c.Assert(recorder.Events(), DeepEquals, []string{"GameConnected connected", "GameClosed closed 'NoHost'"})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c.Assert(await("timeout", ctx, nil), Equals, context.DeadlineExceeded)
+	relay.Answer("NewGame", "false")
+	c.Assert(await("refused", context.Background(), nil), Equals, errCreateGameFailed)
+	// Nobody waits anymore
+	c.Assert(client.waiters.waiting, HasLen, 0)
+}
+
+func (s *ClientRPCSuite) TestPoolGetGameReportsRemainingLifetime(c *C) {
+	relay := NewSlowRelay(c, 0)
+	defer relay.ln.Close()
+	relay.Answer("GetGame", fmt.Sprintf(`{"Name":"aging","RemainingLifetime":%d}`, int64(time.Minute)))
+	client := newClientRPC(relay.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(client.connect(), IsNil)
+	pool := &RelayPool{relays: []*ClientRPC{client}, games: map[string]*ClientRPC{"aging": client}}
+
+	game, err := pool.GetGame("aging")
+	c.Assert(err, IsNil)
+	c.Assert(game.RemainingLifetime, Equals, time.Minute)
+	_, err = pool.GetGame("unknown")
+	c.Assert(err, Equals, ErrGameNotFound)
+}
+
+func (s *ClientRPCSuite) TestBuildJoinInstruction(c *C) {
+	relay := NewSlowRelay(c, 0)
+	defer relay.ln.Close()
+	relay.Answer("Capabilities", fmt.Sprintf("%d", CapabilityReconnect|CapabilityUDP))
+	relay.Answer("GetGame", `{"Name":"joinable"}`)
+	relay.Answer("Status", `{"PublicAddress":"relay.example.org","GamePort":7397,"ProtocolVersion":5}`)
+	client := newClientRPC(relay.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(client.connect(), IsNil)
+	pool := &RelayPool{relays: []*ClientRPC{client}, games: map[string]*ClientRPC{"joinable": client}}
+
+	instruction, err := pool.BuildJoinInstruction("joinable")
+	c.Assert(err, IsNil)
+	c.Assert(instruction, DeepEquals, JoinInstruction{
+		Address:         "relay.example.org",
+		Port:            7397,
+		GameName:        "joinable",
+		ProtocolVersion: 5,
+		Capabilities:    CapabilityReconnect | CapabilityUDP,
+	})
+	// The relay is not asked about games which are not known to be on it
+	calls := relay.Calls()
+	_, err = pool.BuildJoinInstruction("unknown")
+	c.Assert(err, Equals, ErrGameNotFound)
+	c.Assert(relay.Calls(), Equals, calls)
+}
+
+func (s *ClientRPCSuite) TestPoolSupportsProtocolsOfAllRelays(c *C) {
+	var relays []*ClientRPC
+	for _, versions := range []string{"[3,4,5]", "[4,5,6]", "[2,5,4]"} {
+		relay := NewSlowRelay(c, 0)
+		defer relay.ln.Close()
+		relay.Answer("SupportedProtocols", versions)
+		client := newClientRPC(relay.ln.Addr().String(), ClientRPCOptions{})
+		c.Assert(client.connect(), IsNil)
+		relays = append(relays, client)
+	}
+	pool := &RelayPool{relays: relays}
+	versions, err := pool.SupportedProtocols()
+	c.Assert(err, IsNil)
+	// In the order of the first relay
+	c.Assert(versions, DeepEquals, []int{4, 5})
+
+	// Unknown if a relay can not be asked
+	down := NewSlowRelay(c, 0)
+	unreachable := newClientRPC(down.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(unreachable.connect(), IsNil)
+	down.ln.Close()
+	unreachable.currentRelay().Close()
+	pool = &RelayPool{relays: append(relays, unreachable)}
+	_, err = pool.SupportedProtocols()
+	c.Assert(err, NotNil)
+}
+
+func (s *ClientRPCSuite) TestPoolTrafficRateSumsReachableRelays(c *C) {
+	first := NewSlowRelay(c, 0)
+	defer first.ln.Close()
+	first.Answer("TrafficRate", "1000.5")
+	second := NewSlowRelay(c, 0)
+	defer second.ln.Close()
+	second.Answer("TrafficRate", "500")
+	down := NewSlowRelay(c, 0)
+	var relays []*ClientRPC
+	for _, relay := range []*SlowRelay{first, second, down} {
+		client := newClientRPC(relay.ln.Addr().String(), ClientRPCOptions{})
+		c.Assert(client.connect(), IsNil)
+		relays = append(relays, client)
+	}
+	down.ln.Close()
+	relays[2].currentRelay().Close()
+
+	pool := &RelayPool{relays: relays}
+	rate, err := pool.TrafficRate(time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(rate, Equals, 1500.5)
+	var request TrafficRequest
+	c.Assert(json.Unmarshal(first.Params("TrafficRate"), &[]interface{}{&request}), IsNil)
+	c.Assert(request.Window, Equals, time.Minute)
+
+	// Fails only if no relay is reachable
+	pool = &RelayPool{relays: relays[2:]}
+	_, err = pool.TrafficRate(time.Minute)
+	c.Assert(err, NotNil)
+}
+
+func (s *ClientRPCSuite) TestPoolStatusReportsUnreachableRelayAsUnhealthy(c *C) {
+	up := NewSlowRelay(c, 0)
+	defer up.ln.Close()
+	down := NewSlowRelay(c, 0)
+	healthy := newClientRPC(up.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(healthy.connect(), IsNil)
+	unreachable := newClientRPC(down.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(unreachable.connect(), IsNil)
+	down.ln.Close()
+	unreachable.currentRelay().Close()
+	pool := &RelayPool{
+		relays:    []*ClientRPC{healthy, unreachable},
+		unhealthy: make(map[*ClientRPC]error),
+	}
+
+	members := pool.PoolStatus()
+	c.Assert(members, HasLen, 2)
+	c.Assert(members[0].Healthy, Equals, true)
+	c.Assert(members[0].Region, Equals, "eu")
+	c.Assert(members[0].Games, Equals, 3)
+	c.Assert(members[0].Load, Equals, 0.75)
+	c.Assert(members[1].Healthy, Equals, false)
+	c.Assert(members[1].Err, NotNil)
+	c.Assert(pool.unhealthy[unreachable], Equals, members[1].Err)
+}
+
+func (s *ClientRPCSuite) TestFailedPoolSubscriptionIsRolledBack(c *C) {
+	up := NewSlowRelay(c, 0)
+	defer up.ln.Close()
+	down := NewSlowRelay(c, 0)
+	reachable := newClientRPC(up.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(reachable.connect(), IsNil)
+	unreachable := newClientRPC(down.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(unreachable.connect(), IsNil)
+	down.ln.Close()
+	unreachable.currentRelay().Close()
+	pool := &RelayPool{
+		relays:      []*ClientRPC{reachable, unreachable},
+		subscribers: newEventSubscribers(),
+	}
+
+	_, err := pool.Subscribe(func(Event) {})
+	c.Assert(err, NotNil)
+	// The reachable relay no longer sends events and the next subscription turns them on again
+	c.Assert(up.Methods(), DeepEquals, []string{"ServerRPCMethods.Capabilities", "ServerRPCMethods.Subscribe", "ServerRPCMethods.Subscribe"})
+	var request SubscriptionRequest
+	c.Assert(json.Unmarshal(up.Params("Subscribe"), &[]interface{}{&request}), IsNil)
+	c.Assert(request.Subscribe, Equals, false)
+	_, first := pool.subscribers.add(func(Event) {})
+	c.Assert(first, Equals, true)
+}
+
+func (s *ClientRPCSuite) TestRelayWeightsShareNewGames(c *C) {
+	stable := NewSlowRelay(c, 0)
+	defer stable.ln.Close()
+	canary := NewSlowRelay(c, 0)
+	defer canary.ln.Close()
+	first := newClientRPC(stable.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(first.connect(), IsNil)
+	second := newClientRPC(canary.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(second.connect(), IsNil)
+	pool := &RelayPool{
+		relays:    []*ClientRPC{first, second},
+		games:     make(map[string]*ClientRPC),
+		reserved:  make(map[string]poolReservation),
+		unhealthy: make(map[*ClientRPC]error),
+	}
+	c.Assert(pool.SetRelayWeight("unknown:7398", 5), NotNil)
+	c.Assert(pool.SetRelayWeight(canary.ln.Addr().String(), -1), NotNil)
+
+	c.Assert(pool.SetRelayWeight(canary.ln.Addr().String(), 0), IsNil)
+	for i := 0; i < 3; i++ {
+		c.Assert(pool.TryCreateGame(GameData{Name: fmt.Sprint("game", i)}, "", 0), IsNil)
+	}
+	for _, relay := range pool.games {
+		c.Assert(relay, Equals, first)
+	}
+	c.Assert(pool.PoolStatus()[1].Weight, Equals, 0)
+
+	// 5 of 105 games go to a relay with weight 5 next to one with the default weight
+	games := []int{0, 0}
+	for i := 0; i < 1050; i++ {
+		if lessLoaded(games[1], 5, games[0], DefaultRelayWeight) {
+			games[1]++
+		} else {
+			games[0]++
+		}
+	}
+	c.Assert(games[1], Equals, 50)
+}
+
+func (s *ClientRPCSuite) TestPoolIsNotBlockedWhileCreatingAGame(c *C) {
+	relay := NewSlowRelay(c, 200*time.Millisecond)
+	defer relay.ln.Close()
+	client := newClientRPC(relay.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(client.connect(), IsNil)
+	defer client.CloseConnection()
+	pool := &RelayPool{
+		relays:    []*ClientRPC{client},
+		games:     make(map[string]*ClientRPC),
+		reserved:  make(map[string]poolReservation),
+		unhealthy: make(map[*ClientRPC]error),
+	}
+	created := make(chan error)
+	go func() { created <- pool.TryCreateGame(GameData{Name: "slow"}, "", 0) }()
+	for !strings.HasSuffix(strings.Join(relay.Methods(), " "), "ServerRPCMethods.Status") {
+		time.Sleep(time.Millisecond)
+	}
+	// The relay did not answer yet, but the pool is usable
+	start := time.Now()
+	c.Assert(pool.RemoveGame("unknown"), Equals, false)
+	c.Assert(pool.TryCreateGame(GameData{Name: "slow"}, "", 0), Equals, ErrGameExists)
+	c.Assert(time.Since(start) < 100*time.Millisecond, Equals, true)
+	c.Assert(<-created, IsNil)
+	c.Assert(pool.games["slow"], Equals, client)
+}
+
+func (s *ClientRPCSuite) TestPingProbesEveryRelayOfThePool(c *C) {
+	healthy := NewSlowRelay(c, 0)
+	defer healthy.ln.Close()
+	healthy.Answer("Ping", "{}")
+	recovered := NewSlowRelay(c, 0)
+	defer recovered.ln.Close()
+	recovered.Answer("Ping", "{}")
+	down := NewSlowRelay(c, 0)
+	var relays []*ClientRPC
+	for _, relay := range []*SlowRelay{healthy, recovered, down} {
+		client := newClientRPC(relay.ln.Addr().String(), ClientRPCOptions{})
+		c.Assert(client.connect(), IsNil)
+		relays = append(relays, client)
+	}
+	down.ln.Close()
+	relays[2].currentRelay().Close()
+	pool := &RelayPool{
+		relays:    relays,
+		games:     make(map[string]*ClientRPC),
+		reserved:  make(map[string]poolReservation),
+		unhealthy: map[*ClientRPC]error{relays[1]: errors.New("old"), relays[2]: errors.New("old")},
+	}
+
+	// The relays after the first healthy one are pinged, too
+	c.Assert(pool.Ping(), IsNil)
+	_, marked := pool.unhealthy[relays[1]]
+	c.Assert(marked, Equals, false)
+	c.Assert(pool.unhealthy[relays[2]], NotNil)
+	c.Assert(pool.unhealthy[relays[2]].Error(), Not(Equals), "old")
+
+	// Fails only if no relay answers
+	pool.relays = relays[2:]
+	c.Assert(pool.Ping(), NotNil)
+}
+
+func (s *ClientRPCSuite) TestGamesOfAnOwnerStayOnTheirRelay(c *C) {
+	old := NewSlowRelay(c, 0)
+	defer old.ln.Close()
+	other := NewSlowRelay(c, 0)
+	defer other.ln.Close()
+	first := newClientRPC(old.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(first.connect(), IsNil)
+	second := newClientRPC(other.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(second.connect(), IsNil)
+	pool := &RelayPool{
+		relays:              []*ClientRPC{first, second},
+		games:               make(map[string]*ClientRPC),
+		reserved:            make(map[string]poolReservation),
+		unhealthy:           make(map[*ClientRPC]error),
+		affinityGracePeriod: time.Hour,
+	}
+	c.Assert(pool.TryCreateGame(GameData{Name: "old", OwnerID: "host"}, "", 0), IsNil)
+	c.Assert(pool.games["old"], Equals, first)
+	// New games go to the other relay from now on, but not those of the owner
+	c.Assert(pool.SetRelayWeight(old.ln.Addr().String(), 1), IsNil)
+	c.Assert(pool.TryCreateGame(GameData{Name: "new", OwnerID: "someone"}, "", 0), IsNil)
+	c.Assert(pool.games["new"], Equals, second)
+
+	// The host left and comes back within the grace period
+	(&poolCallback{pool, callbackOrIgnore(nil)}).GameClosed("old", CloseReasonNoHost)
+	c.Assert(pool.TryCreateGame(GameData{Name: "again", OwnerID: "host"}, "", 0), IsNil)
+	c.Assert(pool.games["again"], Equals, first)
+
+	(&poolCallback{pool, callbackOrIgnore(nil)}).GameClosed("again", CloseReasonNormal)
+	pool.affinities["host"].expires = time.Now().Add(-time.Second)
+	c.Assert(pool.TryCreateGame(GameData{Name: "later", OwnerID: "host"}, "", 0), IsNil)
+	c.Assert(pool.games["later"], Equals, second)
+}
+
+func (s *ClientRPCSuite) TestPoolGetsGamesWithOneCallPerRelay(c *C) {
+	east := NewSlowRelay(c, 0)
+	defer east.ln.Close()
+	west := NewSlowRelay(c, 0)
+	defer west.ln.Close()
+	first := newClientRPC(east.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(first.connect(), IsNil)
+	second := newClientRPC(west.ln.Addr().String(), ClientRPCOptions{})
+	c.Assert(second.connect(), IsNil)
+	pool := &RelayPool{
+		relays: []*ClientRPC{first, second},
+		games:  map[string]*ClientRPC{"a": first, "b": first, "c": second},
+	}
+	east.Answer("GetGames", `{"a":{"Name":"a","Public":true},"b":{"Name":"b"}}`)
+	// The game closed meanwhile
+	west.Answer("GetGames", `{}`)
+
+	games, err := pool.GetGames([]string{"a", "b", "c", "unknown"})
+	c.Assert(err, IsNil)
+	c.Assert(games, DeepEquals, map[string]GameData{"a": {Name: "a", Public: true}, "b": {Name: "b"}})
+	var asked GameNames
+	c.Assert(json.Unmarshal(west.Params("GetGames"), &[]interface{}{&asked}), IsNil)
+	c.Assert(asked.Names, DeepEquals, []string{"c"})
+}
+
+func (s *ClientRPCSuite) TestOversizedStatusIsTruncated(c *C) {
+	status := ServerStatus{NGames: 2, Region: "eu", PublicAddress: strings.Repeat("x", 200)}
+	c.Assert(limitStatusSize(status, 0), DeepEquals, status)
+	truncated := limitStatusSize(status, 100)
+	c.Assert(truncated.Truncated, Equals, true)
+	c.Assert(truncated.NGames, Equals, 2)
+	c.Assert(truncated.PublicAddress, Equals, "")
+	c.Assert(truncated.Hint, Not(Equals), "")
+}
+
+func (s *ClientRPCSuite) TestPageOfGames(c *C) {
+	games := []GameData{{Name: "c"}, {Name: "a"}, {Name: "b"}}
+	page, total := pageOfGames(games, 1, 1)
+	c.Assert(total, Equals, 3)
+	c.Assert(page, DeepEquals, []GameData{{Name: "b"}})
+	page, _ = pageOfGames(games, 5, 1)
+	c.Assert(page, HasLen, 0)
+}
+
+// RecordingTracer remembers the spans it started.
+type RecordingTracer struct {
+	mutex sync.Mutex
+	spans []*RecordingSpan
+}
+
+type RecordingSpan struct {
+	name string
+	// Only set by PropagatingTracer
+	parent     string
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+func (t *RecordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	span := &RecordingSpan{name: name, attributes: make(map[string]interface{})}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+func (s *RecordingSpan) SetAttribute(key string, value interface{}) {
+	s.attributes[key] = value
+}
+
+func (s *RecordingSpan) End(err error) {
+	s.err = err
+	s.ended = true
+}
+
+func (s *ClientRPCSuite) TestCallsAreTraced(c *C) {
+	relay := NewBreakingRelay(c)
+	defer relay.ln.Close()
+	tracer := &RecordingTracer{}
+	client := &ClientRPC{relayAddr: relay.ln.Addr().String(), retries: RetryBudgets{Idempotent: 3}, tracer: tracer}
+	c.Assert(client.connect(), IsNil)
+	c.Assert(client.RemoveGame("game"), Equals, false)
+	c.Assert(tracer.spans, HasLen, 1)
+	span := tracer.spans[0]
+	c.Assert(span.name, Equals, "relay.RemoveGame")
+	c.Assert(span.ended, Equals, true)
+	c.Assert(span.err, NotNil)
+	c.Assert(span.attributes[SpanAttributeGame], Equals, "game")
+	c.Assert(span.attributes[SpanAttributeRelay], Equals, relay.ln.Addr().String())
+	c.Assert(span.attributes[SpanAttributeAttempts], Equals, 3)
+	c.Assert(span.attributes[SpanAttributeOutcome], Equals, "error")
+}
+
+type traceKey struct{}
+
+// Propagates the name of the current span as trace context
+type PropagatingTracer struct {
+	RecordingTracer
+}
+
+func (t *PropagatingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	ctx, span := t.RecordingTracer.Start(ctx, name)
+	span.(*RecordingSpan).parent = t.Inject(ctx)
+	return context.WithValue(ctx, traceKey{}, name), span
+}
+
+func (t *PropagatingTracer) Inject(ctx context.Context) string {
+	name, _ := ctx.Value(traceKey{}).(string)
+	return name
+}
+
+func (t *PropagatingTracer) Extract(ctx context.Context, traceParent string) context.Context {
+	return context.WithValue(ctx, traceKey{}, traceParent)
+}
+
+// Removes every game, the other methods are not implemented
+type RemovingCallback struct {
+	ServerCallback
+}
+
+func (r *RemovingCallback) RemoveGame(name string) bool {
+	return true
+}
+
+func (s *ClientRPCSuite) TestTraceIsContinuedByTheRelay(c *C) {
+	relay := NewSlowRelay(c, 0)
+	defer relay.ln.Close()
+	tracer := &PropagatingTracer{}
+	client := newClientRPC(relay.ln.Addr().String(), ClientRPCOptions{Tracer: tracer})
+	c.Assert(client.connect(), IsNil)
+	defer client.CloseConnection()
+	c.Assert(client.RemoveGame("game"), Equals, true)
+	var params []GameData
+	c.Assert(json.Unmarshal(relay.Params("RemoveGame"), &params), IsNil)
+	c.Assert(params, HasLen, 1)
+	c.Assert(params[0].TraceParent, Equals, "relay.RemoveGame")
+
+	relayTracer := &PropagatingTracer{}
+	methods := &ServerRPCMethods{server: &ServerRPC{callback: &RemovingCallback{}, tracer: relayTracer}}
+	var success bool
+	c.Assert(methods.RemoveGame(&params[0], &success), IsNil)
+	c.Assert(relayTracer.spans, HasLen, 1)
+	span := relayTracer.spans[0]
+	c.Assert(span.name, Equals, "relay.server.RemoveGame")
+	c.Assert(span.parent, Equals, "relay.RemoveGame")
+	c.Assert(span.ended, Equals, true)
+	c.Assert(span.attributes[SpanAttributeGame], Equals, "game")
+	c.Assert(span.attributes[SpanAttributeOutcome], Equals, "ok")
+}
+
+func (s *ClientRPCSuite) TestConnectionStateReportsLostRelay(c *C) {
+	relay := NewBreakingRelay(c)
+	defer relay.ln.Close()
+	client := &ClientRPC{relayAddr: relay.ln.Addr().String(), retries: RetryBudgets{Idempotent: 3}}
+	c.Assert(client.ConnectionState().Connected, Equals, false)
+	c.Assert(client.connect(), IsNil)
+	c.Assert(client.ConnectionState(), DeepEquals, ConnectionState{Connected: true})
+	c.Assert(client.RemoveGame("game"), Equals, false)
+	state := client.ConnectionState()
+	c.Assert(state.Connected, Equals, false)
+	c.Assert(state.LastError, Equals, io.ErrUnexpectedEOF)
+	c.Assert(state.AttemptsRemaining, Equals, 0)
+	c.Assert(state.NextRetryAt.IsZero(), Equals, true)
+
+	relay.ln.Close()
+	client.refreshInterval = time.Minute
+	c.Assert(client.Refresh(), NotNil)
+	state = client.ConnectionState()
+	c.Assert(state.Connected, Equals, false)
+	c.Assert(state.NextRetryAt.After(time.Now()), Equals, true)
+}
+
+func (s *ClientRPCSuite) TestAdminTokenRotation(c *C) {
+	server := &ServerRPC{adminToken: "old"}
+	methods := &ServerRPCMethods{server: server}
+	var success bool
+	c.Assert(methods.SetAuthTokens(&AuthTokensRequest{AdminToken: "guess", Current: "new"}, &success), Equals, ErrUnauthorized)
+	c.Assert(methods.SetAuthTokens(&AuthTokensRequest{AdminToken: "old"}, &success), Equals, ErrEmptyToken)
+	c.Assert(methods.SetAuthTokens(&AuthTokensRequest{AdminToken: "old", Current: "old", Next: "new"}, &success), IsNil)
+	c.Assert(server.authorize("old"), IsNil)
+	c.Assert(server.authorize("new"), IsNil)
+	c.Assert(methods.SetAuthTokens(&AuthTokensRequest{AdminToken: "new", Current: "new"}, &success), IsNil)
+	c.Assert(server.authorize("old"), Equals, ErrUnauthorized)
+	c.Assert(server.authorize("new"), IsNil)
+	c.Assert(server.authorize(""), Equals, ErrUnauthorized)
+}
+
+// blockingPublisher passes the events on to a channel, blocking until they are taken.
+type blockingPublisher struct {
+	events chan Event
+}
+
+func (p blockingPublisher) Publish(event Event) error {
+	p.events <- event
+	return nil
+}
+
+func (s *ClientRPCSuite) TestSlowEventPublishersDoNotBlockTheRelay(c *C) {
+	server := &ServerRPC{callbacks: make(chan pendingCallback, 4), requestIDs: make(map[string]string)}
+	publisher := blockingPublisher{make(chan Event)}
+	server.publishers = server.newPublishers(ServerRPCOptions{EventPublishers: []EventPublisher{publisher}, EventQueueSize: 1})
+
+	server.PublishEvent(Event{Type: EventGameCreated, Game: "first"})
+	first := <-publisher.events
+	c.Assert(first.Game, Equals, "first")
+	c.Assert(first.Time.IsZero(), Equals, false)
+	// The publisher hangs on the second event, the third waits and the fourth is dropped
+	server.PublishEvent(Event{Type: EventGameCreated, Game: "second"})
+	queued := server.publishers[1].(*queuedPublisher)
+	for len(queued.events) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, game := range []string{"third", "fourth"} {
+		server.PublishEvent(Event{Type: EventGameCreated, Game: game})
+	}
+	c.Assert(atomic.LoadInt32(&queued.dropping), Equals, int32(1))
+	// The metaserver did not subscribe
+	c.Assert(server.callbacks, HasLen, 0)
+	atomic.StoreInt32(&server.subscribed, 1)
+	server.PublishEvent(Event{Type: EventGameClosed, Game: "fifth"})
+	c.Assert(server.callbacks, HasLen, 1)
+
+	var games []string
+	for i := 0; i < 2; i++ {
+		games = append(games, (<-publisher.events).Game)
+	}
+	c.Assert(games, DeepEquals, []string{"second", "third"})
+}
+
+func (s *ClientRPCSuite) TestEventPublishersStopWhenClosed(c *C) {
+	server := &ServerRPC{callbacks: make(chan pendingCallback, 4), requestIDs: make(map[string]string)}
+	publisher := blockingPublisher{make(chan Event)}
+	server.publishers = server.newPublishers(ServerRPCOptions{EventPublishers: []EventPublisher{publisher}, EventQueueSize: 1})
+	queued := server.publishers[1].(*queuedPublisher)
+
+	// The publisher hangs on the first event while the second waits in the queue
+	c.Assert(queued.Publish(Event{Type: EventGameCreated, Game: "first"}), IsNil)
+	for len(queued.events) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(queued.Publish(Event{Type: EventGameCreated, Game: "second"}), IsNil)
+	server.closePublishers()
+	server.closePublishers()
+	c.Assert(queued.Publish(Event{Type: EventGameCreated, Game: "third"}), Equals, errPublisherClosed)
+
+	// The event being published is finished, the queued one is dropped
+	c.Assert((<-publisher.events).Game, Equals, "first")
+	select {
+	case event := <-publisher.events:
+		c.Fatalf("Published %v after closing", event.Game)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Answers the notifications of a relay as the metaserver would. Each call waits
+// for a value of gate if it is not nil. Notifications for a game called "fail" fail
+type NotificationRecorder struct {
+	calls chan GameData
+	gate  chan struct{}
+}
+
+func (r *NotificationRecorder) GameConnected(in *GameData, response *bool) error {
+	if r.gate != nil {
+		<-r.gate
+	}
+	r.calls <- *in
+	if in.Name == "fail" {
+		return errors.New("refused")
+	}
+	return nil
+}
+
+// Creates a ServerRPC connected to the recorder, without sending its notifications yet
+func newRecordedServerRPC(recorder *NotificationRecorder, queueSize int, overflow CallbackOverflowPolicy) *ServerRPC {
+	methods := rpc.NewServer()
+	methods.RegisterName("ClientRPCMethods", recorder)
+	ours, theirs := net.Pipe()
+	go methods.ServeCodec(jsonrpc.NewServerCodec(theirs))
+	return &ServerRPC{
+		client:     jsonrpc.NewClient(ours),
+		callbacks:  make(chan pendingCallback, queueSize),
+		overflow:   overflow,
+		requestIDs: make(map[string]string),
+	}
+}
+
+// Returns the names of the games of the queued notifications
+func queuedGames(server *ServerRPC) []string {
+	var games []string
+	for len(server.callbacks) > 0 {
+		games = append(games, (<-server.callbacks).gameName)
+	}
+	return games
+}
+
+func (s *ClientRPCSuite) TestCallbackOverflowPolicies(c *C) {
+	oldest := newRecordedServerRPC(nil, 2, CallbackOverflowDropOldest)
+	flag := newRecordedServerRPC(nil, 2, CallbackOverflowDropAndFlag)
+	for _, game := range []string{"first", "second", "third"} {
+		oldest.GameConnected(game)
+		flag.GameConnected(game)
+	}
+	c.Assert(oldest.takeDroppedEvents(), Equals, true)
+	c.Assert(queuedGames(oldest), DeepEquals, []string{"second", "third"})
+	c.Assert(flag.takeDroppedEvents(), Equals, true)
+	c.Assert(queuedGames(flag), DeepEquals, []string{"first", "second"})
+
+	block := newRecordedServerRPC(nil, 2, CallbackOverflowBlock)
+	block.GameConnected("first")
+	block.GameConnected("second")
+	queued := make(chan bool)
+	go func() {
+		block.GameConnected("third")
+		queued <- true
+	}()
+	select {
+	case <-queued:
+		c.Fatal("Queued a notification although the queue is full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.Assert((<-block.callbacks).gameName, Equals, "first")
+	<-queued
+	c.Assert(block.takeDroppedEvents(), Equals, false)
+	c.Assert(queuedGames(block), DeepEquals, []string{"second", "third"})
+}
+
+func (s *ClientRPCSuite) TestDropsWhileSendingAreReported(c *C) {
+	recorder := &NotificationRecorder{calls: make(chan GameData), gate: make(chan struct{})}
+	server := newRecordedServerRPC(recorder, 1, CallbackOverflowDropAndFlag)
+	go server.sendCallbacks()
+	server.setEventsDropped(true)
+	server.GameConnected("first")
+	// Wait until first is being send, then drop the third while it is
+	recorder.gate <- struct{}{}
+	for len(server.callbacks) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	server.GameConnected("second")
+	server.GameConnected("third")
+	first := <-recorder.calls
+	c.Assert(first.Name, Equals, "first")
+	c.Assert(first.EventsDropped, Equals, true)
+	recorder.gate <- struct{}{}
+	second := <-recorder.calls
+	c.Assert(second.Name, Equals, "second")
+	c.Assert(second.EventsDropped, Equals, true)
+
+	// A failed notification does not clear the flag
+	server.setEventsDropped(true)
+	server.GameConnected("fail")
+	recorder.gate <- struct{}{}
+	c.Assert((<-recorder.calls).EventsDropped, Equals, true)
+	server.GameConnected("last")
+	recorder.gate <- struct{}{}
+	last := <-recorder.calls
+	c.Assert(last.Name, Equals, "last")
+	c.Assert(last.EventsDropped, Equals, true)
+	close(server.callbacks)
+}
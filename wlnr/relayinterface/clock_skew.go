@@ -0,0 +1,59 @@
+package relayinterface
+
+import (
+	"time"
+)
+
+// How far the clock of a relay may be off before a warning is logged, if
+// ClientRPCOptions.MaxClockSkew is not set
+const DefaultMaxClockSkew = 2 * time.Second
+
+// Estimates how far the clock of the relay is ahead of ours from a call sent
+// and answered at the given times of our clock, assuming that the relay read
+// its clock halfway in between
+func estimateClockSkew(sent, received, relayNow time.Time) time.Duration {
+	return relayNow.Sub(sent.Add(received.Sub(sent) / 2))
+}
+
+// Remembers the clock of the relay as reported in the answer to a Ping.
+// Relays too old to report it are ignored. Warns when the skew grows beyond
+// the maximum and when it is back within it
+func (client *ClientRPC) noteClockSkew(sent, received, relayNow time.Time) {
+	if relayNow.IsZero() {
+		return
+	}
+	skew := estimateClockSkew(sent, received, relayNow)
+	previous, known := client.ClockSkew()
+	client.skew.Store(skew)
+	max := client.maxClockSkew
+	if max <= 0 {
+		max = DefaultMaxClockSkew
+	}
+	tooLarge := func(d time.Duration) bool { return d > max || d < -max }
+	if tooLarge(skew) && (!known || !tooLarge(previous)) {
+		RPCLog.Warnf("ClientRPC: Clock of relay at %v is off by %v, check the time synchronization of both hosts", client.relayAddr, skew)
+	} else if known && tooLarge(previous) && !tooLarge(skew) {
+		RPCLog.Infof("ClientRPC: Clock of relay at %v is only off by %v now", client.relayAddr, skew)
+	}
+}
+
+// ClockSkew returns how far the clock of the relay is ahead of ours, negative
+// if it is behind, as estimated by the last Ping or Health. known is false if
+// the relay has not been pinged yet or is too old to report its clock.
+func (client *ClientRPC) ClockSkew() (skew time.Duration, known bool) {
+	skew, known = client.skew.Load().(time.Duration)
+	return skew, known
+}
+
+// Converts the time of our clock to the one of the relay. Pings the relay first
+// if the skew is not known yet, and leaves the time as it is if that fails
+func (client *ClientRPC) relayTime(t time.Time) time.Time {
+	skew, known := client.ClockSkew()
+	if !known {
+		if client.Ping() != nil {
+			return t
+		}
+		skew, _ = client.ClockSkew()
+	}
+	return t.Add(skew)
+}
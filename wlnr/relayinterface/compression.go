@@ -0,0 +1,148 @@
+package relayinterface
+
+import (
+	"bufio"
+	"compress/flate"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"time"
+)
+
+// Send as first byte by the side opening a connection if it wants to compress it.
+// Since plain jsonrpc starts with '{', the other side can tell both cases apart.
+const compressionRequest byte = 0x01
+
+// The answers to a compressionRequest
+const (
+	compressionAccepted byte = 0x01
+	compressionRefused  byte = 0x00
+)
+
+// How long to wait for the answer to a compressionRequest.
+const compressionNegotiationTimeout = 10 * time.Second
+
+// Joins the reading and writing halves of a connection.
+type rpcConn struct {
+	io.Reader
+	io.Writer
+	conn net.Conn
+}
+
+func (c *rpcConn) Close() error {
+	return c.conn.Close()
+}
+
+// Compresses everything written to it. Flushes after each write
+// since jsonrpc writes whole messages and waits for the answer.
+type flushingWriter struct {
+	w *flate.Writer
+}
+
+func (f *flushingWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, f.w.Flush()
+}
+
+// Wraps the connection so all data passing it is compressed.
+func compressConn(conn net.Conn, r io.Reader) io.ReadWriteCloser {
+	w, _ := flate.NewWriter(conn, flate.DefaultCompression)
+	return &rpcConn{
+		Reader: flate.NewReader(r),
+		Writer: &flushingWriter{w},
+		conn:   conn,
+	}
+}
+
+// Opens a connection to an rpc server.
+// If compress is set, asks the server to compress the connection. If the
+// server refuses, the connection is used uncompressed.
+func dialRPC(addr string, timeout time.Duration, compress bool) (io.ReadWriteCloser, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if !compress {
+		return conn, nil
+	}
+	answer := []byte{compressionRequest}
+	conn.SetDeadline(time.Now().Add(compressionNegotiationTimeout))
+	if _, err = conn.Write(answer); err == nil {
+		_, err = io.ReadFull(conn, answer)
+	}
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		// Probably an older server which does not know about compression
+		// and closed the connection. Try again without asking
+		conn.Close()
+		return dialRPC(addr, timeout, false)
+	}
+	if answer[0] != compressionAccepted {
+		return conn, nil
+	}
+	return compressConn(conn, conn), nil
+}
+
+// Prepares a connection accepted by an rpc server for serving.
+// If the other side asks for compression, it is used if allowed by compress.
+func acceptRPC(conn net.Conn, compress bool) (io.ReadWriteCloser, error) {
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != compressionRequest {
+		// Plain jsonrpc
+		return &rpcConn{reader, conn, conn}, nil
+	}
+	reader.ReadByte()
+	if !compress {
+		if _, err := conn.Write([]byte{compressionRefused}); err != nil {
+			return nil, err
+		}
+		return &rpcConn{reader, conn, conn}, nil
+	}
+	if _, err := conn.Write([]byte{compressionAccepted}); err != nil {
+		return nil, err
+	}
+	return compressConn(conn, reader), nil
+}
+
+// How often to check whether the other side of an idle rpc connection is still there.
+const rpcKeepAlivePeriod = 30 * time.Second
+
+// A connection which fails to read when nothing arrives for the timeout
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c idleConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+// Serves rpc requests on an accepted connection with the given rpc server until it is closed.
+// The connection is closed when the other side closes it, even if only for writing,
+// when it does not answer keep-alive probes anymore or, if idleTimeout is set, when
+// no request arrives for that long.
+func serveRPC(conn net.Conn, compress bool, server *rpc.Server, idleTimeout time.Duration) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(rpcKeepAlivePeriod)
+	}
+	if idleTimeout > 0 {
+		conn = idleConn{conn, idleTimeout}
+	}
+	rwc, err := acceptRPC(conn, compress)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	// Returns on the first read error and closes rwc
+	server.ServeCodec(jsonrpc.NewServerCodec(rwc))
+}
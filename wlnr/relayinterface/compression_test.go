@@ -0,0 +1,174 @@
+package relayinterface
+
+import (
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type CompressionSuite struct{}
+
+var _ = Suite(&CompressionSuite{})
+
+type CompressionTestService struct{}
+
+func (s *CompressionTestService) Echo(in *string, out *string) error {
+	*out = *in
+	return nil
+}
+
+func init() {
+	rpc.Register(&CompressionTestService{})
+}
+
+// Starts an rpc server on a free port. Returns its address.
+func StartRPCServer(c *C, compress bool) (net.Listener, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveRPC(conn, compress, rpc.DefaultServer, 0)
+		}
+	}()
+	return ln, ln.Addr().String()
+}
+
+func ExpectEcho(c *C, conn io.ReadWriteCloser) {
+	client := jsonrpc.NewClient(conn)
+	defer client.Close()
+	var out string
+	c.Assert(client.Call("CompressionTestService.Echo", "hello relay", &out), IsNil)
+	c.Assert(out, Equals, "hello relay")
+	c.Assert(client.Call("CompressionTestService.Echo", "hello again", &out), IsNil)
+	c.Assert(out, Equals, "hello again")
+}
+
+func (s *CompressionSuite) TestCompressedConnection(c *C) {
+	ln, addr := StartRPCServer(c, true)
+	defer ln.Close()
+	conn, err := dialRPC(addr, time.Second, true)
+	c.Assert(err, IsNil)
+	_, compressed := conn.(*rpcConn)
+	c.Assert(compressed, Equals, true)
+	ExpectEcho(c, conn)
+}
+
+func (s *CompressionSuite) TestServerRefusesCompression(c *C) {
+	ln, addr := StartRPCServer(c, false)
+	defer ln.Close()
+	conn, err := dialRPC(addr, time.Second, true)
+	c.Assert(err, IsNil)
+	ExpectEcho(c, conn)
+}
+
+func (s *CompressionSuite) TestUncompressedClient(c *C) {
+	ln, addr := StartRPCServer(c, true)
+	defer ln.Close()
+	conn, err := dialRPC(addr, time.Second, false)
+	c.Assert(err, IsNil)
+	ExpectEcho(c, conn)
+}
+
+// A connection which panics when it is read from
+type panickingConn struct {
+	net.Conn
+}
+
+func (c panickingConn) Read(p []byte) (int, error) {
+	panic("broken connection")
+}
+
+func (s *CompressionSuite) TestServerSurvivesMalformedRequestsAndPanics(c *C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+	server := &ServerRPC{}
+	go server.serveMetaserver(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	c.Assert(err, IsNil)
+	fmt.Fprintf(conn, "{\"method\": 42, \"params\": [\n")
+	conn.Close()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	server.serveConnection(panickingConn{local})
+	c.Assert(atomic.LoadInt32(&server.panics), Equals, int32(1))
+
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	c.Assert(err, IsNil)
+	ExpectEcho(c, conn)
+}
+
+type countingWriter struct {
+	n int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
+
+// Reports how many bytes the payload needs on the wire per message.
+func benchmarkPayload(b *testing.B, payload interface{}, compress bool) {
+	counter := &countingWriter{}
+	var w io.Writer = counter
+	if compress {
+		fw, _ := flate.NewWriter(counter, flate.DefaultCompression)
+		w = &flushingWriter{fw}
+	}
+	encoder := json.NewEncoder(w)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		encoder.Encode(payload)
+	}
+	b.ReportMetric(float64(counter.n)/float64(b.N), "wire-bytes/msg")
+}
+
+// Compares the size of a Status response from a relay hosting many games
+// with and without compression. The status only contains counters, so it stays
+// below 200 bytes regardless of the number of games. Compressing it saves little
+// bandwidth in absolute numbers but costs several times the CPU time, which is
+// why compression is disabled by default. Consecutive messages share the
+// compression dictionary, as they do on a real connection.
+func BenchmarkStatusPayload(b *testing.B) {
+	status := ServerStatus{
+		NClients:        4000,
+		NClientsInGames: 3500,
+		NGames:          1000,
+		NOpenGames:      250,
+		Region:          "eu",
+		MaxGames:        2000,
+		InstanceID:      "0123456789abcdef",
+		PublicAddress:   "widelands.org",
+		GamePort:        7397,
+	}
+	b.Run("plain", func(b *testing.B) { benchmarkPayload(b, status, false) })
+	b.Run("compressed", func(b *testing.B) { benchmarkPayload(b, status, true) })
+}
+
+// Same as BenchmarkStatusPayload but for the players of a crowded game.
+// Larger payloads like this one are where compression pays off on a slow link.
+func BenchmarkPlayersPayload(b *testing.B) {
+	players := make([]PlayerInfo, 200)
+	for i := range players {
+		players[i] = PlayerInfo{ID: uint64(i + 1), IsHost: i == 0, RemoteAddr: fmt.Sprintf("192.0.2.%d:%d", i, 40000+i)}
+	}
+	b.Run("plain", func(b *testing.B) { benchmarkPayload(b, players, false) })
+	b.Run("compressed", func(b *testing.B) { benchmarkPayload(b, players, true) })
+}
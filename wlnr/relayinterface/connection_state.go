@@ -0,0 +1,42 @@
+package relayinterface
+
+import (
+	"time"
+)
+
+// ConnectionState tells whether a ClientRPC can reach its relay, see ClientRPC.ConnectionState.
+type ConnectionState struct {
+	// Whether the last attempt to reach the relay succeeded
+	Connected bool
+	// Why the last attempt failed, nil if Connected
+	LastError error
+	// When the relay is tried again if no call tries it before, see
+	// ClientRPCOptions.RefreshInterval. Zero if the next call tries it
+	NextRetryAt time.Time
+	// How often the call which is currently retrying still tries to reach the
+	// relay, see RetryBudgets. 0 if no call is retrying
+	AttemptsRemaining int
+}
+
+// ConnectionState reports whether the relay is reachable and, if not, how it is retried.
+func (client *ClientRPC) ConnectionState() ConnectionState {
+	state, _ := client.state.Load().(ConnectionState)
+	return state
+}
+
+// Records that the relay has been reached
+func (client *ClientRPC) markConnected() {
+	if !client.ConnectionState().Connected {
+		client.state.Store(ConnectionState{Connected: true})
+	}
+}
+
+// Records that the relay could not be reached. attemptsRemaining is how often the
+// current call tries again
+func (client *ClientRPC) markDisconnected(err error, attemptsRemaining int) {
+	state := ConnectionState{LastError: err, AttemptsRemaining: attemptsRemaining}
+	if client.refreshInterval > 0 {
+		state.NextRetryAt = time.Now().Add(client.refreshInterval)
+	}
+	client.state.Store(state)
+}
@@ -0,0 +1,130 @@
+package relayinterface
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sort"
+	"strings"
+)
+
+// Errors returned by the relay. They are passed over rpc as text,
+// knownError turns them back into these values on the metaserver side.
+var (
+	ErrGameNotFound      = errors.New("Game does not exist")
+	ErrWrongPassword     = errors.New("Wrong host password")
+	ErrNotRecorded       = errors.New("Game is not recorded")
+	ErrUnauthorized      = errors.New("Not authorized")
+	ErrGameExists        = errors.New("Game already exists")
+	ErrNameReserved      = errors.New("Game name is reserved")
+	ErrPlayerNotFound    = errors.New("Player is not connected to the game")
+	ErrTooManyAttempts   = errors.New("Too many attempts, try again later")
+	ErrRankedGame        = errors.New("Not allowed in ranked games")
+	ErrEmptyMessage      = errors.New("Message must not be empty")
+	ErrMaintenancePassed = errors.New("Maintenance time has already passed")
+	ErrEmptyToken        = errors.New("Token must not be empty")
+	ErrLockedOut         = errors.New("Too many wrong passwords, locked for a while")
+	ErrRelayFull         = errors.New("Relay has reached its maximal number of games")
+	ErrOwnerGameLimit    = errors.New("Owner has reached its maximal number of games")
+	ErrEmptyPlayerName   = errors.New("Player name must not be empty")
+	ErrRelayOverloaded   = errors.New("Relay is overloaded and only creates ranked games")
+)
+
+var knownErrors = []error{
+	ErrGameNotFound,
+	ErrWrongPassword,
+	ErrNotRecorded,
+	ErrUnauthorized,
+	ErrGameExists,
+	ErrNameReserved,
+	ErrPlayerNotFound,
+	ErrTooManyAttempts,
+	ErrRankedGame,
+	ErrEmptyMessage,
+	ErrMaintenancePassed,
+	ErrEmptyToken,
+	ErrLockedOut,
+	ErrRelayFull,
+	ErrOwnerGameLimit,
+	ErrEmptyPlayerName,
+	ErrRelayOverloaded,
+}
+
+// Errors of connecting to a relay, wrapped in a *ConnectionError.
+// They happen locally and are never passed over rpc.
+var (
+	ErrRelayUnreachable = errors.New("Relay is unreachable")
+	ErrListenFailed     = errors.New("Unable to listen for notifications of relays")
+	ErrNoHealthyRelay   = errors.New("No healthy relay available")
+)
+
+// NoHealthyRelayError is returned by a RelayPool when none of its relays can take a new game.
+// errors.Is(err, ErrNoHealthyRelay) is true for it.
+type NoHealthyRelayError struct {
+	// Why each relay has been skipped by its address, e.g., "full" or "down: <error>"
+	Skipped map[string]string
+}
+
+func (e *NoHealthyRelayError) Error() string {
+	reasons := make([]string, 0, len(e.Skipped))
+	for addr, reason := range e.Skipped {
+		reasons = append(reasons, fmt.Sprintf("%v (%v)", addr, reason))
+	}
+	sort.Strings(reasons)
+	if len(reasons) == 0 {
+		return ErrNoHealthyRelay.Error()
+	}
+	return ErrNoHealthyRelay.Error() + ": " + strings.Join(reasons, ", ")
+}
+
+func (e *NoHealthyRelayError) Is(target error) bool {
+	return target == ErrNoHealthyRelay
+}
+
+// ConnectionError is returned when connecting to a relay fails.
+// errors.Is(err, ErrRelayUnreachable) tells whether the relay could not be reached,
+// errors.Is(err, ErrListenFailed) whether our own rpc server could not be opened.
+type ConnectionError struct {
+	// ErrRelayUnreachable or ErrListenFailed
+	Kind error
+	// The address of the relay or the address we tried to listen on
+	Addr string
+	// The error of dialing or listening
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("%v (%v): %v", e.Kind, e.Addr, e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ConnectionError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Returns the known error with the given text, or a new error with the
+// text if it is unknown. An empty text means that there is no error.
+func errorFromText(text string) error {
+	if text == "" {
+		return nil
+	}
+	return knownError(rpc.ServerError(text))
+}
+
+// Returns the known error matching an error returned by an rpc call,
+// so callers can compare against the exported errors.
+func knownError(err error) error {
+	serverErr, ok := err.(rpc.ServerError)
+	if !ok {
+		return err
+	}
+	for _, known := range knownErrors {
+		if string(serverErr) == known.Error() {
+			return known
+		}
+	}
+	return err
+}
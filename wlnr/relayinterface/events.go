@@ -0,0 +1,132 @@
+package relayinterface
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType tells what happened on the relay.
+type EventType string
+
+const (
+	EventGameCreated        EventType = "GameCreated"
+	EventGameConnected      EventType = "GameConnected"
+	EventGameClosed         EventType = "GameClosed"
+	EventClientConnected    EventType = "ClientConnected"
+	EventClientDisconnected EventType = "ClientDisconnected"
+	EventClientReconnected  EventType = "ClientReconnected"
+	EventHostChanged        EventType = "HostChanged"
+)
+
+// Event describes something that happened to a game or client on the relay.
+// Events are only send to a metaserver which subscribed to them.
+type Event struct {
+	Type EventType
+	// When the relay noticed the event
+	Time time.Time
+	// The game the event is about
+	Game string
+	// The player the event is about, if any
+	PlayerID uint64
+	// Why the game has been closed, only set for EventGameClosed
+	CloseReason CloseReason
+	// Set if earlier events or notifications have been dropped, see GameData.EventsDropped
+	EventsDropped bool
+	// The GameData.RequestID the game has been created with, if any
+	RequestID string
+}
+
+// TimelineEvent is an entry of the timeline of a game, see Client.GetGameTimeline.
+type TimelineEvent struct {
+	// EventGameCreated, EventGameConnected, EventClientConnected, EventClientDisconnected,
+	// EventClientReconnected, EventHostChanged or EventGameClosed
+	Type EventType
+	Time time.Time
+	// The player the event is about, if any
+	PlayerID uint64
+	// Why the game has been closed, only set for EventGameClosed
+	CloseReason CloseReason
+}
+
+// SubscriptionRequest turns sending events on or off.
+type SubscriptionRequest struct {
+	Subscribe bool
+}
+
+// eventSubscribers keeps the handlers of Subscribe.
+type eventSubscribers struct {
+	handlers map[int]func(Event)
+	nextID   int
+	mutex    sync.Mutex
+}
+
+func newEventSubscribers() *eventSubscribers {
+	return &eventSubscribers{
+		handlers: make(map[int]func(Event)),
+	}
+}
+
+// Adds the handler. Returns its id and whether it is the first one.
+func (s *eventSubscribers) add(handler func(Event)) (int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id := s.nextID
+	s.nextID++
+	s.handlers[id] = handler
+	return id, len(s.handlers) == 1
+}
+
+// Removes the handler with the given id. Returns whether there are no handlers left.
+func (s *eventSubscribers) remove(id int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.handlers[id]; !ok {
+		// Removed before
+		return false
+	}
+	delete(s.handlers, id)
+	return len(s.handlers) == 0
+}
+
+// Calls all handlers with the event, one after the other.
+// The relay waits for this, so slow handlers make the relay queue its
+// notifications which are then handled according to its overflow policy.
+func (s *eventSubscribers) publish(event Event) {
+	s.mutex.Lock()
+	handlers := make([]func(Event), 0, len(s.handlers))
+	for _, handler := range s.handlers {
+		handlers = append(handlers, handler)
+	}
+	s.mutex.Unlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// Adds the handler and turns the events on for the given relays if it is the first one.
+// The returned function removes the handler again and turns the events off after the last one.
+func subscribe(s *eventSubscribers, relays []*ClientRPC, handler func(Event)) (func(), error) {
+	id, first := s.add(handler)
+	if first {
+		for i, relay := range relays {
+			if err := relay.setSubscribed(true); err != nil {
+				// Turn the events off again on the relays which already subscribed
+				for _, subscribed := range relays[:i] {
+					subscribed.setSubscribed(false)
+				}
+				s.remove(id)
+				return nil, err
+			}
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if s.remove(id) {
+				for _, relay := range relays {
+					relay.setSubscribed(false)
+				}
+			}
+		})
+	}, nil
+}
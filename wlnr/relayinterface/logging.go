@@ -0,0 +1,117 @@
+package relayinterface
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// LogLevel is the minimal importance of the messages a Logger writes.
+type LogLevel int32
+
+const (
+	// Everything, including messages for each forwarded packet
+	LogLevelDebug LogLevel = iota
+	// Messages about what is happening, e.g., games being created
+	LogLevelInfo
+	// Only problems
+	LogLevelWarn
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int32(l))
+}
+
+// ParseLogLevel returns the level with the given name, i.e., "debug", "info" or "warn".
+// An empty name means LogLevelInfo.
+func ParseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LogLevelDebug, nil
+	case "", "info":
+		return LogLevelInfo, nil
+	case "warn":
+		return LogLevelWarn, nil
+	}
+	return LogLevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// Logger writes the messages of one subsystem to the standard logger
+// if they are at least as important as its level.
+// The level can be changed while the logger is in use.
+type Logger struct {
+	level int32
+}
+
+// NewLogger creates a logger writing messages of the given level and above.
+func NewLogger(level LogLevel) *Logger {
+	return &Logger{level: int32(level)}
+}
+
+// Level returns the current level of the logger.
+func (l *Logger) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(&l.level))
+}
+
+// SetLevel changes which messages are written from now on.
+func (l *Logger) SetLevel(level LogLevel) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// Enabled returns whether messages of the given level are written.
+// Useful to avoid preparing expensive debug messages.
+func (l *Logger) Enabled(level LogLevel) bool {
+	return level >= l.Level()
+}
+
+func (l *Logger) logf(level LogLevel, format string, v ...interface{}) {
+	if l.Enabled(level) {
+		message := fmt.Sprintf(format, v...)
+		log.Output(3, message)
+		if capture := logCapture.Load().(func(LogLine)); capture != nil {
+			capture(LogLine{Time: time.Now(), Level: level, Message: message})
+		}
+	}
+}
+
+// The function every written message is passed to, see CaptureLogs
+var logCapture atomic.Value
+
+func init() {
+	logCapture.Store((func(LogLine))(nil))
+}
+
+// CaptureLogs passes every message written by any Logger to the given function,
+// e.g., to keep the recent messages for GetRecentLogs. nil stops capturing.
+func CaptureLogs(capture func(LogLine)) {
+	logCapture.Store(capture)
+}
+
+// Debugf writes a message useful when looking into a single problem.
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.logf(LogLevelDebug, format, v...)
+}
+
+// Infof writes a message about normal operation.
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.logf(LogLevelInfo, format, v...)
+}
+
+// Warnf writes a message about a problem.
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.logf(LogLevelWarn, format, v...)
+}
+
+// RPCLog is used for the messages about the rpc connection between the
+// metaserver and the relay.
+var RPCLog = NewLogger(LogLevelInfo)
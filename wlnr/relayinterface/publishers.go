@@ -0,0 +1,121 @@
+package relayinterface
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// How many events may wait for each EventPublisher if EventQueueSize is not configured
+const DefaultEventQueueSize = 256
+
+var errEventQueueFull = errors.New("Event queue of publisher is full")
+var errPublisherClosed = errors.New("Event publisher has been closed")
+
+// EventPublisher passes the events of the relay on, e.g., to a message queue
+// like NATS or Redis for analytics, see ServerRPCOptions.EventPublishers.
+// Implement it with an adapter to the client library of the queue, the
+// relayinterface does not depend on one itself. Sending the events to a
+// subscribed metaserver is one EventPublisher as well.
+type EventPublisher interface {
+	// Publishes the event. Called from one goroutine per publisher in the order
+	// of the events, so it may block. Errors are logged, the event is not
+	// published again.
+	Publish(event Event) error
+}
+
+// Sends the events to the metaserver if it subscribed to them.
+// They share the queue with the notifications.
+type metaserverPublisher struct {
+	server *ServerRPC
+}
+
+func (p metaserverPublisher) Publish(event Event) error {
+	if atomic.LoadInt32(&p.server.subscribed) == 0 {
+		return nil
+	}
+	p.server.queueCallback(pendingCallback{action: "Event", gameName: event.Game, event: &event})
+	return nil
+}
+
+// Queues the events for a publisher given by the operator, so a slow or
+// unreachable queue never holds up the relay. Events are dropped while the
+// queue is full and once the publisher has been closed.
+type queuedPublisher struct {
+	publisher EventPublisher
+	events    chan Event
+	// Closed when the relay shuts down, stops the goroutine publishing the events
+	closed    chan struct{}
+	closeOnce sync.Once
+	// Whether events have been dropped since the last one has been queued. Accessed atomically
+	dropping int32
+}
+
+func newQueuedPublisher(publisher EventPublisher, size int) *queuedPublisher {
+	if size <= 0 {
+		size = DefaultEventQueueSize
+	}
+	q := &queuedPublisher{publisher: publisher, events: make(chan Event, size), closed: make(chan struct{})}
+	go q.run()
+	return q
+}
+
+func (q *queuedPublisher) Publish(event Event) error {
+	select {
+	case <-q.closed:
+		return errPublisherClosed
+	default:
+	}
+	select {
+	case q.events <- event:
+		atomic.StoreInt32(&q.dropping, 0)
+		return nil
+	default:
+		if atomic.CompareAndSwapInt32(&q.dropping, 0, 1) {
+			RPCLog.Warnf("ServerRPC: Event publisher is too slow, dropping events")
+		}
+		return errEventQueueFull
+	}
+}
+
+func (q *queuedPublisher) run() {
+	for {
+		// Check for close first, select would pick a queued event as well
+		select {
+		case <-q.closed:
+			return
+		default:
+		}
+		select {
+		case <-q.closed:
+			return
+		case event := <-q.events:
+			if err := q.publisher.Publish(event); err != nil {
+				RPCLog.Warnf("ServerRPC: Unable to publish event %v of game '%v': %v", event.Type, event.Game, err)
+			}
+		}
+	}
+}
+
+// Stops publishing events. The event being published is finished, the queued ones are dropped
+func (q *queuedPublisher) close() {
+	q.closeOnce.Do(func() { close(q.closed) })
+}
+
+// Stops the goroutines of the publishers given by the operator
+func (server *ServerRPC) closePublishers() {
+	for _, publisher := range server.publishers {
+		if queued, ok := publisher.(*queuedPublisher); ok {
+			queued.close()
+		}
+	}
+}
+
+// Returns the publishers of the server: The metaserver followed by the ones of the options
+func (server *ServerRPC) newPublishers(options ServerRPCOptions) []EventPublisher {
+	publishers := []EventPublisher{metaserverPublisher{server}}
+	for _, publisher := range options.EventPublishers {
+		publishers = append(publishers, newQueuedPublisher(publisher, options.EventQueueSize))
+	}
+	return publishers
+}
@@ -0,0 +1,1248 @@
+package relayinterface
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RelayPool implements relayinterface.Client over RPC connections to
+// multiple relays. New games are distributed between the relays.
+type RelayPool struct {
+	relays   []*ClientRPC
+	listener net.Listener
+
+	// The relay each game has been created on
+	games map[string]*ClientRPC
+	// The games being created, they are added to games once the relay created them
+	creating map[string]bool
+	// The relay each game name has been reserved on
+	reserved map[string]poolReservation
+	// Relays which failed the last WarmUp, Ping or status request with the error.
+	// No games are created on them until they answer again
+	unhealthy map[*ClientRPC]error
+	// The weights set by SetRelayWeight, DefaultRelayWeight for the other relays
+	weights map[*ClientRPC]int
+	// The relay the games of each owner are created on by owner, see stickyRelay,
+	// and by the names of the games they count
+	affinities          map[string]*poolAffinity
+	affinityOf          map[string]*poolAffinity
+	affinityGracePeriod time.Duration
+	mutex               sync.Mutex
+
+	// Callers waiting for hosts to connect
+	waiters *hostWaiters
+	// The handlers of Subscribe
+	subscribers *eventSubscribers
+}
+
+// NewRelayPool creates a pool of relays running RPC servers at the given addresses.
+// Relays that can not be reached are left out of the pool.
+// All relays send their notifications to the RPC server on port 7399 which
+// calls the methods of the given callback.
+func NewRelayPool(callback ClientCallback, relayAddrs []string, options ClientRPCOptions) *RelayPool {
+	callback = callbackOrIgnore(callback)
+	pool := &RelayPool{
+		games:       make(map[string]*ClientRPC),
+		creating:    make(map[string]bool),
+		reserved:    make(map[string]poolReservation),
+		unhealthy:   make(map[*ClientRPC]error),
+		weights:     make(map[*ClientRPC]int),
+		affinities:  make(map[string]*poolAffinity),
+		affinityOf:  make(map[string]*poolAffinity),
+		waiters:     newHostWaiters(),
+		subscribers: newEventSubscribers(),
+
+		affinityGracePeriod: options.AffinityGracePeriod,
+	}
+	// The relays we are connected to by their instance id
+	instances := make(map[string]string)
+	for _, addr := range relayAddrs {
+		relay := newClientRPC(addr, options)
+		if err := relay.connect(); err != nil {
+			RPCLog.Warnf("RelayPool: %v", err)
+			continue
+		}
+		status, err := relay.Status()
+		if err != nil {
+			RPCLog.Warnf("RelayPool: Unable to get status of relay at %v: %v", addr, err)
+			relay.CloseConnection()
+			continue
+		}
+		if other, ok := instances[status.InstanceID]; ok {
+			RPCLog.Infof("RelayPool: Relay at %v is the same instance as the one at %v, ignoring it", addr, other)
+			relay.CloseConnection()
+			continue
+		}
+		instances[status.InstanceID] = addr
+		pool.relays = append(pool.relays, relay)
+		relay.startRefreshing(options.RefreshInterval)
+	}
+	if len(pool.relays) == 0 {
+		RPCLog.Warnf("RelayPool: Unable to connect to any relay")
+		return nil
+	}
+
+	listener, err := listenForRelays(&notifyingCallback{&poolCallback{pool, callback}, pool.waiters}, pool.subscribers, relayListenAddress, options.Compress)
+	if err != nil {
+		RPCLog.Warnf("RelayPool: %v", err)
+		for _, relay := range pool.relays {
+			relay.CloseConnection()
+		}
+		return nil
+	}
+	pool.listener = listener
+	return pool
+}
+
+// poolCallback forgets closed games before passing the notifications on.
+type poolCallback struct {
+	pool     *RelayPool
+	callback ClientCallback
+}
+
+func (c *poolCallback) GameConnected(name string) {
+	c.callback.GameConnected(name)
+}
+
+func (c *poolCallback) GameClosed(name string, reason CloseReason) {
+	c.pool.mutex.Lock()
+	delete(c.pool.games, name)
+	c.pool.releaseAffinity(name)
+	c.pool.mutex.Unlock()
+	c.callback.GameClosed(name, reason)
+}
+
+func (c *poolCallback) ClientReconnected(name string, playerID uint64) {
+	c.callback.ClientReconnected(name, playerID)
+}
+
+func (c *poolCallback) HostChanged(name string, playerID uint64) {
+	c.callback.HostChanged(name, playerID)
+}
+
+func (c *poolCallback) OnCapacityWarning(current, max int) {
+	c.callback.OnCapacityWarning(current, max)
+}
+
+func (c *poolCallback) OnRelayAlert(alert RelayAlert) {
+	c.callback.OnRelayAlert(alert)
+}
+
+func (c *poolCallback) ClientJoinRejected(rejection JoinRejection) {
+	c.callback.ClientJoinRejected(rejection)
+}
+
+func (c *poolCallback) ClientChat(message ChatMessage) {
+	c.callback.ClientChat(message)
+}
+
+func (c *poolCallback) Status() *ServerStatus {
+	return c.callback.Status()
+}
+
+// WarmUpError lists the relays of the pool which failed WarmUp.
+type WarmUpError struct {
+	// The error of each unhealthy relay by its address
+	Unhealthy map[string]error
+}
+
+func (e *WarmUpError) Error() string {
+	addrs := make([]string, 0, len(e.Unhealthy))
+	for addr, err := range e.Unhealthy {
+		addrs = append(addrs, fmt.Sprintf("%v (%v)", addr, err))
+	}
+	sort.Strings(addrs)
+	return "unhealthy relays: " + strings.Join(addrs, ", ")
+}
+
+// WarmUp pings all relays of the pool in parallel, reconnecting to them if needed.
+// Until the next call, games are only created on the relays which answered.
+// Relays not answering before ctx expires count as unhealthy.
+// Returns a *WarmUpError if any relay is unhealthy.
+func (pool *RelayPool) WarmUp(ctx context.Context) error {
+	type result struct {
+		relay *ClientRPC
+		err   error
+	}
+	results := make(chan result, len(pool.relays))
+	for _, relay := range pool.relays {
+		go func(relay *ClientRPC) {
+			results <- result{relay, relay.Ping()}
+		}(relay)
+	}
+	// Relays without an answer yet have a nil error
+	unhealthy := make(map[*ClientRPC]error, len(pool.relays))
+	for _, relay := range pool.relays {
+		unhealthy[relay] = nil
+	}
+	for pending := len(pool.relays); pending > 0; {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				delete(unhealthy, r.relay)
+			} else {
+				unhealthy[r.relay] = r.err
+			}
+		case <-ctx.Done():
+			for relay, err := range unhealthy {
+				if err == nil {
+					unhealthy[relay] = ctx.Err()
+				}
+			}
+			pending = 0
+		}
+	}
+
+	pool.mutex.Lock()
+	pool.unhealthy = make(map[*ClientRPC]error, len(unhealthy))
+	for relay, err := range unhealthy {
+		pool.unhealthy[relay] = err
+	}
+	pool.mutex.Unlock()
+	if len(unhealthy) == 0 {
+		return nil
+	}
+	warmUpErr := &WarmUpError{Unhealthy: make(map[string]error, len(unhealthy))}
+	for relay, err := range unhealthy {
+		RPCLog.Warnf("RelayPool: Relay at %v is unhealthy: %v", relay.relayAddr, err)
+		warmUpErr.Unhealthy[relay.relayAddr] = err
+	}
+	return warmUpErr
+}
+
+// The weight of relays for which SetRelayWeight has not been called
+const DefaultRelayWeight = 100
+
+// SetRelayWeight changes the share of new games the relay at the given address
+// receives. New games are distributed in proportion to the weights of the relays,
+// so a canary relay with weight 5 next to one with the default weight receives
+// about 5% of them. With weight 0 the relay receives no new games, its existing
+// games are kept.
+func (pool *RelayPool) SetRelayWeight(addr string, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("Weight of relay must not be negative: %v", weight)
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, relay := range pool.relays {
+		if relay.relayAddr != addr {
+			continue
+		}
+		if pool.weights == nil {
+			pool.weights = make(map[*ClientRPC]int)
+		}
+		pool.weights[relay] = weight
+		RPCLog.Infof("RelayPool: Weight of relay at %v set to %v", addr, weight)
+		return nil
+	}
+	return fmt.Errorf("No relay at %v in the pool", addr)
+}
+
+// Returns the weight of the relay. Has to be called with the mutex of the pool locked
+func (pool *RelayPool) weightOf(relay *ClientRPC) int {
+	if weight, ok := pool.weights[relay]; ok {
+		return weight
+	}
+	return DefaultRelayWeight
+}
+
+// Whether a relay with the given number of games and weight should receive the
+// next game rather than one with the other number of games and weight.
+// Games are distributed in proportion to the weights this way
+func lessLoaded(games, weight, otherGames, otherWeight int) bool {
+	return (games+1)*otherWeight < (otherGames+1)*weight
+}
+
+// Selects the relay a new game should be created on.
+// Only relays supporting the required capabilities are considered, relays with
+// a scheduled maintenance or with weight 0 are draining and are not considered either.
+// Relays in the given region are preferred if they have room for another game.
+// Otherwise, the least loaded relay relative to its weight is used. Relays which
+// reached their soft limit are only used if all others are full. Relays known to
+// be unhealthy are skipped without asking them. Returns a *NoHealthyRelayError if
+// no relay can be used. Has to be called without the mutex of the pool locked,
+// the relays are asked for their status without holding it.
+func (pool *RelayPool) selectRelay(region string, required RelayCapabilities) (*ClientRPC, error) {
+	var best, bestInRegion, nearlyFull *ClientRPC
+	bestLoad, bestLoadInRegion, nearlyFullLoad := 0, 0, 0
+	bestWeight, bestWeightInRegion := 0, 0
+	skipped := make(map[string]string)
+	var candidates []*ClientRPC
+	weights := make(map[*ClientRPC]int, len(pool.relays))
+	pool.mutex.Lock()
+	for _, relay := range pool.relays {
+		if reason := pool.excludedRelay(relay, required); reason != "" {
+			skipped[relay.relayAddr] = reason
+			continue
+		}
+		candidates = append(candidates, relay)
+		weights[relay] = pool.weightOf(relay)
+	}
+	pool.mutex.Unlock()
+	for _, relay := range candidates {
+		status, reason := pool.checkRelayStatus(relay)
+		if reason != "" {
+			skipped[relay.relayAddr] = reason
+			continue
+		}
+		weight := weights[relay]
+		if status.SoftMaxGames > 0 && status.NGames >= status.SoftMaxGames {
+			if nearlyFull == nil || status.NGames < nearlyFullLoad {
+				nearlyFull = relay
+				nearlyFullLoad = status.NGames
+			}
+			continue
+		}
+		if best == nil || lessLoaded(status.NGames, weight, bestLoad, bestWeight) {
+			best = relay
+			bestLoad, bestWeight = status.NGames, weight
+		}
+		if region != "" && status.Region == region && (bestInRegion == nil || lessLoaded(status.NGames, weight, bestLoadInRegion, bestWeightInRegion)) {
+			bestInRegion = relay
+			bestLoadInRegion, bestWeightInRegion = status.NGames, weight
+		}
+	}
+	if bestInRegion != nil {
+		return bestInRegion, nil
+	}
+	if best != nil {
+		return best, nil
+	}
+	if nearlyFull != nil {
+		return nearlyFull, nil
+	}
+	return nil, &NoHealthyRelayError{Skipped: skipped}
+}
+
+// Returns why the relay can not take a new game with the required capabilities,
+// see NoHealthyRelayError, or an empty string if it might, which only its status
+// tells. Has to be called with the mutex of the pool locked
+func (pool *RelayPool) excludedRelay(relay *ClientRPC, required RelayCapabilities) string {
+	if err, ok := pool.unhealthy[relay]; ok {
+		return fmt.Sprintf("down: %v", err)
+	}
+	if capabilities := relay.currentCapabilities(); !capabilities.Has(required) {
+		return "missing capabilities " + (required &^ capabilities).String()
+	}
+	if pool.weightOf(relay) == 0 {
+		return "weight 0"
+	}
+	return ""
+}
+
+// Returns the status of the relay and an empty string if it has room for a new
+// game, or why it has not. Has to be called without the mutex of the pool locked
+// since it waits for the answer of the relay
+func (pool *RelayPool) checkRelayStatus(relay *ClientRPC) (ServerStatus, string) {
+	status, err := relay.Status()
+	if err != nil {
+		RPCLog.Warnf("RelayPool: Unable to get status of relay at %v: %v", relay.relayAddr, err)
+		pool.mutex.Lock()
+		pool.unhealthy[relay] = err
+		pool.mutex.Unlock()
+		return ServerStatus{}, fmt.Sprintf("down: %v", err)
+	}
+	if !status.MaintenanceAt.IsZero() {
+		return status, "draining"
+	}
+	if status.MaxGames > 0 && status.NGames >= status.MaxGames {
+		return status, "full"
+	}
+	return status, ""
+}
+
+// CreateGame creates the game on the least loaded relay of the pool.
+func (pool *RelayPool) CreateGame(name string, hostPassword string) bool {
+	return pool.CreateGameInRegion(name, hostPassword, "")
+}
+
+// CreateGameInRegion creates the game on a relay in the given region.
+// If there is no such relay with room for the game, the least loaded one is used.
+func (pool *RelayPool) CreateGameInRegion(name string, hostPassword string, region string) bool {
+	return pool.CreateGameRequiring(name, hostPassword, region, 0)
+}
+
+// CreateGameRequiring creates the game on a relay supporting the required capabilities.
+// Relays in the given region are preferred.
+func (pool *RelayPool) CreateGameRequiring(name string, hostPassword string, region string, required RelayCapabilities) bool {
+	return pool.createGame(GameData{Name: name, Password: hostPassword, Public: true}, region, required)
+}
+
+// CreateGameWithSettings creates the game described by the given data on the least loaded relay of the pool.
+func (pool *RelayPool) CreateGameWithSettings(data GameData) bool {
+	return pool.createGame(data, "", 0)
+}
+
+func (pool *RelayPool) createGame(data GameData, region string, required RelayCapabilities) bool {
+	if err := pool.TryCreateGame(data, region, required); err != nil {
+		RPCLog.Warnf("RelayPool: Unable to create game '%v': %v", data.Name, err)
+		return false
+	}
+	return true
+}
+
+// TryCreateGame creates the game on a relay supporting the required capabilities,
+// preferring relays in the given region. Games of an owner whose game is on a
+// relay, or was until recently, are created on that relay if it can take them,
+// see ClientRPCOptions.AffinityGracePeriod. Unlike CreateGameWithSettings it tells why
+// the game could not be created. If no relay of the pool can be used, it fails
+// at once with a *NoHealthyRelayError, which matches ErrNoHealthyRelay.
+// Other calls of the pool are not held up while the relays are asked.
+func (pool *RelayPool) TryCreateGame(data GameData, region string, required RelayCapabilities) error {
+	name := data.Name
+	pool.mutex.Lock()
+	if _, ok := pool.games[name]; ok || pool.creating[name] {
+		pool.mutex.Unlock()
+		return ErrGameExists
+	}
+	reservation, reserved := pool.reserved[name]
+	reserved = reserved && data.ReservationToken != ""
+	if reserved {
+		// The reservation only exists on that relay
+		delete(pool.reserved, name)
+	}
+	if pool.creating == nil {
+		pool.creating = make(map[string]bool)
+	}
+	pool.creating[name] = true
+	pool.mutex.Unlock()
+
+	relay := reservation.relay
+	var err error
+	if !reserved {
+		if relay = pool.stickyRelay(data.OwnerID, required); relay == nil {
+			relay, err = pool.selectRelay(region, required)
+		}
+	}
+	if err == nil {
+		err = relay.CreateGameErr(data)
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	delete(pool.creating, name)
+	if err != nil {
+		return err
+	}
+	pool.games[name] = relay
+	pool.recordAffinity(name, data.OwnerID, relay)
+	return nil
+}
+
+// CreateGameErr creates the game described by the given data on the least loaded
+// relay of the pool and tells why it could not be created, see TryCreateGame.
+func (pool *RelayPool) CreateGameErr(data GameData) error {
+	return pool.TryCreateGame(data, "", 0)
+}
+
+// CountGamesByOwner sums up the games of the owner on all reachable relays of the pool.
+// Each relay limits the games of an owner on its own. Fails only if no relay is reachable.
+func (pool *RelayPool) CountGamesByOwner(ownerID string) (int, error) {
+	total := 0
+	var lastErr error
+	reachable := 0
+	for _, relay := range pool.relays {
+		count, err := relay.CountGamesByOwner(ownerID)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reachable++
+		total += count
+	}
+	if reachable == 0 {
+		return total, lastErr
+	}
+	return total, nil
+}
+
+// ReserveGameName reserves the name on the least loaded relay. The game
+// created with the reservation token is created on the same relay.
+func (pool *RelayPool) ReserveGameName(name string, ttl time.Duration) (string, error) {
+	pool.mutex.Lock()
+	if _, ok := pool.games[name]; ok || pool.creating[name] {
+		pool.mutex.Unlock()
+		return "", ErrGameExists
+	}
+	now := time.Now()
+	for key, old := range pool.reserved {
+		if now.After(old.expires) {
+			delete(pool.reserved, key)
+		}
+	}
+	old, ok := pool.reserved[name]
+	pool.mutex.Unlock()
+	// Still reserved there, let the relay refuse it
+	relay := old.relay
+	if !ok {
+		var err error
+		if relay, err = pool.selectRelay("", 0); err != nil {
+			return "", err
+		}
+	}
+	token, err := relay.ReserveGameName(name, ttl)
+	if err != nil {
+		return "", err
+	}
+	pool.mutex.Lock()
+	pool.reserved[name] = poolReservation{relay, now.Add(ttl)}
+	pool.mutex.Unlock()
+	return token, nil
+}
+
+// The relay a game name has been reserved on and when the reservation ends
+type poolReservation struct {
+	relay   *ClientRPC
+	expires time.Time
+}
+
+// CreateGameAndAwaitHost creates the game on the least loaded relay and waits until the host connected.
+func (pool *RelayPool) CreateGameAndAwaitHost(ctx context.Context, name string, hostPassword string) error {
+	return pool.waiters.createAndAwait(ctx, name, func() error {
+		return pool.TryCreateGame(GameData{Name: name, Password: hostPassword, Public: true}, "", 0)
+	})
+}
+
+// RemoveGame removes the game from the relay it has been created on.
+func (pool *RelayPool) RemoveGame(name string) bool {
+	pool.mutex.Lock()
+	relay, ok := pool.games[name]
+	delete(pool.games, name)
+	pool.mutex.Unlock()
+	if !ok {
+		RPCLog.Warnf("RelayPool: Game '%v' is unknown", name)
+		return false
+	}
+	return relay.RemoveGame(name)
+}
+
+// RemoveGames removes the games from the relays they have been created on.
+// Games on unreachable relays get the error of the call to the relay as result.
+func (pool *RelayPool) RemoveGames(names []string) (map[string]error, error) {
+	results := make(map[string]error, len(names))
+	byRelay := make(map[*ClientRPC][]string)
+	pool.mutex.Lock()
+	for _, name := range names {
+		relay, ok := pool.games[name]
+		if !ok {
+			results[name] = ErrGameNotFound
+			continue
+		}
+		delete(pool.games, name)
+		byRelay[relay] = append(byRelay[relay], name)
+	}
+	pool.mutex.Unlock()
+	for relay, relayNames := range byRelay {
+		relayResults, err := relay.RemoveGames(relayNames)
+		for _, name := range relayNames {
+			if err != nil {
+				results[name] = err
+			} else {
+				results[name] = relayResults[name]
+			}
+		}
+	}
+	return results, nil
+}
+
+// RemoveGamesByOwner removes the games of the owner from all reachable relays of the pool.
+// Fails only if no relay is reachable.
+func (pool *RelayPool) RemoveGamesByOwner(ownerID string) (int, error) {
+	removed := 0
+	var lastErr error
+	reachable := 0
+	for _, relay := range pool.relays {
+		names, err := relay.removeGamesByOwner(ownerID)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reachable++
+		removed += len(names)
+		pool.mutex.Lock()
+		for _, name := range names {
+			delete(pool.games, name)
+		}
+		pool.mutex.Unlock()
+	}
+	if reachable == 0 {
+		return removed, lastErr
+	}
+	return removed, nil
+}
+
+// Returns the relay the game with the given name has been created on
+func (pool *RelayPool) relayOf(name string) (*ClientRPC, error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	relay, ok := pool.games[name]
+	if !ok {
+		return nil, ErrGameNotFound
+	}
+	return relay, nil
+}
+
+// LockGame locks or unlocks the game on the relay it has been created on.
+func (pool *RelayPool) LockGame(gameName string, hostPassword string, locked bool) (bool, error) {
+	relay, err := pool.relayOf(gameName)
+	if err != nil {
+		return false, err
+	}
+	return relay.LockGame(gameName, hostPassword, locked)
+}
+
+// MakeInviteOnly makes the game invite-only on the relay it has been created on.
+func (pool *RelayPool) MakeInviteOnly(name string, hostPassword string, invites int) ([]string, error) {
+	relay, err := pool.relayOf(name)
+	if err != nil {
+		return nil, err
+	}
+	return relay.MakeInviteOnly(name, hostPassword, invites)
+}
+
+// SetVisibility changes the visibility of the game on the relay it has been created on.
+func (pool *RelayPool) SetVisibility(name string, hostPassword string, public bool) error {
+	relay, err := pool.relayOf(name)
+	if err != nil {
+		return err
+	}
+	return relay.SetVisibility(name, hostPassword, public)
+}
+
+// FindPlayer searches the player on all reachable relays of the pool.
+func (pool *RelayPool) FindPlayer(name string) ([]PlayerLocation, error) {
+	var locations []PlayerLocation
+	var lastErr error
+	reachable := 0
+	for _, relay := range pool.relays {
+		relayLocations, err := relay.FindPlayer(name)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reachable++
+		locations = append(locations, relayLocations...)
+	}
+	if reachable == 0 {
+		return locations, lastErr
+	}
+	return locations, nil
+}
+
+// GetGameHistory merges the recently closed games of all reachable relays of the pool.
+func (pool *RelayPool) GetGameHistory(limit int) ([]GameSummary, error) {
+	var summaries []GameSummary
+	var lastErr error
+	reachable := 0
+	for _, relay := range pool.relays {
+		relaySummaries, err := relay.GetGameHistory(limit)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reachable++
+		summaries = append(summaries, relaySummaries...)
+	}
+	if reachable == 0 {
+		return summaries, lastErr
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].ClosedAt.After(summaries[j].ClosedAt)
+	})
+	if limit > 0 && len(summaries) > limit {
+		summaries = summaries[:limit]
+	}
+	return summaries, nil
+}
+
+// GetGameTimeline requests the timeline of the game from the relay it has been created on.
+// The pool forgets closed games, so their timeline is requested from all reachable relays
+// and the one of the game closed last is returned.
+func (pool *RelayPool) GetGameTimeline(gameName string) ([]TimelineEvent, error) {
+	if relay, err := pool.relayOf(gameName); err == nil {
+		return relay.GetGameTimeline(gameName)
+	}
+	var latest []TimelineEvent
+	var closedAt time.Time
+	found := false
+	lastErr := ErrGameNotFound
+	for _, relay := range pool.relays {
+		timeline, err := relay.GetGameTimeline(gameName)
+		if err != nil {
+			if err != ErrGameNotFound {
+				lastErr = fmt.Errorf("%v: %v", relay.relayAddr, err)
+			}
+			continue
+		}
+		var last time.Time
+		if len(timeline) > 0 {
+			last = timeline[len(timeline)-1].Time
+		}
+		if !found || last.After(closedAt) {
+			latest, closedAt, found = timeline, last, true
+		}
+	}
+	if !found {
+		return nil, lastErr
+	}
+	return latest, nil
+}
+
+// VerifyHostPassword checks the host password on the relay the game has been created on.
+func (pool *RelayPool) VerifyHostPassword(gameName, password string) (bool, error) {
+	relay, err := pool.relayOf(gameName)
+	if err != nil {
+		return false, err
+	}
+	return relay.VerifyHostPassword(gameName, password)
+}
+
+// KickPlayerByID kicks the player from the game on the relay it has been created on.
+func (pool *RelayPool) KickPlayerByID(gameName, hostPassword string, playerID uint64) (bool, error) {
+	relay, err := pool.relayOf(gameName)
+	if err != nil {
+		return false, err
+	}
+	return relay.KickPlayerByID(gameName, hostPassword, playerID)
+}
+
+// TransferHost changes the host of the game on the relay it has been created on.
+func (pool *RelayPool) TransferHost(gameName, hostPassword, newHostPlayer, newHostPassword string) (bool, error) {
+	relay, err := pool.relayOf(gameName)
+	if err != nil {
+		return false, err
+	}
+	return relay.TransferHost(gameName, hostPassword, newHostPlayer, newHostPassword)
+}
+
+// ListGames requests the games of all reachable relays of the pool.
+func (pool *RelayPool) ListGames() ([]GameData, error) {
+	var games []GameData
+	var lastErr error
+	reachable := 0
+	for _, relay := range pool.relays {
+		relayGames, err := relay.ListGames()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reachable++
+		games = append(games, relayGames...)
+	}
+	if reachable == 0 {
+		return games, lastErr
+	}
+	return games, nil
+}
+
+// ListGamesFiltered requests the games matching the filter from all reachable relays of the pool.
+func (pool *RelayPool) ListGamesFiltered(filter GameFilter) ([]GameData, error) {
+	var games []GameData
+	var lastErr error
+	reachable := 0
+	for _, relay := range pool.relays {
+		relayGames, err := relay.ListGamesFiltered(filter)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reachable++
+		games = append(games, relayGames...)
+	}
+	if reachable == 0 {
+		return games, lastErr
+	}
+	return games, nil
+}
+
+// ListGamesPage requests the games of all reachable relays of the pool and
+// returns the requested page of them.
+func (pool *RelayPool) ListGamesPage(offset, limit int) ([]GameData, int, error) {
+	games, err := pool.ListGames()
+	if err != nil {
+		return nil, 0, err
+	}
+	page, total := pageOfGames(games, offset, limit)
+	return page, total, nil
+}
+
+// ForwardingLatency combines the forwarding latency of all reachable relays.
+// The average is weighted by the number of timed frames, the percentiles
+// are the worst ones of all relays.
+func (pool *RelayPool) ForwardingLatency() (avg, p95, p99 time.Duration, err error) {
+	var sum time.Duration
+	var samples int64
+	var lastErr error
+	reachable := 0
+	for _, relay := range pool.relays {
+		stats, err := relay.forwardingLatency("")
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reachable++
+		sum += stats.Average * time.Duration(stats.Samples)
+		samples += stats.Samples
+		if stats.P95 > p95 {
+			p95 = stats.P95
+		}
+		if stats.P99 > p99 {
+			p99 = stats.P99
+		}
+	}
+	if reachable == 0 {
+		return 0, 0, 0, lastErr
+	}
+	if samples > 0 {
+		avg = sum / time.Duration(samples)
+	}
+	return avg, p95, p99, nil
+}
+
+// GameForwardingLatency requests the forwarding latency from the relay the game has been created on.
+func (pool *RelayPool) GameForwardingLatency(gameName string) (avg, p95, p99 time.Duration, err error) {
+	relay, err := pool.relayOf(gameName)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return relay.GameForwardingLatency(gameName)
+}
+
+// GetGameTraffic requests the traffic of the game from the relay it has been created on.
+func (pool *RelayPool) GetGameTraffic(gameName string) (GameTraffic, error) {
+	relay, err := pool.relayOf(gameName)
+	if err != nil {
+		return GameTraffic{}, err
+	}
+	return relay.GetGameTraffic(gameName)
+}
+
+// ResetGameCounters resets the traffic counters of the game on the relay it has been created on.
+func (pool *RelayPool) ResetGameCounters(gameName, hostPassword string) error {
+	relay, err := pool.relayOf(gameName)
+	if err != nil {
+		return err
+	}
+	return relay.ResetGameCounters(gameName, hostPassword)
+}
+
+// DumpGameState requests the snapshot of the game from the relay it has been created on.
+func (pool *RelayPool) DumpGameState(gameName string) (GameStateDump, error) {
+	relay, err := pool.relayOf(gameName)
+	if err != nil {
+		return GameStateDump{}, err
+	}
+	return relay.DumpGameState(gameName)
+}
+
+// GetGamePlayers requests the players of the game from the relay it has been created on.
+func (pool *RelayPool) GetGamePlayers(name string) ([]PlayerInfo, error) {
+	relay, err := pool.relayOf(name)
+	if err != nil {
+		return nil, err
+	}
+	return relay.GetGamePlayers(name)
+}
+
+// IsPlayerConnected asks the relay the game has been created on whether the player is connected.
+func (pool *RelayPool) IsPlayerConnected(gameName string, playerID uint64) (PlayerConnection, error) {
+	relay, err := pool.relayOf(gameName)
+	if err != nil {
+		return "", err
+	}
+	return relay.IsPlayerConnected(gameName, playerID)
+}
+
+// BuildJoinInstruction asks the relay the game has been created on how to join it.
+func (pool *RelayPool) BuildJoinInstruction(gameName string) (JoinInstruction, error) {
+	relay, err := pool.relayOf(gameName)
+	if err != nil {
+		return JoinInstruction{}, err
+	}
+	return relay.BuildJoinInstruction(gameName)
+}
+
+// GetGame requests the description of the game from the relay it has been created on.
+func (pool *RelayPool) GetGame(name string) (GameData, error) {
+	relay, err := pool.relayOf(name)
+	if err != nil {
+		return GameData{}, err
+	}
+	return relay.GetGame(name)
+}
+
+// GetGames requests the descriptions of the games from the relays they have been
+// created on, with one call per relay. Games unknown to the pool are missing in the result.
+// Fails if a relay with some of the games does not answer.
+func (pool *RelayPool) GetGames(names []string) (map[string]GameData, error) {
+	byRelay := make(map[*ClientRPC][]string)
+	pool.mutex.Lock()
+	for _, name := range names {
+		if relay, ok := pool.games[name]; ok {
+			byRelay[relay] = append(byRelay[relay], name)
+		}
+	}
+	pool.mutex.Unlock()
+	games := make(map[string]GameData, len(names))
+	for relay, relayNames := range byRelay {
+		relayGames, err := relay.GetGames(relayNames)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", relay.relayAddr, err)
+		}
+		for name, game := range relayGames {
+			games[name] = game
+		}
+	}
+	return games, nil
+}
+
+// RotateRecording starts a new recording file on the relay the game has been created on.
+func (pool *RelayPool) RotateRecording(gameName string) (string, error) {
+	relay, err := pool.relayOf(gameName)
+	if err != nil {
+		return "", err
+	}
+	return relay.RotateRecording(gameName)
+}
+
+// IssueJoinToken requests a token from the relay the game has been created on.
+func (pool *RelayPool) IssueJoinToken(gameName string) (string, error) {
+	relay, err := pool.relayOf(gameName)
+	if err != nil {
+		return "", err
+	}
+	return relay.IssueJoinToken(gameName)
+}
+
+// IssuePlayerJoinToken requests a token for the player from the relay the game has been created on.
+func (pool *RelayPool) IssuePlayerJoinToken(gameName, playerName string) (string, error) {
+	relay, err := pool.relayOf(gameName)
+	if err != nil {
+		return "", err
+	}
+	return relay.IssuePlayerJoinToken(gameName, playerName)
+}
+
+// ScheduleMaintenance announces the maintenance on all relays of the pool.
+// The relays which could be reached keep it even if others fail.
+func (pool *RelayPool) ScheduleMaintenance(message string, at time.Time) error {
+	var lastErr error
+	for _, relay := range pool.relays {
+		if err := relay.ScheduleMaintenance(message, at); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// SetAuthTokens changes the admin tokens of all relays of the pool.
+// The relays which could be reached accept the new tokens even if others fail.
+func (pool *RelayPool) SetAuthTokens(current, next string) error {
+	var lastErr error
+	for _, relay := range pool.relays {
+		if err := relay.SetAuthTokens(current, next); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// SetAdminToken replaces the admin token presented to all relays of the pool.
+func (pool *RelayPool) SetAdminToken(token string) {
+	for _, relay := range pool.relays {
+		relay.SetAdminToken(token)
+	}
+}
+
+// CancelMaintenance cancels the maintenance on all relays of the pool.
+func (pool *RelayPool) CancelMaintenance() error {
+	var lastErr error
+	for _, relay := range pool.relays {
+		if err := relay.CancelMaintenance(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Capabilities returns the capabilities supported by all relays of the pool.
+func (pool *RelayPool) Capabilities() (RelayCapabilities, error) {
+	all := ^RelayCapabilities(0)
+	for _, relay := range pool.relays {
+		capabilities, err := relay.Capabilities()
+		if err != nil {
+			return 0, err
+		}
+		all &= capabilities
+	}
+	return all, nil
+}
+
+// ClockSkew returns the largest skew between our clock and the one of a relay
+// of the pool, ahead or behind. known is false if no relay has been pinged yet.
+func (pool *RelayPool) ClockSkew() (skew time.Duration, known bool) {
+	abs := func(d time.Duration) time.Duration {
+		if d < 0 {
+			return -d
+		}
+		return d
+	}
+	for _, relay := range pool.relays {
+		if relaySkew, ok := relay.ClockSkew(); ok && (!known || abs(relaySkew) > abs(skew)) {
+			skew, known = relaySkew, true
+		}
+	}
+	return skew, known
+}
+
+// SupportedProtocols returns the protocol versions supported by all relays of the pool.
+func (pool *RelayPool) SupportedProtocols() ([]int, error) {
+	var common []int
+	for i, relay := range pool.relays {
+		versions, err := relay.SupportedProtocols()
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			common = versions
+			continue
+		}
+		supported := make(map[int]bool, len(versions))
+		for _, version := range versions {
+			supported[version] = true
+		}
+		kept := common[:0]
+		for _, version := range common {
+			if supported[version] {
+				kept = append(kept, version)
+			}
+		}
+		common = kept
+	}
+	return common, nil
+}
+
+// SelfTest runs the self test on all relays of the pool.
+// Returns the failure of the first relay which did not pass it.
+func (pool *RelayPool) SelfTest() error {
+	for _, relay := range pool.relays {
+		if err := relay.SelfTest(); err != nil {
+			return fmt.Errorf("%v: %v", relay.relayAddr, err)
+		}
+	}
+	return nil
+}
+
+// VerifyReachability checks the public addresses of all relays of the pool.
+// Returns whether all of them are reachable or the first error of a relay which
+// could not check it.
+func (pool *RelayPool) VerifyReachability(ctx context.Context) (bool, error) {
+	reachable := true
+	for _, relay := range pool.relays {
+		ok, err := relay.VerifyReachability(ctx)
+		if err != nil {
+			return false, fmt.Errorf("%v: %v", relay.relayAddr, err)
+		}
+		if !ok {
+			RPCLog.Warnf("RelayPool: Relay at %v is not reachable at its public address", relay.relayAddr)
+			reachable = false
+		}
+	}
+	return reachable, nil
+}
+
+// Ping succeeds if at least one relay of the pool is reachable.
+// Every relay is pinged and marked as healthy or unhealthy, so a relay which
+// recovered is used for new games again.
+func (pool *RelayPool) Ping() error {
+	var lastErr error
+	reachable := false
+	for _, relay := range pool.relays {
+		err := relay.Ping()
+		pool.mutex.Lock()
+		if err == nil {
+			delete(pool.unhealthy, relay)
+		} else {
+			pool.unhealthy[relay] = err
+		}
+		pool.mutex.Unlock()
+		if err == nil {
+			reachable = true
+		} else {
+			lastErr = err
+		}
+	}
+	if reachable {
+		return nil
+	}
+	return lastErr
+}
+
+// RelayPoolMember describes one relay of a RelayPool, see PoolStatus.
+type RelayPoolMember struct {
+	Addr   string
+	Region string
+	// Whether the relay answered, Err tells why not otherwise
+	Healthy bool
+	Err     error
+	// Number of games on the relay
+	Games int
+	// How full the relay is, from 0 (empty) to 1 (MaxGames reached).
+	// Always 0 for relays without a limit of games
+	Load float64
+	// Whether the relay has a scheduled maintenance and gets no new games
+	Draining bool
+	// The share of new games the relay receives, see SetRelayWeight
+	Weight int
+	// The complete status, only set if the relay is healthy
+	Status ServerStatus
+}
+
+// PoolStatus requests the status of all relays of the pool, e.g., for an admin page.
+// A relay which does not answer is reported as unhealthy and marked as such for
+// selecting the relays of new games.
+func (pool *RelayPool) PoolStatus() []RelayPoolMember {
+	members := make([]RelayPoolMember, 0, len(pool.relays))
+	for _, relay := range pool.relays {
+		member := RelayPoolMember{Addr: relay.relayAddr}
+		status, err := relay.Status()
+		pool.mutex.Lock()
+		member.Weight = pool.weightOf(relay)
+		if err == nil {
+			delete(pool.unhealthy, relay)
+		} else {
+			pool.unhealthy[relay] = err
+		}
+		pool.mutex.Unlock()
+		if err != nil {
+			member.Err = err
+			members = append(members, member)
+			continue
+		}
+		member.Healthy = true
+		member.Region = status.Region
+		member.Games = status.NGames
+		if status.MaxGames > 0 {
+			member.Load = float64(status.NGames) / float64(status.MaxGames)
+		}
+		member.Draining = !status.MaintenanceAt.IsZero()
+		member.Status = status
+		members = append(members, member)
+	}
+	return members
+}
+
+// Health reports the health of the first unhealthy relay, or of the first
+// relay if all are healthy. Errors are prefixed with the address of the relay.
+func (pool *RelayPool) Health() HealthReport {
+	var report HealthReport
+	for i, relay := range pool.relays {
+		r := relay.Health()
+		if r.RelayOK && r.CallbackOK {
+			if i == 0 {
+				report = r
+			}
+			continue
+		}
+		if r.RelayError != "" {
+			r.RelayError = relay.relayAddr + ": " + r.RelayError
+		}
+		if r.CallbackError != "" {
+			r.CallbackError = relay.relayAddr + ": " + r.CallbackError
+		}
+		return r
+	}
+	return report
+}
+
+// Status sums up the status of all reachable relays of the pool.
+// The region is only set if all relays are in the same region.
+func (pool *RelayPool) Status() (ServerStatus, error) {
+	var sum ServerStatus
+	var lastErr error
+	reachable := 0
+	unlimited := false
+	for _, relay := range pool.relays {
+		status, err := relay.Status()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if reachable == 0 {
+			sum.Region = status.Region
+		} else if sum.Region != status.Region {
+			sum.Region = ""
+		}
+		reachable++
+		sum.NClients += status.NClients
+		sum.NGames += status.NGames
+		sum.NOpenGames += status.NOpenGames
+		sum.MaxGames += status.MaxGames
+		if status.MaxGames == 0 {
+			unlimited = true
+		}
+	}
+	if unlimited {
+		sum.MaxGames = 0
+	}
+	if reachable == 0 {
+		return sum, lastErr
+	}
+	return sum, nil
+}
+
+// TrafficRate sums up the traffic rates of all reachable relays of the pool.
+func (pool *RelayPool) TrafficRate(window time.Duration) (float64, error) {
+	var sum float64
+	var lastErr error
+	reachable := 0
+	for _, relay := range pool.relays {
+		rate, err := relay.TrafficRate(window)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reachable++
+		sum += rate
+	}
+	if reachable == 0 {
+		return sum, lastErr
+	}
+	return sum, nil
+}
+
+// Subscribe calls the handler with each event reported by any relay of the pool
+// until the returned function is called.
+func (pool *RelayPool) Subscribe(handler func(Event)) (func(), error) {
+	return subscribe(pool.subscribers, pool.relays, handler)
+}
+
+// Quiesce quiesces all relays of the pool in parallel. Returns the first error.
+func (pool *RelayPool) Quiesce(ctx context.Context) error {
+	errs := make(chan error, len(pool.relays))
+	for _, relay := range pool.relays {
+		go func(relay *ClientRPC) {
+			errs <- relay.Quiesce(ctx)
+		}(relay)
+	}
+	var firstErr error
+	for range pool.relays {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// CloseConnection terminates the connections to all relays.
+func (pool *RelayPool) CloseConnection() {
+	pool.listener.Close()
+	for _, relay := range pool.relays {
+		relay.CloseConnection()
+	}
+}
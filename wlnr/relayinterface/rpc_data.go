@@ -1,9 +1,562 @@
 package relayinterface
 
+import (
+	"fmt"
+	"time"
+)
+
 // GameData is the data structure passed between client and server over rpc.
 type GameData struct {
 	Name     string
 	Password string
+	// Set by the relay on a notification if earlier notifications have been
+	// dropped because the metaserver could not keep up. The metaserver
+	// should re-sync its list of games when it sees this.
+	EventsDropped bool
+	// The id of a player in the game, if the message is about a player
+	PlayerID uint64
+	// Whether the game should be listed in the lobby. Private games are still
+	// returned by ListGames, but the lobby should not show them.
+	// Joining does not depend on this.
+	Public bool
+	// If set, the relay closes the game when no game data has been forwarded
+	// for this long, even if players are still connected. Disabled if 0.
+	AutoCloseAfterNoTraffic time.Duration
+	// Why the game has been closed, only set on GameClosed
+	CloseReason CloseReason
+	// How long the game may still exist before the relay closes it.
+	// Only set by the relay, 0 if the lifetime of games is unlimited
+	RemainingLifetime time.Duration
+	// How long the relay waits for the host to connect before removing the game.
+	// Only set by the relay, 0 once the host connected
+	TimeUntilNoHostClose time.Duration
+	// How long until the relay closes the game if no game data is forwarded
+	// until then, see AutoCloseAfterNoTraffic. Only set by the relay, 0 if disabled
+	TimeUntilNoTrafficClose time.Duration
+	// The shortest of the times above, so the host can show a single countdown.
+	// Only set by the relay, 0 if none of the timeouts applies
+	TimeUntilClose time.Duration
+	// Attributes of the game for the lobby, e.g., the map name.
+	// The relay stores them without looking at them, see MaxTags and MaxTagLength
+	Tags map[string]string
+	// Identifies who created the game, e.g., the address of the host, so all
+	// games of the owner can be removed at once. The relay does not interpret it
+	OwnerID string
+	// Whether the participants can send datagrams over the UDP port of the relay
+	// in addition to the TCP connection. Ignored if the relay has no UDP port
+	UDPEnabled bool
+	// Token returned by ReserveGameName, needed to create a game with a reserved name
+	ReservationToken string
+	// Whether the game is competitive. Compared to other games, the relay
+	//  - refuses to create the game if it does not record games (RecordDir is not configured),
+	//  - pings the participants every 20 instead of 90 seconds and disconnects
+	//    them if they do not answer before the next ping,
+	//  - refuses TransferHost with a new host password with ErrRankedGame.
+	// Nothing else changes. The relay can not pause games, so there is no pausing to disable
+	Ranked bool
+	// Optional id chosen by the metaserver to trace the creation of the game, e.g., a UUID.
+	// The relay adds it to its log lines about the game and to the notifications about it
+	RequestID string
+	// Whether new players are refused while the players in the game keep playing,
+	// see LockGame. Ignored when creating a game
+	Locked bool
+	// Which frames of game data are recorded if the relay records games.
+	// The zero value records all of them
+	RecordSampling FrameSampling
+	// Whether the game only lets in new players with a join token, see MakeInviteOnly.
+	// Only set by the relay
+	InviteOnly bool
+	// The key epoch the host of a game with end-to-end encryption announced last,
+	// e.g., to debug players using different keys. Only set by the relay, 0 if none
+	KeyEpoch int
+	// Trace context of the call of the metaserver, see TracePropagator. Empty if not traced
+	TraceParent string
+}
+
+// FrameSampling selects the frames of game data recorded for a game, so long
+// games can be traced cheaply. The recorded frames keep their time and sender,
+// so the timing of the game can still be reconstructed approximately
+type FrameSampling struct {
+	// Only frames of at least this many bytes, including their length, are recorded. Ignored if 0
+	MinSize int
+	// Only frames of at most this many bytes are recorded. Ignored if 0
+	MaxSize int
+	// Only every Nth of the frames within the size limits is recorded, starting
+	// with the first one. All of them are recorded if this is 0 or 1
+	EveryNth int
+}
+
+// Returns an error if the sampling can not be used
+func validateSampling(sampling FrameSampling) error {
+	if sampling.MinSize < 0 || sampling.MaxSize < 0 || sampling.EveryNth < 0 {
+		return fmt.Errorf("Values of RecordSampling must not be negative")
+	}
+	if sampling.MaxSize > 0 && sampling.MaxSize < sampling.MinSize {
+		return fmt.Errorf("MaxSize of RecordSampling must not be below MinSize")
+	}
+	return nil
+}
+
+// Limits for GameData.Tags enforced by the relay
+const (
+	// Maximal number of tags per game
+	MaxTags = 16
+	// Maximal length of the key and of the value of a tag in bytes
+	MaxTagLength = 256
+)
+
+// Returns an error if the tags exceed the limits
+func validateTags(tags map[string]string) error {
+	if len(tags) > MaxTags {
+		return fmt.Errorf("Too many tags: %v, at most %v are allowed", len(tags), MaxTags)
+	}
+	for key, value := range tags {
+		if len(key) > MaxTagLength || len(value) > MaxTagLength {
+			return fmt.Errorf("Tag '%.20v' is too long, at most %v bytes are allowed", key, MaxTagLength)
+		}
+	}
+	return nil
+}
+
+// CloseReason tells the metaserver why a game has been closed by the relay.
+type CloseReason string
+
+const (
+	// The host left the game or the metaserver removed it
+	CloseReasonNormal CloseReason = ""
+	// The host did not connect in time after the game has been created
+	CloseReasonNoHost CloseReason = "NoHost"
+	// No game data has been forwarded within GameData.AutoCloseAfterNoTraffic
+	CloseReasonNoTraffic CloseReason = "NoTraffic"
+	// The game existed for longer than the maximal lifetime configured on the relay
+	CloseReasonExpired CloseReason = "Expired"
+	// The relay has been shut down
+	CloseReasonShutdown CloseReason = "Shutdown"
+)
+
+// JoinInstruction tells a player how to join a game on a relay.
+// It is passed on to the player by the metaserver.
+type JoinInstruction struct {
+	// Host name or IP address of the relay. Empty if the relay does not know
+	// its public address, then the address of the relay as known to the
+	// metaserver should be used
+	Address string
+	// The port the relay accepts game connections on
+	Port int
+	// The name of the game on the relay
+	GameName string
+	// The version of the protocol to use for talking to the relay
+	ProtocolVersion uint8
+	// The optional features of the relay
+	Capabilities RelayCapabilities
+}
+
+// RelayLimits are the resource limits of a relay which can be changed at runtime.
+// A limit of 0 means unlimited.
+type RelayLimits struct {
+	// Maximal number of games on the relay
+	MaxGames int
+	// Maximal number of game connections from one IP address
+	MaxConnectionsPerIP int
+}
+
+// GameFilter selects the games returned by ListGamesFiltered.
+// The zero value matches all games, each field set narrows them down.
+type GameFilter struct {
+	// Only games whose host is connected and which are not locked, see LockGame
+	OnlyOpen bool
+	// Only games whose host speaks a version of the relay protocol in this range,
+	// see SupportedProtocols. Games whose host did not connect yet have no version
+	// and do not match if one of the limits is set. Ignored if 0
+	MinProtocol int
+	MaxProtocol int
+	// Only games with this in their name, ignoring case. Ignored if empty
+	NameContains string
+	// Leaves out the games which are not listed publicly, see GameData.Public
+	ExcludePrivate bool
+	// Leaves out ranked games, see GameData.Ranked
+	ExcludeRanked bool
+}
+
+// GamesPageRequest is send by the metaserver to request some of the games of a relay.
+type GamesPageRequest struct {
+	Offset int
+	Limit  int
+}
+
+// GamesPage is the answer to a GamesPageRequest.
+type GamesPage struct {
+	Games []GameData
+	// The number of all games on the relay
+	Total int
+}
+
+// MaintenanceRequest is send by the metaserver to announce a restart of a relay to the players.
+type MaintenanceRequest struct {
+	// Has to match the admin token configured on the relay
+	AdminToken string
+	// Shown to the players, ignored when cancelling
+	Message string
+	// When the relay will be restarted, ignored when cancelling
+	At time.Time
+}
+
+// RelayConfigView contains the settings a relay is running with by name,
+// after applying the defaults and reading the secrets. Secrets are shown as "***" if set.
+type RelayConfigView map[string]string
+
+// LimitsRequest is send by the metaserver to query or change the limits of a relay.
+type LimitsRequest struct {
+	// Has to match the admin token configured on the relay
+	AdminToken string
+	// The new limits, ignored when querying them
+	Limits RelayLimits
+}
+
+// AuthTokensRequest is send by the metaserver to change the admin tokens of a relay.
+type AuthTokensRequest struct {
+	// Has to match one of the admin tokens the relay accepts now
+	AdminToken string
+	// The tokens the relay accepts from now on, Next might be empty
+	Current string
+	Next    string
+}
+
+// TimedGameRequest asks the relay to create a game and report how long that took.
+type TimedGameRequest struct {
+	Game GameData
+	// When the metaserver did send the request
+	SentAt time.Time
+}
+
+// CreateGameTiming tells where the time went when the relay created a game.
+type CreateGameTiming struct {
+	// From sending the request until the relay started handling it.
+	// Includes the difference between the clocks of metaserver and relay
+	Transfer time.Duration
+	// Checking the request, e.g., the tags
+	Validation time.Duration
+	// Creating the game on the relay
+	Setup time.Duration
+}
+
+// ReservationRequest asks the relay to keep a game name free.
+type ReservationRequest struct {
+	Name string
+	// How long the name is kept free
+	TTL time.Duration
+}
+
+// InviteOnlyRequest is send by the metaserver to make a game invite-only.
+type InviteOnlyRequest struct {
+	Name     string
+	Password string
+	// How many join tokens to return as invitations
+	Invites int
+}
+
+// The most invitations MakeInviteOnly returns at once, a game has no room for more players
+const MaxInvites = 250
+
+// PlayerJoinTokenRequest is send by the metaserver to get a join token for an authenticated player.
+type PlayerJoinTokenRequest struct {
+	Name string
+	// The name of the player as authenticated by the metaserver
+	PlayerName string
+}
+
+// LogLine is a message written by one of the loggers of the relay.
+type LogLine struct {
+	Time    time.Time
+	Level   LogLevel
+	Message string
+}
+
+// LogsRequest is send by the metaserver to get the recent log messages of a relay.
+type LogsRequest struct {
+	// Has to match the admin token configured on the relay
+	AdminToken string
+	// The most messages returned, all kept ones if not positive
+	Limit int
+	// Only messages of this level and above are returned
+	MinLevel LogLevel
+}
+
+// GameSummary describes a game after it has been closed on the relay.
+type GameSummary struct {
+	Name string
+	// How long the game existed on the relay
+	Duration time.Duration
+	// The most players connected at the same time, including the host
+	PeakPlayers int
+	// The number of bytes of game data the relay forwarded to the players
+	TotalBytes  int64
+	CloseReason CloseReason
+	ClosedAt    time.Time
+}
+
+// HostTransfer asks the relay to make another player the host of a game.
+type HostTransfer struct {
+	Name string
+	// The current host password of the game
+	Password string
+	// The id of the connected player becoming the new host
+	NewHost string
+	// Replaces the host password of the game if not empty
+	NewPassword string
+}
+
+// KickRequest is send by the metaserver to remove a player from a game.
+type KickRequest struct {
+	Name string
+	// The host password of the game
+	Password string
+	// The id of the player inside the game, see PlayerInfo.ID
+	PlayerID uint64
+}
+
+// GameNames lists games the metaserver wants to do something with at once.
+type GameNames struct {
+	Names []string
+}
+
+// HelloData is send by the relay when connecting to the metaserver.
+type HelloData struct {
+	// Random id of the relay process, generated on startup
+	InstanceID string
+	// The optional features the relay supports
+	Capabilities RelayCapabilities
+}
+
+// PlayerInfo describes a player connected to a game on the relay.
+type PlayerInfo struct {
+	// The id of the player inside the game
+	ID     uint64
+	IsHost bool
+	// Whether the player only watches the game
+	Spectator bool
+	// The name of the player in the lobby if the game told the relay about it
+	Name string
+	// The largest frame of game data forwarded between the host and the player,
+	// negotiated from the preferences of both. 0 if there is no limit or this is the host
+	MaxFrameSize int
+	// IP address and port of the player as seen by the relay, i.e., its public
+	// address if it is behind a NAT. Only set if the relay has audit logging enabled
+	RemoteAddr string
+	// Address the UDP datagrams of the player come from, which differs from
+	// RemoteAddr in the port behind a symmetric NAT. Only set if the relay has
+	// audit logging enabled and the player sent its UDP token
+	UDPAddr string
+}
+
+// PlayerConnection tells whether a player of a game is connected to the relay,
+// see Client.IsPlayerConnected.
+type PlayerConnection string
+
+const (
+	// The player is connected to the game
+	PlayerConnected PlayerConnection = "Connected"
+	// The player lost its connection and may still reconnect to its slot
+	PlayerReconnecting PlayerConnection = "Reconnecting"
+	// The player left the game, has been kicked or did not reconnect in time.
+	// Also returned for ids which never have been used in the game
+	PlayerGone PlayerConnection = "Gone"
+)
+
+// PlayerConnectionRequest is send by the metaserver to check whether a player is connected.
+type PlayerConnectionRequest struct {
+	Name string
+	// The id of the player inside the game, see PlayerInfo.ID
+	PlayerID uint64
+}
+
+// GameStateDump is a snapshot of what the relay knows about a game, for debugging.
+type GameStateDump struct {
+	Name string
+	// When the snapshot has been taken
+	TakenAt   time.Time
+	CreatedAt time.Time
+	// The relay protocol version negotiated with the host, 0 if the host did not connect yet
+	ProtocolVersion uint8
+	Public          bool
+	UDPEnabled      bool
+	Tags            map[string]string
+	// The id the next client joining the game gets
+	NextClientID  uint8
+	HostConnected bool
+	// The host and the connected clients
+	Participants []ParticipantDump
+	// The ids of the clients which lost their connection and can still reconnect
+	ReconnectSlots []uint64
+	BytesForwarded int64
+	// When game data has been forwarded the last time
+	LastTraffic time.Time
+	Recorded    bool
+	// Where the dump has been written to next to the recording, empty if it has not been written
+	Path string
+}
+
+// ParticipantDump is the state of a connection to a game in a GameStateDump.
+type ParticipantDump struct {
+	PlayerInfo
+	// The sequence number of the last ping the relay sent
+	LastPingSeq    uint8
+	WaitingForPong bool
+	// How long the last ping took to be answered
+	RTT time.Duration
+	// Whether the participant got a token to reconnect with
+	CanReconnect bool
+}
+
+// LatencyStats tells how long frames of game data took from being read by the relay
+// until they have been written to the receiving connections. Only some frames are timed.
+type LatencyStats struct {
+	Average time.Duration
+	// The percentiles are rounded up to the next power of two microseconds
+	P95 time.Duration
+	P99 time.Duration
+	// The number of timed frames
+	Samples int64
+}
+
+// GameTraffic tells how much game data has been forwarded in a game since Since,
+// which is the creation of the game or the last ResetGameCounters.
+type GameTraffic struct {
+	// Bytes written to the participants, a frame send to three clients counts three times
+	Bytes int64
+	// Frames and datagrams forwarded, each counts once no matter how many receive it
+	Frames int64
+	Since  time.Time
+}
+
+// CapacityWarning is send by the relay when it is nearly full.
+type CapacityWarning struct {
+	// Number of games on the relay
+	Current int
+	// Maximal number of games on the relay
+	Max int
+}
+
+// SheddingLevel tells which new connections an overloaded relay refuses to
+// protect the games in progress, see ServerStatus.Shedding.
+type SheddingLevel int
+
+const (
+	// All connections are accepted
+	SheddingNone SheddingLevel = iota
+	// New spectators are refused
+	SheddingSpectators
+	// New spectators, new players of games which are not ranked and new games
+	// which are not ranked are refused. Only ranked games still get new players
+	SheddingCasual
+)
+
+func (l SheddingLevel) String() string {
+	switch l {
+	case SheddingNone:
+		return "none"
+	case SheddingSpectators:
+		return "spectators"
+	case SheddingCasual:
+		return "casual"
+	}
+	return fmt.Sprintf("SheddingLevel(%d)", int(l))
+}
+
+// JoinRejectReason tells why a connection to a game has been refused.
+type JoinRejectReason string
+
+const (
+	// The connection presented a wrong host password
+	RejectWrongPassword JoinRejectReason = "WrongPassword"
+	// Too many wrong host passwords have been presented, see ErrLockedOut
+	RejectLockedOut JoinRejectReason = "LockedOut"
+	// The host locked the game, see LockGame
+	RejectGameLocked JoinRejectReason = "GameLocked"
+	// The game is invite-only and the connection had no join token of it, see MakeInviteOnly
+	RejectNotInvited JoinRejectReason = "NotInvited"
+	// The relay is overloaded and refuses connections like this one, see SheddingLevel
+	RejectOverloaded JoinRejectReason = "Overloaded"
+)
+
+// JoinRejection is send by the relay when it refused a connection to a game.
+type JoinRejection struct {
+	Game string
+	// The address the connection came from
+	RemoteAddr string
+	Reason     JoinRejectReason
+}
+
+// ChatMessage is send by the relay for each chat message in a game if it is
+// configured to report them.
+type ChatMessage struct {
+	Game string
+	// The id of the sender in the game, see PlayerInfo.ID
+	PlayerID uint64
+	// The name of the sender in the lobby, might be empty
+	PlayerName string
+	Spectator  bool
+	Message    string
+}
+
+// AlertCode tells which problem a RelayAlert is about.
+type AlertCode string
+
+const (
+	// The relay gets more game connections than it can handle and should be scaled out
+	AlertOverloaded AlertCode = "Overloaded"
+	// Games are throttled since the relay reached its MaxTotalBandwidth
+	AlertBandwidthExceeded AlertCode = "BandwidthExceeded"
+)
+
+// RelayAlert is send by the relay when operators should look at it.
+type RelayAlert struct {
+	Code AlertCode
+	// Details for the operators
+	Message string
+}
+
+// PlayerLocation tells which game a player is connected to.
+type PlayerLocation struct {
+	GameName string
+	// The id of the player inside the game
+	PlayerID    uint64
+	IsHost      bool
+	IsSpectator bool
+}
+
+// PingRequest is send by the metaserver to check whether the relay is reachable.
+type PingRequest struct {
+	// Whether the relay should try to reach the metaserver on the callback channel
+	CheckCallback bool
+}
+
+// PingResponse is the answer of the relay to a PingRequest.
+type PingResponse struct {
+	// Whether the relay could reach the metaserver on the callback channel
+	CallbackOK bool
+	// Why the relay could not reach the metaserver
+	CallbackError string
+	// The time of the clock of the relay when it received the request, to estimate
+	// how far the clocks are apart. Zero if the relay is too old to report it
+	Now time.Time
+	// How long calling the metaserver back took, if requested
+	CallbackTook time.Duration
+}
+
+// HealthReport describes the state of both directions of the connection to a relay.
+type HealthReport struct {
+	// Whether calls to the relay work
+	RelayOK    bool
+	RelayError string
+	// Whether the relay can call us back
+	CallbackOK    bool
+	CallbackError string
+}
+
+// TrafficRequest asks the relay for its traffic rate over the given window.
+type TrafficRequest struct {
+	Window time.Duration
 }
 
 /*
@@ -1,12 +1,40 @@
 package relayinterface
 
+import (
+	"context"
+	"time"
+)
+
 // The Server interface describes the notifications that can be send to a
 // connected metaserver instance.
 type Server interface {
 	// Notify metaserver that a host connected to a game.
 	GameConnected(name string)
 	// Notify metaserver that a game has ended.
-	GameClosed(name string)
+	GameClosed(name string, reason CloseReason)
+	// Notify metaserver that a client reconnected to its old slot in a game.
+	ClientReconnected(name string, playerID uint64)
+	// Notify metaserver that the player with the given id became the host of a game.
+	// The id is the one the player had before becoming the host.
+	HostChanged(name string, playerID uint64)
+	// Warn metaserver that the relay is nearly full.
+	OnCapacityWarning(current, max int)
+	// Alert metaserver of a problem of the relay operators should know about.
+	OnRelayAlert(alert RelayAlert)
+	// Notify metaserver that a connection to a game has been refused.
+	ClientJoinRejected(rejection JoinRejection)
+	// Pass a chat message of a game to the metaserver.
+	ClientChat(message ChatMessage)
+	// Send the event to the metaserver if it subscribed to events and to the
+	// EventPublishers of ServerRPCOptions. Never waits for the publishers.
+	// GameConnected, GameClosed, ClientReconnected and HostChanged publish their events themselves.
+	PublishEvent(event Event)
+	// Accept both tokens for administrative calls of the metaserver from now on.
+	// next might be empty, see ClientRPC.SetAuthTokens.
+	SetAuthTokens(current, next string)
+	// Waits until the queued notifications have been send to the metaserver.
+	// Fails with the error of ctx if it is done before.
+	Flush(ctx context.Context) error
 	// Closes the connection to metaserver.
 	CloseConnection()
 }
@@ -14,6 +42,46 @@ type Server interface {
 // ServerCallback contains methods that are called when
 // the metaserver sends a command.
 type ServerCallback interface {
-	CreateGame(name string, password string) bool
+	// Returns ErrGameExists, ErrRelayFull, ErrNotRecorded, ErrOwnerGameLimit or
+	// ErrNameReserved if the game can not be created
+	CreateGameErr(game GameData) error
+	CountGamesByOwner(ownerID string) int
+	ReserveGameName(name string, ttl time.Duration) (string, error)
 	RemoveGame(name string) bool
+	RemoveGamesByOwner(ownerID string) []string
+	SetVisibility(name string, password string, public bool) error
+	MakeInviteOnly(name string, password string, invites int) ([]string, error)
+	LockGame(name string, password string, locked bool) error
+	TransferHost(name, password, newHost, newPassword string) error
+	KickPlayerByID(name, password string, playerID uint64) error
+	VerifyHostPassword(name, password string) (bool, error)
+	ListGames() []GameData
+	ListGamesFiltered(filter GameFilter) []GameData
+	Status() ServerStatus
+	TrafficRate(window time.Duration) float64
+	GetGamePlayers(name string) ([]PlayerInfo, bool)
+	// Returns ErrGameNotFound if there is no game with the name
+	IsPlayerConnected(name string, playerID uint64) (PlayerConnection, error)
+	FindPlayer(name string) []PlayerLocation
+	DumpGameState(name string) (GameStateDump, error)
+	ForwardingLatency(name string) (LatencyStats, error)
+	GameTraffic(name string) (GameTraffic, error)
+	ResetGameCounters(name, password string) error
+	GetGame(name string) (GameData, bool)
+	RotateRecording(name string) (string, error)
+	IssueJoinToken(name string) (string, error)
+	IssuePlayerJoinToken(name, player string) (string, error)
+	GetGameHistory(limit int) []GameSummary
+	// Returns ErrGameNotFound if the game neither exists nor is in the history
+	GetGameTimeline(name string) ([]TimelineEvent, error)
+	GetLimits() RelayLimits
+	SetLimits(limits RelayLimits)
+	EffectiveConfig() RelayConfigView
+	GetRecentLogs(limit int, minLevel LogLevel) []LogLine
+	ScheduleMaintenance(message string, at time.Time) error
+	CancelMaintenance()
+	Capabilities() RelayCapabilities
+	SupportedProtocols() []int
+	SelfTest() error
+	VerifyReachability() (bool, error)
 }
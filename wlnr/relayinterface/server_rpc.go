@@ -1,20 +1,139 @@
 package relayinterface
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/rpc"
 	"net/rpc/jsonrpc"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// CallbackOverflowPolicy decides what happens to a notification for the metaserver
+// when the queue of pending notifications is full.
+type CallbackOverflowPolicy int
+
+const (
+	// Wait until there is room in the queue. No notification is ever lost, but
+	// the relay code firing the notification (e.g., a game accepting its host)
+	// stalls as long as the metaserver is slow.
+	CallbackOverflowBlock CallbackOverflowPolicy = iota
+	// Discard the oldest pending notification to make room for the new one.
+	// The relay never stalls and the metaserver receives the most recent
+	// notifications, but it has to re-sync since older ones got lost.
+	CallbackOverflowDropOldest
+	// Discard the new notification. The relay never stalls and the
+	// notifications that are already waiting are delivered in order, but
+	// the metaserver has to re-sync since the newest ones got lost.
+	CallbackOverflowDropAndFlag
+)
+
+// The number of pending notifications if ServerRPCOptions.CallbackQueueSize is not set.
+const DefaultCallbackQueueSize = 64
+
+// ServerRPCOptions contains the settings for a ServerRPC.
+// The zero value is a valid configuration.
+type ServerRPCOptions struct {
+	// Maximal number of notifications waiting to be send to the metaserver.
+	CallbackQueueSize int
+	// What to do when the queue is full.
+	CallbackOverflow CallbackOverflowPolicy
+	// Address of the RPC server of the metaserver. Defaults to localhost:7399.
+	MetaserverAddr string
+	// Whether to compress the rpc connections if the metaserver supports it.
+	// Only worth it for a metaserver at a remote location, see BenchmarkStatusPayload.
+	Compress bool
+	// Token the metaserver has to present for administrative calls like SetLimits.
+	// These calls are refused if this is empty.
+	AdminToken string
+	// Statuses larger than this many bytes of JSON are truncated, see ServerStatus.Truncated.
+	// Defaults to DefaultMaxStatusSize
+	MaxStatusSize int
+	// Connections of the metaserver are closed when no request arrives for this long.
+	// The metaserver connects again for its next call. Disabled if 0
+	IdleTimeout time.Duration
+	// Get all events of the relay in addition to a subscribed metaserver, e.g.,
+	// to push them to a message queue. Each has its own queue of EventQueueSize
+	// events, defaults to DefaultEventQueueSize
+	EventPublishers []EventPublisher
+	EventQueueSize  int
+	// Creates a span around NewGame and RemoveGame calls of the metaserver, as child
+	// of the span the metaserver sent if it is a TracePropagator. Calls are not traced if nil
+	Tracer Tracer
+}
+
+var errNotConnected = errors.New("Not connected to metaserver")
+
+// A notification waiting to be send to the metaserver.
+type pendingCallback struct {
+	action   string
+	gameName string
+	// The GameData.RequestID of the game, if any
+	requestID string
+	playerID  uint64
+	reason    CloseReason
+	// Send instead of a GameData if the notification is not about a game
+	payload interface{}
+	// Set if this is an event instead of a notification
+	event *Event
+}
+
 // ServerRPC implements the server part of a rpc connection between
 // metaserver and relay server.
 type ServerRPC struct {
-	callback ServerCallback
-	client   *rpc.Client
-	listener net.Listener
+	callback       ServerCallback
+	client         *rpc.Client
+	listener       net.Listener
+	metaserverAddr string
+	compress       bool
+	// The tokens accepted for administrative calls, protected by tokenMutex
+	adminToken     string
+	nextAdminToken string
+	tokenMutex     sync.RWMutex
+	maxStatusSize  int
+	idleTimeout    time.Duration
+	// Random id of this relay process, used to detect connection loops
+	instanceID string
+	// Protects client
+	clientMutex sync.Mutex
+
+	// Notifications waiting to be send to the metaserver
+	callbacks chan pendingCallback
+	overflow  CallbackOverflowPolicy
+
+	// Whether notifications have been dropped since the last successful one
+	eventsDropped bool
+	droppedMutex  sync.Mutex
+
+	// Whether the metaserver subscribed to events. Accessed atomically
+	subscribed int32
+	// Where the events go, see EventPublisher
+	publishers []EventPublisher
+	// Continues the traces of the metaserver, nil if not tracing
+	tracer Tracer
+
+	// The GameData.RequestID of the games which have been created with one
+	requestIDs      map[string]string
+	requestIDsMutex sync.Mutex
+
+	// Held while a notification is send to the metaserver
+	sendingMutex sync.Mutex
+	// Closed when the metaserver connects again after Quiesce, nil if not quiesced
+	resumed     chan struct{}
+	resumeMutex sync.Mutex
+
+	// How often serving a connection of the metaserver panicked. Accessed atomically
+	panics int32
+
+	// The number of queued notifications which have not been send yet. Accessed atomically
+	unsent int32
 }
 
 // ServerRPCMethods is a helper structure for the exposed rpc methods
@@ -26,14 +145,33 @@ type ServerRPCMethods struct {
 // NewServerRPC creates a struct that implements relayinterface.Server over RPC.
 // Opens an RPC server running on port 7398.
 // Methods of the given callback are called with notifications of the client.
-func NewServerRPC(callback ServerCallback) Server {
+func NewServerRPC(callback ServerCallback, options ServerRPCOptions) Server {
 	// Start rpc server so the metaserver can tell us about new games
-	log.Printf("Starting RPC server")
+	RPCLog.Infof("Starting RPC server")
 
+	queueSize := options.CallbackQueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultCallbackQueueSize
+	}
+	metaserverAddr := options.MetaserverAddr
+	if metaserverAddr == "" {
+		metaserverAddr = "localhost:7399"
+	}
 	server := &ServerRPC{
-		callback: callback,
-		client:   nil,
+		callback:       callback,
+		client:         nil,
+		metaserverAddr: metaserverAddr,
+		compress:       options.Compress,
+		adminToken:     options.AdminToken,
+		maxStatusSize:  options.MaxStatusSize,
+		idleTimeout:    options.IdleTimeout,
+		instanceID:     newInstanceID(),
+		callbacks:      make(chan pendingCallback, queueSize),
+		overflow:       options.CallbackOverflow,
+		requestIDs:     make(map[string]string),
+		tracer:         options.Tracer,
 	}
+	server.publishers = server.newPublishers(options)
 
 	serverMethods := &ServerRPCMethods{
 		server: server,
@@ -41,104 +179,876 @@ func NewServerRPC(callback ServerCallback) Server {
 	rpc.Register(serverMethods)
 	l, e := net.Listen("tcp", ":7398")
 	if e != nil {
-		log.Printf("Unable to listen on rpc port: %v", e)
+		RPCLog.Warnf("Unable to listen on rpc port: %v", e)
 	}
 	server.listener = l
 
-	go func() {
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				continue
-			}
-			go jsonrpc.ServeConn(conn)
+	go server.serveMetaserver(l)
+	go server.sendCallbacks()
+
+	return server
+}
+
+// Accepts the rpc connections of the metaserver and serves each one in its own goroutine
+func (server *ServerRPC) serveMetaserver(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			continue
+		}
+		server.resume()
+		go server.serveConnection(conn)
+	}
+}
+
+// Serves a rpc connection of the metaserver. A panic while doing so only closes the
+// connection, the metaserver can connect again. It is logged and counted in ServerStatus.RPCPanics
+func (server *ServerRPC) serveConnection(conn net.Conn) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt32(&server.panics, 1)
+			RPCLog.Warnf("ServerRPC: Serving rpc connection from %v panicked: %v", conn.RemoteAddr(), r)
+			conn.Close()
 		}
 	}()
+	serveRPC(conn, server.compress, rpc.DefaultServer, server.idleTimeout)
+}
 
-	return server
+// Generates the id of this relay process
+func newInstanceID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Unable to generate instance id: %v", err)
+	}
+	return hex.EncodeToString(b)
 }
 
 // Establishes a connection to the metaserver.
 func (server *ServerRPC) connect() bool {
 	// Open connection to metaserver
-	connection, err := net.DialTimeout("tcp", "localhost:7399", time.Duration(10)*time.Second)
+	connection, err := dialRPC(server.metaserverAddr, time.Duration(10)*time.Second, server.compress)
 	if err != nil {
-		log.Printf("ServerRPC: Unable to connect to metaserver at localhost: %v", err)
+		RPCLog.Warnf("ServerRPC: Unable to connect to metaserver at %v: %v", server.metaserverAddr, err)
 		return false
 	}
-	server.client = jsonrpc.NewClient(connection)
-	log.Println("ServerRPC: Connected to metaserver")
+	client := jsonrpc.NewClient(connection)
+	if err := server.handshake(client); err != nil {
+		RPCLog.Warnf("ServerRPC: Refusing connection to %v: %v", server.metaserverAddr, err)
+		client.Close()
+		return false
+	}
+	server.client = client
+	RPCLog.Infof("ServerRPC: Connected to metaserver")
 	return true
 }
 
-// CloseConnection terminates the connection to the metaserver.
+// Introduces us to the metaserver. Fails if the other side is not a metaserver
+// but this or another relay, which happens when MetaserverAddr is misconfigured.
+func (server *ServerRPC) handshake(client *rpc.Client) error {
+	var ignored bool
+	hello := HelloData{
+		InstanceID:   server.instanceID,
+		Capabilities: server.callback.Capabilities(),
+	}
+	err := client.Call("ClientRPCMethods.Hello", hello, &ignored)
+	if err == nil {
+		return nil
+	}
+	var status ServerStatus
+	if client.Call("ServerRPCMethods.Status", "", &status) != nil {
+		// Not a relay either, report the original problem
+		return err
+	}
+	if status.InstanceID == server.instanceID {
+		return errors.New("connected to ourself instead of the metaserver")
+	}
+	return fmt.Errorf("connected to relay %v instead of the metaserver", status.InstanceID)
+}
+
+// CloseConnection terminates the connection to the metaserver and stops publishing events.
 func (server *ServerRPC) CloseConnection() {
 	server.listener.Close()
+	server.closePublishers()
 }
 
 // Calls a method on the rpc client.
 // (Re-)Connects to the client if currently not connected or the connection is broken.
-func (server *ServerRPC) callClientMethod(action, gameName string) {
+func (server *ServerRPC) callMetaserverMethod(method string, args interface{}, reply interface{}) error {
+	server.clientMutex.Lock()
+	defer server.clientMutex.Unlock()
 	if server.client == nil {
 		// Probably there never was a connection, try to create one now
 		// Isn't done in the constructor since we have a circular dependency between
 		// relay and metaserver
 		if !server.connect() {
-			return
+			return errNotConnected
 		}
 	}
+	var err error
+	for i := 0; i < 2; i++ {
+		err = server.client.Call("ClientRPCMethods."+method, args, reply)
+		if err != rpc.ErrShutdown {
+			return err
+		}
+		if !server.connect() {
+			RPCLog.Warnf("ServerRPC: Lost connection to metaserver and are unable to reconnect")
+			return err
+		}
+		RPCLog.Warnf("ServerRPC: Lost connection to metaserver but was able to reconnect")
+	}
+	return err
+}
+
+// Sends a notification to the metaserver. Returns whether the call succeeded.
+func (server *ServerRPC) callClientMethod(c pendingCallback, eventsDropped bool) bool {
 	var ignored bool
-	data := GameData{
-		Name: gameName,
+	if c.event != nil {
+		event := *c.event
+		event.EventsDropped = eventsDropped
+		err := server.callMetaserverMethod("Event", event, &ignored)
+		if err != nil && err != errNotConnected {
+			RPCLog.Warnf("ServerRPC  error: %v", err)
+		}
+		return err == nil
 	}
-	for i := 0; i < 2; i++ {
-		err := server.client.Call("ClientRPCMethods."+action, data, &ignored)
-		if err == nil {
-			break
+	if c.payload != nil {
+		err := server.callMetaserverMethod(c.action, c.payload, &ignored)
+		if err != nil && err != errNotConnected {
+			RPCLog.Warnf("ServerRPC  error: %v", err)
 		}
-		if err == rpc.ErrShutdown {
-			if !server.connect() {
-				log.Printf("ServerRPC: Lost connection to metaserver and are unable to reconnect")
+		return err == nil
+	}
+	data := GameData{
+		Name:          c.gameName,
+		RequestID:     c.requestID,
+		EventsDropped: eventsDropped,
+		PlayerID:      c.playerID,
+		CloseReason:   c.reason,
+	}
+	err := server.callMetaserverMethod(c.action, data, &ignored)
+	if err != nil && err != errNotConnected {
+		RPCLog.Warnf("ServerRPC  error: %v", err)
+	}
+	return err == nil
+}
+
+// Adds a notification to the queue, handling an overflow as configured.
+func (server *ServerRPC) queueCallback(c pendingCallback) {
+	// Counted before it is queued, so it is never send before being counted
+	atomic.AddInt32(&server.unsent, 1)
+	switch server.overflow {
+	case CallbackOverflowDropOldest:
+		for {
+			select {
+			case server.callbacks <- c:
 				return
+			default:
 			}
-			log.Printf("ServerRPC: Lost connection to metaserver but was able to reconnect")
-		} else {
-			log.Printf("ServerRPC  error: %v", err)
-			return
+			select {
+			case old := <-server.callbacks:
+				RPCLog.Warnf("ServerRPC: Callback queue full, dropping %v for game '%v'", old.action, old.gameName)
+				server.setEventsDropped(true)
+				atomic.AddInt32(&server.unsent, -1)
+			default:
+			}
+		}
+	case CallbackOverflowDropAndFlag:
+		select {
+		case server.callbacks <- c:
+		default:
+			RPCLog.Warnf("ServerRPC: Callback queue full, dropping %v for game '%v'", c.action, c.gameName)
+			server.setEventsDropped(true)
+			atomic.AddInt32(&server.unsent, -1)
+		}
+	default:
+		server.callbacks <- c
+	}
+}
+
+func (server *ServerRPC) setEventsDropped(dropped bool) {
+	server.droppedMutex.Lock()
+	server.eventsDropped = dropped
+	server.droppedMutex.Unlock()
+}
+
+// Returns whether notifications have been dropped and clears the flag, so
+// drops while the next notification is send set it again
+func (server *ServerRPC) takeDroppedEvents() bool {
+	server.droppedMutex.Lock()
+	defer server.droppedMutex.Unlock()
+	dropped := server.eventsDropped
+	server.eventsDropped = false
+	return dropped
+}
+
+// Sends the queued notifications to the metaserver one after the other.
+// Holds them back while the metaserver is quiesced.
+func (server *ServerRPC) sendCallbacks() {
+	for c := range server.callbacks {
+		server.sendingMutex.Lock()
+		for resumed := server.quiesced(); resumed != nil; resumed = server.quiesced() {
+			server.sendingMutex.Unlock()
+			<-resumed
+			server.sendingMutex.Lock()
+		}
+		dropped := server.takeDroppedEvents()
+		if !server.callClientMethod(c, dropped) && dropped {
+			// The metaserver did not learn about it, so tell it with the next one
+			server.setEventsDropped(true)
+		}
+		server.sendingMutex.Unlock()
+		atomic.AddInt32(&server.unsent, -1)
+	}
+}
+
+// How often Flush checks whether all notifications have been send
+const flushPollInterval = 10 * time.Millisecond
+
+// Flush waits until all queued notifications have been send to the metaserver,
+// or given up on if the metaserver can not be reached.
+func (server *ServerRPC) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&server.unsent) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
 		}
 	}
+	return nil
+}
 
+// Returns the channel closed on resume if notifications are held back, nil otherwise
+func (server *ServerRPC) quiesced() chan struct{} {
+	server.resumeMutex.Lock()
+	defer server.resumeMutex.Unlock()
+	return server.resumed
+}
+
+// Holds back further notifications and waits for the one being send.
+// Returns the number of notifications held back
+func (server *ServerRPC) quiesce() int {
+	server.resumeMutex.Lock()
+	if server.resumed == nil {
+		server.resumed = make(chan struct{})
+	}
+	server.resumeMutex.Unlock()
+	server.sendingMutex.Lock()
+	defer server.sendingMutex.Unlock()
+	// Connect again when the notifications are resumed, the metaserver is going away
+	server.clientMutex.Lock()
+	if server.client != nil {
+		server.client.Close()
+		server.client = nil
+	}
+	server.clientMutex.Unlock()
+	return len(server.callbacks)
+}
+
+// Sends the held back notifications again, a metaserver connected to us
+func (server *ServerRPC) resume() {
+	server.resumeMutex.Lock()
+	defer server.resumeMutex.Unlock()
+	if server.resumed != nil {
+		RPCLog.Infof("ServerRPC: Metaserver is back, resuming notifications")
+		close(server.resumed)
+		server.resumed = nil
+	}
+}
+
+// Remembers the request id a game has been created with so it can be added to the notifications
+func (server *ServerRPC) setRequestID(name, requestID string) {
+	if requestID == "" {
+		return
+	}
+	server.requestIDsMutex.Lock()
+	server.requestIDs[name] = requestID
+	server.requestIDsMutex.Unlock()
+}
+
+// Returns the request id the game has been created with, if any.
+// Forgets it if the game is closed
+func (server *ServerRPC) requestID(name string, closed bool) string {
+	server.requestIDsMutex.Lock()
+	defer server.requestIDsMutex.Unlock()
+	id := server.requestIDs[name]
+	if closed {
+		delete(server.requestIDs, name)
+	}
+	return id
 }
 
 // GameConnected informs the metaserver that a host connected to a game.
 func (server *ServerRPC) GameConnected(name string) {
 	// Tell the metaserver about it
-	server.callClientMethod("GameConnected", name)
+	requestID := server.requestID(name, false)
+	server.queueCallback(pendingCallback{action: "GameConnected", gameName: name, requestID: requestID})
+	server.PublishEvent(Event{Type: EventGameConnected, Game: name, RequestID: requestID})
 }
 
 // GameClosed informs the metaserver that a game has ended.
-func (server *ServerRPC) GameClosed(name string) {
-	server.callClientMethod("GameClosed", name)
+func (server *ServerRPC) GameClosed(name string, reason CloseReason) {
+	requestID := server.requestID(name, true)
+	server.queueCallback(pendingCallback{action: "GameClosed", gameName: name, requestID: requestID, reason: reason})
+	server.PublishEvent(Event{Type: EventGameClosed, Game: name, RequestID: requestID, CloseReason: reason})
+}
+
+// HostChanged informs the metaserver that another player became the host of a game.
+func (server *ServerRPC) HostChanged(name string, playerID uint64) {
+	requestID := server.requestID(name, false)
+	server.queueCallback(pendingCallback{action: "HostChanged", gameName: name, requestID: requestID, playerID: playerID})
+	server.PublishEvent(Event{Type: EventHostChanged, Game: name, RequestID: requestID, PlayerID: playerID})
+}
+
+// OnCapacityWarning warns the metaserver that the relay is nearly full.
+func (server *ServerRPC) OnCapacityWarning(current, max int) {
+	server.queueCallback(pendingCallback{action: "OnCapacityWarning", payload: CapacityWarning{current, max}})
+}
+
+// OnRelayAlert alerts the metaserver of a problem of the relay.
+func (server *ServerRPC) OnRelayAlert(alert RelayAlert) {
+	server.queueCallback(pendingCallback{action: "OnRelayAlert", payload: alert})
+}
+
+// ClientJoinRejected informs the metaserver that a connection to a game has been refused.
+func (server *ServerRPC) ClientJoinRejected(rejection JoinRejection) {
+	server.queueCallback(pendingCallback{action: "ClientJoinRejected", gameName: rejection.Game, payload: rejection})
+}
+
+// ClientChat passes a chat message of a game to the metaserver.
+func (server *ServerRPC) ClientChat(message ChatMessage) {
+	server.queueCallback(pendingCallback{action: "ClientChat", gameName: message.Game, payload: message})
+}
+
+// ClientReconnected informs the metaserver that a client reconnected to its old slot.
+func (server *ServerRPC) ClientReconnected(name string, playerID uint64) {
+	requestID := server.requestID(name, false)
+	server.queueCallback(pendingCallback{action: "ClientReconnected", gameName: name, requestID: requestID, playerID: playerID})
+	server.PublishEvent(Event{Type: EventClientReconnected, Game: name, RequestID: requestID, PlayerID: playerID})
+}
+
+// PublishEvent sends the event to the metaserver if it subscribed to events
+// and to the EventPublishers of the options.
+func (server *ServerRPC) PublishEvent(event Event) {
+	if atomic.LoadInt32(&server.subscribed) == 0 && len(server.publishers) <= 1 {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.RequestID == "" && event.Game != "" {
+		event.RequestID = server.requestID(event.Game, false)
+	}
+	for _, publisher := range server.publishers {
+		// Failures are logged by the publishers
+		publisher.Publish(event)
+	}
+}
+
+// Subscribe is called by the rpc server when the metaserver wants to receive events or not anymore.
+func (serverM *ServerRPCMethods) Subscribe(in *SubscriptionRequest, success *bool) error {
+	var subscribed int32
+	if in.Subscribe {
+		subscribed = 1
+	}
+	atomic.StoreInt32(&serverM.server.subscribed, subscribed)
+	RPCLog.Infof("ServerRPC: Metaserver subscribed to events: %v", in.Subscribe)
+	*success = true
+	return nil
+}
+
+// Quiesce is called by the rpc server when the metaserver shuts down.
+// Notifications are held back until the metaserver connects to us again.
+func (serverM *ServerRPCMethods) Quiesce(in *string, pending *int) error {
+	*pending = serverM.server.quiesce()
+	RPCLog.Infof("ServerRPC: Metaserver is shutting down, holding back %v notifications", *pending)
+	return nil
 }
 
 // NewGame is called by the rpc server when the metaserver wants to start a new game.
 // Calls the respective method of the ServerCallback given on construction.
-func (serverM *ServerRPCMethods) NewGame(in *GameData, success *bool) error {
-	ret := serverM.server.callback.CreateGame(in.Name, in.Password)
-	if ret != true {
-		return errors.New("Game already exists")
+func (serverM *ServerRPCMethods) NewGame(in *GameData, success *bool) (err error) {
+	endSpan := serverM.server.continueSpan("NewGame", *in)
+	defer func() { endSpan(err) }()
+	if err := validateTags(in.Tags); err != nil {
+		return err
 	}
+	if err := validateSampling(in.RecordSampling); err != nil {
+		return err
+	}
+	if err := serverM.server.callback.CreateGameErr(*in); err != nil {
+		return err
+	}
+	serverM.server.setRequestID(in.Name, in.RequestID)
 	*success = true
 	return nil
 }
 
+// CountGamesByOwner is called by the rpc server when the metaserver requests the number of games of an owner.
+func (serverM *ServerRPCMethods) CountGamesByOwner(in *string, count *int) error {
+	*count = serverM.server.callback.CountGamesByOwner(*in)
+	return nil
+}
+
+// ReserveGameName is called by the rpc server when the metaserver wants to keep a name free for a game.
+func (serverM *ServerRPCMethods) ReserveGameName(in *ReservationRequest, token *string) error {
+	if in.TTL <= 0 {
+		return errors.New("TTL of reservation must be positive")
+	}
+	t, err := serverM.server.callback.ReserveGameName(in.Name, in.TTL)
+	if err != nil {
+		return err
+	}
+	*token = t
+	return nil
+}
+
+// NewGameWithTiming is the same as NewGame, but reports how long the steps of creating the game took.
+func (serverM *ServerRPCMethods) NewGameWithTiming(in *TimedGameRequest, timing *CreateGameTiming) (err error) {
+	received := time.Now()
+	endSpan := serverM.server.continueSpan("NewGame", in.Game)
+	defer func() { endSpan(err) }()
+	timing.Transfer = received.Sub(in.SentAt)
+	err = validateTags(in.Game.Tags)
+	if err == nil {
+		err = validateSampling(in.Game.RecordSampling)
+	}
+	validated := time.Now()
+	timing.Validation = validated.Sub(received)
+	if err != nil {
+		return err
+	}
+	err = serverM.server.callback.CreateGameErr(in.Game)
+	timing.Setup = time.Since(validated)
+	if err != nil {
+		return err
+	}
+	serverM.server.setRequestID(in.Game.Name, in.Game.RequestID)
+	return nil
+}
+
 // NewGame is called by the rpc server when the metaserver wants to remove a existing game.
 // Calls the respective method of the ServerCallback given on construction.
-func (serverM *ServerRPCMethods) RemoveGame(in *GameData, success *bool) error {
+func (serverM *ServerRPCMethods) RemoveGame(in *GameData, success *bool) (err error) {
+	endSpan := serverM.server.continueSpan("RemoveGame", *in)
+	defer func() { endSpan(err) }()
 	ret := serverM.server.callback.RemoveGame(in.Name)
 	if ret != true {
-		return errors.New("Game does not exist")
+		return ErrGameNotFound
+	}
+	*success = true
+	return nil
+}
+
+// RemoveGamesByOwner is called by the rpc server when the metaserver wants to remove all games of an owner.
+// The response contains the names of the removed games.
+func (serverM *ServerRPCMethods) RemoveGamesByOwner(in *GameData, response *[]string) error {
+	*response = serverM.server.callback.RemoveGamesByOwner(in.OwnerID)
+	return nil
+}
+
+// RemoveGames is called by the rpc server when the metaserver wants to remove multiple games at once.
+// Each game is removed independently. The response contains the error for each game
+// which could not be removed and an empty string for each removed game.
+func (serverM *ServerRPCMethods) RemoveGames(in *GameNames, response *map[string]string) error {
+	results := make(map[string]string, len(in.Names))
+	for _, name := range in.Names {
+		if serverM.server.callback.RemoveGame(name) {
+			results[name] = ""
+		} else {
+			results[name] = ErrGameNotFound.Error()
+		}
+	}
+	*response = results
+	return nil
+}
+
+// Status is called by the rpc server when the metaserver requests the status of the relay.
+func (serverM *ServerRPCMethods) Status(in *string, response *ServerStatus) error {
+	status := serverM.server.callback.Status()
+	status.InstanceID = serverM.server.instanceID
+	status.RPCPanics = int(atomic.LoadInt32(&serverM.server.panics))
+	*response = limitStatusSize(status, serverM.server.maxStatusSize)
+	return nil
+}
+
+// TrafficRate is called by the rpc server when the metaserver requests the traffic of the relay.
+func (serverM *ServerRPCMethods) TrafficRate(in *TrafficRequest, response *float64) error {
+	*response = serverM.server.callback.TrafficRate(in.Window)
+	return nil
+}
+
+// GetGamePlayers is called by the rpc server when the metaserver requests the players of a game.
+func (serverM *ServerRPCMethods) GetGamePlayers(in *GameData, response *[]PlayerInfo) error {
+	players, ok := serverM.server.callback.GetGamePlayers(in.Name)
+	if !ok {
+		return ErrGameNotFound
+	}
+	*response = players
+	return nil
+}
+
+// IsPlayerConnected is called by the rpc server when the metaserver checks whether a player is connected.
+func (serverM *ServerRPCMethods) IsPlayerConnected(in *PlayerConnectionRequest, response *PlayerConnection) error {
+	connection, err := serverM.server.callback.IsPlayerConnected(in.Name, in.PlayerID)
+	if err != nil {
+		return err
+	}
+	*response = connection
+	return nil
+}
+
+// GetGame is called by the rpc server when the metaserver requests the description of a game.
+func (serverM *ServerRPCMethods) GetGame(in *GameData, response *GameData) error {
+	game, ok := serverM.server.callback.GetGame(in.Name)
+	if !ok {
+		return ErrGameNotFound
 	}
+	*response = game
+	return nil
+}
+
+// GetGames is called by the rpc server when the metaserver requests the descriptions of multiple games at once.
+// Games which do not exist are left out of the response.
+func (serverM *ServerRPCMethods) GetGames(in *GameNames, response *map[string]GameData) error {
+	games := make(map[string]GameData, len(in.Names))
+	for _, name := range in.Names {
+		if game, ok := serverM.server.callback.GetGame(name); ok {
+			games[name] = game
+		}
+	}
+	*response = games
+	return nil
+}
+
+// RotateRecording is called by the rpc server when the metaserver wants the recording of a game to continue in a new file.
+func (serverM *ServerRPCMethods) RotateRecording(in *GameData, response *string) error {
+	path, err := serverM.server.callback.RotateRecording(in.Name)
+	if err != nil {
+		return err
+	}
+	*response = path
+	return nil
+}
+
+// IssueJoinToken is called by the rpc server when the metaserver wants to allow a connection to a game.
+func (serverM *ServerRPCMethods) IssueJoinToken(in *GameData, response *string) error {
+	token, err := serverM.server.callback.IssueJoinToken(in.Name)
+	if err != nil {
+		return err
+	}
+	*response = token
+	return nil
+}
+
+// IssuePlayerJoinToken is called by the rpc server when the metaserver wants to allow a connection of an authenticated player.
+func (serverM *ServerRPCMethods) IssuePlayerJoinToken(in *PlayerJoinTokenRequest, response *string) error {
+	if in.PlayerName == "" {
+		return ErrEmptyPlayerName
+	}
+	token, err := serverM.server.callback.IssuePlayerJoinToken(in.Name, in.PlayerName)
+	if err != nil {
+		return err
+	}
+	*response = token
+	return nil
+}
+
+// Returns ErrUnauthorized unless the given token is one of the admin tokens.
+func (server *ServerRPC) authorize(token string) error {
+	server.tokenMutex.RLock()
+	defer server.tokenMutex.RUnlock()
+	for _, valid := range []string{server.adminToken, server.nextAdminToken} {
+		if valid != "" && subtle.ConstantTimeCompare([]byte(token), []byte(valid)) == 1 {
+			return nil
+		}
+	}
+	return ErrUnauthorized
+}
+
+// SetAuthTokens replaces the admin tokens the metaserver can present.
+func (server *ServerRPC) SetAuthTokens(current, next string) {
+	server.tokenMutex.Lock()
+	defer server.tokenMutex.Unlock()
+	server.adminToken = current
+	server.nextAdminToken = next
+	RPCLog.Infof("ServerRPC: Admin tokens changed, accepting %v of them", countTokens(current, next))
+}
+
+func countTokens(tokens ...string) int {
+	n := 0
+	for _, token := range tokens {
+		if token != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// SetAuthTokens is called by the rpc server when the metaserver rotates the admin tokens.
+func (serverM *ServerRPCMethods) SetAuthTokens(in *AuthTokensRequest, success *bool) error {
+	if err := serverM.server.authorize(in.AdminToken); err != nil {
+		return err
+	}
+	if in.Current == "" {
+		return ErrEmptyToken
+	}
+	serverM.server.SetAuthTokens(in.Current, in.Next)
 	*success = true
 	return nil
 }
+
+// GetLimits is called by the rpc server when the metaserver requests the resource limits of the relay.
+func (serverM *ServerRPCMethods) GetLimits(in *LimitsRequest, response *RelayLimits) error {
+	if err := serverM.server.authorize(in.AdminToken); err != nil {
+		return err
+	}
+	*response = serverM.server.callback.GetLimits()
+	return nil
+}
+
+// SetLimits is called by the rpc server when the metaserver changes the resource limits of the relay.
+func (serverM *ServerRPCMethods) SetLimits(in *LimitsRequest, success *bool) error {
+	if err := serverM.server.authorize(in.AdminToken); err != nil {
+		return err
+	}
+	if in.Limits.MaxGames < 0 || in.Limits.MaxConnectionsPerIP < 0 {
+		return errors.New("Limits must not be negative")
+	}
+	serverM.server.callback.SetLimits(in.Limits)
+	*success = true
+	return nil
+}
+
+// GetEffectiveConfig is called by the rpc server when the metaserver requests the settings of the relay.
+func (serverM *ServerRPCMethods) GetEffectiveConfig(in *LimitsRequest, response *RelayConfigView) error {
+	if err := serverM.server.authorize(in.AdminToken); err != nil {
+		return err
+	}
+	*response = serverM.server.callback.EffectiveConfig()
+	return nil
+}
+
+// GetRecentLogs is called by the rpc server when the metaserver requests the recent log messages of the relay.
+func (serverM *ServerRPCMethods) GetRecentLogs(in *LogsRequest, response *[]LogLine) error {
+	if err := serverM.server.authorize(in.AdminToken); err != nil {
+		return err
+	}
+	*response = serverM.server.callback.GetRecentLogs(in.Limit, in.MinLevel)
+	return nil
+}
+
+// ScheduleMaintenance is called by the rpc server when the metaserver announces a restart of the relay.
+func (serverM *ServerRPCMethods) ScheduleMaintenance(in *MaintenanceRequest, success *bool) error {
+	if err := serverM.server.authorize(in.AdminToken); err != nil {
+		return err
+	}
+	if err := serverM.server.callback.ScheduleMaintenance(in.Message, in.At); err != nil {
+		return err
+	}
+	*success = true
+	return nil
+}
+
+// CancelMaintenance is called by the rpc server when the metaserver calls off the announced restart.
+func (serverM *ServerRPCMethods) CancelMaintenance(in *MaintenanceRequest, success *bool) error {
+	if err := serverM.server.authorize(in.AdminToken); err != nil {
+		return err
+	}
+	serverM.server.callback.CancelMaintenance()
+	*success = true
+	return nil
+}
+
+// Ping is called by the rpc server when the metaserver checks whether the relay is reachable.
+// If requested, the relay checks whether it can reach the metaserver in return.
+// The answer contains the time of the relay so the metaserver can notice unsynchronized clocks.
+func (serverM *ServerRPCMethods) Ping(in *PingRequest, response *PingResponse) error {
+	response.Now = time.Now()
+	if !in.CheckCallback {
+		return nil
+	}
+	var ignored bool
+	err := serverM.server.callMetaserverMethod("Ping", "", &ignored)
+	response.CallbackTook = time.Since(response.Now)
+	if err != nil {
+		response.CallbackError = err.Error()
+		return nil
+	}
+	response.CallbackOK = true
+	return nil
+}
+
+// SupportedProtocols is called by the rpc server when the metaserver asks for the protocol versions of the relay.
+func (serverM *ServerRPCMethods) SupportedProtocols(in *string, response *[]int) error {
+	*response = serverM.server.callback.SupportedProtocols()
+	return nil
+}
+
+// SelfTest is called by the rpc server when the metaserver wants the relay to check that it forwards game data.
+func (serverM *ServerRPCMethods) SelfTest(in *string, success *bool) error {
+	if err := serverM.server.callback.SelfTest(); err != nil {
+		return err
+	}
+	*success = true
+	return nil
+}
+
+// VerifyReachability is called by the rpc server when the metaserver wants the relay to check its public address.
+func (serverM *ServerRPCMethods) VerifyReachability(in *string, reachable *bool) error {
+	ok, err := serverM.server.callback.VerifyReachability()
+	if err != nil {
+		return err
+	}
+	*reachable = ok
+	return nil
+}
+
+// Capabilities is called by the rpc server when the metaserver asks for the optional features of the relay.
+func (serverM *ServerRPCMethods) Capabilities(in *string, response *RelayCapabilities) error {
+	*response = serverM.server.callback.Capabilities()
+	return nil
+}
+
+// LockGame is called by the rpc server when the metaserver wants to change whether a game accepts new players.
+func (serverM *ServerRPCMethods) LockGame(in *GameData, success *bool) error {
+	if err := serverM.server.callback.LockGame(in.Name, in.Password, in.Locked); err != nil {
+		return err
+	}
+	*success = true
+	return nil
+}
+
+// SetVisibility is called by the rpc server when the metaserver wants to change whether a game is listed.
+func (serverM *ServerRPCMethods) SetVisibility(in *GameData, success *bool) error {
+	if err := serverM.server.callback.SetVisibility(in.Name, in.Password, in.Public); err != nil {
+		return err
+	}
+	*success = true
+	return nil
+}
+
+// MakeInviteOnly is called by the rpc server when the metaserver wants a game to only let in invited players.
+func (serverM *ServerRPCMethods) MakeInviteOnly(in *InviteOnlyRequest, response *[]string) error {
+	if in.Invites < 0 || in.Invites > MaxInvites {
+		return fmt.Errorf("Number of invites must be between 0 and %v", MaxInvites)
+	}
+	tokens, err := serverM.server.callback.MakeInviteOnly(in.Name, in.Password, in.Invites)
+	if err != nil {
+		return err
+	}
+	*response = tokens
+	return nil
+}
+
+// ForwardingLatency is called by the rpc server when the metaserver wants to know how fast frames are forwarded.
+// An empty game name means all games.
+func (serverM *ServerRPCMethods) ForwardingLatency(in *GameData, response *LatencyStats) error {
+	stats, err := serverM.server.callback.ForwardingLatency(in.Name)
+	if err != nil {
+		return err
+	}
+	*response = stats
+	return nil
+}
+
+// GetGameTraffic is called by the rpc server when the metaserver wants to know how much was forwarded in a game.
+func (serverM *ServerRPCMethods) GetGameTraffic(in *GameData, response *GameTraffic) error {
+	traffic, err := serverM.server.callback.GameTraffic(in.Name)
+	if err != nil {
+		return err
+	}
+	*response = traffic
+	return nil
+}
+
+// ResetGameCounters is called by the rpc server when the metaserver wants to measure the traffic of a game from now on.
+func (serverM *ServerRPCMethods) ResetGameCounters(in *GameData, success *bool) error {
+	if err := serverM.server.callback.ResetGameCounters(in.Name, in.Password); err != nil {
+		return err
+	}
+	*success = true
+	return nil
+}
+
+// DumpGameState is called by the rpc server when the metaserver wants a snapshot of a game for debugging.
+func (serverM *ServerRPCMethods) DumpGameState(in *GameData, response *GameStateDump) error {
+	dump, err := serverM.server.callback.DumpGameState(in.Name)
+	if err != nil {
+		return err
+	}
+	*response = dump
+	return nil
+}
+
+// FindPlayer is called by the rpc server when the metaserver wants to know which games a player is in.
+func (serverM *ServerRPCMethods) FindPlayer(in *string, response *[]PlayerLocation) error {
+	*response = serverM.server.callback.FindPlayer(*in)
+	return nil
+}
+
+// GetGameHistory is called by the rpc server when the metaserver requests the recently closed games.
+func (serverM *ServerRPCMethods) GetGameHistory(in *int, response *[]GameSummary) error {
+	*response = serverM.server.callback.GetGameHistory(*in)
+	return nil
+}
+
+// GetGameTimeline is called by the rpc server when the metaserver requests the timeline of a game.
+func (serverM *ServerRPCMethods) GetGameTimeline(in *GameData, response *[]TimelineEvent) error {
+	timeline, err := serverM.server.callback.GetGameTimeline(in.Name)
+	if err != nil {
+		return err
+	}
+	*response = timeline
+	return nil
+}
+
+// VerifyHostPassword is called by the rpc server when the metaserver wants to check a host password.
+func (serverM *ServerRPCMethods) VerifyHostPassword(in *GameData, matches *bool) error {
+	var err error
+	*matches, err = serverM.server.callback.VerifyHostPassword(in.Name, in.Password)
+	return err
+}
+
+// TransferHost is called by the rpc server when the metaserver wants another player to host a game.
+func (serverM *ServerRPCMethods) TransferHost(in *HostTransfer, success *bool) error {
+	if err := serverM.server.callback.TransferHost(in.Name, in.Password, in.NewHost, in.NewPassword); err != nil {
+		return err
+	}
+	*success = true
+	return nil
+}
+
+// KickPlayerByID is called by the rpc server when the metaserver removes a player from a game.
+func (serverM *ServerRPCMethods) KickPlayerByID(in *KickRequest, success *bool) error {
+	if err := serverM.server.callback.KickPlayerByID(in.Name, in.Password, in.PlayerID); err != nil {
+		return err
+	}
+	*success = true
+	return nil
+}
+
+// ListGamesPage is called by the rpc server when the metaserver requests some of the games on the relay.
+func (serverM *ServerRPCMethods) ListGamesPage(in *GamesPageRequest, response *GamesPage) error {
+	if in.Limit <= 0 {
+		return errors.New("Limit of the page must be positive")
+	}
+	response.Games, response.Total = pageOfGames(serverM.server.callback.ListGames(), in.Offset, in.Limit)
+	return nil
+}
+
+// ListGamesFiltered is called by the rpc server when the metaserver requests the games on the relay matching a filter.
+func (serverM *ServerRPCMethods) ListGamesFiltered(in *GameFilter, response *[]GameData) error {
+	if in.MinProtocol > 0 && in.MaxProtocol > 0 && in.MinProtocol > in.MaxProtocol {
+		return errors.New("MinProtocol of the filter must not be above MaxProtocol")
+	}
+	*response = serverM.server.callback.ListGamesFiltered(*in)
+	return nil
+}
+
+// ListGames is called by the rpc server when the metaserver requests all games on the relay.
+func (serverM *ServerRPCMethods) ListGames(in *string, response *[]GameData) error {
+	*response = serverM.server.callback.ListGames()
+	return nil
+}
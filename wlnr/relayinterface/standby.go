@@ -0,0 +1,133 @@
+package relayinterface
+
+import (
+	"net/rpc"
+	"sort"
+)
+
+// Failover tells that a ClientRPC gave up its relay and moved to the standby
+// relay, see ClientRPCOptions.StandbyAddr.
+type Failover struct {
+	// The addresses of the relay given up and of the relay used from now on
+	From, To string
+	// Why the relay has been given up
+	Cause error
+	// The games which have been created on the new relay again
+	Replayed []string
+	// The games which could not be created again, with the reason
+	Failed map[string]error
+}
+
+// Adds the standby relay at the given address to the client. Its connection
+// is opened now, so failing over does not have to wait for it
+func (client *ClientRPC) addStandby(addr string, options ClientRPCOptions) {
+	standby := newClientRPC(addr, options)
+	if err := standby.connect(); err != nil {
+		RPCLog.Warnf("ClientRPC: Standby relay is not reachable, trying again when failing over: %v", err)
+	}
+	standby.startRefreshing(options.RefreshInterval)
+	client.standby = standby
+	client.onFailover = options.OnFailover
+	client.knownGames = make(map[string]GameData)
+}
+
+// Remembers the game to create it again when failing over. Does nothing without standby
+func (client *ClientRPC) rememberGame(data GameData) {
+	if client.standby == nil {
+		return
+	}
+	client.gamesMutex.Lock()
+	client.knownGames[data.Name] = data
+	client.gamesMutex.Unlock()
+}
+
+// Forgets the games after they have been removed or closed
+func (client *ClientRPC) forgetGames(names ...string) {
+	if client.standby == nil {
+		return
+	}
+	client.gamesMutex.Lock()
+	for _, name := range names {
+		delete(client.knownGames, name)
+	}
+	client.gamesMutex.Unlock()
+}
+
+// Moves the client to the standby relay after the given connection to the relay
+// has been lost for good. The standby takes the place of the lost relay, so the
+// client can fail back to it later. The games created through the client are
+// created on the new relay again and OnFailover is called.
+// Returns false if there is no standby or it can not be reached either.
+func (client *ClientRPC) failover(lost *rpc.Client, cause error) bool {
+	if client.standby == nil {
+		return false
+	}
+	standby := client.standby
+	client.relayMutex.Lock()
+	if client.relay != lost {
+		// Another call failed over or reconnected meanwhile
+		client.relayMutex.Unlock()
+		return true
+	}
+	standby.relayMutex.Lock()
+	spare, capabilities := standby.relay, standby.capabilities
+	if spare == nil {
+		var err error
+		if spare, capabilities, err = standby.dial(standby.relayAddr); err != nil {
+			RPCLog.Warnf("ClientRPC: Unable to fail over to standby relay at %v: %v", standby.relayAddr, err)
+			standby.relayMutex.Unlock()
+			client.relayMutex.Unlock()
+			return false
+		}
+	}
+	client.setRelay(spare, capabilities)
+	standby.relay, standby.calls = nil, nil
+	from, to := client.relayAddr, standby.relayAddr
+	client.relayAddr, standby.relayAddr = to, from
+	standby.capabilities = 0
+	standby.relayMutex.Unlock()
+	client.relayMutex.Unlock()
+	lost.Close()
+	client.markConnected()
+	RPCLog.Warnf("ClientRPC: Failed over from relay at %v to standby relay at %v: %v", from, to, cause)
+
+	failover := Failover{From: from, To: to, Cause: cause, Failed: make(map[string]error)}
+	client.gamesMutex.Lock()
+	games := make([]GameData, 0, len(client.knownGames))
+	for _, data := range client.knownGames {
+		games = append(games, data)
+	}
+	client.gamesMutex.Unlock()
+	sort.Slice(games, func(i, j int) bool { return games[i].Name < games[j].Name })
+	for _, data := range games {
+		// Directly on the new connection, a failing call must not fail over again
+		success := false
+		err := spare.Call("ServerRPCMethods.NewGame", data, &success)
+		if err == nil && !success {
+			err = errCreateGameFailed
+		}
+		if err != nil {
+			failover.Failed[data.Name] = knownError(err)
+			continue
+		}
+		failover.Replayed = append(failover.Replayed, data.Name)
+	}
+	if len(failover.Failed) > 0 {
+		RPCLog.Warnf("ClientRPC: Unable to create %v of %v games on standby relay at %v", len(failover.Failed), len(games), to)
+	}
+	if client.onFailover != nil {
+		client.onFailover(failover)
+	}
+	return true
+}
+
+// standbyCallback forgets closed games before passing the notifications on.
+type standbyCallback struct {
+	ClientCallback
+	client *ClientRPC
+}
+
+func (c *standbyCallback) GameClosed(name string, reason CloseReason) {
+	c.client.forgetGames(name)
+	c.ClientCallback.GameClosed(name, reason)
+}
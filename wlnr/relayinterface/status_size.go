@@ -0,0 +1,66 @@
+package relayinterface
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// The largest status in bytes of JSON a relay sends if ServerRPCOptions.MaxStatusSize is not set
+const DefaultMaxStatusSize = 64 << 10
+
+// Returned in ServerStatus.Hint when the status had to be truncated
+const truncatedStatusHint = "status too large, use ListGamesPage for details about the games"
+
+// Returns the status to send if it would be larger than max bytes of JSON:
+// Only the numbers and whatever identifies the relay are kept, Truncated is set.
+func limitStatusSize(status ServerStatus, max int) ServerStatus {
+	if max <= 0 {
+		max = DefaultMaxStatusSize
+	}
+	b, err := json.Marshal(status)
+	if err == nil && len(b) <= max {
+		return status
+	}
+	RPCLog.Warnf("ServerRPC: Status of %v bytes exceeds %v bytes, sending it truncated (%v)", len(b), max, err)
+	return ServerStatus{
+		NClients:            status.NClients,
+		NClientsInGames:     status.NClientsInGames,
+		NGames:              status.NGames,
+		NOpenGames:          status.NOpenGames,
+		MaxGames:            status.MaxGames,
+		SoftMaxGames:        status.SoftMaxGames,
+		MaxConnectionsPerIP: status.MaxConnectionsPerIP,
+		NSpectators:         status.NSpectators,
+		MaxTotalSpectators:  status.MaxTotalSpectators,
+		InstanceID:          status.InstanceID,
+		GamePort:            status.GamePort,
+		UDPPort:             status.UDPPort,
+		ProtocolVersion:     status.ProtocolVersion,
+		MaintenanceAt:       status.MaintenanceAt,
+		MinClientVersion:    status.MinClientVersion,
+		RPCPanics:           status.RPCPanics,
+		Shedding:            status.Shedding,
+		Throughput:          status.Throughput,
+		MaxTotalBandwidth:   status.MaxTotalBandwidth,
+		BandwidthThrottled:  status.BandwidthThrottled,
+		Truncated:           true,
+		Hint:                truncatedStatusHint,
+	}
+}
+
+// Returns the page of the games sorted by name and the number of all games
+func pageOfGames(games []GameData, offset, limit int) ([]GameData, int) {
+	sort.Slice(games, func(i, j int) bool { return games[i].Name < games[j].Name })
+	total := len(games)
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return games[offset:end], total
+}
@@ -0,0 +1,123 @@
+package relayinterface
+
+import (
+	"context"
+)
+
+// Tracer creates a span for each rpc call of a ClientRPC to its relay, see
+// ClientRPCOptions.Tracer. Implement it with an adapter to the tracing library
+// in use, e.g., around a tracer of an OpenTelemetry TracerProvider. The
+// relayinterface does not depend on a tracing library itself.
+type Tracer interface {
+	// Starts a span with the given name as child of the span in ctx, if any.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// TracePropagator is implemented by Tracers which pass the trace on to the relay,
+// e.g., as W3C traceparent. A ClientRPC sets GameData.TraceParent of its calls to
+// the trace context of their span, and a ServerRPC continues the trace from there.
+type TracePropagator interface {
+	// Returns the trace context of the span in ctx, empty if there is none.
+	Inject(ctx context.Context) string
+	// Returns ctx with the trace context returned by Inject.
+	Extract(ctx context.Context, traceParent string) context.Context
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// Adds an attribute to the span, the values are strings and ints.
+	SetAttribute(key string, value interface{})
+	// Ends the span. err is nil if the operation succeeded.
+	End(err error)
+}
+
+// Names of the attributes of the spans around rpc calls
+const (
+	// The address of the relay
+	SpanAttributeRelay = "relay.address"
+	// The name of the game the call is about, if any
+	SpanAttributeGame = "relay.game"
+	// How often the call has been attempted, see RetryBudgets
+	SpanAttributeAttempts = "relay.attempts"
+	// "ok" or "error"
+	SpanAttributeOutcome = "relay.outcome"
+)
+
+// Returns the name of the game the arguments of a call are about, empty if none
+func gameNameOf(args interface{}) string {
+	switch args := args.(type) {
+	case GameData:
+		return args.Name
+	case TimedGameRequest:
+		return args.Game.Name
+	case ReservationRequest:
+		return args.Name
+	case HostTransfer:
+		return args.Name
+	case KickRequest:
+		return args.Name
+	}
+	return ""
+}
+
+// Starts the span of a call if the client has a tracer. Returns the context of
+// the span and the function ending it with the outcome and the number of attempts
+func (client *ClientRPC) startSpan(ctx context.Context, method string, args interface{}) (context.Context, func(err error, attempts int)) {
+	if client.tracer == nil {
+		return ctx, func(error, int) {}
+	}
+	ctx, span := client.tracer.Start(ctx, "relay."+method)
+	span.SetAttribute(SpanAttributeRelay, client.relayAddr)
+	if name := gameNameOf(args); name != "" {
+		span.SetAttribute(SpanAttributeGame, name)
+	}
+	return ctx, func(err error, attempts int) {
+		span.SetAttribute(SpanAttributeAttempts, attempts)
+		if err == nil {
+			span.SetAttribute(SpanAttributeOutcome, "ok")
+		} else {
+			span.SetAttribute(SpanAttributeOutcome, "error")
+		}
+		span.End(err)
+	}
+}
+
+// Returns the arguments of a call with the trace context of the span in ctx,
+// if the tracer of the client propagates it and the arguments can carry it
+func (client *ClientRPC) withTraceParent(ctx context.Context, args interface{}) interface{} {
+	propagator, ok := client.tracer.(TracePropagator)
+	if !ok {
+		return args
+	}
+	switch a := args.(type) {
+	case GameData:
+		a.TraceParent = propagator.Inject(ctx)
+		return a
+	case TimedGameRequest:
+		a.Game.TraceParent = propagator.Inject(ctx)
+		return a
+	}
+	return args
+}
+
+// Starts the span of a call of the metaserver as child of the span the
+// metaserver sent with it, if the server has a tracer. Returns the function ending it
+func (server *ServerRPC) continueSpan(method string, data GameData) func(err error) {
+	if server.tracer == nil {
+		return func(error) {}
+	}
+	ctx := context.Background()
+	if propagator, ok := server.tracer.(TracePropagator); ok && data.TraceParent != "" {
+		ctx = propagator.Extract(ctx, data.TraceParent)
+	}
+	_, span := server.tracer.Start(ctx, "relay.server."+method)
+	span.SetAttribute(SpanAttributeGame, data.Name)
+	return func(err error) {
+		if err == nil {
+			span.SetAttribute(SpanAttributeOutcome, "ok")
+		} else {
+			span.SetAttribute(SpanAttributeOutcome, "error")
+		}
+		span.End(err)
+	}
+}
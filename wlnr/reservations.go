@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// A game name kept free for the holder of the token
+type reservation struct {
+	token   string
+	expires time.Time
+}
+
+// Reservations keeps game names reserved before the games are created.
+type Reservations struct {
+	reserved map[string]reservation
+	mutex    sync.Mutex
+}
+
+func NewReservations() *Reservations {
+	return &Reservations{
+		reserved: make(map[string]reservation),
+	}
+}
+
+// Reserves the name for the given time. Returns the token needed to claim
+// it or false if it is reserved already.
+func (r *Reservations) Reserve(key string, ttl time.Duration) (string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if old, ok := r.reserved[key]; ok && time.Now().Before(old.expires) {
+		return "", false
+	}
+	token := newReconnectToken()
+	r.reserved[key] = reservation{token: token, expires: time.Now().Add(ttl)}
+	return token, true
+}
+
+// Claims the name for creating a game. Succeeds if the name is not reserved,
+// the reservation expired or the token matches. Ends the reservation on success.
+func (r *Reservations) Claim(key string, token string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	old, ok := r.reserved[key]
+	if !ok {
+		return true
+	}
+	if time.Now().Before(old.expires) && old.token != token {
+		return false
+	}
+	delete(r.reserved, key)
+	return true
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Reads a secret from the environment variable or the file with the given names,
+// whichever is set. The values are never part of the returned errors so they do not
+// end up in the log. Returns an empty secret if neither is set
+func readSecret(field, env, file string) (string, error) {
+	if env != "" && file != "" {
+		return "", fmt.Errorf("only one of %vEnv and %vFile can be set", field, field)
+	}
+	if env != "" {
+		value, ok := os.LookupEnv(env)
+		if !ok || value == "" {
+			return "", fmt.Errorf("environment variable %v for %vEnv is not set", env, field)
+		}
+		return value, nil
+	}
+	if file == "" {
+		return "", nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("unable to read %vFile: %v", field, err)
+	}
+	value := strings.TrimRight(string(b), "\r\n")
+	if value == "" {
+		return "", fmt.Errorf("%vFile '%v' is empty", field, file)
+	}
+	if info, err := os.Stat(file); err == nil && info.Mode().Perm()&0077 != 0 {
+		relayinterface.RPCLog.Warnf("%vFile '%v' can be read by other users", field, file)
+	}
+	return value, nil
+}
+
+// The fields of RelayConfig which are secret. They are only shown as redacted
+var secretConfigFields = map[string]bool{
+	"AdminToken": true,
+}
+
+// What is shown instead of a secret which is set
+const redactedSecret = "***"
+
+// Fills in the secrets the configuration references instead of containing them
+func (l *RelayConfig) loadSecrets() error {
+	token, err := readSecret("AdminToken", l.AdminTokenEnv, l.AdminTokenFile)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		if l.AdminToken != "" {
+			return fmt.Errorf("AdminToken can not be set together with AdminTokenEnv or AdminTokenFile")
+		}
+		l.AdminToken = token
+	}
+	return nil
+}
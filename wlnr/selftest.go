@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// The games created by SelfTest are named with this prefix and a random suffix
+const selfTestGamePrefix = "selftest-"
+
+// How long SelfTest may take
+const selfTestTimeout = 5 * time.Second
+
+// Checks that game data is forwarded: Creates a private game, connects a host
+// and a client to the game port like a game would, sends a frame from the host
+// and checks that the client receives it unchanged. The game is removed afterwards.
+// The metaserver is notified about the game like about any other game
+func (s *Server) SelfTest() error {
+	if s.gamePort == 0 {
+		return fmt.Errorf("Self test failed: relay does not accept game connections")
+	}
+	name, password, remove, err := s.createThrowawayGame(selfTestGamePrefix)
+	if err != nil {
+		return fmt.Errorf("Self test failed: unable to create game: %v", err)
+	}
+	defer remove()
+	deadline := time.Now().Add(selfTestTimeout)
+
+	addr := net.JoinHostPort(s.localGameHost(), fmt.Sprint(s.gamePort))
+	host, err := s.dialSelfTest(addr, name, password, deadline)
+	if err != nil {
+		return fmt.Errorf("Self test failed: host unable to join: %v", err)
+	}
+	defer host.conn.Close()
+	client, err := s.dialSelfTest(addr, name, "", deadline)
+	if err != nil {
+		return fmt.Errorf("Self test failed: client unable to join: %v", err)
+	}
+	defer client.conn.Close()
+	if err := host.await(kConnectClient); err != nil {
+		return fmt.Errorf("Self test failed: host not told about client: %v", err)
+	}
+	id, err := host.reader.ReadByte()
+	if err != nil {
+		return fmt.Errorf("Self test failed: host not told about client: %v", err)
+	}
+
+	payload := []byte(newReconnectToken())
+	frame := append([]byte{0, byte(len(payload) + 2)}, payload...)
+	if _, err := host.conn.Write(append([]byte{kToClients, id, 0}, frame...)); err != nil {
+		return fmt.Errorf("Self test failed: unable to send frame: %v", err)
+	}
+	if err := client.await(kFromHost); err != nil {
+		return fmt.Errorf("Self test failed: frame not received: %v", err)
+	}
+	received := make([]byte, len(frame))
+	if _, err := io.ReadFull(client.reader, received); err != nil {
+		return fmt.Errorf("Self test failed: frame not received: %v", err)
+	}
+	if !bytes.Equal(received, frame) {
+		return fmt.Errorf("Self test failed: frame changed while being forwarded")
+	}
+	return nil
+}
+
+// Creates a private game whose name starts with the given prefix. Returns its name,
+// its host password and a function removing it again
+func (s *Server) createThrowawayGame(prefix string) (name, password string, remove func(), err error) {
+	name = prefix + newReconnectToken()
+	password = newReconnectToken()
+	if err := s.CreateGameErr(relayinterface.GameData{Name: name, Password: password}); err != nil {
+		return "", "", nil, err
+	}
+	return name, password, func() {
+		if game := s.findGame(name); game != nil {
+			game.Shutdown()
+		}
+	}, nil
+}
+
+// Returns the address the game port can be reached at from the relay itself
+func (s *Server) localGameHost() string {
+	host, _, err := net.SplitHostPort(s.config.GameListenAddr)
+	if err != nil || host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return host
+}
+
+// A connection of SelfTest to the game port, behaving like a game
+type selfTestPeer struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Connects to the game port at the given address and joins the game, as host if
+// the password is given
+func (s *Server) dialSelfTest(addr, name, password string, deadline time.Time) (*selfTestPeer, error) {
+	conn, err := net.DialTimeout("tcp", addr, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+	var handshake []byte
+	if s.config.RequireJoinTokens {
+		cmd := NewCommand(kJoinToken)
+		cmd.AppendString(s.joinTokens.Issue(name, selfTestTimeout))
+		handshake = append(handshake, cmd.GetBytes()...)
+	}
+	if s.config.MinClientVersion != "" {
+		cmd := NewCommand(kClientVersion)
+		cmd.AppendString(s.config.MinClientVersion)
+		handshake = append(handshake, cmd.GetBytes()...)
+	}
+	cmd := NewCommand(kHello)
+	cmd.AppendUInt(kRelayProtocolVersion)
+	cmd.AppendString(name)
+	cmd.AppendString(password)
+	handshake = append(handshake, cmd.GetBytes()...)
+	peer := &selfTestPeer{conn: conn, reader: bufio.NewReader(conn)}
+	if _, err := conn.Write(handshake); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := peer.await(kWelcome); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The protocol version and the name of the game
+	peer.reader.ReadByte()
+	welcomed, err := peer.reader.ReadString(0)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if strings.TrimSuffix(welcomed, "\x00") != name {
+		// Something else answers at the address, e.g., another relay
+		conn.Close()
+		return nil, fmt.Errorf("welcomed to game '%v' instead", strings.TrimSuffix(welcomed, "\x00"))
+	}
+	return peer, nil
+}
+
+// Reads commands until the given one arrives, answering pings on the way.
+// Its payload is left to be read by the caller
+func (p *selfTestPeer) await(want uint8) error {
+	for {
+		cmd, err := p.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch cmd {
+		case want:
+			return nil
+		case kPing:
+			seq, err := p.reader.ReadByte()
+			if err != nil {
+				return err
+			}
+			p.conn.Write([]byte{kPong, seq})
+		case kUDPToken, kReconnectToken:
+			p.reader.ReadString(0)
+		case kMaintenance:
+			p.reader.ReadString(0)
+			p.reader.ReadString(0)
+		case kProtocolError:
+			code, _ := p.reader.ReadByte()
+			description, _ := p.reader.ReadString(0)
+			return fmt.Errorf("relay refused with code %v (%v)", code, description)
+		case kDisconnect:
+			reason, _ := p.reader.ReadString(0)
+			return fmt.Errorf("relay disconnected: %v", reason)
+		default:
+			return fmt.Errorf("unexpected command %v", cmd)
+		}
+	}
+}
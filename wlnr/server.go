@@ -2,20 +2,67 @@ package main
 
 import (
 	"container/list"
+	"context"
+	"fmt"
 	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
 	"log"
 	"net"
-	"os"
-	"os/signal"
-	"syscall"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// The address the relay listens on for game connections if none is configured
+const DefaultGameListenAddr = ":7397"
+
 type Server struct {
 	acceptedConnections chan net.Conn
 	shutdownServer      chan bool
 	serverHasShutdown   chan bool
-	games               *list.List
-	wlms                relayinterface.Server
+	// The games on the relay, guarded by gamesMutex. A game removes itself while
+	// holding its lifecycle mutex, so gamesMutex must not be held when locking that
+	games      *list.List
+	gamesMutex sync.Mutex
+	wlms       relayinterface.Server
+	config     RelayConfig
+	// The port game connections are accepted on
+	gamePort int
+	// Counts the traffic send by the relay
+	traffic *TrafficMeter
+	// The numbers reported by Status
+	counters StatusCounters
+	// Tokens issued for connections to games
+	joinTokens *JoinTokens
+	// The limits which can be changed at runtime, initialized from config
+	limits Limits
+	// Whether the metaserver has been warned that the relay is nearly full. Accessed atomically
+	capacityWarned int32
+	// Shares MaxTotalBandwidth between the games, nil if unlimited
+	bandwidth *bandwidthShaper
+	// The last result of sheddingLevel, to log changes. Accessed atomically
+	shedding int32
+	// The number of game connections by IP address
+	connections *connectionsPerIP
+	// Names reserved for games which are not created yet
+	reservations *Reservations
+	// Forwards datagrams of games using UDP. Nil if not configured
+	udp *UDPRelay
+	// The port of udp, 0 if not configured
+	udpPort int
+	// Summaries of the recently closed games
+	history *GameHistory
+	// The recent log messages, kept for GetRecentLogs
+	logs *LogBuffer
+	// The result of the last VerifyReachability
+	reachability reachabilityCheck
+	// The games of the players by name
+	players *PlayerIndex
+	// How long the timed frames of all games took to be forwarded
+	latency *LatencyHistogram
+	// The upcoming maintenance announced to players
+	maintenance *Maintenance
 }
 
 func (s *Server) InitiateShutdown() error {
@@ -27,122 +74,632 @@ func (s *Server) WaitTillShutdown() {
 	<-s.serverHasShutdown
 }
 
-func (s *Server) CreateGame(name, password string) bool {
+func (s *Server) CreateGame(data relayinterface.GameData) bool {
+	return s.CreateGameErr(data) == nil
+}
+
+// Same as CreateGame but returns why the game could not be created
+func (s *Server) CreateGameErr(data relayinterface.GameData) error {
+	s.gamesMutex.Lock()
+	defer s.gamesMutex.Unlock()
+	name := data.Name
+	if maxGames := s.limits.Get().MaxGames; maxGames > 0 && s.games.Len() >= maxGames {
+		lifecycleLog.Warnf("Error: Ordered to create game %v, but there are already %v games", gameLogName(name, data.RequestID), s.games.Len())
+		return relayinterface.ErrRelayFull
+	}
 
 	// Check if the game already exists
 	for e := s.games.Front(); e != nil; e = e.Next() {
 		game := e.Value.(*Game)
-		if game.Name() == name {
-			log.Printf("Error: Ordered to create game '%v', but it already exists", name)
-			return false
+		if game.key == s.gameKey(name) {
+			lifecycleLog.Warnf("Error: Ordered to create game %v, but it already exists", gameLogName(name, data.RequestID))
+			return relayinterface.ErrGameExists
 		}
 	}
+	if !data.Ranked && s.sheddingLevel() >= relayinterface.SheddingCasual {
+		lifecycleLog.Warnf("Error: Ordered to create game %v, but the relay is overloaded and only creates ranked games", gameLogName(name, data.RequestID))
+		return relayinterface.ErrRelayOverloaded
+	}
+	if data.Ranked && s.config.RecordDir == "" {
+		lifecycleLog.Warnf("Error: Ordered to create ranked game %v, but games are not recorded", gameLogName(name, data.RequestID))
+		return relayinterface.ErrNotRecorded
+	}
+	if limit := s.ownerGameLimit(data.OwnerID); limit > 0 && s.countGamesByOwner(data.OwnerID) >= limit {
+		lifecycleLog.Warnf("Error: Ordered to create game %v, but owner '%v' already has %v games", gameLogName(name, data.RequestID), data.OwnerID, limit)
+		return relayinterface.ErrOwnerGameLimit
+	}
+	if !s.reservations.Claim(s.gameKey(name), data.ReservationToken) {
+		lifecycleLog.Warnf("Error: Ordered to create game %v, but its name is reserved", gameLogName(name, data.RequestID))
+		return relayinterface.ErrNameReserved
+	}
 	// It does not, add it
-	game := NewGame(name, password, s)
-	log.Printf("Created game '%v'", name)
+	game := NewGame(data, s)
+	lifecycleLog.Infof("Created game %v", game.logName())
 	s.games.PushBack(game)
-	return true
+	s.counters.AddGames(1)
+	s.wlms.PublishEvent(relayinterface.Event{Type: relayinterface.EventGameCreated, Game: name, RequestID: data.RequestID})
+	s.checkCapacity()
+	return nil
 }
 
-func (s *Server) RemoveGame(name string) bool {
+// Returns how many games the owner may have at the same time, 0 if unlimited
+func (s *Server) ownerGameLimit(ownerID string) int {
+	if ownerID == "" {
+		return 0
+	}
+	if limit, ok := s.config.OwnerGameLimits[ownerID]; ok {
+		return limit
+	}
+	return s.config.MaxGamesPerOwner
+}
+
+// Returns the number of games with the given owner
+func (s *Server) CountGamesByOwner(ownerID string) int {
+	s.gamesMutex.Lock()
+	defer s.gamesMutex.Unlock()
+	return s.countGamesByOwner(ownerID)
+}
+
+func (s *Server) countGamesByOwner(ownerID string) int {
+	count := 0
 	for e := s.games.Front(); e != nil; e = e.Next() {
-		g := e.Value.(*Game)
-		if g.Name() == name {
-			log.Printf("Removing game '%v' as told by metaserver", name)
-			g.Shutdown()
-			return true
+		if g := e.Value.(*Game); ownerID != "" && g.ownerID == ownerID {
+			count++
+		}
+	}
+	return count
+}
+
+// Returns the name of a game as used for comparing it with other names.
+// Surrounding whitespace is ignored and, if configured, the case, too.
+func (s *Server) gameKey(name string) string {
+	key := strings.TrimSpace(name)
+	if s.config.CaseInsensitiveGameNames {
+		key = strings.ToLower(key)
+	}
+	return key
+}
+
+// Keeps the name free for a game created with the returned token
+// until the given time passed
+func (s *Server) ReserveGameName(name string, ttl time.Duration) (string, error) {
+	if s.findGame(name) != nil {
+		return "", relayinterface.ErrGameExists
+	}
+	token, ok := s.reservations.Reserve(s.gameKey(name), ttl)
+	if !ok {
+		return "", relayinterface.ErrNameReserved
+	}
+	lifecycleLog.Infof("Reserved game name '%v' for %v", name, ttl)
+	return token, nil
+}
+
+// Returns the game with the given name or nil if there is none
+func (s *Server) findGame(name string) *Game {
+	s.gamesMutex.Lock()
+	defer s.gamesMutex.Unlock()
+	for e := s.games.Front(); e != nil; e = e.Next() {
+		game := e.Value.(*Game)
+		if game.key == s.gameKey(name) {
+			return game
+		}
+	}
+	return nil
+}
+
+// Changes whether the game is listed publicly
+func (s *Server) SetVisibility(name, password string, public bool) error {
+	game := s.findGame(name)
+	if game == nil {
+		return relayinterface.ErrGameNotFound
+	}
+	if err := game.checkHostPassword(password, ""); err != nil {
+		return err
+	}
+	game.lifecycle.Lock()
+	if game.public != public {
+		lifecycleLog.Infof("Game %v is now public: %v", game.logName(), public)
+	}
+	game.public = public
+	if public {
+		game.inviteOnly = false
+	}
+	game.lifecycle.Unlock()
+	return nil
+}
+
+// Makes the game private and refuses new clients without a join token of the game.
+// Returns the given number of new join tokens. Connected clients stay, and clients
+// reattaching to their slot as well as the host are let in without token
+func (s *Server) MakeInviteOnly(name, password string, invites int) ([]string, error) {
+	game := s.findGame(name)
+	if game == nil {
+		return nil, relayinterface.ErrGameNotFound
+	}
+	if err := game.checkHostPassword(password, ""); err != nil {
+		return nil, err
+	}
+	game.lifecycle.Lock()
+	if !game.inviteOnly {
+		lifecycleLog.Infof("Game %v is now invite-only", game.logName())
+	}
+	game.public = false
+	game.inviteOnly = true
+	game.lifecycle.Unlock()
+	tokens := make([]string, 0, invites)
+	for i := 0; i < invites; i++ {
+		tokens = append(tokens, s.joinTokens.IssueFor(name, "", s.joinTokenLifetime()))
+	}
+	return tokens, nil
+}
+
+// Changes whether new clients are refused by the game
+func (s *Server) LockGame(name, password string, locked bool) error {
+	game := s.findGame(name)
+	if game == nil {
+		return relayinterface.ErrGameNotFound
+	}
+	if err := game.checkHostPassword(password, ""); err != nil {
+		return err
+	}
+	game.lifecycle.Lock()
+	if game.locked != locked {
+		lifecycleLog.Infof("Game %v is now locked: %v", game.logName(), locked)
+	}
+	game.locked = locked
+	game.lifecycle.Unlock()
+	return nil
+}
+
+// Checks the host password of the game without changing anything.
+// Only a few checks per minute are allowed for each game to prevent guessing the password
+func (s *Server) VerifyHostPassword(name, password string) (bool, error) {
+	game := s.findGame(name)
+	if game == nil {
+		return false, relayinterface.ErrGameNotFound
+	}
+	if !game.passwordChecks.Allow() {
+		lifecycleLog.Warnf("Refusing to check host password of game '%v' since it has been checked too often", name)
+		return false, relayinterface.ErrTooManyAttempts
+	}
+	switch err := game.checkHostPassword(password, ""); err {
+	case nil:
+		return true, nil
+	case relayinterface.ErrWrongPassword:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Disconnects the client with the given id from the game
+func (s *Server) KickPlayerByID(name, password string, playerID uint64) error {
+	game := s.findGame(name)
+	if game == nil {
+		return relayinterface.ErrGameNotFound
+	}
+	if err := game.checkHostPassword(password, ""); err != nil {
+		return err
+	}
+	if playerID == uint64(ID_HOST) || playerID > 255 {
+		return relayinterface.ErrPlayerNotFound
+	}
+	// Looked up while holding the lifecycle mutex, so a client which is
+	// replaced by a reconnect in the meantime is not kicked
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	client := game.getClient(uint8(playerID))
+	if client == nil {
+		return relayinterface.ErrPlayerNotFound
+	}
+	lifecycleLog.Infof("Kicking client (id=%v) from game %v", playerID, game.logName())
+	game.disconnectClient(client, "KICKED")
+	return nil
+}
+
+// Makes the connected client with the given id the host of the game
+func (s *Server) TransferHost(name, password, newHost, newPassword string) error {
+	game := s.findGame(name)
+	if game == nil {
+		return relayinterface.ErrGameNotFound
+	}
+	if err := game.checkHostPassword(password, ""); err != nil {
+		return err
+	}
+	id, err := strconv.ParseUint(newHost, 10, 8)
+	if err != nil || uint8(id) == ID_HOST {
+		return relayinterface.ErrPlayerNotFound
+	}
+	if game.ranked && newPassword != "" {
+		return relayinterface.ErrRankedGame
+	}
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	if game.currentlyShuttingDown {
+		return relayinterface.ErrGameNotFound
+	}
+	return game.transferHost(uint8(id), newPassword)
+}
+
+// Returns all games on the relay without their passwords
+func (s *Server) ListGames() []relayinterface.GameData {
+	list := s.gameList()
+	games := make([]relayinterface.GameData, 0, len(list))
+	for _, game := range list {
+		games = append(games, game.Data())
+	}
+	return games
+}
+
+// Returns the games on the relay matching the filter without their passwords
+func (s *Server) ListGamesFiltered(filter relayinterface.GameFilter) []relayinterface.GameData {
+	games := []relayinterface.GameData{}
+	for _, game := range s.gameList() {
+		if game.matches(filter) {
+			games = append(games, game.Data())
 		}
 	}
-	log.Printf("Error: Did not find game '%v' to remove as told by metaserver", name)
+	return games
+}
+
+// Returns the games currently on the relay
+func (s *Server) gameList() []*Game {
+	s.gamesMutex.Lock()
+	defer s.gamesMutex.Unlock()
+	games := make([]*Game, 0, s.games.Len())
+	for e := s.games.Front(); e != nil; e = e.Next() {
+		games = append(games, e.Value.(*Game))
+	}
+	return games
+}
+
+// Finishes the current recording file of the game and starts a new one.
+// Returns the path of the finished file
+func (s *Server) RotateRecording(name string) (string, error) {
+	game := s.findGame(name)
+	if game == nil {
+		return "", relayinterface.ErrGameNotFound
+	}
+	if game.recorder == nil {
+		return "", relayinterface.ErrNotRecorded
+	}
+	return game.recorder.Rotate()
+}
+
+// Creates a token allowing one connection to the given game
+func (s *Server) IssueJoinToken(name string) (string, error) {
+	return s.IssuePlayerJoinToken(name, "")
+}
+
+// Same as IssueJoinToken for the player with the given name, see EnforcePlayerNames
+func (s *Server) IssuePlayerJoinToken(name, player string) (string, error) {
+	if s.findGame(name) == nil {
+		return "", relayinterface.ErrGameNotFound
+	}
+	return s.joinTokens.IssueFor(name, player, s.joinTokenLifetime()), nil
+}
+
+// Returns how long issued join tokens can be used
+func (s *Server) joinTokenLifetime() time.Duration {
+	if lifetime := s.config.JoinTokenLifetime.Duration; lifetime > 0 {
+		return lifetime
+	}
+	return DefaultJoinTokenLifetime
+}
+
+// Returns the players of the game with the given name.
+// Returns false if the game does not exist
+func (s *Server) GetGamePlayers(name string) ([]relayinterface.PlayerInfo, bool) {
+	game := s.findGame(name)
+	if game == nil {
+		return nil, false
+	}
+	return game.Players(), true
+}
+
+// Returns whether the player with the given id is connected to the game, waits
+// for reconnecting to its slot or is gone
+func (s *Server) IsPlayerConnected(name string, playerID uint64) (relayinterface.PlayerConnection, error) {
+	game := s.findGame(name)
+	if game == nil {
+		return "", relayinterface.ErrGameNotFound
+	}
+	if playerID > 255 {
+		return relayinterface.PlayerGone, nil
+	}
+	return game.playerConnection(uint8(playerID)), nil
+}
+
+// Returns the description of the game with the given name.
+// Returns false if the game does not exist
+func (s *Server) GetGame(name string) (relayinterface.GameData, bool) {
+	game := s.findGame(name)
+	if game == nil {
+		return relayinterface.GameData{}, false
+	}
+	return game.Data(), true
+}
+
+// Removes the game with the given name. Once it returned true, GameClosed has
+// been queued and no GameConnected follows since hosts connecting are refused
+func (s *Server) RemoveGame(name string) bool {
+	if g := s.findGame(name); g != nil {
+		lifecycleLog.Infof("Removing game '%v' as told by metaserver", name)
+		g.Shutdown()
+		return true
+	}
+	lifecycleLog.Warnf("Error: Did not find game '%v' to remove as told by metaserver", name)
 	return false
 }
 
+// Removes all games with the given owner. Returns the names of the removed games
+func (s *Server) RemoveGamesByOwner(ownerID string) []string {
+	var owned []*Game
+	for _, g := range s.gameList() {
+		if ownerID != "" && g.ownerID == ownerID {
+			owned = append(owned, g)
+		}
+	}
+	names := make([]string, 0, len(owned))
+	for _, g := range owned {
+		lifecycleLog.Infof("Removing game '%v' of owner '%v' as told by metaserver", g.Name(), ownerID)
+		names = append(names, g.Name())
+		g.Shutdown()
+	}
+	return names
+}
+
+// Returns the games the player with the given name is connected to
+func (s *Server) FindPlayer(name string) []relayinterface.PlayerLocation {
+	return s.players.Find(name)
+}
+
+// Returns the current status of the relay.
+// Only reads counters, so this can be called often without slowing down games.
+func (s *Server) Status() relayinterface.ServerStatus {
+	limits := s.limits.Get()
+	status := relayinterface.ServerStatus{
+		NClients:            s.counters.Clients(),
+		NGames:              s.counters.Games(),
+		NOpenGames:          s.counters.OpenGames(),
+		Region:              s.config.Region,
+		MaxGames:            limits.MaxGames,
+		SoftMaxGames:        s.softMaxGames(),
+		MaxConnectionsPerIP: limits.MaxConnectionsPerIP,
+		NSpectators:         s.counters.Spectators(),
+		MaxTotalSpectators:  s.config.MaxTotalSpectators,
+		PublicAddress:       s.config.PublicAddress,
+		GamePort:            s.gamePort,
+		UDPPort:             s.udpPort,
+		ProtocolVersion:     kRelayProtocolVersion,
+		MaintenanceAt:       s.maintenance.scheduled(),
+		MinClientVersion:    s.config.MinClientVersion,
+		Shedding:            s.sheddingLevel(),
+		Throughput:          s.traffic.Rate(TRAFFIC_SAMPLE_INTERVAL),
+		MaxTotalBandwidth:   s.config.MaxTotalBandwidth,
+		BandwidthThrottled:  s.bandwidth.throttledCount(),
+	}
+	status.ReachabilityCheckedAt, status.Reachable, status.ReachabilityError = s.reachability.last()
+	return status
+}
+
+// Returns the summaries of up to limit recently closed games, the last closed one first
+func (s *Server) GetGameHistory(limit int) []relayinterface.GameSummary {
+	return s.history.Recent(limit)
+}
+
+// Returns up to limit of the most recent log messages with at least the given level, the oldest first
+func (s *Server) GetRecentLogs(limit int, minLevel relayinterface.LogLevel) []relayinterface.LogLine {
+	return s.logs.Recent(limit, minLevel)
+}
+
+// Returns the current resource limits
+func (s *Server) GetLimits() relayinterface.RelayLimits {
+	return s.limits.Get()
+}
+
+// Changes the resource limits. Games and connections that exist already are not affected
+func (s *Server) SetLimits(limits relayinterface.RelayLimits) {
+	lifecycleLog.Infof("Changing limits to %+v", limits)
+	s.limits.Set(limits)
+}
+
+// Returns the configuration of the relay with the limits it is using now
+func (s *Server) EffectiveConfig() relayinterface.RelayConfigView {
+	view := s.config.View()
+	limits := s.limits.Get()
+	view["MaxGames"] = strconv.Itoa(limits.MaxGames)
+	view["MaxConnectionsPerIP"] = strconv.Itoa(limits.MaxConnectionsPerIP)
+	return view
+}
+
+// Returns the optional features enabled on this relay
+func (s *Server) Capabilities() relayinterface.RelayCapabilities {
+	var capabilities relayinterface.RelayCapabilities
+	if s.config.CompressRPC {
+		capabilities |= relayinterface.CapabilityCompression
+	}
+	if s.config.ReconnectGracePeriod.Duration > 0 {
+		capabilities |= relayinterface.CapabilityReconnect
+	}
+	if s.config.RequireJoinTokens {
+		capabilities |= relayinterface.CapabilityJoinTokens
+	}
+	if s.udp != nil {
+		capabilities |= relayinterface.CapabilityUDP | relayinterface.CapabilityMux
+	}
+	return capabilities
+}
+
+// Returns the versions of the relay protocol with a framer in ascending order
+func (s *Server) SupportedProtocols() []int {
+	versions := make([]int, 0, len(framers))
+	for version := range framers {
+		versions = append(versions, int(version))
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// Returns the average number of bytes per second send by the relay over the given window
+func (s *Server) TrafficRate(window time.Duration) float64 {
+	return s.traffic.Rate(window)
+}
+
 func (s *Server) GameConnected(name string) {
 	s.wlms.GameConnected(name)
 }
 
+func (s *Server) ClientReconnected(name string, id uint8) {
+	s.wlms.ClientReconnected(name, uint64(id))
+}
+
+func (s *Server) HostChanged(name string, id uint64) {
+	s.wlms.HostChanged(name, id)
+}
+
 // Search for a game with the given name. If it exists but no host is connected, remove it
 func (s *Server) RemoveGameIfNoHostIsConnected(name string) {
-	for e := s.games.Front(); e != nil; e = e.Next() {
-		g := e.Value.(*Game)
-		if g.Name() == name && g.host == nil {
-			log.Printf("Removing game '%v' since no host connected to it", name)
-			s.wlms.GameClosed(name)
-			s.games.Remove(e)
-			return
-		}
+	g := s.findGame(name)
+	if g == nil {
+		return
+	}
+	g.lifecycle.Lock()
+	defer g.lifecycle.Unlock()
+	if g.host != nil || g.currentlyShuttingDown {
+		return
 	}
+	// A host connecting from now on is refused
+	g.currentlyShuttingDown = true
+	lifecycleLog.Infof("Removing game '%v' since no host connected to it", name)
+	g.closeReason = relayinterface.CloseReasonNoHost
+	s.RemoveGameObject(g)
 }
 
+// Removes the game from the list of games and tells the metaserver about it.
+// Called by the game while holding its lifecycle mutex
 func (s *Server) RemoveGameObject(game *Game) {
+	s.gamesMutex.Lock()
+	defer s.gamesMutex.Unlock()
 	for e := s.games.Front(); e != nil; e = e.Next() {
 		if e.Value.(*Game) == game {
-			s.wlms.GameClosed(game.Name())
+			if !game.persisted {
+				s.wlms.GameClosed(game.Name(), game.closeReason)
+			}
+			game.recordTimeline(relayinterface.TimelineEvent{Type: relayinterface.EventGameClosed, CloseReason: game.closeReason})
+			s.history.Add(game.summary(), game.Timeline())
 			s.games.Remove(e)
+			s.counters.AddGames(-1)
+			s.checkCapacity()
 			return
 		}
 	}
-	log.Printf("Error: Did not find game '%v' to remove!", game.Name())
+	lifecycleLog.Warnf("Error: Did not find game '%v' to remove!", game.Name())
 }
 
-func RunServer() {
-	ln, err := net.Listen("tcp", ":7397")
+// Opens the listener for game connections on the given address, marking the
+// traffic with the DSCP value if it is not 0. Returns the listener and the port it is bound to.
+func listenForGames(addr string, dscp int) (net.Listener, int, error) {
+	if addr == "" {
+		addr = DefaultGameListenAddr
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid GameListenAddr '%v': %v", addr, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, 0, fmt.Errorf("invalid port in GameListenAddr '%v'", addr)
+	}
+	ln, err := gameListenConfig(dscp).Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ln, ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+func RunServer(config RelayConfig) {
+	config.applyLogLevels()
+	ln, gamePort, err := listenForGames(config.GameListenAddr, config.GameTrafficDSCP)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer ln.Close()
-
-	C := make(chan net.Conn)
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				break
-			}
-			C <- conn
-		}
-	}()
+	lifecycleLog.Infof("Accepting game connections on port %v", gamePort)
 
 	server := &Server{
-		acceptedConnections: C,
+		acceptedConnections: make(chan net.Conn, config.AcceptQueueSize),
 		shutdownServer:      make(chan bool),
 		serverHasShutdown:   make(chan bool),
 		games:               list.New(),
 		wlms:                nil,
+		config:              config,
+		gamePort:            gamePort,
+		traffic:             NewTrafficMeter(),
+		joinTokens:          NewJoinTokens(),
+		connections:         newConnectionsPerIP(),
+		reservations:        NewReservations(),
+		history:             NewGameHistory(config.HistorySize),
+		logs:                NewLogBuffer(config.LogBufferSize),
+		players:             NewPlayerIndex(),
+		latency:             &LatencyHistogram{},
+		maintenance:         &Maintenance{},
+		bandwidth:           newBandwidthShaper(config.MaxTotalBandwidth),
 	}
-	server.wlms = relayinterface.NewServerRPC(server)
+	relayinterface.CaptureLogs(server.logs.Add)
+	defer relayinterface.CaptureLogs(nil)
+	if config.UDPListenAddr != "" {
+		server.udp, server.udpPort, err = listenForDatagrams(config.UDPListenAddr, config.GameTrafficDSCP, server.traffic)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer server.udp.Close()
+		lifecycleLog.Infof("Accepting datagrams on UDP port %v", server.udpPort)
+	}
+	server.limits.Set(relayinterface.RelayLimits{
+		MaxGames:            config.MaxGames,
+		MaxConnectionsPerIP: config.MaxConnectionsPerIP,
+	})
+	server.wlms = relayinterface.NewServerRPC(server, config.RPCOptions())
 	defer server.wlms.CloseConnection()
+	go server.acceptConnections(ln)
 
+	if config.StateFile != "" {
+		server.restoreState()
+	}
 	go server.mainLoop()
+	if config.PublicAddress != "" {
+		go func() {
+			if _, err := server.VerifyReachability(); err != nil {
+				lifecycleLog.Warnf("Unable to check whether the relay is reachable at its PublicAddress: %v", err)
+			}
+		}()
+	}
 
-	log.Println("The client ids are only unique within one game. Id=1 is host")
-
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigs
-		log.Printf("Signal received, initiating shutdown")
-		server.InitiateShutdown()
-	}()
+	lifecycleLog.Infof("The client ids are only unique within one game. Id=1 is host")
 
-	server.WaitTillShutdown()
-	return
+	server.shutdownOnSignal(ln)
 }
 
 func (s *Server) mainLoop() {
+	snapshots, stopSnapshots := s.stateTicker()
+	defer stopSnapshots()
 	for {
 		select {
+		case <-snapshots:
+			s.writeState()
 		case conn, ok := <-s.acceptedConnections:
 			if !ok {
 				return
 			}
-			go s.dealWithNewConnection(New(conn))
-		case <-s.shutdownServer:
-			for s.games.Len() > 0 {
-				e := s.games.Front()
-				e.Value.(*Game).Shutdown()
-				// Game removes itself
+			tracked := s.connections.track(conn, s.limits.Get().MaxConnectionsPerIP)
+			if tracked == nil {
+				lifecycleLog.Warnf("Refusing connection from %v since it has too many connections", conn.RemoteAddr())
+				New(conn, s.traffic).Disconnect("TOO_MANY_CONNECTIONS")
+				continue
 			}
+			go s.dealWithNewConnection(New(tracked, s.traffic))
+		case <-s.shutdownServer:
+			s.shutdownGames()
 			close(s.acceptedConnections)
 			s.serverHasShutdown <- true
 			return
@@ -150,39 +707,136 @@ func (s *Server) mainLoop() {
 	}
 }
 
+// Returns the reason to disconnect a connection whose handshake failed with the
+// given error. The error is nil if the handshake has been read but is invalid
+func handshakeFailure(err error) string {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "TIMEOUT"
+	}
+	return "PROTOCOL_VIOLATION"
+}
+
 func (s *Server) dealWithNewConnection(client *Client) {
+	if timeout := s.config.IdleConnectionTimeout.Duration; timeout > 0 {
+		client.conn.SetReadDeadline(time.Now().Add(timeout))
+	}
 	cmd, error := client.ReadUint8()
+	tokenGame, tokenPlayer := "", ""
+	if s.config.RequireJoinTokens && (error != nil || cmd != kJoinToken) {
+		client.Disconnect("NO_TOKEN")
+		return
+	}
+	// Join tokens are optional otherwise, invite-only games need them
+	if error == nil && cmd == kJoinToken {
+		token, error := client.ReadString()
+		if error != nil {
+			client.Disconnect(handshakeFailure(error))
+			return
+		}
+		game, player, ok := s.joinTokens.Redeem(token)
+		if !ok {
+			client.Disconnect("NO_TOKEN")
+			return
+		}
+		tokenGame, tokenPlayer = game, player
+		client.invited = true
+		cmd, error = client.ReadUint8()
+	} else if s.config.EnforcePlayerNames {
+		// Without a token there is no name the metaserver vouches for
+		lifecycleLog.Infof("Refusing client from %v without a join token, player names are enforced",
+			client.RemoteAddr())
+		client.Disconnect("NO_TOKEN")
+		return
+	}
+	if error == nil && cmd == kSpectator {
+		client.spectator = true
+		cmd, error = client.ReadUint8()
+	}
+	if error == nil && cmd == kMux {
+		client.muxed = true
+		cmd, error = client.ReadUint8()
+	}
+	if error == nil && cmd == kPlayerName {
+		client.playerName, error = client.ReadString()
+		if error != nil {
+			client.Disconnect(handshakeFailure(error))
+			return
+		}
+		if s.config.EnforcePlayerNames && client.playerName != tokenPlayer {
+			lifecycleLog.Infof("Refusing client from %v claiming to be '%v' with a join token for '%v'",
+				client.RemoteAddr(), client.playerName, tokenPlayer)
+			client.Disconnect("NAME_MISMATCH")
+			return
+		}
+		cmd, error = client.ReadUint8()
+	}
+	if s.config.EnforcePlayerNames {
+		// The metaserver authenticated the player, so the name of the token counts
+		client.playerName = tokenPlayer
+	}
+	if error == nil && cmd == kFrameSize {
+		var size []byte
+		size, error = client.ReadBytes(2)
+		if error != nil {
+			client.Disconnect(handshakeFailure(error))
+			return
+		}
+		client.frameSize = int(size[0])<<8 | int(size[1])
+		cmd, error = client.ReadUint8()
+	}
+	if error == nil && cmd == kClientVersion {
+		client.clientVersion, error = client.ReadString()
+		if error != nil {
+			client.Disconnect(handshakeFailure(error))
+			return
+		}
+		cmd, error = client.ReadUint8()
+	}
+	if error == nil && cmd == kObservedAddress {
+		client.observeAddress = true
+		cmd, error = client.ReadUint8()
+	}
 	if error != nil || cmd != kHello {
-		client.Disconnect("PROTOCOL_VIOLATION")
+		client.Disconnect(handshakeFailure(error))
 		return
 	}
 	version, error := client.ReadUint8()
 	if error != nil {
-		client.Disconnect("PROTOCOL_VIOLATION")
+		client.Disconnect(handshakeFailure(error))
 		return
 	}
-	if version != kRelayProtocolVersion {
+	client.framer = framerFor(version)
+	if client.framer == nil {
 		client.Disconnect("WRONG_VERSION")
 		return
 	}
 
 	name, error := client.ReadString()
 	if error != nil {
-		client.Disconnect("PROTOCOL_VIOLATION")
+		client.Disconnect(handshakeFailure(error))
 		return
 	}
 	password, error := client.ReadString()
 	if error != nil {
-		client.Disconnect("PROTOCOL_VIOLATION")
+		client.Disconnect(handshakeFailure(error))
+		return
+	}
+	if client.invited && s.gameKey(name) != s.gameKey(tokenGame) {
+		client.Disconnect("NO_TOKEN")
+		return
+	}
+	if !s.acceptsClientVersion(client.clientVersion) {
+		lifecycleLog.Infof("Refusing client from %v with version '%v' for game '%v', at least %v is required",
+			client.RemoteAddr(), client.clientVersion, name, s.config.MinClientVersion)
+		client.Disconnect("UPGRADE_REQUIRED")
 		return
 	}
 	// The game will handle the client
-	for e := s.games.Front(); e != nil; e = e.Next() {
-		game := e.Value.(*Game)
-		if game.Name() == name {
-			game.addClient(client, version, password)
-			return
-		}
+	if game := s.findGame(name); game != nil {
+		// The connection is associated with a game now, the game notices when it is idle
+		client.conn.SetReadDeadline(time.Time{})
+		game.addClient(client, version, password)
+		return
 	}
 	// Matching game not found, close connection
 	client.Disconnect("GAME_UNKNOWN")
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"sync/atomic"
+)
+
+// How much a new connection matters while the relay is overloaded.
+// Connections of lower priority are refused first, see ShedSpectatorsAt
+type connectionPriority int
+
+const (
+	prioritySpectator connectionPriority = iota
+	priorityCasual
+	priorityRanked
+)
+
+// Returns the priority of the client joining a game which is ranked or not
+func (client *Client) priority(ranked bool) connectionPriority {
+	switch {
+	case client.spectator:
+		return prioritySpectator
+	case ranked:
+		return priorityRanked
+	}
+	return priorityCasual
+}
+
+// Returns which new connections are refused at the current number of
+// connected hosts and clients
+func (s *Server) sheddingLevel() relayinterface.SheddingLevel {
+	clients := s.counters.Clients()
+	level := relayinterface.SheddingNone
+	if s.config.ShedCasualAt > 0 && clients >= s.config.ShedCasualAt {
+		level = relayinterface.SheddingCasual
+	} else if s.config.ShedSpectatorsAt > 0 && clients >= s.config.ShedSpectatorsAt {
+		level = relayinterface.SheddingSpectators
+	}
+	if old := relayinterface.SheddingLevel(atomic.SwapInt32(&s.shedding, int32(level))); old != level {
+		lifecycleLog.Warnf("Shedding load, refusing new connections: %v (was %v) with %v connected players", level, old, clients)
+	}
+	return level
+}
+
+// Returns whether a new connection with the given priority is refused since the relay is overloaded
+func (s *Server) sheds(priority connectionPriority) bool {
+	// Each level refuses one more priority, starting with the lowest
+	return int(priority) < int(s.sheddingLevel())
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// How long a shutdown may take if ShutdownTimeout is not configured
+const DefaultShutdownTimeout = 30 * time.Second
+
+// Waits for SIGINT or SIGTERM and shuts the relay down: No new game connections
+// are accepted, the players are disconnected with "SHUTDOWN" and the metaserver
+// is told about the closed games. A second signal or exceeding ShutdownTimeout
+// ends the relay at once
+func (s *Server) shutdownOnSignal(ln net.Listener) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	timeout := s.config.ShutdownTimeout.Duration
+	lifecycleLog.Infof("Received %v, shutting down within %v. Another signal exits at once", sig, timeout)
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case sig := <-sigs:
+			lifecycleLog.Warnf("Received %v again, exiting without finishing the shutdown", sig)
+		case <-time.After(timeout):
+			lifecycleLog.Warnf("Shutdown did not finish within %v, exiting", timeout)
+		case <-finished:
+			return
+		}
+		os.Exit(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ln.Close()
+	s.InitiateShutdown()
+	s.WaitTillShutdown()
+	if err := s.wlms.Flush(ctx); err != nil {
+		lifecycleLog.Warnf("Unable to send all notifications to the metaserver before exiting: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// How often the state file is written if StateSnapshotInterval is not configured
+const DefaultStateSnapshotInterval = 10 * time.Second
+
+// How long restored games wait for their players if StateRestoreGracePeriod is not configured
+const DefaultStateRestoreGracePeriod = 60 * time.Second
+
+// The content of the state file
+type relayState struct {
+	Games []gameState
+}
+
+// What is needed to restore a game after a restart of the relay
+type gameState struct {
+	Name                    string
+	HostPasswordHash        string
+	Public                  bool
+	Locked                  bool
+	InviteOnly              bool
+	OwnerID                 string
+	UDPEnabled              bool
+	Ranked                  bool
+	Tags                    map[string]string
+	AutoCloseAfterNoTraffic time.Duration
+	RecordSampling          relayinterface.FrameSampling
+	KeyEpoch                int32
+	// Zero if the lifetime is unlimited
+	ExpiresAt    time.Time
+	NextClientID uint8
+	Participants []participantState
+}
+
+// A client of a game which can reconnect after a restart of the relay
+type participantState struct {
+	ID             uint8
+	ReconnectToken string
+	Spectator      bool
+}
+
+// Returns what has to be written to the state file to restore the game
+func (game *Game) state() gameState {
+	game.lifecycle.Lock()
+	defer game.lifecycle.Unlock()
+	state := gameState{
+		Name:                    game.gameName,
+		HostPasswordHash:        game.hostPasswordHash,
+		Public:                  game.public,
+		Locked:                  game.locked,
+		InviteOnly:              game.inviteOnly,
+		OwnerID:                 game.ownerID,
+		UDPEnabled:              game.udpEnabled,
+		Ranked:                  game.ranked,
+		Tags:                    game.tags,
+		AutoCloseAfterNoTraffic: game.autoCloseAfterNoTraffic,
+		RecordSampling:          game.recordSampling,
+		KeyEpoch:                atomic.LoadInt32(&game.keyEpoch),
+		ExpiresAt:               game.expiresAt,
+		NextClientID:            game.nextClientId,
+	}
+	for e := game.clients.Front(); e != nil; e = e.Next() {
+		client := e.Value.(*Client)
+		if client.reconnectToken != "" {
+			state.Participants = append(state.Participants, participantState{client.id, client.reconnectToken, client.spectator})
+		}
+	}
+	for token, slot := range game.reconnectSlots {
+		state.Participants = append(state.Participants, participantState{slot.id, token, slot.spectator})
+	}
+	return state
+}
+
+// Recreates a game from the state file. The host and the participants have
+// the given time to reconnect, the participants with their reconnection tokens.
+func restoreGame(state gameState, server *Server, grace time.Duration) *Game {
+	game := newGame(relayinterface.GameData{
+		Name:                    state.Name,
+		Public:                  state.Public,
+		OwnerID:                 state.OwnerID,
+		UDPEnabled:              state.UDPEnabled,
+		Ranked:                  state.Ranked,
+		Tags:                    state.Tags,
+		AutoCloseAfterNoTraffic: state.AutoCloseAfterNoTraffic,
+		RecordSampling:          state.RecordSampling,
+	}, server, grace)
+	game.hostPasswordHash = state.HostPasswordHash
+	game.locked = state.Locked
+	game.inviteOnly = state.InviteOnly
+	game.keyEpoch = state.KeyEpoch
+	if state.NextClientID > game.nextClientId {
+		game.nextClientId = state.NextClientID
+	}
+	if !state.ExpiresAt.IsZero() {
+		if game.lifetimeTimer != nil {
+			game.lifetimeTimer.Stop()
+		}
+		game.expiresAt = state.ExpiresAt
+		game.lifetimeTimer = time.AfterFunc(time.Until(state.ExpiresAt), game.expire)
+	}
+	for _, p := range state.Participants {
+		token := p.ReconnectToken
+		slot := &reconnectSlot{id: p.ID, spectator: p.Spectator}
+		slot.timer = time.AfterFunc(grace, func() { game.expireSlot(token, slot) })
+		game.reconnectSlots[token] = slot
+	}
+	return game
+}
+
+// Writes the state of all games to the state file and returns the games written.
+// The file is replaced atomically so a crash while writing does not destroy the last state.
+func (s *Server) writeState() map[*Game]bool {
+	state := relayState{}
+	games := s.gameList()
+	for _, game := range games {
+		state.Games = append(state.Games, game.state())
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		lifecycleLog.Warnf("Unable to encode state: %v", err)
+		return nil
+	}
+	path := s.config.StateFile
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		lifecycleLog.Warnf("Unable to write state file: %v", err)
+		return nil
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		lifecycleLog.Warnf("Unable to write state file: %v", err)
+		return nil
+	}
+	written := make(map[*Game]bool, len(games))
+	for _, game := range games {
+		written[game] = true
+	}
+	return written
+}
+
+// Shuts down all games since the relay is shutting down. With a state file, the
+// games are written to it before, and the metaserver is not told that they closed
+// since they are restored on the next start
+func (s *Server) shutdownGames() {
+	var persisted map[*Game]bool
+	if s.config.StateFile != "" {
+		persisted = s.writeState()
+	}
+	for _, game := range s.gameList() {
+		game.shutdownRelay(persisted[game])
+		// Game removes itself
+	}
+}
+
+// Restores the games from the state file, if there is one
+func (s *Server) restoreState() {
+	b, err := ioutil.ReadFile(s.config.StateFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		lifecycleLog.Warnf("Unable to read state file: %v", err)
+		return
+	}
+	var state relayState
+	if err := json.Unmarshal(b, &state); err != nil {
+		lifecycleLog.Warnf("Unable to decode state file: %v", err)
+		return
+	}
+	grace := s.config.StateRestoreGracePeriod.Duration
+	if grace <= 0 {
+		grace = DefaultStateRestoreGracePeriod
+	}
+	for _, gs := range state.Games {
+		if s.findGame(gs.Name) != nil {
+			continue
+		}
+		if !gs.ExpiresAt.IsZero() && time.Now().After(gs.ExpiresAt) {
+			lifecycleLog.Infof("Not restoring game '%v' since its lifetime is over", gs.Name)
+			continue
+		}
+		game := restoreGame(gs, s, grace)
+		s.gamesMutex.Lock()
+		s.games.PushBack(game)
+		s.gamesMutex.Unlock()
+		s.counters.AddGames(1)
+		lifecycleLog.Infof("Restored game '%v' with %v participants, waiting %v for them to reconnect", gs.Name, len(gs.Participants), grace)
+	}
+}
+
+// Returns a channel receiving the times to write the state file.
+// The channel is nil if no state file is configured.
+func (s *Server) stateTicker() (<-chan time.Time, func()) {
+	if s.config.StateFile == "" {
+		return nil, func() {}
+	}
+	interval := s.config.StateSnapshotInterval.Duration
+	if interval <= 0 {
+		interval = DefaultStateSnapshotInterval
+	}
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// Counters for the status of the relay. They are updated when games and
+// clients come and go and can be read at any time without taking a lock,
+// so requesting the status never stalls the forwarding of game data.
+type StatusCounters struct {
+	games     int64
+	openGames int64
+	clients   int64
+	// Included in clients
+	spectators int64
+}
+
+func (c *StatusCounters) AddGames(delta int64) {
+	atomic.AddInt64(&c.games, delta)
+}
+
+func (c *StatusCounters) AddOpenGames(delta int64) {
+	atomic.AddInt64(&c.openGames, delta)
+}
+
+func (c *StatusCounters) AddClients(delta int64) {
+	atomic.AddInt64(&c.clients, delta)
+}
+
+func (c *StatusCounters) AddSpectators(delta int64) {
+	atomic.AddInt64(&c.spectators, delta)
+}
+
+// Counts a new spectator unless there are max spectators already.
+// Returns whether the spectator has been counted. The number is unlimited if max is 0
+func (c *StatusCounters) TryAddSpectator(max int) bool {
+	for {
+		current := atomic.LoadInt64(&c.spectators)
+		if max > 0 && current >= int64(max) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&c.spectators, current, current+1) {
+			return true
+		}
+	}
+}
+
+func (c *StatusCounters) Games() int {
+	return int(atomic.LoadInt64(&c.games))
+}
+
+func (c *StatusCounters) OpenGames() int {
+	return int(atomic.LoadInt64(&c.openGames))
+}
+
+func (c *StatusCounters) Clients() int {
+	return int(atomic.LoadInt64(&c.clients))
+}
+
+func (c *StatusCounters) Spectators() int {
+	return int(atomic.LoadInt64(&c.spectators))
+}
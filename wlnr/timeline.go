@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"time"
+)
+
+// How many events the timeline of a game keeps. Later events are dropped,
+// except for the close of the game
+const maxTimelineEvents = 1000
+
+// Adds the event to the timeline of the game, see GetGameTimeline
+func (game *Game) recordTimeline(event relayinterface.TimelineEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	game.timelineMutex.Lock()
+	defer game.timelineMutex.Unlock()
+	if len(game.timeline) >= maxTimelineEvents && event.Type != relayinterface.EventGameClosed {
+		return
+	}
+	game.timeline = append(game.timeline, event)
+}
+
+// Returns a copy of the timeline of the game, the oldest event first
+func (game *Game) Timeline() []relayinterface.TimelineEvent {
+	game.timelineMutex.Lock()
+	defer game.timelineMutex.Unlock()
+	return append([]relayinterface.TimelineEvent(nil), game.timeline...)
+}
+
+// Returns the timeline of the game with the given name. Closed games are looked
+// up in the history, so their timeline is available as long as their summary
+func (s *Server) GetGameTimeline(name string) ([]relayinterface.TimelineEvent, error) {
+	if game := s.findGame(name); game != nil {
+		return game.Timeline(), nil
+	}
+	if timeline, ok := s.history.Timeline(s.gameKey(name), s.gameKey); ok {
+		return timeline, nil
+	}
+	return nil, relayinterface.ErrGameNotFound
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the traffic counter is sampled
+const TRAFFIC_SAMPLE_INTERVAL = time.Second
+
+// How many samples are kept, limiting the window TrafficRate can be asked for
+const TRAFFIC_SAMPLE_COUNT = 300
+
+// Counts the bytes send by the relay and remembers the count over the last
+// few minutes in a ring buffer to calculate the traffic rate.
+type TrafficMeter struct {
+	// Number of bytes send since the start of the relay. Accessed atomically
+	bytesSend uint64
+
+	// Ring buffer with the values of bytesSend at each sample
+	samples []uint64
+	// Index of the next sample to write
+	next int
+	// Number of valid samples in the buffer
+	filled int
+	mutex  sync.Mutex
+}
+
+func NewTrafficMeter() *TrafficMeter {
+	meter := &TrafficMeter{
+		samples: make([]uint64, TRAFFIC_SAMPLE_COUNT),
+	}
+	meter.sample()
+	go func() {
+		ticker := time.NewTicker(TRAFFIC_SAMPLE_INTERVAL)
+		for range ticker.C {
+			meter.sample()
+		}
+	}()
+	return meter
+}
+
+// Counts the given number of bytes as send.
+func (t *TrafficMeter) AddBytesSend(n int) {
+	atomic.AddUint64(&t.bytesSend, uint64(n))
+}
+
+func (t *TrafficMeter) sample() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.samples[t.next] = atomic.LoadUint64(&t.bytesSend)
+	t.next = (t.next + 1) % len(t.samples)
+	if t.filled < len(t.samples) {
+		t.filled++
+	}
+}
+
+// Returns the average number of bytes send per second over the given window.
+// The window is clamped to the time covered by the samples.
+func (t *TrafficMeter) Rate(window time.Duration) float64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.filled < 2 {
+		return 0
+	}
+	steps := int(window / TRAFFIC_SAMPLE_INTERVAL)
+	if steps < 1 {
+		steps = 1
+	}
+	if steps > t.filled-1 {
+		steps = t.filled - 1
+	}
+	n := len(t.samples)
+	newest := t.samples[(t.next-1+n)%n]
+	oldest := t.samples[(t.next-1-steps+2*n)%n]
+	return float64(newest-oldest) / (float64(steps) * TRAFFIC_SAMPLE_INTERVAL.Seconds())
+}
+
+// Returns the game data forwarded in the game since it has been created or since
+// its counters have been reset the last time
+func (s *Server) GameTraffic(name string) (relayinterface.GameTraffic, error) {
+	game := s.findGame(name)
+	if game == nil {
+		return relayinterface.GameTraffic{}, relayinterface.ErrGameNotFound
+	}
+	since := game.createdAt
+	if reset := atomic.LoadInt64(&game.countersSince); reset != 0 {
+		since = time.Unix(0, reset)
+	}
+	return relayinterface.GameTraffic{
+		Bytes:  atomic.LoadInt64(&game.counterBytes),
+		Frames: atomic.LoadInt64(&game.counterFrames),
+		Since:  since,
+	}, nil
+}
+
+// Zeroes the traffic counters of the game, so GameTraffic counts from now on.
+// The totals in the history and in dumps of the game are not affected
+func (s *Server) ResetGameCounters(name, password string) error {
+	game := s.findGame(name)
+	if game == nil {
+		return relayinterface.ErrGameNotFound
+	}
+	if err := game.checkHostPassword(password, ""); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&game.countersSince, time.Now().UnixNano())
+	atomic.StoreInt64(&game.counterBytes, 0)
+	atomic.StoreInt64(&game.counterFrames, 0)
+	lifecycleLog.Infof("Reset the traffic counters of game %v", game.logName())
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// The largest datagram forwarded by the UDP relay
+const maxDatagramSize = 1500
+
+// A host or client of a game allowed to send datagrams over the UDP relay
+type udpParticipant struct {
+	game   *Game
+	client *Client
+	token  string
+	// Where datagrams for the participant are sent to. Nil until the
+	// participant sent its token
+	addr net.Addr
+	// Whether the datagrams are carried over the TCP connection, see kMux
+	muxed bool
+}
+
+// UDPRelay forwards datagrams between the participants of games with
+// GameData.UDPEnabled, next to the game data passed over TCP.
+// All games share one socket. A participant is told a token over its TCP
+// connection after the welcome and has to send it as first datagram so the
+// relay knows its address. Afterwards, a datagram from a client is sent to
+// the host prefixed with the id of the client. A datagram from the host starts
+// with the id of the receiving client, or 0 for all clients of the game.
+// Participants which negotiated kMux send and receive their datagrams as
+// kDatagram over their TCP connection instead, without a token.
+type UDPRelay struct {
+	conn net.PacketConn
+
+	mutex    sync.Mutex
+	byToken  map[string]*udpParticipant
+	byAddr   map[string]*udpParticipant
+	byClient map[*Client]*udpParticipant
+	traffic  *TrafficMeter
+}
+
+// Opens the UDP socket on the given address and returns the relay with its port.
+// The datagrams send are marked with the DSCP value if it is not 0
+func listenForDatagrams(addr string, dscp int, traffic *TrafficMeter) (*UDPRelay, int, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid UDPListenAddr '%v': %v", addr, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, 0, fmt.Errorf("invalid port in UDPListenAddr '%v'", addr)
+	}
+	conn, err := gameListenConfig(dscp).ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	relay := &UDPRelay{
+		conn:     conn,
+		byToken:  make(map[string]*udpParticipant),
+		byAddr:   make(map[string]*udpParticipant),
+		byClient: make(map[*Client]*udpParticipant),
+		traffic:  traffic,
+	}
+	go relay.serve()
+	return relay, conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+// Allows the client to use the UDP relay for the game.
+// Returns the token the client has to send as first datagram
+func (u *UDPRelay) Issue(game *Game, client *Client) string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.forget(client)
+	p := &udpParticipant{game: game, client: client, token: newReconnectToken()}
+	u.byToken[p.token] = p
+	u.byClient[client] = p
+	return p.token
+}
+
+// Allows the client to use the UDP relay for the game over its TCP connection
+func (u *UDPRelay) IssueMuxed(game *Game, client *Client) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.forget(client)
+	u.byClient[client] = &udpParticipant{game: game, client: client, muxed: true}
+}
+
+// Forwards a datagram the client sent as kDatagram over its TCP connection
+func (u *UDPRelay) HandleMuxed(client *Client, datagram []byte) {
+	u.mutex.Lock()
+	from, ok := u.byClient[client]
+	u.mutex.Unlock()
+	if ok && from.muxed {
+		u.forward(from, datagram)
+	}
+}
+
+// Stops forwarding datagrams from and to the client
+func (u *UDPRelay) Forget(client *Client) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.forget(client)
+}
+
+func (u *UDPRelay) forget(client *Client) {
+	p, ok := u.byClient[client]
+	if !ok {
+		return
+	}
+	delete(u.byClient, client)
+	if p.token != "" {
+		delete(u.byToken, p.token)
+	}
+	if p.addr != nil {
+		delete(u.byAddr, p.addr.String())
+	}
+}
+
+// Returns the address the datagrams of the client come from, empty if the
+// relay does not know it (yet)
+func (u *UDPRelay) AddrOf(client *Client) string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if p, ok := u.byClient[client]; ok && p.addr != nil {
+		return p.addr.String()
+	}
+	return ""
+}
+
+// Closes the socket, which ends forwarding for all games
+func (u *UDPRelay) Close() error {
+	return u.conn.Close()
+}
+
+func (u *UDPRelay) serve() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		u.handleDatagram(buf[:n], addr)
+	}
+}
+
+func (u *UDPRelay) handleDatagram(datagram []byte, addr net.Addr) {
+	u.mutex.Lock()
+	from, ok := u.byAddr[addr.String()]
+	if !ok {
+		// Unknown senders can only introduce themselves with a token
+		u.introduce(datagram, addr)
+		u.mutex.Unlock()
+		return
+	}
+	u.mutex.Unlock()
+	u.forward(from, datagram)
+}
+
+// Remembers the address of the participant the token has been issued to.
+// Has to be called with the mutex held
+func (u *UDPRelay) introduce(token []byte, addr net.Addr) {
+	p, ok := u.byToken[string(token)]
+	if !ok {
+		return
+	}
+	if p.addr != nil {
+		delete(u.byAddr, p.addr.String())
+	}
+	p.addr = addr
+	u.byAddr[addr.String()] = p
+	forwardingLog.Debugf("UDP address of client (id=%v) of game '%v' is %v", p.client.id, p.game.Name(), addr)
+	if p.client.observeAddress && !p.client.isClosed() {
+		// Not waiting for a slow client while holding the mutex, it can send the token again
+		p.client.TrySendCommand(observedAddressCommand(kTransportUDP, addr.String()))
+	}
+}
+
+// Passes the datagram on to the participants it is meant for. Has to be called
+// without the mutex held since the participants are taken with the lifecycle
+// mutex of the game, which is held while registering with the relay
+func (u *UDPRelay) forward(from *udpParticipant, datagram []byte) {
+	game := from.game
+	host, clients := game.participants()
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	forwarded := 0
+	if from.client == host {
+		if len(datagram) < 1 {
+			return
+		}
+		to := datagram[0]
+		receivers := 1
+		if to == 0 {
+			receivers = len(clients)
+		}
+		if !game.allowDatagram((len(datagram) - 1) * receivers) {
+			return
+		}
+		for _, client := range clients {
+			if to == 0 || client.id == to {
+				forwarded += u.send(client, datagram[1:])
+			}
+		}
+	} else if host != nil {
+		if !game.allowDatagram(len(datagram) + 1) {
+			return
+		}
+		packet := make([]byte, 0, len(datagram)+1)
+		packet = append(packet, from.client.id)
+		packet = append(packet, datagram...)
+		forwarded += u.send(host, packet)
+	}
+	game.noteTraffic(forwarded)
+}
+
+// Sends the datagram to the client if it told us its address and returns the
+// number of bytes sent. Has to be called with the mutex held
+func (u *UDPRelay) send(client *Client, datagram []byte) int {
+	p, ok := u.byClient[client]
+	if !ok {
+		return 0
+	}
+	if p.muxed {
+		if client.isClosed() {
+			// Disconnecting, the writer might not take commands anymore
+			return 0
+		}
+		cmd := NewCommand(kDatagram)
+		cmd.AppendUInt(uint8(len(datagram) >> 8))
+		cmd.AppendUInt(uint8(len(datagram)))
+		cmd.AppendBytes(datagram)
+		client.SendCommand(cmd)
+		return len(datagram)
+	}
+	if p.addr == nil {
+		return 0
+	}
+	n, err := u.conn.WriteTo(datagram, p.addr)
+	if err != nil {
+		forwardingLog.Debugf("Unable to send datagram to %v: %v", p.addr, err)
+		return 0
+	}
+	u.traffic.AddBytesSend(n)
+	return n
+}